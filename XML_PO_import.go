@@ -3,11 +3,21 @@ File name: XML_PO_import.go
 Is a Child process started by public_input_service:
 
  1. Input from a XML file, named by parent on the command-line (Args).
+    A .x12 file is an X12 interchange of 850 purchase orders instead,
+    each read into the same order the XML carries (see package x12),
+    and a .edi file an EDIFACT interchange of ORDERS (see package
+    edifact).
 
  2. To parse and processes XML data, sending 'Fixed Length' data to
     a partner process on another host & port (192.168.1.240:30770)
 
  3. Send results as XML response back to customer, written to out folder.
+    An order that came as an 850 is answered with an 855, one that
+    came as an ORDERS with an ORDRSP.
+
+ 4. Acknowledge every X12 interchange with a 997 or 999 and every
+    EDIFACT one with a CONTRL, and settle the acknowledgments partners
+    send of ours (see package acks).
 
 */
 package main
@@ -16,17 +26,29 @@ package main
 import (
 	"bytes"
 	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"net"
-	"net/smtp"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/blackjack/syslog"
+	"github.com/cloud3000/BaseEDI/acks"
+	"github.com/cloud3000/BaseEDI/ediconfig"
+	"github.com/cloud3000/BaseEDI/edifact"
+	"github.com/cloud3000/BaseEDI/ediframe"
+	"github.com/cloud3000/BaseEDI/edilog"
+	"github.com/cloud3000/BaseEDI/hostpool"
+	"github.com/cloud3000/BaseEDI/ledger"
+	"github.com/cloud3000/BaseEDI/metrics"
+	"github.com/cloud3000/BaseEDI/notify"
+	"github.com/cloud3000/BaseEDI/x12"
 	"github.com/cloud3000/ediclientsocks" // clientedi Client socket lib
 	// EDI Socket client lib
 )
@@ -46,7 +68,6 @@ type POresponse struct {
 }
 
 const (
-	outpath   = "/home/edimgr/acmeship/out/"
 	emailfrom = "acmeship@cloud3000.com"
 	emailto   = "edimgr@cloud3000.com"
 	custid    = "ACMESHIP"
@@ -54,25 +75,73 @@ const (
 	smtppass  = "xcvsdfwer234"
 	smtpserv  = "smtpserv.com"
 	smtpport  = ":587"
+
+	// exitRetry (EX_TEMPFAIL) tells public_input_service the host timed out
+	// and the file may be tried again later.
+	exitRetry = 75
 )
 
-func ediEmail(mailfrom string, mailto string, mailsub string, mailmsg string) int {
-	// Set up authentication information.
-	auth := smtp.PlainAuth("", smtpuser, smtppass, smtpserv)
-
-	// Connect to the server, authenticate, set the sender and recipient,
-	// and send the email all in one step.
-	to := []string{mailto}
-	msg := []byte("To: " + mailto + "\r\n" +
-		"From: " + mailfrom + "\r\n" +
-		"Subject: " + mailsub + "\r\n" +
-		"\r\n" +
-		mailmsg + "\r\n")
-	err := smtp.SendMail(smtpserv+smtpport, auth, smtpuser, to, msg)
-	if err != nil {
-		fmt.Printf("%v\n", err)
+var (
+	configPath     = flag.String("config", ediconfig.DefaultPath, "The configuration file")
+	connectTimeout = flag.Duration("connect-timeout", 30*time.Second, "Deadline for connecting to the host")
+	recordTimeout  = flag.Duration("record-timeout", time.Minute, "Deadline for each record sent to or received from the host")
+	sessionTimeout = flag.Duration("session-timeout", 10*time.Minute, "Deadline for the whole host session")
+	helloTimeout   = flag.Duration("hello-timeout", 3*time.Second, "How long to wait for a protocol 2 host to answer the protocol offer")
+	outDir         = flag.String("out", "", "Write the response into this directory instead of dirs.poResponses")
+)
+
+// hostStatus is our copy of the status returned by the clientedi calls.
+type hostStatus struct {
+	Op      string
+	Number  int
+	Message string
+}
+
+var (
+	config          *ediconfig.Config
+	book            *ledger.Ledger // nil if it could not be opened
+	notifier        *notify.Dispatcher
+	sessionDeadline time.Time // Set when data2Host starts the session.
+	recordDeadline  time.Time // The deadline of the last host operation.
+
+	hostName  string   // The endpoint the order went to.
+	protocol  = 1      // The wire protocol agreed with the host.
+	batchSize int      // Records per frame in protocol 2, 0 is the whole order.
+	pending   []string // Records waiting for the next frame.
+
+	imported []string // Orders in the file a host has taken.
+)
+
+// The counts are handed to public_input_service as the import exits.
+var (
+	mParseFailures = metrics.NewCounter("edi_parse_failures_total", "Orders that were not valid XML, by partner.", "partner")
+	mConnectFails  = metrics.NewCounter("edi_host_connect_failures_total", "Failed connections to host endpoints, by endpoint.", "host")
+	mHostSend      = metrics.NewHistogram("edi_host_send_seconds", "Time to send one record or frame to the host, by endpoint.", nil, "host")
+)
+
+// notifyPO sends a notification about the order being imported,
+// with the order and any other documents named attached.
+func notifyPO(typ string, subject string, fields []notify.Field, docs ...string) {
+	ev := notify.Event{
+		Type:    typ,
+		ID:      edilog.ID(),
+		Subject: subject,
+		Partner: notify.PartnerOf(flag.Arg(0)),
+		Fields:  fields,
 	}
-	return 0
+	for _, doc := range append([]string{flag.Arg(0)}, docs...) {
+		ev.Attachments = append(ev.Attachments, notify.Attachment{Path: doc})
+	}
+	notifier.Notify(ev)
+}
+
+// exit delivers the notifications still queued, flushes the ledger,
+// hands the counts to public_input_service and exits.
+func exit(code int) {
+	notifier.Close(time.Minute)
+	book.Close()
+	metrics.Export()
+	os.Exit(code)
 }
 
 // Some XML files contain invalid UTF-8 characters, we try to fix.
@@ -115,9 +184,7 @@ func xmlResponse(resp POresponse, linkActions string, linkResponse string) {
 			Response       string `xml:"Response"`
 		} `xml:"Order"`
 	}
-	syslog.Syslog(syslog.LOG_INFO, "Building Response")
-	syslog.Syslogf(syslog.LOG_INFO, "Response: %s %s ",
-		resp.Order.OrderNumber, linkResponse)
+	slog.Info("Building response", "order", resp.Order.OrderNumber, "action", linkActions, "response", linkResponse)
 
 	rdata := &fXML{}
 	t := time.Now()
@@ -129,72 +196,157 @@ func xmlResponse(resp POresponse, linkActions string, linkResponse string) {
 	rdata.Order.ProjectNumber = resp.Order.ProjectNumber
 	rdata.Order.ContractNumber = resp.Order.ContractNumber
 	rdata.Order.Response = linkResponse // resp.Order.Response
-	orderparts := strings.Split(rdata.Order.OrderNumber, "/")
-	var newfn string
-	switch len(orderparts) {
-	case 1:
-		newfn = fmt.Sprintf("%sRESPONSE_%s_%s_PO_RESPONSE_%s.xml",
-			outpath, custid, rdata.Order.ProjectNumber, orderparts[0])
-	case 2:
-		newfn = fmt.Sprintf("%sRESPONSE_%s_%s_PO_RESPONSE_%s_%s.xml",
-			outpath, custid, rdata.Order.ProjectNumber, orderparts[0], orderparts[1])
-	default:
-		newfn = fmt.Sprintf("%sRESPONSE_%s_%s_PO_RESPONSE_%s.xml",
-			outpath, custid, rdata.Order.ProjectNumber, rdata.Order.OrderNumber)
-	}
+	newfn := responseName(rdata.Order.OrderNumber, rdata.Order.ProjectNumber, ".xml")
 
 	if m, err2 := xml.MarshalIndent(rdata, "", "\t"); err2 != nil {
 		panic("xml.MarshalIndent FAILED: " + err2.Error())
 	} else {
 		xmlheader := fmt.Sprintf("<?xml version=\"1.0\" encoding=\"ISO-8859-1\" ?>\n")
 		m = append([]byte(xmlheader), m...)
-		fmt.Printf("\nResponse filename: %s\n", newfn)
-		syslog.Syslogf(syslog.LOG_INFO, "Response file: %s\n", newfn)
-		ioerr := ioutil.WriteFile(newfn, []byte(fmt.Sprintf("%s\n\n\n", m)), 0644)
-		if ioerr != nil {
-			fmt.Printf("%v", ioerr)
-			efrom := emailfrom
-			eto := emailto
-			esub := "[EDI] PO Response WriteFile FAILED "
-			emsg := fmt.Sprintf(
-				"        Filename: %s\n\n"+
-					"           Order: %s\n"+
-					"         Project: %s\n"+
-					"   Import Status: %s\n"+
-					" Response Failed: %s\n"+
-					"       Date Time: %s\n",
-				path.Base(os.Args[1]),
-				rdata.Order.OrderNumber,
-				rdata.Order.ProjectNumber,
-				linkActions,
-				fmt.Sprintf("ioutil.WriteFile FAILED: %s ", ioerr.Error()),
-				time.Now().Format("2006-01-02 15:04:05"))
-			ediEmail(efrom, eto, esub, emsg)
-		} else {
-			efrom := emailfrom
-			eto := emailto
-			esub := "[EDI] PO Import Status: " + linkActions
-			emsg := fmt.Sprintf(
-				"      Filename: %s\n\n"+
-					"         Order: %s\n"+
-					"       Project: %s\n"+
-					"Status Message: %s\n"+
-					"     Date Time: %s\n",
-				path.Base(os.Args[1]),
-				rdata.Order.OrderNumber,
-				rdata.Order.ProjectNumber,
-				linkResponse,
-				time.Now().Format("2006-01-02 15:04:05"))
-			ediEmail(efrom, eto, esub, emsg)
-		}
+		writeResponse(newfn, []byte(fmt.Sprintf("%s\n\n\n", m)), nil, resp, linkActions, linkResponse)
+		slog.Debug("Response", "xml", string(m))
+	}
+}
 
-		fmt.Printf("\n%s\n\n", m)
+// responseDir is where responses are written, ending in a slash.
+func responseDir() string {
+	if *outDir != "" {
+		// An API order, the partner fetches the response.
+		return strings.TrimSuffix(*outDir, "/") + "/"
 	}
+	return config.Dirs.POResponses
+}
+
+// responseName is the file the response to an order is written to,
+// with the extension ext.
+func responseName(order string, project string, ext string) string {
+	orderparts := strings.Split(order, "/")
+	outpath := responseDir()
+	switch len(orderparts) {
+	case 1:
+		return fmt.Sprintf("%sRESPONSE_%s_%s_PO_RESPONSE_%s%s",
+			outpath, custid, project, orderparts[0], ext)
+	case 2:
+		return fmt.Sprintf("%sRESPONSE_%s_%s_PO_RESPONSE_%s_%s%s",
+			outpath, custid, project, orderparts[0], orderparts[1], ext)
+	}
+	return fmt.Sprintf("%sRESPONSE_%s_%s_PO_RESPONSE_%s%s",
+		outpath, custid, project, order, ext)
+}
+
+// writeResponse writes the response b to newfn, or reports builderr if
+// it could not be made, and records it for public_output_service.
+func writeResponse(newfn string, b []byte, builderr error, resp POresponse, linkActions string, linkResponse string) {
+	ioerr := builderr
+	if ioerr == nil {
+		ioerr = ioutil.WriteFile(newfn, b, 0644)
+	}
+	if ioerr != nil {
+		slog.Error("Failed to write response", "response", newfn, "err", ioerr)
+		notifyPO(notify.ResponseError, "[EDI] PO Response WriteFile FAILED ", notify.F(
+			"Filename", path.Base(flag.Arg(0)),
+			"Order", resp.Order.OrderNumber,
+			"Project", resp.Order.ProjectNumber,
+			"Import Status", linkActions,
+			"Response Failed", fmt.Sprintf("ioutil.WriteFile FAILED: %s ", ioerr.Error())))
+		return
+	}
+	notifyPO(notify.POStatus, "[EDI] PO Import Status: "+linkActions, notify.F(
+		"Filename", path.Base(flag.Arg(0)),
+		"Order", resp.Order.OrderNumber,
+		"Project", resp.Order.ProjectNumber,
+		"Status Message", linkResponse), newfn)
+	book.RecordKeys(edilog.ID(), ledger.Response, path.Base(newfn), ledger.Written, path.Base(flag.Arg(0)), ledger.Keys{
+		Order:   resp.Order.OrderNumber,
+		Project: resp.Order.ProjectNumber,
+		Message: resp.MessageID,
+	})
+	// public_output_service looks the ID up when it sends the file.
+	book.Flush()
+	slog.Info("Response written", "response", newfn)
+}
+
+// x12Response answers an order that came as an 850 with an 855, in the
+// version and usage the 850 came in, to the ID that sent it.
+func x12Response(q Query, resp POresponse, linkActions string, linkResponse string) {
+	slog.Info("Building 855", "order", resp.Order.OrderNumber, "action", linkActions, "response", linkResponse)
+	src := q.x12
+	cfg := config.X12
+	env := x12Reply(src.ic, src.group, "PR")
+	ack := x12.POAck{Message: linkResponse, Date: env.Date}
+	switch strings.ToUpper(linkActions) {
+	case "ACCEPTED", "ACCEPT", "OK":
+		ack.Type, ack.Status = x12.AckDetail, x12.ItemAccepted
+	case "REJECTED", "REJECT", "ERROR":
+		ack.Type, ack.Status = x12.AckReject, x12.ItemRejected
+	default:
+		ack.Type = x12.AckNoDetail
+	}
+	newfn := responseName(resp.Order.OrderNumber, resp.Order.ProjectNumber, ".x12")
+	var err error
+	if env.Control, env.Group, err = x12.OpenControls(cfg.ControlFile).Next(); err != nil {
+		writeResponse(newfn, nil, err, resp, linkActions, linkResponse)
+		return
+	}
+	w := x12.NewWriter(env, x12.DelimitersOf(cfg.Delimiters), cfg.LineBreaks)
+	x12.WritePOAck(w, src.po, ack)
+	b := w.Bytes()
+	writeResponse(newfn, b, nil, resp, linkActions, linkResponse)
+	slog.Debug("Response", "x12", string(b))
+}
+
+// x12Reply is the envelope of an answer to ic: from the ID it was sent
+// to, or x12.sender, back to its sender, in the version of its group g
+// if there is one, and as a test if ic was.
+func x12Reply(ic *x12.Interchange, g *x12.Group, code string) x12.Envelope {
+	cfg := config.X12
+	env := x12.Envelope{
+		SenderQual:   ic.ReceiverQual,
+		Sender:       ic.Receiver,
+		ReceiverQual: ic.SenderQual,
+		Receiver:     ic.Sender,
+		Version:      cfg.Version,
+		Usage:        cfg.Usage,
+		Code:         code,
+		Date:         time.Now(),
+	}
+	if g != nil {
+		env.AppSender, env.AppReceiver, env.Version = g.Receiver, g.Sender, g.Version
+	}
+	if cfg.Sender != "" {
+		env.Sender, env.AppSender = cfg.Sender, cfg.Sender
+		env.SenderQual = cfg.SenderQual
+		if env.SenderQual == "" {
+			env.SenderQual = "ZZ"
+		}
+	}
+	if ic.Usage == "T" {
+		env.Usage = "T"
+	}
+	return env
 }
 
 // Query is here
 type Query struct {
 	File `xml:"fXML"`
+
+	x12     *x12Order     // the 850 the order came as, nil for fXML
+	edifact *edifactOrder // the ORDERS the order came as, nil for fXML
+}
+
+// x12Order is where an order read from X12 came from, to answer it.
+type x12Order struct {
+	ic    *x12.Interchange
+	group *x12.Group
+	po    *x12.PO
+}
+
+// edifactOrder is where an order read from EDIFACT came from, to
+// answer it.
+type edifactOrder struct {
+	ic    *edifact.Interchange
+	msg   *edifact.Message
+	order *edifact.Order
 }
 
 // File is the inbound XML data.
@@ -282,6 +434,74 @@ func checkErr(err error) {
 	}
 }
 
+// hostDeadline arms the deadline for the next host operation: the record
+// timeout, cut short by whatever is left of the session.
+func hostDeadline(c *net.TCPConn) {
+	recordDeadline = time.Now().Add(*recordTimeout)
+	if !sessionDeadline.IsZero() && sessionDeadline.Before(recordDeadline) {
+		recordDeadline = sessionDeadline
+	}
+	c.SetDeadline(recordDeadline)
+}
+
+// hostExit reports a failed host operation and ends the import.
+// If the failure was an expired deadline we exit with exitRetry, unless
+// orders in the file have already gone to a host.
+func hostExit(status hostStatus) {
+	fields := notify.F(
+		"Filename", path.Base(flag.Arg(0)),
+		"Operation", status.Op,
+		"Error Number", strconv.Itoa(status.Number),
+		"Error Message", status.Message)
+	if len(imported) > 0 {
+		// Trying the file again would send these twice.
+		fields = append(fields, notify.F("Already Imported", strings.Join(imported, ", "))...)
+		notifyPO(notify.PONetwork, "[EDI] PO Import Network Error", fields)
+		exit(1)
+	}
+	notifyPO(notify.PONetwork, "[EDI] PO Import Network Error", fields)
+	if !recordDeadline.IsZero() && !time.Now().Before(recordDeadline) {
+		slog.Error("Host deadline expired, exit for retry")
+		exit(exitRetry)
+	}
+	exit(1)
+}
+
+// hostConnect is clientedi.Connect with the connect timeout applied.
+func hostConnect(addr string) (*net.TCPConn, hostStatus) {
+	type result struct {
+		conn   *net.TCPConn
+		status hostStatus
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, status := clientedi.Connect(addr)
+		done <- result{conn, hostStatus{status.Op, status.Number, status.Message}}
+	}()
+
+	timeout := *connectTimeout
+	if left := time.Until(sessionDeadline); left < timeout {
+		timeout = left
+	}
+	recordDeadline = time.Now().Add(timeout)
+	select {
+	case r := <-done:
+		return r.conn, r.status
+	case <-time.After(timeout):
+		// The host may still answer, don't leave it holding a session.
+		go func() {
+			if r := <-done; r.status.Number == 0 {
+				clientedi.Disconnect(r.conn)
+			}
+		}()
+		return nil, hostStatus{
+			Op:      "connect",
+			Number:  int(syscall.ETIMEDOUT),
+			Message: fmt.Sprintf("connect to %s timed out after %v", addr, timeout),
+		}
+	}
+}
+
 func dataSend(c *net.TCPConn, format string, data string) int {
 	str1 := fmt.Sprintf(format, data)
 	// fmt.Printf(str1)
@@ -290,55 +510,150 @@ func dataSend(c *net.TCPConn, format string, data string) int {
 	str4 := strings.TrimSpace(str3[0])
 	str5 := strings.TrimSpace(str3[1])
 	str6 := str4 + "=" + str5
-	status := clientedi.Send(c, str6)
+	return hostRecord(c, str6)
+}
+
+// hostNegotiate offers protocol 2 to the host and reports whether it
+// answered. An old host never answers: it files the offer as one more
+// order record, and could still answer late, or drops the connection,
+// so the connection is of no more use.
+func hostNegotiate(c *net.TCPConn) bool {
+	hostDeadline(c)
+	if status := clientedi.Send(c, ediframe.Hello(ediframe.Version)); status.Number != 0 {
+		slog.Info("Host did not take the protocol offer", "errno", status.Number, "err", status.Message)
+		return false
+	}
+	c.SetDeadline(time.Now().Add(*helloTimeout))
+	rec, status := clientedi.Recv(c)
 	if status.Number != 0 {
-		efrom := emailfrom
-		eto := emailto
-		esub := "[EDI] PO Import Network Error"
-		emsg := fmt.Sprintf(
-			"     Filename: %s\n\n"+
-				"    Operation: %s\n"+
-				" Error Number: %d\n"+
-				"Error Message: %s\n"+
-				"    Date Time: %s\n",
-			path.Base(os.Args[1]),
-			status.Op,
-			status.Number,
-			status.Message,
-			time.Now().Format("2006-01-02 15:04:05"))
-		ediEmail(efrom, eto, esub, emsg)
-		os.Exit(1)
+		return false
+	}
+	v := ediframe.ParseHello(rec[0:status.Len])
+	if v < 2 {
+		return false
+	}
+	if v > ediframe.Version {
+		v = ediframe.Version
+	}
+	protocol = v
+	slog.Info("Host speaks protocol", "protocol", v)
+	return true
+}
+
+// hostRecord passes one record on to the host. In protocol 2 it is
+// held until there are enough records for a frame.
+func hostRecord(c *net.TCPConn, rec string) int {
+	if protocol < 2 {
+		return hostSend(c, rec)
+	}
+	pending = append(pending, rec)
+	if batchSize > 0 && len(pending) >= batchSize {
+		return hostFlush(c)
+	}
+	return 0
+}
+
+// hostFlush sends the held records as one frame.
+func hostFlush(c *net.TCPConn) int {
+	if len(pending) == 0 {
+		return 0
+	}
+	recs := pending
+	pending = nil
+	frame, err := ediframe.Encode(recs)
+	if err != nil {
+		// A protocol 2 host still takes single records.
+		slog.Error("Sending records one at a time", "err", err)
+		for _, rec := range recs {
+			hostSend(c, rec)
+		}
+		return 0
+	}
+	return hostSend(c, frame)
+}
 
+// hostSend sends one record to the host within the record deadline.
+func hostSend(c *net.TCPConn, rec string) int {
+	hostDeadline(c)
+	start := time.Now()
+	status := clientedi.Send(c, rec)
+	mHostSend.Observe(time.Since(start).Seconds(), hostName)
+	if status.Number != 0 {
+		slog.Error("Host send failed", "op", status.Op, "errno", status.Number, "err", status.Message)
+		hostExit(hostStatus{status.Op, status.Number, status.Message})
 	}
 	return 0
 }
 
+// dataRecv reads one reply from the host, failing like dataSend does.
+func dataRecv(c *net.TCPConn) string {
+	hostDeadline(c)
+	data, status := clientedi.Recv(c)
+	if status.Number != 0 {
+		slog.Error("Host receive failed", "op", status.Op, "errno", status.Number, "err", status.Message)
+		hostExit(hostStatus{status.Op, status.Number, status.Message})
+	}
+	slog.Debug("Received from host", "len", status.Len)
+	return data[0:status.Len]
+}
+
 func data2Host(q Query) {
-	syslog.Syslogf(syslog.LOG_INFO, "Connecting to: %s", "192.168.1.240:30770")
-	conn, edierr := clientedi.Connect("192.168.1.240:30770")
+	sessionDeadline = time.Now().Add(*sessionTimeout)
+
+	// Try the endpoints for this order until one takes the connection.
+	// Only connect failures move on to the next endpoint, once records
+	// have been sent the order belongs to that host.
+	pool := hostpool.New(config.Hosts)
+	var conn *net.TCPConn
+	var edierr hostStatus
+	var hostaddr string
+	var tried []string
+	for _, ep := range pool.Route(q.File.Fileord.ContractNumber, q.File.Fileord.ProjectNumber) {
+		hostaddr = ep.Addr
+		// Each endpoint, and each order of an interchange, starts
+		// again in protocol 1.
+		protocol, pending, batchSize = 1, nil, 0
+		slog.Info("Connecting", "host", ep.Name, "addr", hostaddr)
+		conn, edierr = hostConnect(hostaddr)
+		if edierr.Number == 0 && ep.Protocol == 2 && !hostNegotiate(conn) {
+			// Start again on a new connection, in protocol 1.
+			slog.Info("No protocol reply from host, reconnecting with protocol 1", "host", ep.Name)
+			conn.Close()
+			conn, edierr = hostConnect(hostaddr)
+		}
+		if edierr.Number == 0 {
+			hostName = ep.Name
+			pool.MarkUp(ep.Name)
+			batchSize = ep.BatchSize
+			break
+		}
+		slog.Error("Connect failed", "host", ep.Name, "addr", hostaddr, "err", edierr.Message)
+		mConnectFails.Inc(ep.Name)
+		pool.MarkDown(ep.Name, fmt.Errorf("%s", edierr.Message))
+		tried = append(tried, fmt.Sprintf("%s (%s): %s", ep.Name, hostaddr, edierr.Message))
+		if !time.Now().Before(sessionDeadline) {
+			break
+		}
+	}
 	if edierr.Number != 0 {
-		errstr := fmt.Sprintf("%s Error=%d", edierr.Message, edierr.Number)
-		fmt.Printf("%s ", errstr)
-		efrom := emailfrom
-		eto := emailto
-		esub := "[EDI] PO Import Network Error"
-		emsg := fmt.Sprintf(
-			"      Filename: %s\n\n"+
-				"         Order: %s\n"+
-				"       Project: %s\n"+
-				"     Operation: %s\n"+
-				"  Error Number: %d\n"+
-				" Error Message: %s\n"+
-				"     Date Time: %s\n",
-			path.Base(os.Args[1]),
-			q.File.Fileord.Ordno,
-			q.File.Fileord.ProjectNumber,
-			edierr.Op,
-			edierr.Number,
-			edierr.Message,
-			time.Now().Format("2006-01-02 15:04:05"))
-		ediEmail(efrom, eto, esub, emsg)
-		os.Exit(1)
+		edierr.Message = strings.Join(tried, "\n")
+		slog.Error("No host took the order", "errno", edierr.Number, "tried", len(tried))
+		fields := notify.F(
+			"Filename", path.Base(flag.Arg(0)),
+			"Order", q.File.Fileord.Ordno,
+			"Project", q.File.Fileord.ProjectNumber,
+			"Operation", edierr.Op,
+			"Error Number", strconv.Itoa(edierr.Number),
+			"Error Message", edierr.Message)
+		if len(imported) > 0 {
+			// Trying the file again would send these twice.
+			fields = append(fields, notify.F("Already Imported", strings.Join(imported, ", "))...)
+			notifyPO(notify.PONetwork, "[EDI] PO Import Network Error", fields)
+			exit(1)
+		}
+		notifyPO(notify.PONetwork, "[EDI] PO Import Network Error", fields)
+		// Nothing reached a host, the order can safely be tried again.
+		exit(exitRetry)
 	}
 
 	//fmt.Printf("\n ****** Purchase Order ****** \n")
@@ -354,7 +669,7 @@ func data2Host(q Query) {
 	dataSend(conn, "to.Id              \t%s\n", q.File.Credto.ID)
 	dataSend(conn, "to.Dm              \t%s\n", q.File.Credto.Dm)
 	//fmt.Printf("\n ******      Order     ****** \n")
-	syslog.Syslogf(syslog.LOG_INFO, "Order number %s", q.Fileord.Ordno)
+	slog.Info("Sending order", "order", q.Fileord.Ordno)
 	dataSend(conn, "Ordno              \t%s\n", q.File.Fileord.Ordno)
 	dataSend(conn, "Prjord             \t%s\n", q.File.Fileord.Prjord)
 	dataSend(conn, "Action             \t%s\n", q.File.Fileord.Action)
@@ -407,27 +722,16 @@ func data2Host(q Query) {
 			dataSend(conn, "ClientReportTable \t%s\n", " ")
 			dataSend(conn, "UIDSerialNumber \t%s\n", " ")
 			dataSend(conn, "UIDType \t%s\n", " ")
-			efrom := emailfrom
-			eto := emailto
-			esub := "[EDI] Incoming Asset: " + q.Fileord.Ordno
-			emsg := fmt.Sprintf(
-				"              PO: %s\n"+
-					"       Line item: %s\n"+
-					"MaterialItemCode: %s\n"+
-					"           Value: $%s %s\n"+
-					"     DESCRIPTION: %s\n\n"+
-					"       Date Time: %s\n",
-				q.Fileord.Ordno,
-				item.LineNumber,
-				item.MaterialItemCode,
-				item.POUnitPrice,
-				item.POCurrency,
-				item.MaterialShortDescription,
-				time.Now().Format("2006-01-02 15:04:05"))
-			ediEmail(efrom, eto, esub, emsg)
+			notifyPO(notify.POAsset, "[EDI] Incoming Asset: "+q.Fileord.Ordno, notify.F(
+				"PO", q.Fileord.Ordno,
+				"Line item", item.LineNumber,
+				"MaterialItemCode", item.MaterialItemCode,
+				"Value", fmt.Sprintf("$%s %s", item.POUnitPrice, item.POCurrency),
+				"DESCRIPTION", item.MaterialShortDescription))
 		}
 	}
-	clientedi.Send(conn, "EDIEOF")
+	hostFlush(conn)
+	hostSend(conn, "EDIEOF")
 	t := time.Now()
 	var resp POresponse
 	resp.MessageID = q.File.Msg
@@ -436,23 +740,609 @@ func data2Host(q Query) {
 	resp.Order.OrderNumber = q.File.Fileord.Ordno
 	resp.Order.ProjectNumber = q.File.Fileord.ProjectNumber
 	resp.Order.ContractNumber = q.File.Fileord.ContractNumber
-	myaction, actstat := clientedi.Recv(conn)
-	myresponse, respstat := clientedi.Recv(conn)
-	fmt.Printf("action len=%d\n", actstat.Len)
-	fmt.Printf("ressp len=%d\n", respstat.Len)
-	resp.Order.Action = fmt.Sprintf("%s", myaction[0:actstat.Len])
-	resp.Order.Response = fmt.Sprintf("%s", myresponse[0:respstat.Len])
-	syslog.Syslogf(syslog.LOG_INFO, "DisConnecting from: %s", "192.168.1.240:30770")
+	resp.Order.Action = dataRecv(conn)
+	resp.Order.Response = dataRecv(conn)
+	slog.Info("Disconnecting", "addr", hostaddr, "action", resp.Order.Action)
 	clientedi.Disconnect(conn)
+	imported = append(imported, q.File.Fileord.Ordno)
+	if q.x12 != nil {
+		x12Response(q, resp, resp.Order.Action, resp.Order.Response)
+		return
+	}
+	if q.edifact != nil {
+		edifactResponse(q, resp, resp.Order.Action, resp.Order.Response)
+		return
+	}
 	xmlResponse(resp, resp.Order.Action, resp.Order.Response)
 
 }
 
-func main() {
-	syslog.Openlog("XML_PO_import", syslog.LOG_PID, syslog.LOG_USER)
-	syslog.Syslog(syslog.LOG_INFO, "XML_PO_import started")
-	defer syslog.Syslog(syslog.LOG_INFO, "XML_PO_import ended")
+// x12Actions are the fXML order actions for the BEG01 purposes.
+var x12Actions = map[string]string{
+	"00": "Create",
+	"01": "Cancel",
+	"04": "Change",
+	"05": "Replace",
+	"06": "Confirm",
+	"07": "Duplicate",
+}
+
+// x12UOM names the common X12 units of measure.
+var x12UOM = map[string]string{
+	"BX":  "Box",
+	"CA":  "Case",
+	"EA":  "Each",
+	"FT":  "Foot",
+	"KG":  "Kilogram",
+	"LB":  "Pound",
+	"PK":  "Package",
+	"RL":  "Roll",
+	"SET": "Set",
+}
+
+// x12Orders reads the 850s in the X12 interchange b, each as the order
+// its fXML would be, and settles the 997s and 999s in it. What is
+// wrong with it is noted in the acknowledgment returned, nil if the
+// ISA could not be read. The interchange is refused whole if any of
+// its orders is wrong.
+func x12Orders(fn string, b []byte) ([]Query, *x12.FunctionalAck, error) {
+	ic, err := x12.Parse(b)
+	if ic == nil {
+		return nil, nil, err
+	}
+	fa := x12.NewFunctionalAck(ic, err)
+	if err != nil {
+		return nil, fa, err
+	}
+	var qs []Query
+	var first error
+	acked := false
+	for _, g := range ic.Groups {
+		switch g.Code {
+		case "PO":
+		case "FA":
+			x12Settle(ic, g)
+			acked = true
+			continue
+		default:
+			// 1: functional group not supported.
+			fa.Group(g).Codes = append(fa.Group(g).Codes, "1")
+			if first == nil {
+				first = &x12.EnvelopeError{Level: x12.LevelGroup, Control: g.Control, Segment: "GS", Code: "1",
+					Msg: fmt.Sprintf("functional group %s is not purchase orders", g.Code)}
+			}
+			continue
+		}
+		for _, t := range g.Sets {
+			if t.Code != "850" {
+				// 1: transaction set not supported.
+				fa.Set(t).Codes = append(fa.Set(t).Codes, "1")
+				if first == nil {
+					first = &x12.EnvelopeError{Level: x12.LevelSet, Control: t.Control, Segment: "ST", Code: "1",
+						Msg: fmt.Sprintf("transaction set %s is not an 850", t.Code)}
+				}
+				continue
+			}
+			po, err := x12.ReadPO(t)
+			if err != nil {
+				var errs x12.SegmentErrors
+				if errors.As(err, &errs) {
+					fa.Set(t).Errors = errs
+				}
+				if first == nil {
+					first = err
+				}
+				continue
+			}
+			qs = append(qs, x12Query(fn, ic, g, po))
+		}
+	}
+	if first != nil {
+		return nil, fa, first
+	}
+	if len(qs) == 0 && !acked {
+		return nil, fa, &x12.EnvelopeError{Level: x12.LevelInterchange, Control: ic.Control, Code: "024", Msg: "no purchase orders"}
+	}
+	return qs, fa, nil
+}
 
+// x12Acknowledge answers the interchange with its TA1 and 997s or 999s,
+// in RESPONSE_ACMESHIP_<sender>_ACK_<ISA13>.x12. It does so once: a
+// file tried again after a host timeout is not acknowledged again.
+func x12Acknowledge(fn string, fa *x12.FunctionalAck) {
+	ic := fa.Interchange
+	if len(fa.Groups) == 0 && fa.Error == nil && !ic.AckRequested {
+		// Nothing but acknowledgments, which are not acknowledged.
+		return
+	}
+	cfg := config.X12
+	var g *x12.Group
+	if len(fa.Groups) > 0 {
+		g = fa.Groups[0].Group
+	}
+	env := x12Reply(ic, g, "FA")
+	code := cfg.FunctionalAck
+	if code == "" {
+		code = "997"
+		if env.Version >= "005010" {
+			code = "999"
+		}
+	}
+	newfn := fmt.Sprintf("%sRESPONSE_%s_%s_ACK_%s.x12", responseDir(), custid, ic.Sender, ic.Control)
+	if _, ok := ledger.Last(config.Ledger, path.Base(newfn)); ok {
+		slog.Info("Interchange already acknowledged", "ack", newfn)
+		return
+	}
+	var err error
+	if env.Control, env.Group, err = x12.OpenControls(cfg.ControlFile).Next(); err != nil {
+		slog.Error("Failed to number the acknowledgment", "err", err)
+		return
+	}
+	w := x12.NewWriter(env, x12.DelimitersOf(cfg.Delimiters), cfg.LineBreaks)
+	x12.WriteFunctionalAck(w, fa, code)
+	if err := ioutil.WriteFile(newfn, w.Bytes(), 0644); err != nil {
+		slog.Error("Failed to write acknowledgment", "ack", newfn, "err", err)
+		return
+	}
+	book.RecordKeys(edilog.ID(), ledger.Response, path.Base(newfn), ledger.Written, path.Base(fn), ledger.Keys{
+		Message: ic.Sender + "_" + ic.Control,
+		Partner: notify.PartnerOf(fn),
+	})
+	book.Flush()
+	slog.Info("Acknowledgment written", "ack", newfn, "set", code)
+}
+
+// x12Settle settles the acknowledgments owed us that the 997s or 999s
+// in g are.
+func x12Settle(ic *x12.Interchange, g *x12.Group) {
+	for _, t := range g.Sets {
+		r, err := x12.ReadFunctionalAck(t)
+		if err != nil {
+			slog.Warn("Acknowledgment not understood", "from", ic.Sender, "set", t.Control, "err", err)
+			continue
+		}
+		settleAck(ic.Sender, r.Code, r.Control, r.Status, r.String())
+	}
+}
+
+// settleAck settles the acknowledgment from partner of the group of
+// code and control number, X12 or EDIFACT, and reports one that
+// rejects what we sent.
+func settleAck(partner string, code string, control string, status string, report string) {
+	o, ok, err := acks.Open(config.X12.AckFile).Settle(partner, code, control, status, time.Now())
+	if err != nil {
+		slog.Error("Failed to settle acknowledgment", "from", partner, "group", control, "err", err)
+		return
+	}
+	if !ok {
+		slog.Warn("Acknowledgment of a group not owed one", "from", partner, "ack", report)
+		return
+	}
+	slog.Info("Acknowledgment came", "from", partner, "ack", report, "doc", o.Doc)
+	book.Record(ledger.IDOf(config.Ledger, o.Doc), o.Kind, o.Doc, ledger.Acknowledged, status)
+	if status == x12.Rejected || status == x12.PartiallyAccepted {
+		notifier.Notify(notify.Event{
+			Type:    notify.AckRejected,
+			ID:      edilog.ID(),
+			Subject: "[EDI] Acknowledgment Rejects: " + o.Doc,
+			Partner: notify.PartnerOf(o.Doc),
+			Fields: notify.F(
+				"Filename", o.Doc,
+				"Partner", partner,
+				"Group", o.Code+" "+o.Group,
+				"Acknowledgment", report),
+		})
+	}
+}
+
+// x12Query maps an 850 onto the fXML order.
+func x12Query(fn string, ic *x12.Interchange, g *x12.Group, po *x12.PO) Query {
+	var q Query
+	q.x12 = &x12Order{ic, g, po}
+	q.File.Msg = fmt.Sprintf("%s_%s_%s", ic.Sender, ic.Control, po.Set)
+	q.File.Datetime = g.Date.Format("2006-01-02T15:04:05")
+	q.File.Fileversion = g.Version
+	q.File.Credfrom.ID, q.File.Credfrom.Dm = ic.Sender, ic.SenderQual
+	q.File.Credto.ID, q.File.Credto.Dm = ic.Receiver, ic.ReceiverQual
+
+	o := &q.File.Fileord
+	o.Ordno = po.Number
+	o.Prjord = po.Release
+	o.Action = x12Actions[po.Purpose]
+	if o.Action == "" {
+		o.Action = po.Purpose
+	}
+	// The project, and the contract, route the order. Without a REF
+	// the project is the one in the file name, as for XML.
+	o.ProjectNumber = po.Refs["PJ"]
+	if fileparts := strings.Split(path.Base(fn), "_"); o.ProjectNumber == "" && len(fileparts) > 2 {
+		o.ProjectNumber = fileparts[2]
+	}
+	o.ContractNumber = po.Refs["CT"]
+	if o.ContractNumber == "" {
+		o.ContractNumber = o.ProjectNumber
+	}
+	if v, ok := po.Party("VN", "SE", "SU"); ok {
+		o.VendorName = v.Name
+		o.VendorAddress1 = strings.Join(v.Address, ", ")
+		o.VendorCity = v.City
+		o.VendorState = v.State
+		o.VendorPostalCode = v.Postal
+		o.VendorCountry = v.Country
+		o.VendorContactName = v.Contact
+		o.VendorTelephone = v.Phone
+	}
+	o.IncoTerms = po.Terms
+	o.IncoLocation = po.Location
+	o.PODescription = po.Description
+	o.Comments = strings.Join(po.Notes, "\n")
+
+	shipTo, _ := po.Party("ST")
+	var qty, amount float64
+	for _, l := range po.Lines {
+		var item Line
+		item.LineNumber = l.Number
+		item.Qty = l.Qty
+		item.RevisionNumber = "0"
+		item.IssueDate = po.Date.Format("2006-01-02")
+		for _, qual := range []string{"BP", "IN", "VP", "MG"} {
+			if id := l.IDs[qual]; id != "" {
+				item.MaterialItemCode = id
+				break
+			}
+		}
+		if len(l.Descriptions) > 0 {
+			item.MaterialShortDescription = l.Descriptions[0]
+			item.MaterialLongDescription = strings.Join(l.Descriptions[1:], " ")
+		}
+		item.UM.UOM = l.UOM
+		item.UM.UOMDescr = x12UOM[l.UOM]
+		item.ProjectUnitPrice = l.Price
+		item.POUnitPrice = l.Price
+		item.ProjectCurrency = po.Currency
+		item.POCurrency = po.Currency
+		item.IsAsset = "No"
+		item.IsUID = "No"
+		item.Destination = shipTo.City
+		if d, ok := l.Dates["002"]; ok {
+			item.DeliveryDate = d.Format("2006-01-02")
+		} else if d, ok := po.Dates["002"]; ok {
+			item.DeliveryDate = d.Format("2006-01-02")
+		}
+		item.Comments = strings.Join(l.Notes, "\n")
+		item.Subline = "0"
+		o.Lineitem = append(o.Lineitem, item)
+
+		n, _ := strconv.ParseFloat(l.Qty, 64)
+		p, _ := strconv.ParseFloat(l.Price, 64)
+		qty += n
+		amount += n * p
+	}
+	q.OrderRequestSummary.TotalLineItems = strconv.Itoa(len(po.Lines))
+	q.OrderRequestSummary.TotalQuantity = strconv.FormatFloat(qty, 'f', -1, 64)
+	q.OrderRequestSummary.TotalAmount = strconv.FormatFloat(amount, 'f', 2, 64)
+	return q
+}
+
+// edifactActions are the fXML order actions for the BGM03 message
+// functions.
+var edifactActions = map[string]string{
+	"9": "Create",
+	"1": "Cancel",
+	"4": "Change",
+	"5": "Replace",
+	"6": "Confirm",
+	"7": "Duplicate",
+}
+
+// edifactUOM names the common UN/ECE units of measure.
+var edifactUOM = map[string]string{
+	"BX":  "Box",
+	"CS":  "Case",
+	"EA":  "Each",
+	"FOT": "Foot",
+	"KGM": "Kilogram",
+	"LBR": "Pound",
+	"MTR": "Metre",
+	"PCE": "Piece",
+	"PK":  "Package",
+	"RO":  "Roll",
+	"SET": "Set",
+}
+
+// edifactOrders reads the ORDERS in the EDIFACT interchange b, each as
+// the order its fXML would be, and settles the CONTRLs in it. What is
+// wrong with it is noted in the acknowledgment returned, nil if the UNB
+// could not be read. The interchange is refused whole if any of its
+// orders is wrong.
+func edifactOrders(fn string, b []byte) ([]Query, *edifact.Ack, error) {
+	ic, err := edifact.Parse(b)
+	if ic == nil {
+		return nil, nil, err
+	}
+	a := edifact.NewAck(ic, err)
+	if err != nil {
+		return nil, a, err
+	}
+	var qs []Query
+	var first error
+	acked := false
+	for _, m := range ic.Messages {
+		switch m.Type {
+		case "ORDERS":
+		case "CONTRL":
+			edifactSettle(ic, m)
+			acked = true
+			continue
+		default:
+			// 17: no agreement to receive the message type.
+			a.Message(m).Codes = append(a.Message(m).Codes, "17")
+			if first == nil {
+				first = &edifact.EnvelopeError{Level: edifact.LevelMessage, Ref: m.Ref, Segment: "UNH", Code: "17",
+					Msg: fmt.Sprintf("message %s is not an ORDERS", m.Type)}
+			}
+			continue
+		}
+		o, err := edifact.ReadOrder(m)
+		if err != nil {
+			var errs edifact.SegmentErrors
+			if errors.As(err, &errs) {
+				a.Message(m).Errors = errs
+			}
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		qs = append(qs, edifactQuery(fn, ic, m, o))
+	}
+	if first != nil {
+		return nil, a, first
+	}
+	if len(qs) == 0 && !acked {
+		// 32: lower level empty.
+		a.Error = &edifact.EnvelopeError{Level: edifact.LevelInterchange, Ref: ic.Control, Code: "32", Msg: "no purchase orders"}
+		return nil, a, a.Error
+	}
+	return qs, a, nil
+}
+
+// edifactAcknowledge answers the interchange with a CONTRL, in
+// RESPONSE_ACMESHIP_<sender>_CONTRL_<UNB05>.edi, once, as
+// x12Acknowledge does.
+func edifactAcknowledge(fn string, a *edifact.Ack) {
+	ic := a.Interchange
+	if a.Empty() {
+		// Nothing but CONTRLs, which are not acknowledged.
+		return
+	}
+	newfn := fmt.Sprintf("%sRESPONSE_%s_%s_CONTRL_%s.edi", responseDir(), custid, ic.Sender, ic.Control)
+	if _, ok := ledger.Last(config.Ledger, path.Base(newfn)); ok {
+		slog.Info("Interchange already acknowledged", "ack", newfn)
+		return
+	}
+	env := edifactReply(ic)
+	// A CONTRL is not itself acknowledged.
+	env.AckRequested = false
+	var err error
+	if env.Control, _, err = x12.OpenControls(config.EDIFACT.ControlFile).Next(); err != nil {
+		slog.Error("Failed to number the acknowledgment", "err", err)
+		return
+	}
+	w := edifact.NewWriter(env, ic.Delims, config.EDIFACT.LineBreaks)
+	edifact.WriteContrl(w, a)
+	if err := ioutil.WriteFile(newfn, w.Bytes(), 0644); err != nil {
+		slog.Error("Failed to write acknowledgment", "ack", newfn, "err", err)
+		return
+	}
+	book.RecordKeys(edilog.ID(), ledger.Response, path.Base(newfn), ledger.Written, path.Base(fn), ledger.Keys{
+		Message: ic.Sender + "_" + ic.Control,
+		Partner: notify.PartnerOf(fn),
+	})
+	book.Flush()
+	slog.Info("Acknowledgment written", "ack", newfn, "message", "CONTRL")
+}
+
+// edifactSettle settles the acknowledgment owed us that the CONTRL m
+// is.
+func edifactSettle(ic *edifact.Interchange, m *edifact.Message) {
+	r, err := edifact.ReadContrl(m)
+	if err != nil {
+		slog.Warn("Acknowledgment not understood", "from", ic.Sender, "message", m.Ref, "err", err)
+		return
+	}
+	settleAck(ic.Sender, "UNB", r.Control, r.Status, r.String())
+}
+
+// edifactResponse answers an order that came as an ORDERS with an
+// ORDRSP, in the syntax and directory the ORDERS came in, to the ID
+// that sent it.
+func edifactResponse(q Query, resp POresponse, linkActions string, linkResponse string) {
+	slog.Info("Building ORDRSP", "order", resp.Order.OrderNumber, "action", linkActions, "response", linkResponse)
+	src := q.edifact
+	env := edifactReply(src.ic)
+	r := edifact.OrderResponse{Message: linkResponse, Date: env.Date}
+	switch strings.ToUpper(linkActions) {
+	case "ACCEPTED", "ACCEPT", "OK":
+		r.Type = edifact.ResponseAccepted
+	case "REJECTED", "REJECT", "ERROR":
+		r.Type = edifact.ResponseRejected
+	default:
+		r.Type = edifact.ResponseAcknowledged
+	}
+	newfn := responseName(resp.Order.OrderNumber, resp.Order.ProjectNumber, ".edi")
+	var err error
+	if env.Control, _, err = x12.OpenControls(config.EDIFACT.ControlFile).Next(); err != nil {
+		writeResponse(newfn, nil, err, resp, linkActions, linkResponse)
+		return
+	}
+	w := edifact.NewWriter(env, src.ic.Delims, config.EDIFACT.LineBreaks)
+	edifact.WriteOrderResponse(w, src.order, src.msg, r)
+	b := w.Bytes()
+	writeResponse(newfn, b, nil, resp, linkActions, linkResponse)
+	slog.Debug("Response", "edifact", string(b))
+}
+
+// edifactReply is the envelope of an answer to ic: from the ID it was
+// sent to, or edifact.sender, back to its sender, in its syntax and as
+// a test if ic was.
+func edifactReply(ic *edifact.Interchange) edifact.Envelope {
+	cfg := config.EDIFACT
+	env := edifact.Envelope{
+		Syntax:       ic.Syntax,
+		Version:      ic.Version,
+		SenderQual:   ic.ReceiverQual,
+		Sender:       ic.Receiver,
+		ReceiverQual: ic.SenderQual,
+		Receiver:     ic.Sender,
+		AckRequested: cfg.AckRequested,
+		Test:         ic.Test,
+		Date:         time.Now(),
+	}
+	if cfg.Sender != "" {
+		env.Sender, env.SenderQual = cfg.Sender, cfg.SenderQual
+	}
+	return env
+}
+
+// edifactQuery maps an ORDERS onto the fXML order, as x12Query does an
+// 850.
+func edifactQuery(fn string, ic *edifact.Interchange, m *edifact.Message, eo *edifact.Order) Query {
+	var q Query
+	q.edifact = &edifactOrder{ic, m, eo}
+	q.File.Msg = fmt.Sprintf("%s_%s_%s", ic.Sender, ic.Control, m.Ref)
+	q.File.Datetime = ic.Date.Format("2006-01-02T15:04:05")
+	q.File.Fileversion = m.Version + ":" + m.Release
+	q.File.Credfrom.ID, q.File.Credfrom.Dm = ic.Sender, ic.SenderQual
+	q.File.Credto.ID, q.File.Credto.Dm = ic.Receiver, ic.ReceiverQual
+
+	o := &q.File.Fileord
+	o.Ordno = eo.Number
+	o.Action = edifactActions[eo.Function]
+	if o.Action == "" {
+		o.Action = eo.Function
+	}
+	// AEP is the project number; without it the project is the one in
+	// the file name, as for XML.
+	o.ProjectNumber = eo.Refs["AEP"]
+	if fileparts := strings.Split(path.Base(fn), "_"); o.ProjectNumber == "" && len(fileparts) > 2 {
+		o.ProjectNumber = fileparts[2]
+	}
+	o.ContractNumber = eo.Refs["CT"]
+	if o.ContractNumber == "" {
+		o.ContractNumber = o.ProjectNumber
+	}
+	if v, ok := eo.Party("SU", "SE"); ok {
+		o.VendorName = v.Name
+		o.VendorAddress1 = strings.Join(v.Address, ", ")
+		o.VendorCity = v.City
+		o.VendorState = v.State
+		o.VendorPostalCode = v.Postal
+		o.VendorCountry = v.Country
+		o.VendorContactName = v.Contact
+		o.VendorTelephone = v.Phone
+	}
+	o.IncoTerms = eo.Terms
+	o.IncoLocation = eo.Location
+	o.PODescription = eo.Description
+	o.Comments = strings.Join(eo.Notes, "\n")
+
+	shipTo, _ := eo.Party("ST", "DP")
+	var qty, amount float64
+	for _, l := range eo.Lines {
+		var item Line
+		item.LineNumber = l.Number
+		item.Qty = l.Qty
+		item.RevisionNumber = "0"
+		item.IssueDate = eo.Date.Format("2006-01-02")
+		for _, qual := range []string{"BP", "IN", "SA", "MF"} {
+			if id := l.IDs[qual]; id != "" {
+				item.MaterialItemCode = id
+				break
+			}
+		}
+		if len(l.Descriptions) > 0 {
+			item.MaterialShortDescription = l.Descriptions[0]
+			item.MaterialLongDescription = strings.Join(l.Descriptions[1:], " ")
+		}
+		item.UM.UOM = l.UOM
+		item.UM.UOMDescr = edifactUOM[l.UOM]
+		item.ProjectUnitPrice = l.Price
+		item.POUnitPrice = l.Price
+		item.ProjectCurrency = eo.Currency
+		item.POCurrency = eo.Currency
+		item.IsAsset = "No"
+		item.IsUID = "No"
+		item.Destination = shipTo.City
+		// 2: delivery date requested.
+		if d, ok := l.Dates["2"]; ok {
+			item.DeliveryDate = d.Format("2006-01-02")
+		} else if d, ok := eo.Dates["2"]; ok {
+			item.DeliveryDate = d.Format("2006-01-02")
+		}
+		item.Comments = strings.Join(l.Notes, "\n")
+		item.Subline = "0"
+		o.Lineitem = append(o.Lineitem, item)
+
+		n, _ := strconv.ParseFloat(l.Qty, 64)
+		p, _ := strconv.ParseFloat(l.Price, 64)
+		qty += n
+		amount += n * p
+	}
+	q.OrderRequestSummary.TotalLineItems = strconv.Itoa(len(eo.Lines))
+	q.OrderRequestSummary.TotalQuantity = strconv.FormatFloat(qty, 'f', -1, 64)
+	q.OrderRequestSummary.TotalAmount = strconv.FormatFloat(amount, 'f', 2, 64)
+	return q
+}
+
+// importOrders pushes the orders read from the interchange in fn to
+// the host, one after another.
+func importOrders(fn string, orders []Query) {
+	for _, q := range orders {
+		book.RecordKeys(edilog.ID(), ledger.PO, path.Base(fn), ledger.Parsed, "", ledger.Keys{
+			Order:   q.File.Fileord.Ordno,
+			Project: q.File.Fileord.ProjectNumber,
+			Message: q.File.Msg,
+			Partner: notify.PartnerOf(fn),
+		})
+		data2Host(q)
+	}
+}
+
+// parseFailed answers an order that could not be read with an ERROR
+// response and exits.
+func parseFailed(fn string, err error) {
+	mParseFailures.Inc(notify.PartnerOf(fn))
+	var resp POresponse
+	fileparts := strings.Split(flag.Arg(0), "_")
+	t := time.Now()
+	resp.MessageID = strings.TrimSuffix(path.Base(strings.Join(fileparts, "_")), path.Ext(fn))
+	resp.Timestamp = t.Format("2006-01-02T15:04:05")
+	resp.Version = "1.0"
+	if len(fileparts) > 3 {
+		resp.Order.OrderNumber = fileparts[3]
+		resp.Order.ProjectNumber = fileparts[2]
+		resp.Order.ContractNumber = fileparts[2]
+	} else {
+		resp.Order.OrderNumber = resp.MessageID
+	}
+	xmlResponse(resp, "ERROR", err.Error())
+	exit(1)
+}
+
+// interchangeFailed reports an X12 or EDIFACT interchange that could
+// not be read and exits. The partner has the 997, 999, TA1 or CONTRL
+// saying what is wrong, so there is no fXML response, which they would
+// not take.
+func interchangeFailed(fn string, err error) {
+	mParseFailures.Inc(notify.PartnerOf(fn))
+	notifyPO(notify.POError, "[EDI] IMPORT ERROR: "+path.Base(fn), notify.F(
+		"Filename", fn,
+		"Error", err.Error()))
+	exit(1)
+}
+
+func main() {
 	flag.Usage = func() {
 		fmt.Printf("Usage of %s:", os.Args[0])
 		fmt.Printf(" followed by One xml filename. \n")
@@ -468,37 +1358,98 @@ func main() {
 		flag.Usage()
 		os.Exit(1)
 	}
+	var cfgerr error
+	if config, cfgerr = ediconfig.Load(*configPath); cfgerr != nil {
+		edilog.Fatal("Failed to load configuration", "err", cfgerr)
+	}
+	// The correlation ID, when public_input_service started us, comes
+	// from the environment and is on every record.
+	closeLog, logerr := edilog.Setup("XML_PO_import", config.Log)
+	if logerr != nil {
+		edilog.Fatal("Failed to open log", "err", logerr)
+	}
+	defer closeLog()
+	slog.Info("XML_PO_import started", "file", flag.Arg(0))
+	defer slog.Info("XML_PO_import ended")
+	defer metrics.Export()
+	var lerr error
+	if book, lerr = ledger.Open(config.Ledger, "XML_PO_import"); lerr != nil {
+		slog.Error("Failed to open ledger", "err", lerr)
+	}
+	defer book.Close()
+	serv, port, user, pass := config.Mail.Settings(smtpserv, smtpport, smtpuser, smtppass)
+	var nerr error
+	notifier, nerr = notify.New(config.Notify, notify.Defaults{
+		Source: "XML_PO_import",
+		From:   emailfrom,
+		To:     emailto,
+		Mail:   ediconfig.Mail{Server: serv, Port: port, User: user, Password: pass},
+	})
+	if nerr != nil {
+		edilog.Fatal("Failed to start notifications", "err", nerr)
+	}
+	defer notifier.Close(time.Minute)
 
 	for _, fn := range flag.Args() {
-		syslog.Syslogf(syslog.LOG_ERR, "%s", fn)
 		xmlFile, err := os.Open(fn)
 		if err != nil {
-			syslog.Syslogf(syslog.LOG_ERR, "%s", err.Error())
-			panic(err)
+			edilog.Fatal("Failed to open order", "file", fn, "err", err)
 		}
-		fmt.Printf("\nFile: %s\n", fn)
 		b, _ := ioutil.ReadAll(xmlFile)
+		if path.Ext(fn) == ".x12" {
+			orders, fa, err := x12Orders(fn, b)
+			if fa != nil {
+				x12Acknowledge(fn, fa)
+			}
+			if err != nil {
+				var env *x12.EnvelopeError
+				if errors.As(err, &env) {
+					slog.Error("Interchange envelope is wrong", "file", fn, "level", env.Level,
+						"control", env.Control, "segment", env.Segment, "pos", env.Pos, "code", env.Code, "err", env.Msg)
+				} else {
+					slog.Error("Purchase order is not a valid 850", "file", fn, "err", err)
+				}
+				interchangeFailed(fn, err)
+			}
+			importOrders(fn, orders)
+			xmlFile.Close()
+			continue
+		}
+		if path.Ext(fn) == ".edi" {
+			orders, a, err := edifactOrders(fn, b)
+			if a != nil {
+				edifactAcknowledge(fn, a)
+			}
+			if err != nil {
+				var env *edifact.EnvelopeError
+				if errors.As(err, &env) {
+					slog.Error("Interchange envelope is wrong", "file", fn, "level", env.Level,
+						"ref", env.Ref, "segment", env.Segment, "pos", env.Pos, "code", env.Code, "err", env.Msg)
+				} else {
+					slog.Error("Purchase order is not a valid ORDERS", "file", fn, "err", err)
+				}
+				interchangeFailed(fn, err)
+			}
+			importOrders(fn, orders)
+			xmlFile.Close()
+			continue
+		}
 		b = xmlfix(b)
 
 		// Unmarshal the xml file.
 		var q Query
 		xmlerr := xml.Unmarshal(b, &q)
 		if xmlerr != nil {
-			fmt.Printf("%s\n", xmlerr.Error())
-			syslog.Err(xmlerr.Error())
-			var resp POresponse
-			fileparts := strings.Split(os.Args[1], "_")
-			t := time.Now()
-			resp.MessageID = strings.Replace(path.Base(strings.Join(fileparts, "_")), ".xml", "", -1)
-			resp.Timestamp = t.Format("2006-01-02T15:04:05")
-			resp.Version = "1.0"
-			resp.Order.OrderNumber = fileparts[3]
-			resp.Order.ProjectNumber = fileparts[2]
-			resp.Order.ContractNumber = fileparts[2]
-			xmlResponse(resp, "ERROR", xmlerr.Error())
-			os.Exit(1)
+			slog.Error("Order is not valid XML", "file", fn, "err", xmlerr)
+			parseFailed(fn, xmlerr)
 		}
 		// Now the xmlfile has been Unmarshaled
+		book.RecordKeys(edilog.ID(), ledger.PO, path.Base(fn), ledger.Parsed, "", ledger.Keys{
+			Order:   q.File.Fileord.Ordno,
+			Project: q.File.Fileord.ProjectNumber,
+			Message: q.File.Msg,
+			Partner: notify.PartnerOf(fn),
+		})
 		// Push all the xml data to the local application host.
 		data2Host(q)
 		xmlFile.Close()
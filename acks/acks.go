@@ -0,0 +1,174 @@
+/*
+Package acks keeps the functional acknowledgments partners owe us.
+
+public_output_service notes a 997 or 999 owed for each functional group
+of an X12 interchange it sends, and a CONTRL for each EDIFACT
+interchange that asks for one, due after x12.ackWithin. XML_PO_import
+settles them as the partners' acknowledgments come in, and
+public_output_service reports those not come in time, once each.
+
+The list is a JSON file, locked while it is read and changed, as the
+programs change it at once. Settled acknowledgments are kept a week,
+for operators to see, and so are those reported overdue that never
+came, counting from when they were due.
+*/
+package acks
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// keepSettled is how long an acknowledgment that came, or that was
+// reported and never came, is kept.
+const keepSettled = 7 * 24 * time.Hour
+
+// Owed is the acknowledgment of one group we sent, or of an EDIFACT
+// interchange.
+type Owed struct {
+	Partner     string    `json:"partner"`     // the ISA08 or UNB03 it went to
+	Interchange string    `json:"interchange"` // its ISA13 or UNB05
+	Group       string    `json:"group"`       // GS06, or UNB05 again
+	Code        string    `json:"code"`        // GS01, such as PR or SH, or UNB
+	Doc         string    `json:"doc"`         // the file sent
+	Kind        string    `json:"kind"`        // its ledger kind
+	Sent        time.Time `json:"sent"`
+	Due         time.Time `json:"due"`
+	// Status is the AK901 of the acknowledgment, or what a CONTRL says
+	// in its terms, "" until it comes at Settled.
+	Status  string    `json:"status,omitempty"`
+	Settled time.Time `json:"settled,omitempty"`
+	// Reported is set once it has been reported overdue.
+	Reported bool `json:"reported,omitempty"`
+}
+
+// List is the acknowledgments owed, kept in a file.
+type List struct {
+	path string
+	now  func() time.Time // the clock, replaced in tests
+}
+
+// Open returns the list kept in the file at path. The file is made
+// when the first acknowledgment is owed.
+func Open(path string) *List {
+	return &List{path: path, now: time.Now}
+}
+
+// Expect notes the acknowledgments owed for groups sent. A group sent
+// again is owed afresh.
+func (l *List) Expect(owed ...Owed) error {
+	return l.change(func(all []Owed) []Owed {
+		for _, o := range owed {
+			if i := find(all, o.Partner, o.Code, o.Group); i >= 0 {
+				all[i] = o
+				continue
+			}
+			all = append(all, o)
+		}
+		return all
+	})
+}
+
+// Settle records the acknowledgment partner sent for the group of code
+// and control number group, with its status. It returns what was owed,
+// false if nothing was.
+func (l *List) Settle(partner string, code string, group string, status string, at time.Time) (Owed, bool, error) {
+	var o Owed
+	found := false
+	err := l.change(func(all []Owed) []Owed {
+		if i := find(all, partner, code, group); i >= 0 {
+			all[i].Status, all[i].Settled = status, at
+			o, found = all[i], true
+		}
+		return all
+	})
+	return o, found, err
+}
+
+// Overdue returns the acknowledgments due by now that have not come
+// and were not reported before, and marks them reported.
+func (l *List) Overdue(now time.Time) ([]Owed, error) {
+	var late []Owed
+	err := l.change(func(all []Owed) []Owed {
+		for i, o := range all {
+			if o.Settled.IsZero() && !o.Reported && !o.Due.After(now) {
+				all[i].Reported = true
+				late = append(late, all[i])
+			}
+		}
+		return all
+	})
+	return late, err
+}
+
+// All returns the list, oldest first.
+func (l *List) All() ([]Owed, error) {
+	var list []Owed
+	err := l.change(func(all []Owed) []Owed {
+		list = append(list, all...)
+		return all
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Sent.Before(list[j].Sent) })
+	return list, err
+}
+
+// change locks the file and replaces the list in it with what fn makes
+// of it, the acknowledgments settled, or reported overdue, long ago
+// dropped first.
+func (l *List) change(fn func([]Owed) []Owed) error {
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("%s: lock: %v", l.path, err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	var all []Owed
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &all); err != nil {
+			return fmt.Errorf("%s: %v", l.path, err)
+		}
+	}
+	now := l.now()
+	kept := all[:0]
+	for _, o := range all {
+		switch {
+		case !o.Settled.IsZero() && now.Sub(o.Settled) >= keepSettled:
+		case o.Settled.IsZero() && o.Reported && now.Sub(o.Due) >= keepSettled:
+		default:
+			kept = append(kept, o)
+		}
+	}
+	if b, err = json.MarshalIndent(fn(kept), "", "\t"); err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(append(b, '\n'), 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// find returns the index of the group partner was sent, -1 if none.
+func find(all []Owed, partner string, code string, group string) int {
+	for i, o := range all {
+		if o.Partner == partner && o.Code == code && o.Group == group {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,162 @@
+package acks
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testList is an empty list on a clock the test sets.
+func testList(t *testing.T, now *time.Time) *List {
+	l := Open(filepath.Join(t.TempDir(), "acks.json"))
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+// groups returns the groups on l, oldest first.
+func groups(t *testing.T, l *List) []string {
+	t.Helper()
+	all, err := l.All()
+	if err != nil {
+		t.Fatalf("All: %v", err)
+	}
+	var gs []string
+	for _, o := range all {
+		gs = append(gs, o.Group)
+	}
+	return gs
+}
+
+func TestSettle(t *testing.T) {
+	sent := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	now := sent
+	l := testList(t, &now)
+	owed := func(partner, code, group string, at time.Time) Owed {
+		return Owed{Partner: partner, Interchange: "100", Group: group, Code: code, Doc: "RSP_" + group, Sent: at, Due: at.Add(time.Hour)}
+	}
+	if err := l.Expect(owed("ACME", "PR", "7", sent.Add(time.Minute)), owed("ACME", "SH", "7", sent), owed("ZENITH", "PR", "7", sent)); err != nil {
+		t.Fatalf("Expect: %v", err)
+	}
+	tests := []struct {
+		name                  string
+		partner, code, group  string
+		status                string
+		found                 bool
+		wantStatus, wantGroup string
+	}{
+		{"owed", "ACME", "PR", "7", "A", true, "A", "7"},
+		{"settled again", "ACME", "PR", "7", "R", true, "R", "7"},
+		{"other partner", "ZENITH", "SH", "7", "A", false, "", ""},
+		{"other group", "ACME", "PR", "8", "A", false, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, found, err := l.Settle(tt.partner, tt.code, tt.group, tt.status, now)
+			if err != nil {
+				t.Fatalf("Settle: %v", err)
+			}
+			if found != tt.found || o.Status != tt.wantStatus || o.Group != tt.wantGroup {
+				t.Errorf("Settle = %+v, %v; want status %q, %v", o, found, tt.wantStatus, tt.found)
+			}
+			if found && (o.Doc != "RSP_7" || !o.Settled.Equal(now)) {
+				t.Errorf("settled %+v", o)
+			}
+		})
+	}
+	all, _ := l.All()
+	if len(all) != 3 || all[0].Code != "SH" || all[2].Code != "PR" || all[2].Partner != "ACME" {
+		t.Errorf("list %+v, want the three, oldest first", all)
+	}
+}
+
+func TestOverdue(t *testing.T) {
+	sent := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	now := sent
+	l := testList(t, &now)
+	l.Expect(
+		Owed{Partner: "ACME", Code: "PR", Group: "1", Sent: sent, Due: sent.Add(time.Hour)},
+		Owed{Partner: "ACME", Code: "PR", Group: "2", Sent: sent, Due: sent.Add(2 * time.Hour)},
+		Owed{Partner: "ACME", Code: "PR", Group: "3", Sent: sent, Due: sent.Add(time.Hour)},
+	)
+	l.Settle("ACME", "PR", "3", "A", sent.Add(time.Minute))
+	tests := []struct {
+		at   time.Duration
+		want []string
+	}{
+		{59 * time.Minute, nil},
+		{time.Hour, []string{"1"}},
+		{90 * time.Minute, nil}, // reported once
+		{3 * time.Hour, []string{"2"}},
+		{4 * time.Hour, nil},
+	}
+	for _, tt := range tests {
+		now = sent.Add(tt.at)
+		late, err := l.Overdue(now)
+		if err != nil {
+			t.Fatalf("Overdue: %v", err)
+		}
+		var got []string
+		for _, o := range late {
+			if !o.Reported {
+				t.Errorf("group %s not marked reported", o.Group)
+			}
+			got = append(got, o.Group)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("overdue at +%v: %v, want %v", tt.at, got, tt.want)
+		}
+	}
+	// Sent again, a group is owed afresh.
+	l.Expect(Owed{Partner: "ACME", Code: "PR", Group: "1", Sent: now, Due: now.Add(time.Hour)})
+	now = now.Add(time.Hour)
+	if late, _ := l.Overdue(now); len(late) != 1 || late[0].Group != "1" {
+		t.Errorf("overdue %+v, want group 1 again", late)
+	}
+}
+
+func TestKeep(t *testing.T) {
+	sent := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	due := sent.Add(time.Hour)
+	tests := []struct {
+		name     string
+		settled  bool
+		reported bool
+		at       time.Duration // after it was due
+		kept     bool
+	}{
+		{"settled", true, false, keepSettled - time.Minute, true},
+		{"settled a week ago", true, false, keepSettled + time.Hour, false},
+		{"settled after it was reported", true, true, keepSettled - time.Minute, true},
+		{"reported", false, true, keepSettled - time.Minute, true},
+		{"reported a week ago", false, true, keepSettled, false},
+		{"owed, not yet reported", false, false, 30 * 24 * time.Hour, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := sent
+			l := testList(t, &now)
+			l.Expect(
+				Owed{Partner: "ACME", Code: "PR", Group: "1", Sent: sent, Due: due},
+				Owed{Partner: "ACME", Code: "PR", Group: "2", Sent: sent.Add(time.Minute), Due: due.Add(1000 * time.Hour)},
+			)
+			if tt.reported {
+				now = due
+				l.Overdue(now)
+			}
+			if tt.settled {
+				// Settled as it fell due, so the week counts from the
+				// same time both ways.
+				l.Settle("ACME", "PR", "1", "A", due)
+			}
+			now = due.Add(tt.at)
+			want := []string{"2"}
+			if tt.kept {
+				want = []string{"1", "2"}
+			}
+			if got := groups(t, l); !reflect.DeepEqual(got, want) {
+				t.Errorf("groups %v, want %v", got, want)
+			}
+		})
+	}
+}
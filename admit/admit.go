@@ -0,0 +1,231 @@
+/*
+Package admit decides which MR connections private_input_service
+takes on.
+
+A connection must come from an allowed address, stay inside its
+source's rate limit and then get one of the session slots. When the
+slots are all in use it waits in a bounded queue, or is turned away
+when the queue is full or its wait runs out.
+*/
+package admit
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cloud3000/BaseEDI/ediconfig"
+)
+
+// Reasons a connection is turned away.
+var (
+	ErrNotAllowed = errors.New("address not allowed")
+	ErrRateLimit  = errors.New("connection rate limit exceeded")
+	ErrBusy       = errors.New("all MR sessions busy")
+	ErrClosed     = errors.New("shutting down")
+)
+
+// forgetAfter is how long an idle source's rate limit is remembered.
+const forgetAfter = 10 * time.Minute
+
+// Controller admits connections to a listener.
+type Controller struct {
+	slots        chan struct{}
+	maxQueued    int
+	queueTimeout time.Duration
+	closed       chan struct{}
+	// now and after are the clock, replaced in tests.
+	now   func() time.Time
+	after func(time.Duration) <-chan time.Time
+
+	mu      sync.Mutex
+	allow   []*net.IPNet
+	rate    ediconfig.RateLimit
+	queued  int
+	sources map[string]*bucket
+	pruned  time.Time
+}
+
+// bucket is a token bucket for one source address.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New returns a Controller for maxSessions concurrent sessions.
+// Up to maxQueued more wait at most queueTimeout for a free slot.
+func New(cfg ediconfig.Private, maxSessions int, maxQueued int, queueTimeout time.Duration) (*Controller, error) {
+	if maxSessions < 1 {
+		return nil, fmt.Errorf("admit: need at least one session")
+	}
+	c := &Controller{
+		slots:        make(chan struct{}, maxSessions),
+		maxQueued:    maxQueued,
+		queueTimeout: queueTimeout,
+		closed:       make(chan struct{}),
+		now:          time.Now,
+		after:        time.After,
+		sources:      make(map[string]*bucket),
+	}
+	if err := c.Update(cfg); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Update replaces the allowlist and rate limit, for a configuration
+// reload. Sources keep what is left of their rate limit.
+func (c *Controller) Update(cfg ediconfig.Private) error {
+	var allow []*net.IPNet
+	for _, a := range cfg.Allow {
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return fmt.Errorf("admit: bad address %q", a)
+			}
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			n = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		allow = append(allow, n)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.allow, c.rate = allow, cfg.RateLimit
+	return nil
+}
+
+// Close turns away the connections waiting for a slot and any that
+// ask for one later.
+func (c *Controller) Close() {
+	close(c.closed)
+}
+
+// Check applies the allowlist and rate limit to a new connection.
+// It does not wait.
+func (c *Controller) Check(addr net.Addr) error {
+	ip := addrIP(addr)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.allow) > 0 {
+		ok := false
+		for _, n := range c.allow {
+			if ip != nil && n.Contains(ip) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return ErrNotAllowed
+		}
+	}
+	if c.rate.Connections == 0 {
+		return nil
+	}
+	now := c.now()
+	c.prune(now)
+	key := ip.String()
+	b := c.sources[key]
+	if b == nil {
+		b = &bucket{tokens: float64(c.rate.Connections), last: now}
+		c.sources[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * float64(c.rate.Connections) / c.rate.Per.Seconds()
+	if b.tokens > float64(c.rate.Connections) {
+		b.tokens = float64(c.rate.Connections)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return ErrRateLimit
+	}
+	b.tokens--
+	return nil
+}
+
+// Acquire waits for a session slot. The returned func gives it back.
+func (c *Controller) Acquire() (func(), error) {
+	release := func() { <-c.slots }
+	select {
+	case <-c.closed:
+		return nil, ErrClosed
+	default:
+	}
+	select {
+	case c.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	c.mu.Lock()
+	if c.queued >= c.maxQueued {
+		c.mu.Unlock()
+		return nil, ErrBusy
+	}
+	c.queued++
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.queued--
+		c.mu.Unlock()
+	}()
+	timeout := c.after(c.queueTimeout)
+	select {
+	case c.slots <- struct{}{}:
+		return release, nil
+	case <-timeout:
+		return nil, ErrBusy
+	case <-c.closed:
+		return nil, ErrClosed
+	}
+}
+
+// Active returns the sessions running and the connections waiting.
+func (c *Controller) Active() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.slots), c.queued
+}
+
+// prune forgets sources whose buckets have long since refilled, c.mu held.
+func (c *Controller) prune(now time.Time) {
+	if now.Sub(c.pruned) < forgetAfter {
+		return
+	}
+	c.pruned = now
+	for k, b := range c.sources {
+		if now.Sub(b.last) > forgetAfter && now.Sub(b.last) > c.rate.Per.Duration {
+			delete(c.sources, k)
+		}
+	}
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+// AcceptBackoff is how long to wait after the nth Accept error in a
+// row, starting at 5ms and doubling up to a second.
+func AcceptBackoff(n int) time.Duration {
+	d := 5 * time.Millisecond
+	for i := 1; i < n && d < time.Second; i++ {
+		d *= 2
+	}
+	if d > time.Second {
+		d = time.Second
+	}
+	return d
+}
@@ -0,0 +1,269 @@
+package admit
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cloud3000/BaseEDI/ediconfig"
+)
+
+// pipeAddr is an address that is not an IP, as net.Pipe has.
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+func tcp(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+}
+
+func TestCheckAllow(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow []string
+		addr  net.Addr
+		want  error
+	}{
+		{"no allowlist", nil, tcp("203.0.113.9"), nil},
+		{"no allowlist, not an IP", nil, pipeAddr("pipe"), nil},
+		{"inside a CIDR", []string{"10.0.0.0/8"}, tcp("10.1.2.3"), nil},
+		{"outside a CIDR", []string{"10.0.0.0/8"}, tcp("11.1.2.3"), ErrNotAllowed},
+		{"second CIDR", []string{"10.0.0.0/8", "192.168.1.0/24"}, tcp("192.168.1.77"), nil},
+		{"one address", []string{"192.168.1.5"}, tcp("192.168.1.5"), nil},
+		{"next to one address", []string{"192.168.1.5"}, tcp("192.168.1.6"), ErrNotAllowed},
+		{"IPv4 in IPv6 form", []string{"10.0.0.0/8"}, tcp("::ffff:10.0.0.1"), nil},
+		{"IPv6 CIDR", []string{"2001:db8::/32"}, tcp("2001:db8::1"), nil},
+		{"IPv6 outside", []string{"2001:db8::/32"}, tcp("2001:db9::1"), ErrNotAllowed},
+		{"host and port", []string{"10.0.0.0/8"}, pipeAddr("10.0.0.1:40000"), nil},
+		{"not an IP", []string{"10.0.0.0/8"}, pipeAddr("pipe"), ErrNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := New(ediconfig.Private{Allow: tt.allow}, 1, 0, 0)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			if err := c.Check(tt.addr); !errors.Is(err, tt.want) {
+				t.Errorf("Check(%s) = %v, want %v", tt.addr, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBadAllow(t *testing.T) {
+	for _, a := range []string{"10.0.0.300", "10.0.0.0/33", "example.com"} {
+		if _, err := New(ediconfig.Private{Allow: []string{a}}, 1, 0, 0); err == nil {
+			t.Errorf("New took allow %q", a)
+		}
+	}
+	if _, err := New(ediconfig.Private{}, 0, 0, 0); err == nil {
+		t.Error("New took no sessions")
+	}
+}
+
+func TestCheckRate(t *testing.T) {
+	// Two connections per ten seconds: a token comes back every five.
+	type step struct {
+		at   time.Duration
+		addr string
+		want error
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"burst", []step{
+			{0, "10.0.0.1", nil},
+			{0, "10.0.0.1", nil},
+			{0, "10.0.0.1", ErrRateLimit},
+		}},
+		{"per source", []step{
+			{0, "10.0.0.1", nil},
+			{0, "10.0.0.1", nil},
+			{0, "10.0.0.2", nil},
+			{0, "10.0.0.2", nil},
+			{0, "10.0.0.2", ErrRateLimit},
+		}},
+		{"refill", []step{
+			{0, "10.0.0.1", nil},
+			{0, "10.0.0.1", nil},
+			{4 * time.Second, "10.0.0.1", ErrRateLimit},
+			{5 * time.Second, "10.0.0.1", nil},
+			{5 * time.Second, "10.0.0.1", ErrRateLimit},
+		}},
+		{"refused connections take no token", []step{
+			{0, "10.0.0.1", nil},
+			{0, "10.0.0.1", nil},
+			{1 * time.Second, "10.0.0.1", ErrRateLimit},
+			{2 * time.Second, "10.0.0.1", ErrRateLimit},
+			{5 * time.Second, "10.0.0.1", nil},
+		}},
+		{"refill stops at the limit", []step{
+			{0, "10.0.0.1", nil},
+			{time.Hour, "10.0.0.1", nil},
+			{time.Hour, "10.0.0.1", nil},
+			{time.Hour, "10.0.0.1", ErrRateLimit},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := New(ediconfig.Private{RateLimit: ediconfig.RateLimit{
+				Connections: 2, Per: ediconfig.Duration{Duration: 10 * time.Second},
+			}}, 1, 0, 0)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			start := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+			var now time.Time
+			c.now = func() time.Time { return now }
+			for i, s := range tt.steps {
+				now = start.Add(s.at)
+				if err := c.Check(tcp(s.addr)); !errors.Is(err, s.want) {
+					t.Errorf("step %d, %s at %v: %v, want %v", i, s.addr, s.at, err, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPrune(t *testing.T) {
+	c, err := New(ediconfig.Private{RateLimit: ediconfig.RateLimit{
+		Connections: 1, Per: ediconfig.Duration{Duration: time.Hour},
+	}}, 1, 0, 0)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	now := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+	c.Check(tcp("10.0.0.1"))
+	now = now.Add(forgetAfter + time.Minute)
+	c.Check(tcp("10.0.0.2"))
+	if _, ok := c.sources["10.0.0.1"]; !ok {
+		t.Error("a source was forgotten inside its rate limit period")
+	}
+	now = now.Add(time.Hour)
+	c.Check(tcp("10.0.0.2"))
+	if _, ok := c.sources["10.0.0.1"]; ok || len(c.sources) != 1 {
+		t.Errorf("sources %v, want 10.0.0.1 forgotten", c.sources)
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	const queueTimeout = time.Minute
+	tests := []struct {
+		name      string
+		maxQueued int
+		busy      bool   // the one slot is taken first
+		closed    bool   // Close is called first
+		then      string // what happens to the waiting connection
+		want      error
+	}{
+		{"slot free", 1, false, false, "", nil},
+		{"closed", 1, false, true, "", ErrClosed},
+		{"queue full", 0, true, false, "", ErrBusy},
+		{"wait times out", 1, true, false, "timeout", ErrBusy},
+		{"slot given back", 1, true, false, "release", nil},
+		{"closed while waiting", 1, true, false, "close", ErrClosed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := New(ediconfig.Private{}, 1, tt.maxQueued, queueTimeout)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			timeout := make(chan time.Time, 1)
+			c.after = func(d time.Duration) <-chan time.Time {
+				if d != queueTimeout {
+					t.Errorf("waits %v, want %v", d, queueTimeout)
+				}
+				return timeout
+			}
+			var first func()
+			if tt.busy {
+				if first, err = c.Acquire(); err != nil {
+					t.Fatalf("first Acquire: %v", err)
+				}
+			}
+			if tt.closed {
+				c.Close()
+			}
+			type result struct {
+				release func()
+				err     error
+			}
+			done := make(chan result, 1)
+			go func() {
+				release, err := c.Acquire()
+				done <- result{release, err}
+			}()
+			if tt.then != "" {
+				for deadline := time.Now().Add(5 * time.Second); ; {
+					if _, queued := c.Active(); queued == 1 {
+						break
+					}
+					if time.Now().After(deadline) {
+						t.Fatal("the connection did not queue")
+					}
+					time.Sleep(time.Millisecond)
+				}
+				switch tt.then {
+				case "timeout":
+					timeout <- time.Now()
+				case "release":
+					first()
+				case "close":
+					c.Close()
+				}
+			}
+			var r result
+			select {
+			case r = <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Acquire did not return")
+			}
+			if !errors.Is(r.err, tt.want) {
+				t.Fatalf("Acquire = %v, want %v", r.err, tt.want)
+			}
+			// The first connection still holds its slot, unless it gave
+			// it back for this one.
+			want := 0
+			if tt.busy && tt.then != "release" {
+				want++
+			}
+			if r.err == nil {
+				want++
+			}
+			if active, queued := c.Active(); active != want || queued != 0 {
+				t.Errorf("%d active and %d queued after Acquire = %v, want %d and 0", active, queued, r.err, want)
+			}
+			if r.err == nil {
+				r.release()
+				if active, _ := c.Active(); active != want-1 {
+					t.Errorf("%d active after the release, want %d", active, want-1)
+				}
+			}
+		})
+	}
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	tests := []struct {
+		n    int
+		want time.Duration
+	}{
+		{0, 5 * time.Millisecond},
+		{1, 5 * time.Millisecond},
+		{2, 10 * time.Millisecond},
+		{3, 20 * time.Millisecond},
+		{8, 640 * time.Millisecond},
+		{9, time.Second},
+		{1000, time.Second},
+	}
+	for _, tt := range tests {
+		if got := AcceptBackoff(tt.n); got != tt.want {
+			t.Errorf("AcceptBackoff(%d) = %v, want %v", tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package dashboard
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloud3000/BaseEDI/edihttp"
+	"github.com/cloud3000/BaseEDI/ledger"
+)
+
+const (
+	maxEdited  = 10 << 20 // the largest edited document a reprocess takes
+	tailEvery  = 500 * time.Millisecond
+	tailBefore = 10 // entries /admin/events starts with unless ?n= says
+)
+
+// docSummary is one document in /admin/docs.
+type docSummary struct {
+	ID    string      `json:"id,omitempty"`
+	Name  string      `json:"name"`
+	Kind  string      `json:"kind"`
+	State string      `json:"state"`
+	Last  time.Time   `json:"last"`
+	Keys  ledger.Keys `json:"keys"`
+}
+
+// adminDocs lists documents, the most recently changed first:
+// GET /admin/docs[?field=order&q=P2-G&n=50]. field and q search as the
+// dashboard does.
+func (d *dashboard) adminDocs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	n := maxRows
+	if v := r.FormValue("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "bad n")
+			return
+		}
+	}
+	docs, err := d.docs()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	field, q := r.FormValue("field"), r.FormValue("q")
+	list := []docSummary{}
+	for _, doc := range docs {
+		if len(list) == n {
+			break
+		}
+		if doc.Match(field, q) {
+			list = append(list, docSummary{doc.ID, doc.Name(), doc.Kind(), doc.State(), doc.Last(), doc.Keys})
+		}
+	}
+	writeJSON(w, list)
+}
+
+// adminDoc serves one document's history: GET /admin/docs/<id>, or
+// by a file name it had, the latest document with that name.
+func (d *dashboard) adminDoc(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/admin/docs/")
+	docs, err := d.docs()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, doc := range docs {
+		if doc.ID != "" && doc.ID == key {
+			writeJSON(w, doc)
+			return
+		}
+	}
+	for _, doc := range docs {
+		for _, e := range doc.Entries {
+			if e.Doc == key {
+				writeJSON(w, doc)
+				return
+			}
+		}
+	}
+	writeError(w, http.StatusNotFound, "no such document")
+}
+
+// adminEvents streams the ledger as it is written, one JSON entry a
+// line, starting with the last few: GET /admin/events[?n=10]. It ends
+// when the client goes or the service shuts down.
+func (d *dashboard) adminEvents(w http.ResponseWriter, r *http.Request) {
+	n := tailBefore
+	if v := r.FormValue("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "bad n")
+			return
+		}
+	}
+	f, err := os.Open(d.opts.Ledger())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer f.Close()
+	// The last n lines, then whatever is added.
+	var last [][]byte
+	br := bufio.NewReader(f)
+	var off int64
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		off += int64(len(line))
+		if n > 0 {
+			last = append(last, line)
+			if len(last) > n {
+				last = last[1:]
+			}
+		}
+	}
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-store")
+	for _, line := range last {
+		w.Write(line)
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+	tick := time.NewTicker(tailEvery)
+	defer tick.Stop()
+	var partial []byte
+	buf := make([]byte, 64*1024)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-tick.C:
+		}
+		for {
+			m, err := f.ReadAt(buf, off)
+			off += int64(m)
+			partial = append(partial, buf[:m]...)
+			if err != nil || m < len(buf) {
+				break
+			}
+		}
+		// Only whole lines; the rest waits for its flush.
+		if i := bytes.LastIndexByte(partial, '\n'); i >= 0 {
+			if _, err := w.Write(partial[:i+1]); err != nil {
+				return
+			}
+			partial = append([]byte(nil), partial[i+1:]...)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// adminErrors lists ./errors: GET /admin/errors.
+func (d *dashboard) adminErrors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	list, err := d.errorFiles()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, list)
+}
+
+// adminError serves one file in ./errors:
+//
+//	GET  /admin/errors/<name>[?version=n]  the file, or an earlier attempt
+//	GET  /admin/errors/<name>/versions     the earlier attempts
+//	POST /admin/errors/<name>/reprocess    put it back, the body replacing it if not empty
+//	POST /admin/errors/<name>/discard      move it to discarded
+func (d *dashboard) adminError(w http.ResponseWriter, r *http.Request) {
+	name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/errors/"), "/")
+	switch action {
+	case "":
+		d.adminFile(w, r, name)
+
+	case "versions":
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+		vs, err := d.opts.Errors.Versions(name)
+		if err != nil {
+			writeError(w, errStatus(err), err.Error())
+			return
+		}
+		writeJSON(w, vs)
+
+	case "reprocess":
+		if !changing(w, r) {
+			return
+		}
+		b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxEdited))
+		if err != nil {
+			writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		var edited []byte
+		if len(b) > 0 {
+			edited = b
+		}
+		id, err := d.putBack(name, edited, operator(r))
+		if err != nil {
+			writeError(w, errStatus(err), err.Error())
+			return
+		}
+		writeJSON(w, struct {
+			Name   string `json:"name"`
+			ID     string `json:"id,omitempty"`
+			Edited bool   `json:"edited"`
+		}{name, id, edited != nil})
+
+	case "discard":
+		if !changing(w, r) {
+			return
+		}
+		dst, err := d.discardFile(name, operator(r))
+		if err != nil {
+			writeError(w, errStatus(err), err.Error())
+			return
+		}
+		writeJSON(w, struct {
+			Name string `json:"name"`
+			To   string `json:"to"`
+		}{name, dst})
+
+	default:
+		writeError(w, http.StatusNotFound, "no such action")
+	}
+}
+
+func (d *dashboard) adminFile(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	version := 0
+	if v := r.FormValue("version"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "bad version")
+			return
+		}
+		version = n
+	}
+	p, err := d.opts.Errors.Open(name, version)
+	if err != nil {
+		writeError(w, errStatus(err), err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeFile(w, r, p)
+}
+
+// operator is who asked for a change through the admin API, for the
+// ledger.
+func operator(r *http.Request) string {
+	return "admin API, " + edihttp.Operator(r) + " from " + r.RemoteAddr
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{msg})
+}
@@ -0,0 +1,394 @@
+/*
+Package dashboard is the operators' web page, served by
+public_input_service on its admin address.
+
+It reads the ledger to find documents by order number, project number,
+MessageID or partner, and shows each one's timeline: received,
+imported, response written, transferred. It lists ./errors, where a
+file can be put back in the inbox to be imported again or discarded,
+and shows the MR sessions private_input_service has running, from
+/sessions on that service's admin address.
+
+Under /admin/ the same is served as JSON for edictl, where a file can
+also be put back edited, with the ledger as it is written.
+
+The pages change files, so only operators get in, as edihttp's admin
+listener sees to, and what they change is recorded under their names.
+Requests that change anything must be POSTs, and from a browser only
+from the dashboard's own pages.
+*/
+package dashboard
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/cloud3000/BaseEDI/ediconfig"
+	"github.com/cloud3000/BaseEDI/edihttp"
+	"github.com/cloud3000/BaseEDI/errdir"
+	"github.com/cloud3000/BaseEDI/ledger"
+)
+
+// maxRows is the most documents a search lists.
+const maxRows = 200
+
+//go:embed html
+var files embed.FS
+
+// Options are where the dashboard finds things.
+type Options struct {
+	// Ledger returns the ledger file, read on each request.
+	Ledger func() string
+	// Book records the reprocess and discard of files, may be nil.
+	Book *ledger.Ledger
+	// Errors is the directory failed orders are moved to.
+	Errors *errdir.Dir
+	// Inbox is the watched directory reprocessed files are put in.
+	Inbox string
+	// Discarded is where discarded files go; they are kept.
+	Discarded string
+	// Sessions returns the URL of private_input_service's /sessions,
+	// "" if it serves no admin interface.
+	Sessions func() string
+	// Admin returns the admin configuration, for fetching Sessions as
+	// the operator.
+	Admin func() ediconfig.Admin
+}
+
+// MRStatus is what private_input_service serves on /sessions.
+type MRStatus struct {
+	Active   int         `json:"active"`
+	Queued   int         `json:"queued"`
+	Max      int         `json:"max"`
+	Sessions []MRSession `json:"sessions"`
+}
+
+// MRSession is one MR session running.
+type MRSession struct {
+	ID      string    `json:"id"`
+	Remote  string    `json:"remote"`
+	Mode    string    `json:"mode"` // in-process or isolated
+	Started time.Time `json:"started"`
+}
+
+type dashboard struct {
+	opts  Options
+	pages map[string]*template.Template
+}
+
+var funcs = template.FuncMap{
+	"when": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Local().Format("2006-01-02 15:04:05")
+	},
+	"since": func(t time.Time) string {
+		return time.Since(t).Round(time.Second).String()
+	},
+	"failed": failed,
+}
+
+// New returns the dashboard's handler, for the root of the service's
+// HTTP address.
+func New(opts Options) http.Handler {
+	d := &dashboard{opts: opts, pages: make(map[string]*template.Template)}
+	for _, p := range []string{"search", "doc", "errors", "sessions"} {
+		d.pages[p] = template.Must(template.New("layout.html").Funcs(funcs).
+			ParseFS(files, "html/layout.html", "html/"+p+".html"))
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", d.search)
+	mux.HandleFunc("/doc", d.doc)
+	mux.HandleFunc("/errors", d.errors)
+	mux.HandleFunc("/errors/reprocess", d.reprocess)
+	mux.HandleFunc("/errors/discard", d.discard)
+	mux.HandleFunc("/mr", d.sessions)
+	mux.HandleFunc("/admin/errors", d.adminErrors)
+	mux.HandleFunc("/admin/errors/", d.adminError)
+	mux.HandleFunc("/admin/docs", d.adminDocs)
+	mux.HandleFunc("/admin/docs/", d.adminDoc)
+	mux.HandleFunc("/admin/events", d.adminEvents)
+	return mux
+}
+
+// failed reports whether state is one a document stops in when
+// something went wrong.
+func failed(state string) bool {
+	return state == ledger.Failed || state == ledger.SendFailed
+}
+
+func (d *dashboard) render(w http.ResponseWriter, page string, data any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := d.pages[page].Execute(w, data); err != nil {
+		slog.Error("dashboard: render", "page", page, "err", err)
+	}
+}
+
+// docs reads the ledger, the most recently changed document first.
+func (d *dashboard) docs() ([]*ledger.Doc, error) {
+	entries, err := ledger.Read(d.opts.Ledger())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return ledger.Docs(entries), nil
+}
+
+func (d *dashboard) search(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	docs, err := d.docs()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	field, q := r.FormValue("field"), r.FormValue("q")
+	var rows []*ledger.Doc
+	more := false
+	for _, doc := range docs {
+		if !doc.Match(field, q) {
+			continue
+		}
+		if len(rows) == maxRows {
+			more = true
+			break
+		}
+		rows = append(rows, doc)
+	}
+	d.render(w, "search", struct {
+		Field, Q string
+		Docs     []*ledger.Doc
+		More     bool
+	}{field, q, rows, more})
+}
+
+// step is one stage of a document's timeline.
+type step struct {
+	Name  string
+	Entry *ledger.Entry
+}
+
+// steps are the stages a document goes through, with the entry that
+// shows each was reached, nil if it has not been.
+func steps(doc *ledger.Doc) []step {
+	if doc.Kind() == ledger.Receipt {
+		return []step{
+			{"Receipt written", doc.At(ledger.Receipt, ledger.Written)},
+			{"Transferred", doc.At(ledger.Receipt, ledger.Sent)},
+		}
+	}
+	return []step{
+		{"Received", doc.At(ledger.PO, ledger.Received)},
+		{"Imported", doc.At(ledger.PO, ledger.Processed)},
+		{"Response written", doc.At(ledger.Response, ledger.Written)},
+		{"Transferred", doc.At(ledger.Response, ledger.Sent)},
+	}
+}
+
+func (d *dashboard) doc(w http.ResponseWriter, r *http.Request) {
+	docs, err := d.docs()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id, name := r.FormValue("id"), r.FormValue("doc")
+	for _, doc := range docs {
+		if (id != "" && doc.ID == id) || (id == "" && doc.ID == "" && doc.Name() == name) {
+			d.render(w, "doc", struct {
+				Doc   *ledger.Doc
+				Steps []step
+			}{doc, steps(doc)})
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// errorFile is one file in ./errors.
+type errorFile struct {
+	errdir.File
+	Versions int         `json:"versions"` // earlier attempts kept
+	ID       string      `json:"id,omitempty"`
+	Reason   string      `json:"reason,omitempty"`
+	Doc      *ledger.Doc `json:"-"` // nil if the ledger does not know it
+}
+
+// errorFiles lists ./errors, with what the ledger says of each file.
+func (d *dashboard) errorFiles() ([]errorFile, error) {
+	docs, err := d.docs()
+	if err != nil {
+		return nil, err
+	}
+	files, err := d.opts.Errors.List()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]errorFile, 0, len(files))
+	for _, f := range files {
+		ef := errorFile{File: f}
+		if vs, err := d.opts.Errors.Versions(f.Name); err == nil {
+			ef.Versions = len(vs)
+		}
+		// docs is newest first, the first to name the file is its latest run.
+		for _, doc := range docs {
+			if e := doc.At("", ledger.Failed); e != nil && e.Doc == ef.Name {
+				ef.Doc, ef.ID, ef.Reason = doc, doc.ID, e.Detail
+				break
+			}
+		}
+		list = append(list, ef)
+	}
+	return list, nil
+}
+
+func (d *dashboard) errors(w http.ResponseWriter, r *http.Request) {
+	list, err := d.errorFiles()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	d.render(w, "errors", struct {
+		Files  []errorFile
+		Notice string
+	}{list, r.FormValue("done")})
+}
+
+// changing checks that a request may change anything: a POST, and
+// from a browser one from the dashboard's own pages.
+func changing(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return false
+	}
+	if !edihttp.SameOrigin(r) {
+		http.Error(w, "cross-origin request refused", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// putBack puts name back in the inbox, edited if edited is not nil,
+// recording who asked in the ledger. The file keeps its correlation ID,
+// so its history goes on where it left off.
+func (d *dashboard) putBack(name string, edited []byte, by string) (string, error) {
+	if _, err := d.opts.Errors.Open(name, 0); err != nil {
+		return "", err
+	}
+	id := d.idOf(name)
+	detail := by
+	if edited != nil {
+		detail += ", edited"
+	}
+	// On the ledger before the file is in the inbox, for the watcher
+	// to find the ID.
+	d.opts.Book.Record(id, ledger.PO, name, ledger.Reprocess, detail)
+	d.opts.Book.Flush()
+	if err := d.opts.Errors.Reprocess(name, edited, d.opts.Inbox); err != nil {
+		d.opts.Book.Record(id, ledger.PO, name, ledger.Failed, "reprocess: "+err.Error())
+		return id, err
+	}
+	slog.Info("Reprocessing", "id", id, "file", name, "by", detail)
+	return id, nil
+}
+
+// discardFile moves name out of ./errors, recording who asked in the
+// ledger.
+func (d *dashboard) discardFile(name string, by string) (string, error) {
+	id := d.idOf(name)
+	dst, err := d.opts.Errors.Discard(name, d.opts.Discarded)
+	if err != nil {
+		return "", err
+	}
+	slog.Info("Discarded", "id", id, "file", name, "to", dst, "by", by)
+	d.opts.Book.Record(id, ledger.PO, name, ledger.Discarded, dst)
+	return dst, nil
+}
+
+// errStatus is the HTTP status for an error from package errdir.
+func errStatus(err error) int {
+	switch {
+	case errors.Is(err, errdir.ErrName):
+		return http.StatusBadRequest
+	case errors.Is(err, errdir.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errdir.ErrBusy):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// idOf is the correlation ID last recorded for the file name in
+// ./errors, "" if there is none.
+func (d *dashboard) idOf(name string) string {
+	return ledger.IDOf(d.opts.Ledger(), name)
+}
+
+func (d *dashboard) reprocess(w http.ResponseWriter, r *http.Request) {
+	if !changing(w, r) {
+		return
+	}
+	name := r.FormValue("name")
+	if _, err := d.putBack(name, nil, "dashboard, "+edihttp.Operator(r)+" from "+r.RemoteAddr); err != nil {
+		http.Error(w, err.Error(), errStatus(err))
+		return
+	}
+	http.Redirect(w, r, "/errors?done="+url.QueryEscape(name+" put back in the inbox"), http.StatusSeeOther)
+}
+
+func (d *dashboard) discard(w http.ResponseWriter, r *http.Request) {
+	if !changing(w, r) {
+		return
+	}
+	name := r.FormValue("name")
+	if _, err := d.discardFile(name, "dashboard, "+edihttp.Operator(r)+" from "+r.RemoteAddr); err != nil {
+		http.Error(w, err.Error(), errStatus(err))
+		return
+	}
+	http.Redirect(w, r, "/errors?done="+url.QueryEscape(name+" discarded"), http.StatusSeeOther)
+}
+
+func (d *dashboard) sessions(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Status *MRStatus
+		Err    string
+	}{}
+	if u := d.opts.Sessions(); u == "" {
+		data.Err = "private_input_service serves no admin interface, see admin.listen"
+	} else if st, err := d.fetchSessions(r, u); err != nil {
+		data.Err = err.Error()
+	} else {
+		data.Status = st
+	}
+	d.render(w, "sessions", data)
+}
+
+// fetchSessions gets the MR sessions from u for the operator of r.
+func (d *dashboard) fetchSessions(r *http.Request, u string) (*MRStatus, error) {
+	resp, err := edihttp.AdminGet(d.opts.Admin(), r, u, 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	var st MRStatus
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return nil, fmt.Errorf("%s: %v", u, err)
+	}
+	sort.Slice(st.Sessions, func(i, j int) bool { return st.Sessions[i].Started.Before(st.Sessions[j].Started) })
+	return &st, nil
+}
@@ -0,0 +1,917 @@
+/*
+Package ediconfig loads the BaseEDI configuration file.
+
+The services and the child processes they start all read the same
+JSON file (./edi.json unless -config says otherwise). A missing file
+is not an error, the defaults match the values the programs used
+before there was a configuration file.
+*/
+package ediconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultPath is where the programs look for the configuration file.
+const DefaultPath = "./edi.json"
+
+// Config is the whole configuration file.
+type Config struct {
+	Hosts    Hosts    `json:"hosts"`
+	Mail     Mail     `json:"mail"`
+	Dirs     Dirs     `json:"dirs"`
+	Private  Private  `json:"private"`
+	Outbound Outbound `json:"outbound"`
+	Notify   Notify   `json:"notify"`
+	Log      Log      `json:"log"`
+	HTTP     HTTP     `json:"http"`
+	Admin    Admin    `json:"admin"`
+	API      API      `json:"api"`
+	X12      X12      `json:"x12"`
+	EDIFACT  EDIFACT  `json:"edifact"`
+	// Ledger is the file the services record document states in,
+	// see package ledger.
+	Ledger string `json:"ledger"`
+}
+
+// Mail is the SMTP server notifications go through. Fields left
+// empty keep the values built into each program.
+type Mail struct {
+	Server   string `json:"server,omitempty"`
+	Port     string `json:"port,omitempty"` // ":587"
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// Settings returns the SMTP server, port, user and password, using
+// the given built-in values for anything the file leaves empty.
+func (m Mail) Settings(server, port, user, password string) (string, string, string, string) {
+	if m.Server != "" {
+		server = m.Server
+	}
+	if m.Port != "" {
+		port = m.Port
+	}
+	if m.User != "" {
+		user = m.User
+	}
+	if m.Password != "" {
+		password = m.Password
+	}
+	return server, port, user, password
+}
+
+// Log is where the programs log to, see package edilog.
+type Log struct {
+	Sink  string `json:"sink"`           // stderr, json or syslog
+	Path  string `json:"path,omitempty"` // the file for the json sink
+	Level string `json:"level"`          // debug, info, warn or error
+}
+
+// HTTP is where the services serve /metrics, /healthz and /readyz,
+// see package edihttp.
+type HTTP struct {
+	// Listen is the address of each service, by program name, such
+	// as "public_input_service": "127.0.0.1:9101". A service not
+	// named serves no HTTP. Changes take effect on restart.
+	Listen map[string]string `json:"listen,omitempty"`
+	// MinFreeMB is the disk space /readyz wants free where the
+	// service keeps its files.
+	MinFreeMB int `json:"minFreeMB"`
+}
+
+// Admin is where the services serve the dashboard and the /admin/
+// interfaces edictl uses, apart from the http addresses a load balancer
+// reaches, see package edihttp. Changes to Listen and TLS take effect
+// on restart, to Operators on reload.
+type Admin struct {
+	// Listen is the admin address of each service, by program name. A
+	// bare port, such as ":9201", is on loopback. A service not named
+	// serves no admin interface.
+	Listen map[string]string `json:"listen,omitempty"`
+	// Operators may use the admin interfaces, with HTTP basic
+	// authentication: the operator's name and token. What they do is
+	// recorded under the name. With none, and no client certificates,
+	// only loopback addresses are allowed and anyone on the machine
+	// gets in.
+	Operators []Operator `json:"operators,omitempty"`
+	// TLS serves the interfaces over HTTPS, needed for addresses off
+	// loopback. With a clientCA a client certificate names the operator
+	// instead of a token.
+	TLS *TLS `json:"tls,omitempty"`
+}
+
+// Operator is one person allowed into the admin interfaces.
+type Operator struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+}
+
+// API is the HTTPS API partners submit orders through, see package
+// poapi. public_input_service serves it. Changes to Listen and TLS take
+// effect on restart, to Partners on reload.
+type API struct {
+	Listen   string       `json:"listen,omitempty"` // empty turns the API off
+	TLS      *TLS         `json:"tls,omitempty"`    // required with Listen
+	Partners []APIPartner `json:"partners,omitempty"`
+	// Jobs is the directory each submitted order is kept in, with its
+	// response, until Keep has passed since it finished.
+	Jobs    string   `json:"jobs"`
+	Keep    Duration `json:"keep"`
+	Workers int      `json:"workers"` // orders imported at once
+	// MaxWait is the longest a submission may ask to wait for its
+	// response before it is given a job to poll.
+	MaxWait Duration `json:"maxWait"`
+}
+
+// APIPartner is a trading partner allowed to use the API. It sends
+// Token as a bearer token; orders it submits are filed under Name.
+type APIPartner struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+}
+
+// X12 is how the X12 documents sent to partners are written, see
+// package x12. With Sender empty an order is answered from the ID it
+// was sent to.
+type X12 struct {
+	SenderQual string `json:"senderQual,omitempty"` // ISA05, such as ZZ
+	Sender     string `json:"sender,omitempty"`     // ISA06 and GS02
+	Version    string `json:"version"`              // GS08, such as 004010
+	Usage      string `json:"usage"`                // ISA15, P production or T test
+	// Delimiters are the segment terminator and the element, component
+	// and repetition separators, in that order, such as "~*:^".
+	Delimiters string `json:"delimiters"`
+	LineBreaks bool   `json:"lineBreaks,omitempty"` // a newline after each segment
+	// ControlFile keeps the interchange and group control numbers
+	// last used. Every program writing X12 must share it.
+	ControlFile string `json:"controlFile"`
+	// FunctionalAck is the set inbound interchanges are acknowledged
+	// with, "997" or "999"; empty answers a group of version 005010 or
+	// later with a 999 and an earlier one with a 997.
+	FunctionalAck string `json:"functionalAck,omitempty"`
+	// AckWithin is how long a partner has to acknowledge what we send,
+	// before it is reported overdue; 0 keeps no track.
+	AckWithin Duration `json:"ackWithin"`
+	// AckFile keeps the acknowledgments owed us, see package acks. It
+	// is shared like ControlFile.
+	AckFile string `json:"ackFile"`
+	// Partners are the partners who take X12 for what is sent them
+	// unasked, the MR receipts. The first whose Contracts match a
+	// receipt's contract number gets it.
+	Partners []X12Partner `json:"partners,omitempty"`
+}
+
+// X12Partner is a partner receipts can be sent to as X12.
+type X12Partner struct {
+	Name  string `json:"name"`            // as in file names
+	Qual  string `json:"qual"`            // ISA07, such as ZZ or 01
+	ID    string `json:"id"`              // ISA08
+	AppID string `json:"appID,omitempty"` // GS03, empty for ID
+	// Receipts is what MR receipts are sent as: "xml", the
+	// customer_MR_*_RECEIPTS_*.xml document, "856", an advance ship
+	// notice, or "861", a receiving advice.
+	Receipts string `json:"receipts"`
+	// Contracts are path.Match patterns of the partner's contract
+	// numbers, such as "G41*".
+	Contracts []string `json:"contracts"`
+}
+
+// Partner returns the partner whose receipts for contract go as X12.
+func (x *X12) Partner(contract string) (X12Partner, bool) {
+	for _, p := range x.Partners {
+		for _, pat := range p.Contracts {
+			if ok, _ := path.Match(pat, contract); ok {
+				return p, true
+			}
+		}
+	}
+	return X12Partner{}, false
+}
+
+// EDIFACT is how the EDIFACT documents sent to partners are written,
+// see package edifact. With Sender empty an order is answered from the
+// ID it was sent to. Interchanges are numbered from ControlFile and
+// their CONTRLs kept track of in x12.ackFile, after x12.ackWithin.
+type EDIFACT struct {
+	SenderQual string `json:"senderQual,omitempty"` // UNB02:2, such as 14 or ZZZ
+	Sender     string `json:"sender,omitempty"`     // UNB02:1
+	// Syntax and Version are UNB01, such as UNOC and 3, and Release the
+	// directory, such as 96A, of what is sent unasked; an order is
+	// answered in those it came in.
+	Syntax     string `json:"syntax"`
+	Version    string `json:"version"`
+	Release    string `json:"release"`
+	LineBreaks bool   `json:"lineBreaks,omitempty"` // a newline after each segment
+	// ControlFile keeps the UNB interchange control reference last
+	// used. Every program writing EDIFACT must share it; it may be
+	// x12.controlFile, to number EDIFACT and X12 as one.
+	ControlFile string `json:"controlFile"`
+	// AckRequested asks partners for a CONTRL of what is sent them,
+	// UNB09.
+	AckRequested bool `json:"ackRequested,omitempty"`
+	// Partners are the partners who take EDIFACT for the MR receipts,
+	// after the X12 partners. The first whose Contracts match a
+	// receipt's contract number gets it.
+	Partners []EDIFACTPartner `json:"partners,omitempty"`
+}
+
+// EDIFACTPartner is a partner receipts can be sent to as EDIFACT.
+type EDIFACTPartner struct {
+	Name string `json:"name"` // as in file names
+	Qual string `json:"qual"` // UNB03:2, such as ZZZ or 14
+	ID   string `json:"id"`   // UNB03:1
+	// Receipts is what MR receipts are sent as: "xml", the
+	// customer_MR_*_RECEIPTS_*.xml document, or "desadv", a despatch
+	// advice.
+	Receipts string `json:"receipts"`
+	// Contracts are path.Match patterns of the partner's contract
+	// numbers, such as "G41*".
+	Contracts []string `json:"contracts"`
+}
+
+// Partner returns the partner whose receipts for contract go as
+// EDIFACT.
+func (e *EDIFACT) Partner(contract string) (EDIFACTPartner, bool) {
+	for _, p := range e.Partners {
+		for _, pat := range p.Contracts {
+			if ok, _ := path.Match(pat, contract); ok {
+				return p, true
+			}
+		}
+	}
+	return EDIFACTPartner{}, false
+}
+
+// Notify says where notifications go, see package notify.
+type Notify struct {
+	// Backends are added to the built-in "mail" and "syslog", or
+	// replace them.
+	Backends map[string]NotifyBackend `json:"backends,omitempty"`
+	// Routes send each event to every route it matches. Empty mails
+	// everything to the program's built-in recipient.
+	Routes []NotifyRoute `json:"routes,omitempty"`
+	// Templates is the directory of message templates, see package
+	// notify. Empty uses the programs' built-in messages.
+	Templates string `json:"templates,omitempty"`
+	// Policies say how each event type is delivered; the first policy
+	// matching an event applies. Events no policy matches are sent
+	// straight away.
+	Policies []NotifyPolicy `json:"policies,omitempty"`
+	// Spool is the directory digests and suppression counts are kept
+	// in. The services and the programs they start must share it.
+	Spool      string   `json:"spool"`
+	QueueSize  int      `json:"queueSize"` // per backend
+	Retries    int      `json:"retries"`
+	RetryDelay Duration `json:"retryDelay"` // doubles each retry
+}
+
+// NotifyBackend is one place notifications are delivered.
+type NotifyBackend struct {
+	Type    string            `json:"type"`              // smtp, webhook, syslog or file
+	Mail    *Mail             `json:"mail,omitempty"`    // smtp, on top of the mail section
+	URL     string            `json:"url,omitempty"`     // webhook
+	Headers map[string]string `json:"headers,omitempty"` // webhook
+	Path    string            `json:"path,omitempty"`    // file
+}
+
+// NotifyPolicy holds back events whose type matches one of Events.
+// Deliver "hourly" or "daily" collects them into one digest per event
+// type, sent at the top of the hour or each day at At ("07:00", default
+// midnight). SuppressAfter sends only the first SuppressAfter events
+// with the same type and subject in each Window, and a summary of the
+// rest when the window ends.
+type NotifyPolicy struct {
+	Events        []string `json:"events"`
+	Deliver       string   `json:"deliver,omitempty"` // immediate, hourly or daily
+	At            string   `json:"at,omitempty"`
+	SuppressAfter int      `json:"suppressAfter,omitempty"`
+	Window        Duration `json:"window,omitempty"`
+}
+
+// NotifyRoute sends the events whose type matches one of Events, a
+// path.Match pattern such as "po.*", to Backends. To replaces the
+// program's recipients. Empty Events matches every event.
+type NotifyRoute struct {
+	Events   []string `json:"events,omitempty"`
+	Backends []string `json:"backends"`
+	To       []string `json:"to,omitempty"`
+	// Attach sends the documents the event is about, the source XML
+	// and the response written, with it.
+	Attach bool `json:"attach,omitempty"`
+}
+
+// Dirs are where documents for the customer are written.
+// public_output_service watches them and sends what arrives.
+type Dirs struct {
+	POResponses string `json:"poResponses"`
+	MRReceipts  string `json:"mrReceipts"`
+}
+
+// Private is where private_input_service listens.
+type Private struct {
+	Host    string `json:"host"` // empty listens on every interface
+	MRPort  string `json:"mrPort"`
+	CmdPort string `json:"cmdPort"`
+	TLS     *TLS   `json:"tls,omitempty"` // nil listens in plaintext
+	// Allow is the addresses and CIDR networks MR connections are
+	// accepted from. Empty accepts them from anywhere.
+	Allow     []string  `json:"allow,omitempty"`
+	RateLimit RateLimit `json:"rateLimit,omitempty"`
+}
+
+// RateLimit allows each source address Connections MR connections
+// per Per, with bursts of up to Connections. Zero turns it off.
+type RateLimit struct {
+	Connections int      `json:"connections"`
+	Per         Duration `json:"per"`
+}
+
+// TLS is the server certificate for a listener and, with ClientCA,
+// the client certificates it accepts. The files are read again when
+// they change, see package editls.
+type TLS struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// ClientCA is a PEM bundle of the CAs client certificates must be
+	// issued by. Empty does not ask clients for a certificate.
+	ClientCA string `json:"clientCA,omitempty"`
+	// AllowClients limits which verified clients get in, matched against
+	// the certificate common name and DNS, email and URI names with
+	// path.Match patterns. Empty allows any client ClientCA verifies.
+	AllowClients []string `json:"allowClients,omitempty"`
+}
+
+// Outbound is the customer sftp server documents are sent to.
+type Outbound struct {
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`
+	User     string   `json:"user"`
+	Password string   `json:"password"`
+	Dirs     []string `json:"dirs"`    // cd into each in turn before the put
+	Options  []string `json:"options"` // extra -o options for sftp
+}
+
+// Hosts lists the application hosts XML_PO_import sends orders to.
+type Hosts struct {
+	Endpoints []Endpoint `json:"endpoints"`
+	// Failover is the order endpoints are tried in, by name.
+	// Endpoints left out are tried last, in the order listed above.
+	Failover []string `json:"failover,omitempty"`
+	// Routes send matching orders to their own endpoints.
+	// The first matching route wins, no match uses Failover.
+	Routes []Route `json:"routes,omitempty"`
+
+	ProbeInterval Duration `json:"probeInterval"` // 0 turns off background probing
+	ProbeTimeout  Duration `json:"probeTimeout"`
+	DownFor       Duration `json:"downFor"` // how long a failed endpoint is tried last
+	StateFile     string   `json:"stateFile"`
+}
+
+// Endpoint is one application host.
+type Endpoint struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"` // host:port
+	// Protocol is the wire protocol version, 1 if not set. 2 offers
+	// version 2 and falls back to 1 if the host does not take it (see
+	// ediframe).
+	Protocol int `json:"protocol,omitempty"`
+	// BatchSize is the records per frame in protocol 2, 0 sends the
+	// whole order in one frame.
+	BatchSize int `json:"batchSize,omitempty"`
+}
+
+// Route matches orders by ContractNumber and ProjectNumber.
+// Patterns use path.Match syntax, an empty pattern matches anything.
+type Route struct {
+	ContractNumber string   `json:"contractNumber,omitempty"`
+	ProjectNumber  string   `json:"projectNumber,omitempty"`
+	Endpoints      []string `json:"endpoints"`
+}
+
+// Duration is a time.Duration written as "30s" or "5m" in the file.
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON accepts a duration string or a number of seconds.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch val := v.(type) {
+	case float64:
+		d.Duration = time.Duration(val * float64(time.Second))
+	case string:
+		dur, err := time.ParseDuration(val)
+		if err != nil {
+			return err
+		}
+		d.Duration = dur
+	default:
+		return fmt.Errorf("invalid duration %s", b)
+	}
+	return nil
+}
+
+// MarshalJSON writes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Default returns the configuration used when there is no file.
+func Default() *Config {
+	return &Config{
+		Hosts: Hosts{
+			Endpoints: []Endpoint{
+				{Name: "primary", Addr: "192.168.1.240:30770"},
+			},
+			ProbeTimeout: Duration{5 * time.Second},
+			DownFor:      Duration{5 * time.Minute},
+			StateFile:    "./hoststate.json",
+		},
+		Dirs: Dirs{
+			POResponses: "/home/edimgr/acmeship/out/",
+			MRReceipts:  "/home/edimgr/custid/out/",
+		},
+		Private: Private{
+			MRPort:  "30771",
+			CmdPort: "30772",
+		},
+		Outbound: Outbound{
+			Host:     "customerdomain.com",
+			Port:     22,
+			User:     "username",
+			Password: "password",
+			Dirs:     []string{"dir1", "dir2"},
+		},
+		Notify: Notify{
+			Spool:      "./spool/notify",
+			QueueSize:  100,
+			Retries:    3,
+			RetryDelay: Duration{30 * time.Second},
+		},
+		Log: Log{
+			Sink:  "stderr",
+			Level: "info",
+		},
+		HTTP: HTTP{
+			MinFreeMB: 100,
+		},
+		API: API{
+			Jobs:    "./jobs",
+			Keep:    Duration{7 * 24 * time.Hour},
+			Workers: 2,
+			MaxWait: Duration{2 * time.Minute},
+		},
+		X12: X12{
+			Version:     "004010",
+			Usage:       "P",
+			Delimiters:  "~*:^",
+			ControlFile: "./x12control.json",
+			AckWithin:   Duration{time.Hour},
+			AckFile:     "./x12acks.json",
+		},
+		EDIFACT: EDIFACT{
+			Syntax:      "UNOC",
+			Version:     "3",
+			Release:     "96A",
+			ControlFile: "./edifactcontrol.json",
+		},
+		Ledger: "./ledger.jsonl",
+	}
+}
+
+// Load reads the configuration file at path on top of the defaults.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	b, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return cfg, nil
+	case err != nil:
+		return nil, err
+	}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	// The programs build file names by appending to these.
+	cfg.Dirs.POResponses = dirSlash(cfg.Dirs.POResponses)
+	cfg.Dirs.MRReceipts = dirSlash(cfg.Dirs.MRReceipts)
+	if err := cfg.check(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+func (t *TLS) check() error {
+	if t.Cert == "" || t.Key == "" {
+		return fmt.Errorf("tls needs a cert and a key")
+	}
+	if len(t.AllowClients) > 0 && t.ClientCA == "" {
+		return fmt.Errorf("tls allowClients needs a clientCA")
+	}
+	for _, p := range t.AllowClients {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("tls allowClients %q: %v", p, err)
+		}
+	}
+	return nil
+}
+
+func (x *X12) check() error {
+	if len(x.Version) != 6 {
+		return fmt.Errorf("version %q is not six digits, such as 004010", x.Version)
+	}
+	if x.Usage != "P" && x.Usage != "T" {
+		return fmt.Errorf("usage %q is not P or T", x.Usage)
+	}
+	if len(x.Delimiters) != 4 {
+		return fmt.Errorf("delimiters %q are not four characters", x.Delimiters)
+	}
+	for i := 0; i < 4; i++ {
+		c := x.Delimiters[i]
+		if c == ' ' || c > '~' || strings.IndexByte(x.Delimiters[i+1:], c) >= 0 ||
+			'0' <= c && c <= '9' || 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' {
+			return fmt.Errorf("delimiters %q must be four different punctuation characters", x.Delimiters)
+		}
+	}
+	if len(x.Sender) > 15 || len(x.SenderQual) > 2 {
+		return fmt.Errorf("sender is at most 15 characters, senderQual 2")
+	}
+	if x.ControlFile == "" {
+		return fmt.Errorf("needs a controlFile")
+	}
+	if x.FunctionalAck != "" && x.FunctionalAck != "997" && x.FunctionalAck != "999" {
+		return fmt.Errorf("functionalAck %q is not 997 or 999", x.FunctionalAck)
+	}
+	if x.AckWithin.Duration < 0 || x.AckWithin.Duration > 0 && x.AckFile == "" {
+		return fmt.Errorf("ackWithin must not be negative and needs an ackFile")
+	}
+	for _, p := range x.Partners {
+		// The partner is part of the file name, between underscores.
+		if p.Name == "" || strings.ContainsAny(p.Name, "_/") {
+			return fmt.Errorf("partner name %q is empty or has _ or /", p.Name)
+		}
+		if p.ID == "" || len(p.ID) > 15 || len(p.Qual) != 2 {
+			return fmt.Errorf("partner %s needs an id of at most 15 characters and a two character qual", p.Name)
+		}
+		switch p.Receipts {
+		case "xml":
+		case "856", "861":
+			if x.Sender == "" {
+				return fmt.Errorf("partner %s: X12 receipts need a sender", p.Name)
+			}
+		default:
+			return fmt.Errorf("partner %s: receipts %q is not xml, 856 or 861", p.Name, p.Receipts)
+		}
+		for _, pat := range p.Contracts {
+			if _, err := path.Match(pat, ""); err != nil {
+				return fmt.Errorf("partner %s: contracts %q: %v", p.Name, pat, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (e *EDIFACT) check() error {
+	if len(e.Syntax) != 4 || !strings.HasPrefix(e.Syntax, "UNO") || e.Syntax[3] < 'A' || e.Syntax[3] > 'Z' {
+		return fmt.Errorf("syntax %q is not a syntax identifier, such as UNOC", e.Syntax)
+	}
+	if e.Version != "3" && e.Version != "4" {
+		return fmt.Errorf("version %q is not 3 or 4", e.Version)
+	}
+	if len(e.Release) != 3 {
+		return fmt.Errorf("release %q is not a directory, such as 96A", e.Release)
+	}
+	if len(e.Sender) > 35 || len(e.SenderQual) > 4 {
+		return fmt.Errorf("sender is at most 35 characters, senderQual 4")
+	}
+	if e.ControlFile == "" {
+		return fmt.Errorf("needs a controlFile")
+	}
+	for _, p := range e.Partners {
+		if p.Name == "" || strings.ContainsAny(p.Name, "_/") {
+			return fmt.Errorf("partner name %q is empty or has _ or /", p.Name)
+		}
+		if p.ID == "" || len(p.ID) > 35 || len(p.Qual) > 4 {
+			return fmt.Errorf("partner %s needs an id of at most 35 characters and a qual of at most 4", p.Name)
+		}
+		switch p.Receipts {
+		case "xml":
+		case "desadv":
+			if e.Sender == "" {
+				return fmt.Errorf("partner %s: EDIFACT receipts need a sender", p.Name)
+			}
+		default:
+			return fmt.Errorf("partner %s: receipts %q is not xml or desadv", p.Name, p.Receipts)
+		}
+		for _, pat := range p.Contracts {
+			if _, err := path.Match(pat, ""); err != nil {
+				return fmt.Errorf("partner %s: contracts %q: %v", p.Name, pat, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (a *API) check() error {
+	if a.Listen == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(a.Listen); err != nil {
+		return err
+	}
+	// Tokens must not cross the network in the clear.
+	if a.TLS == nil {
+		return fmt.Errorf("listen needs tls")
+	}
+	if err := a.TLS.check(); err != nil {
+		return err
+	}
+	if a.Jobs == "" || a.Workers < 1 || a.MaxWait.Duration < 0 || a.Keep.Duration <= 0 {
+		return fmt.Errorf("needs jobs, workers, keep and a maxWait not negative")
+	}
+	tokens := make(map[string]bool)
+	for _, p := range a.Partners {
+		// The partner is part of the file name, between underscores.
+		if p.Name == "" || strings.ContainsAny(p.Name, "_/") {
+			return fmt.Errorf("partner name %q is empty or has _ or /", p.Name)
+		}
+		if len(p.Token) < 16 {
+			return fmt.Errorf("partner %s: token shorter than 16 characters", p.Name)
+		}
+		if tokens[p.Token] {
+			return fmt.Errorf("partner %s: token used twice", p.Name)
+		}
+		tokens[p.Token] = true
+	}
+	return nil
+}
+
+func (a *Admin) check() error {
+	for program, addr := range a.Listen {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("listen %s: %v", program, err)
+		}
+		if host == "" || Loopback(host) {
+			continue
+		}
+		// Tokens must not cross the network in the clear, and the
+		// network must not get in without one.
+		if a.TLS == nil {
+			return fmt.Errorf("listen %s: %s is off loopback and needs tls", program, addr)
+		}
+		if len(a.Operators) == 0 && a.TLS.ClientCA == "" {
+			return fmt.Errorf("listen %s: %s is off loopback and needs operators or a tls clientCA", program, addr)
+		}
+	}
+	if a.TLS != nil {
+		if err := a.TLS.check(); err != nil {
+			return err
+		}
+	}
+	names := make(map[string]bool)
+	tokens := make(map[string]bool)
+	for _, o := range a.Operators {
+		if o.Name == "" || names[o.Name] {
+			return fmt.Errorf("operator name %q is empty or used twice", o.Name)
+		}
+		if len(o.Token) < 16 {
+			return fmt.Errorf("operator %s: token shorter than 16 characters", o.Name)
+		}
+		if tokens[o.Token] {
+			return fmt.Errorf("operator %s: token used twice", o.Name)
+		}
+		names[o.Name], tokens[o.Token] = true, true
+	}
+	return nil
+}
+
+// Loopback reports whether host, a name or address, is this machine
+// only.
+func Loopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func dirSlash(dir string) string {
+	if dir != "" && !strings.HasSuffix(dir, "/") {
+		return dir + "/"
+	}
+	return dir
+}
+
+// check catches the mistakes that would otherwise show up as a
+// failed order at three in the morning.
+func (c *Config) check() error {
+	if len(c.Hosts.Endpoints) == 0 {
+		return fmt.Errorf("hosts: no endpoints")
+	}
+	names := make(map[string]bool)
+	for _, ep := range c.Hosts.Endpoints {
+		if ep.Name == "" || ep.Addr == "" {
+			return fmt.Errorf("hosts: endpoint needs a name and an addr")
+		}
+		if names[ep.Name] {
+			return fmt.Errorf("hosts: duplicate endpoint %q", ep.Name)
+		}
+		if ep.Protocol < 0 || ep.Protocol > 2 || ep.BatchSize < 0 {
+			return fmt.Errorf("hosts: endpoint %q has a bad protocol or batchSize", ep.Name)
+		}
+		names[ep.Name] = true
+	}
+	for _, n := range c.Hosts.Failover {
+		if !names[n] {
+			return fmt.Errorf("hosts: failover names unknown endpoint %q", n)
+		}
+	}
+	for _, r := range c.Hosts.Routes {
+		for _, n := range r.Endpoints {
+			if !names[n] {
+				return fmt.Errorf("hosts: route names unknown endpoint %q", n)
+			}
+		}
+	}
+	for _, a := range c.Private.Allow {
+		if _, _, err := net.ParseCIDR(a); err != nil && net.ParseIP(a) == nil {
+			return fmt.Errorf("private: allow %q is not an address or CIDR network", a)
+		}
+	}
+	if r := c.Private.RateLimit; r.Connections < 0 || (r.Connections > 0 && r.Per.Duration <= 0) {
+		return fmt.Errorf("private: rateLimit needs connections and a per duration")
+	}
+	if t := c.Private.TLS; t != nil {
+		if err := t.check(); err != nil {
+			return fmt.Errorf("private: %v", err)
+		}
+	}
+	if err := c.Admin.check(); err != nil {
+		return fmt.Errorf("admin: %v", err)
+	}
+	if err := c.API.check(); err != nil {
+		return fmt.Errorf("api: %v", err)
+	}
+	if err := c.X12.check(); err != nil {
+		return fmt.Errorf("x12: %v", err)
+	}
+	if err := c.EDIFACT.check(); err != nil {
+		return fmt.Errorf("edifact: %v", err)
+	}
+	for _, r := range c.Notify.Routes {
+		if len(r.Backends) == 0 {
+			return fmt.Errorf("notify: route needs backends")
+		}
+		for _, p := range r.Events {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("notify: route events %q: %v", p, err)
+			}
+		}
+	}
+	for _, p := range c.Notify.Policies {
+		for _, e := range p.Events {
+			if _, err := path.Match(e, ""); err != nil {
+				return fmt.Errorf("notify: policy events %q: %v", e, err)
+			}
+		}
+		switch p.Deliver {
+		case "", "immediate", "hourly", "daily":
+		default:
+			return fmt.Errorf("notify: policy deliver %q is not immediate, hourly or daily", p.Deliver)
+		}
+		if p.At != "" {
+			if _, err := time.Parse("15:04", p.At); err != nil {
+				return fmt.Errorf("notify: policy at %q is not HH:MM", p.At)
+			}
+		}
+		if p.SuppressAfter < 0 || (p.SuppressAfter > 0 && p.Window.Duration <= 0) {
+			return fmt.Errorf("notify: policy suppressAfter needs a window")
+		}
+	}
+	for name, addr := range c.HTTP.Listen {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("http: %s: %v", name, err)
+		}
+	}
+	if c.HTTP.MinFreeMB < 0 {
+		return fmt.Errorf("http: minFreeMB is negative")
+	}
+	switch c.Log.Sink {
+	case "stderr", "syslog":
+	case "json":
+		if c.Log.Path == "" {
+			return fmt.Errorf("log: the json sink needs a path")
+		}
+	default:
+		return fmt.Errorf("log: sink %q is not stderr, json or syslog", c.Log.Sink)
+	}
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("log: level %q is not debug, info, warn or error", c.Log.Level)
+	}
+	if len(c.Notify.Policies) > 0 && c.Notify.Spool == "" {
+		return fmt.Errorf("notify: policies need a spool directory")
+	}
+	if c.Notify.QueueSize < 0 || c.Notify.Retries < 0 {
+		return fmt.Errorf("notify: queueSize and retries cannot be negative")
+	}
+	return nil
+}
+
+// masked are the settings Dump hides the values of.
+var masked = map[string]bool{"password": true, "token": true, "headers": true}
+
+// Dump is the configuration as indented JSON, with every setting
+// filled in and the passwords, tokens and webhook headers masked.
+func (c *Config) Dump() ([]byte, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(mask(v), "", "\t")
+}
+
+func mask(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			if !masked[k] {
+				v[k] = mask(e)
+				continue
+			}
+			switch e := e.(type) {
+			case string:
+				if e != "" {
+					v[k] = "********"
+				}
+			case map[string]any:
+				for h := range e {
+					e[h] = "********"
+				}
+			}
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = mask(e)
+		}
+	}
+	return v
+}
+
+// Live is the configuration of a long running service. Reload swaps
+// in a new one as a whole, so code that needs several settings to
+// agree should Get once and use what it got.
+type Live struct {
+	path string
+	cur  atomic.Pointer[Config]
+}
+
+// NewLive loads the configuration file at path.
+func NewLive(path string) (*Live, error) {
+	cfg, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &Live{path: path}
+	l.cur.Store(cfg)
+	return l, nil
+}
+
+// Get returns the current configuration.
+func (l *Live) Get() *Config {
+	return l.cur.Load()
+}
+
+// Reload reads the file again. On error the current configuration
+// stays in use.
+func (l *Live) Reload() (*Config, error) {
+	cfg, err := Load(l.path)
+	if err != nil {
+		return nil, err
+	}
+	l.cur.Store(cfg)
+	return cfg, nil
+}
+
+// Store makes cfg the current configuration, for a service that checks
+// a configuration it has loaded itself before putting it in use.
+func (l *Live) Store(cfg *Config) {
+	l.cur.Store(cfg)
+}
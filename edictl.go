@@ -0,0 +1,693 @@
+/*
+File: edictl.go
+
+The operators' command line. It works through the services' admin
+interfaces, on their admin.listen addresses: public_input_service for
+documents, errors and events, public_output_service for resends, both
+for pauses, and all three services for tests and configuration.
+
+Requests carry the operator's name, -operator or the login name, and
+token, $EDI_TOKEN, or the client certificate given with -cert and
+-key; the services record what is done under that name. -cacert is
+the CA to check an admin address on HTTPS against.
+
+	edictl docs [-field f] [-n 20] [query]   recent documents and their states
+	edictl history id|file                   one document's full history
+	edictl tail [-n 10] [-partner p] [-id id]
+	                                         follow the ledger as it is written
+	edictl errors [name]                     list ./errors, or the earlier attempts at name
+	edictl reprocess name                    put a failed file back in the inbox
+	edictl resend file                       send an outbound file again
+	edictl pause partner                     hold a partner's documents
+	edictl resume partner                    let them go on
+	edictl paused                            the partners paused
+	edictl acks [-all]                       the acknowledgments partners owe us
+	edictl test                              try the host, sftp and mail connections,
+	                                         and the MR listener, TLS and allowlist
+	edictl config [-file] [service]          the configuration in effect
+
+reprocess takes -edit to change the file in $EDITOR first, -file to
+send another file in its place, or -version to send an earlier attempt.
+The file keeps its history: the failed attempt is kept as a version and
+the ledger carries on under its correlation ID.
+
+edictl exits 1 when a command fails, and test when a connection does.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cloud3000/BaseEDI/acks"
+	"github.com/cloud3000/BaseEDI/ediconfig"
+	"github.com/cloud3000/BaseEDI/edihttp"
+	"github.com/cloud3000/BaseEDI/ledger"
+)
+
+const (
+	inputService   = "public_input_service"
+	outputService  = "public_output_service"
+	privateService = "private_input_service"
+)
+
+var (
+	// partnerServices hold partners' documents, and so their pauses.
+	partnerServices = []string{inputService, outputService}
+	// allServices serve configuration and tests.
+	allServices = []string{inputService, outputService, privateService}
+)
+
+var (
+	configPath = flag.String("config", ediconfig.DefaultPath, "The configuration file")
+	inAddr     = flag.String("addr", "", "public_input_service's admin address or URL, instead of the one in the configuration")
+	outAddr    = flag.String("output-addr", "", "public_output_service's admin address or URL, instead of the one in the configuration")
+	privAddr   = flag.String("private-addr", "", "private_input_service's admin address or URL, instead of the one in the configuration")
+	timeout    = flag.Duration("timeout", 40*time.Second, "How long to wait for a service")
+	operator   = flag.String("operator", "", "The operator name to give with $EDI_TOKEN, the login name if empty")
+	certFile   = flag.String("cert", "", "A client certificate for the admin interfaces")
+	keyFile    = flag.String("key", "", "The client certificate's key")
+	caFile     = flag.String("cacert", "", "The CA the admin interfaces' certificates are checked against, the system's if empty")
+)
+
+// errNoHTTP is a service with no address to reach it on.
+var errNoHTTP = errors.New("serves no admin interface, see admin.listen")
+
+// command is one of edictl's commands.
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"docs", "[-field order|project|message|partner] [-n 20] [query]", listDocs},
+		{"history", "id|file", history},
+		{"tail", "[-n 10] [-partner p] [-id id]", tail},
+		{"errors", "[name]", listErrors},
+		{"reprocess", "[-edit | -file path | -version n] name", reprocess},
+		{"resend", "file", resend},
+		{"pause", "partner", pause},
+		{"resume", "partner", resume},
+		{"paused", "", paused},
+		{"acks", "[-all]", listAcks},
+		{"test", "", test},
+		{"config", "[-file] [service]", showConfig},
+	}
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s: [flags] command [command args…]\n\nCommands:\n", os.Args[0])
+		for _, c := range commands {
+			fmt.Fprintf(os.Stderr, "  %s %s\n", c.name, c.usage)
+		}
+		fmt.Fprintf(os.Stderr, "\nFlags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	for _, c := range commands {
+		if c.name != flag.Arg(0) {
+			continue
+		}
+		if err := c.run(flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "edictl %s: %v\n", c.name, err)
+			os.Exit(1)
+		}
+		return
+	}
+	flag.Usage()
+	os.Exit(2)
+}
+
+// usage is the error for a command given the wrong arguments.
+func usage(name string) error {
+	for _, c := range commands {
+		if c.name == name {
+			return fmt.Errorf("usage: %s %s", name, c.usage)
+		}
+	}
+	return errors.New("usage")
+}
+
+// serviceURL is the URL of path on program's admin address. An
+// address given with -addr, -output-addr or -private-addr may be a URL.
+func serviceURL(program string, path string) (string, error) {
+	override := map[string]string{inputService: *inAddr, outputService: *outAddr, privateService: *privAddr}[program]
+	if strings.Contains(override, "://") {
+		return strings.TrimSuffix(override, "/") + path, nil
+	}
+	if override != "" {
+		return "http://" + override + path, nil
+	}
+	cfg, err := ediconfig.Load(*configPath)
+	if err != nil {
+		return "", err
+	}
+	u := edihttp.AdminURL(cfg.Admin, program, path)
+	if u == "" {
+		return "", fmt.Errorf("%s %w", program, errNoHTTP)
+	}
+	return u, nil
+}
+
+// newRequest is a request of program's admin interface with the
+// operator's token.
+func newRequest(program string, method string, path string, body []byte) (*http.Request, error) {
+	u, err := serviceURL(program, path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("EDI_TOKEN"); token != "" {
+		name := *operator
+		if me, err := user.Current(); err == nil && name == "" {
+			name = me.Username
+		}
+		req.SetBasicAuth(name, token)
+	}
+	return req, nil
+}
+
+// client is the HTTP client for the admin interfaces, with the client
+// certificate and CA given.
+func client(timeout time.Duration) (*http.Client, error) {
+	cfg := &tls.Config{}
+	if *certFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if *caFile != "" {
+		pem, err := os.ReadFile(*caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates", *caFile)
+		}
+	}
+	return &http.Client{Timeout: timeout, Transport: &http.Transport{TLSClientConfig: cfg}}, nil
+}
+
+// request makes a request of program's admin interface and returns
+// the answer's status and body.
+func request(program string, method string, path string, body []byte) (int, []byte, error) {
+	req, err := newRequest(program, method, path, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	c, err := client(*timeout)
+	if err != nil {
+		return 0, nil, err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, b, err
+}
+
+// call is request for an answer that must be 200. Any other is an
+// error, with what the service said.
+func call(program string, method string, path string, body []byte) ([]byte, error) {
+	code, b, err := request(program, method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	if code != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(b, &e) == nil && e.Error != "" {
+			return nil, errors.New(e.Error)
+		}
+		if msg := strings.TrimSpace(string(b)); msg != "" && len(msg) < 200 {
+			return nil, errors.New(msg)
+		}
+		return nil, fmt.Errorf("%s %s: %d %s", program, path, code, http.StatusText(code))
+	}
+	return b, nil
+}
+
+// getJSON calls GET path on program and decodes the answer into v.
+func getJSON(program string, path string, v any) error {
+	b, err := call(program, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func when(t time.Time) string {
+	return t.Local().Format(time.DateTime)
+}
+
+func listDocs(args []string) error {
+	fs := flag.NewFlagSet("docs", flag.ContinueOnError)
+	field := fs.String("field", "", "Search only this: order, project, message or partner")
+	n := fs.Int("n", 20, "Show this many")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return usage("docs")
+	}
+	q := url.Values{"field": {*field}, "q": {fs.Arg(0)}, "n": {strconv.Itoa(*n)}}
+	var docs []struct {
+		ID    string      `json:"id"`
+		Name  string      `json:"name"`
+		State string      `json:"state"`
+		Last  time.Time   `json:"last"`
+		Keys  ledger.Keys `json:"keys"`
+	}
+	if err := getJSON(inputService, "/admin/docs?"+q.Encode(), &docs); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintln(tw, "LAST CHANGE\tID\tDOCUMENT\tORDER\tPARTNER\tSTATE")
+	for _, d := range docs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", when(d.Last), d.ID, d.Name, d.Keys.Order, d.Keys.Partner, d.State)
+	}
+	return nil
+}
+
+func history(args []string) error {
+	if len(args) != 1 {
+		return usage("history")
+	}
+	var doc ledger.Doc
+	if err := getJSON(inputService, "/admin/docs/"+url.PathEscape(args[0]), &doc); err != nil {
+		return err
+	}
+	fmt.Printf("ID:       %s\nOrder:    %s\nProject:  %s\nMessage:  %s\nPartner:  %s\n\n",
+		doc.ID, doc.Keys.Order, doc.Keys.Project, doc.Keys.Message, doc.Keys.Partner)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintln(tw, "TIME\tSERVICE\tDOCUMENT\tSTATE\tDETAIL")
+	for _, e := range doc.Entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", when(e.Time), e.Service, e.Doc, e.State, e.Detail)
+	}
+	return nil
+}
+
+func tail(args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	n := fs.Int("n", 10, "Start with this many earlier entries")
+	partner := fs.String("partner", "", "Only this partner's documents")
+	id := fs.String("id", "", "Only the document with this correlation ID")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return usage("tail")
+	}
+	req, err := newRequest(inputService, http.MethodGet, "/admin/events?n="+strconv.Itoa(*n), nil)
+	if err != nil {
+		return err
+	}
+	// No timeout: it runs until interrupted or the service goes.
+	c, err := client(0)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", req.URL, resp.Status)
+	}
+	s := bufio.NewScanner(resp.Body)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		var e ledger.Entry
+		if json.Unmarshal(s.Bytes(), &e) != nil {
+			continue
+		}
+		if (*id != "" && e.ID != *id) || (*partner != "" && !strings.Contains(e.Doc, "_"+*partner+"_") &&
+			!strings.HasPrefix(e.Doc, *partner+"_") && (e.Keys == nil || e.Keys.Partner != *partner)) {
+			continue
+		}
+		line := fmt.Sprintf("%s  %-16s  %-21s  %-11s  %s", when(e.Time), e.ID, e.Service, e.State, e.Doc)
+		if e.Detail != "" {
+			line += "  " + e.Detail
+		}
+		fmt.Println(line)
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return errors.New("the service closed the stream")
+}
+
+func listErrors(args []string) error {
+	if len(args) > 1 {
+		return usage("errors")
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer tw.Flush()
+	if len(args) == 1 {
+		var vs []struct {
+			Version  int       `json:"version"`
+			Size     int64     `json:"size"`
+			Modified time.Time `json:"modified"`
+		}
+		if err := getJSON(inputService, "/admin/errors/"+url.PathEscape(args[0])+"/versions", &vs); err != nil {
+			return err
+		}
+		fmt.Fprintln(tw, "VERSION\tFAILED\tSIZE")
+		for _, v := range vs {
+			fmt.Fprintf(tw, "%d\t%s\t%d\n", v.Version, when(v.Modified), v.Size)
+		}
+		return nil
+	}
+	var files []struct {
+		Name     string    `json:"name"`
+		Size     int64     `json:"size"`
+		Modified time.Time `json:"modified"`
+		Versions int       `json:"versions"`
+		ID       string    `json:"id"`
+		Reason   string    `json:"reason"`
+	}
+	if err := getJSON(inputService, "/admin/errors", &files); err != nil {
+		return err
+	}
+	fmt.Fprintln(tw, "FAILED\tFILE\tID\tEARLIER\tREASON")
+	for _, f := range files {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", when(f.Modified), f.Name, f.ID, f.Versions, f.Reason)
+	}
+	return nil
+}
+
+func reprocess(args []string) error {
+	fs := flag.NewFlagSet("reprocess", flag.ContinueOnError)
+	edit := fs.Bool("edit", false, "Change the file in $EDITOR before it is sent")
+	file := fs.String("file", "", "Send this file in place of the failed one")
+	version := fs.Int("version", 0, "Start from this earlier attempt rather than the latest")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usage("reprocess")
+	}
+	if *file != "" && (*edit || *version != 0) {
+		return errors.New("-file goes without -edit and -version")
+	}
+	name := fs.Arg(0)
+	path := "/admin/errors/" + url.PathEscape(name)
+
+	var body []byte
+	var err error
+	switch {
+	case *file != "":
+		if body, err = os.ReadFile(*file); err != nil {
+			return err
+		}
+	case *edit || *version != 0:
+		if body, err = call(inputService, http.MethodGet, path+"?version="+strconv.Itoa(*version), nil); err != nil {
+			return err
+		}
+		if *edit {
+			orig := body
+			if body, err = editFile(name, body); err != nil {
+				return err
+			}
+			if *version == 0 && bytes.Equal(body, orig) {
+				body = nil // left as it was
+			}
+		}
+	}
+	if body != nil && len(bytes.TrimSpace(body)) == 0 {
+		return errors.New("nothing to send, the file is empty")
+	}
+
+	b, err := call(inputService, http.MethodPost, path+"/reprocess", body)
+	if err != nil {
+		return err
+	}
+	var res struct {
+		ID     string `json:"id"`
+		Edited bool   `json:"edited"`
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return err
+	}
+	how := "as it was"
+	if res.Edited {
+		how = "edited"
+	}
+	fmt.Printf("%s put back in the inbox %s, id %s\n", name, how, res.ID)
+	return nil
+}
+
+// editFile opens a copy of b in $EDITOR and returns what was saved.
+func editFile(name string, b []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "edictl")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, b, 0600); err != nil {
+		return nil, err
+	}
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	// Through the shell, as $EDITOR may carry arguments.
+	c := exec.Command("/bin/sh", "-c", editor+` "$1"`, "sh", p)
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := c.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %v", editor, err)
+	}
+	return os.ReadFile(p)
+}
+
+func resend(args []string) error {
+	if len(args) != 1 {
+		return usage("resend")
+	}
+	name := filepath.Base(args[0])
+	b, err := call(outputService, http.MethodPost, "/admin/resend/"+url.PathEscape(name), nil)
+	if err != nil {
+		return err
+	}
+	var res struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(b, &res)
+	fmt.Printf("%s put back in the outbox, id %s\n", name, res.ID)
+	return nil
+}
+
+func pause(args []string) error {
+	if len(args) != 1 {
+		return usage("pause")
+	}
+	return eachService(partnerServices, func(program string) error {
+		if _, err := call(program, http.MethodPost, "/admin/partners/"+url.PathEscape(args[0])+"/pause", nil); err != nil {
+			return err
+		}
+		fmt.Printf("%s: %s paused\n", program, args[0])
+		return nil
+	})
+}
+
+func resume(args []string) error {
+	if len(args) != 1 {
+		return usage("resume")
+	}
+	return eachService(partnerServices, func(program string) error {
+		b, err := call(program, http.MethodPost, "/admin/partners/"+url.PathEscape(args[0])+"/resume", nil)
+		if err != nil {
+			return err
+		}
+		var res struct {
+			Released []string `json:"released"`
+			Left     []string `json:"left"`
+		}
+		if err := json.Unmarshal(b, &res); err != nil {
+			return err
+		}
+		fmt.Printf("%s: %s resumed, %d held files released\n", program, args[0], len(res.Released))
+		for _, f := range res.Left {
+			fmt.Printf("%s: %s still held, a file of that name is waiting; resume again once it has gone\n", program, f)
+		}
+		return nil
+	})
+}
+
+func paused(args []string) error {
+	if len(args) != 0 {
+		return usage("paused")
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintln(tw, "SERVICE\tPARTNER\tSINCE\tHELD\tBY")
+	return eachService(partnerServices, func(program string) error {
+		var list []struct {
+			Partner string    `json:"partner"`
+			Since   time.Time `json:"since"`
+			By      string    `json:"by"`
+			Held    int       `json:"held"`
+		}
+		if err := getJSON(program, "/admin/partners", &list); err != nil {
+			return err
+		}
+		for _, p := range list {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", program, p.Partner, when(p.Since), p.Held, p.By)
+		}
+		return nil
+	})
+}
+
+func listAcks(args []string) error {
+	fs := flag.NewFlagSet("acks", flag.ContinueOnError)
+	all := fs.Bool("all", false, "Show the acknowledgments that came as well")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return usage("acks")
+	}
+	var list []acks.Owed
+	if err := getJSON(outputService, "/admin/acks", &list); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintln(tw, "SENT\tPARTNER\tGROUP\tDOCUMENT\tDUE\tSTATE")
+	now := time.Now()
+	for _, o := range list {
+		state := "owed"
+		switch {
+		case !o.Settled.IsZero():
+			if !*all {
+				continue
+			}
+			state = "came " + when(o.Settled) + ", " + o.Status
+		case o.Due.Before(now):
+			state = "overdue"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s %s\t%s\t%s\t%s\n", when(o.Sent), o.Partner, o.Code, o.Group, o.Doc, when(o.Due), state)
+	}
+	return nil
+}
+
+// eachService runs fn for each of programs. A service with no HTTP
+// address is passed over with a warning; it is an error if none has one.
+func eachService(programs []string, fn func(program string) error) error {
+	var errs []error
+	reached := 0
+	for _, program := range programs {
+		err := fn(program)
+		if errors.Is(err, errNoHTTP) {
+			fmt.Fprintf(os.Stderr, "edictl: %v, skipped\n", err)
+			continue
+		}
+		reached++
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", program, err))
+		}
+	}
+	if reached == 0 {
+		return errors.New("no service to ask")
+	}
+	return errors.Join(errs...)
+}
+
+func test(args []string) error {
+	if len(args) != 0 {
+		return usage("test")
+	}
+	failed := false
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVICE\tTEST\tRESULT\tSECONDS\tERROR")
+	err := eachService(allServices, func(program string) error {
+		code, b, err := request(program, http.MethodGet, "/admin/test", nil)
+		if err != nil {
+			return err
+		}
+		var res struct {
+			Checks []edihttp.Result `json:"checks"`
+		}
+		if (code != http.StatusOK && code != http.StatusServiceUnavailable) || json.Unmarshal(b, &res) != nil {
+			return fmt.Errorf("/admin/test: %d %s", code, http.StatusText(code))
+		}
+		for _, c := range res.Checks {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%.1f\t%s\n", program, c.Name, c.Status, c.Duration, c.Error)
+			failed = failed || c.Status != "ok"
+		}
+		return nil
+	})
+	tw.Flush()
+	if err == nil && failed {
+		err = errors.New("a connection failed")
+	}
+	return err
+}
+
+func showConfig(args []string) error {
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	file := fs.Bool("file", false, "Show what the file loads as, rather than what a service runs with")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 || (*file && fs.NArg() != 0) {
+		return usage("config")
+	}
+	var b []byte
+	if *file {
+		cfg, err := ediconfig.Load(*configPath)
+		if err != nil {
+			return err
+		}
+		if b, err = cfg.Dump(); err != nil {
+			return err
+		}
+		b = append(b, '\n')
+	} else {
+		program := inputService
+		if fs.NArg() == 1 {
+			program = fs.Arg(0)
+		}
+		var err error
+		if b, err = call(program, http.MethodGet, "/admin/config", nil); err != nil {
+			return err
+		}
+	}
+	_, err := os.Stdout.Write(b)
+	return err
+}
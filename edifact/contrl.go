@@ -0,0 +1,257 @@
+package edifact
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Acknowledgment statuses, as the x12 package has them, that a CONTRL
+// is read as.
+const (
+	Accepted           = "A"
+	AcceptedWithErrors = "E" // taken, though with errors noted
+	PartiallyAccepted  = "P" // some of the messages rejected
+	Rejected           = "R"
+)
+
+// Action codes, 0083, of UCI, UCF and UCM.
+const (
+	ActionRejected     = "4" // this level and all below rejected
+	ActionAcknowledged = "7" // acknowledged, and the levels below unless rejected
+	ActionReceived     = "8" // the interchange received, not checked
+)
+
+// Ack is what the CONTRL acknowledging an interchange says, gathered as
+// it is read. CONTRL messages are not themselves acknowledged.
+type Ack struct {
+	Interchange *Interchange
+	// Error is what is wrong with the interchange envelope, nil if
+	// nothing; the interchange is then rejected whole.
+	Error    *EnvelopeError
+	Groups   []*GroupAck
+	Messages []*MessageAck
+}
+
+// GroupAck is what a CONTRL says of a group, its UCF.
+type GroupAck struct {
+	Group *Group
+	Codes []string // UCF05, the syntax error codes; only the first is sent
+}
+
+// MessageAck is what a CONTRL says of a message, from UCM to its UCS
+// and UCD segments.
+type MessageAck struct {
+	Message *Message
+	Codes   []string      // UCM04, the syntax error codes; only the first is sent
+	Errors  SegmentErrors // the UCS and UCD segments
+	// Taken means the message was used in spite of its Errors.
+	Taken bool
+}
+
+// NewAck starts the acknowledgment of ic and err, as Parse returned
+// them. The group or message an *EnvelopeError in err is about is in
+// error; the rest are accepted until the caller finds otherwise.
+func NewAck(ic *Interchange, err error) *Ack {
+	a := &Ack{Interchange: ic}
+	for _, g := range ic.Groups {
+		a.Groups = append(a.Groups, &GroupAck{Group: g})
+	}
+	for _, m := range ic.Messages {
+		if m.Type != "CONTRL" {
+			a.Messages = append(a.Messages, &MessageAck{Message: m})
+		}
+	}
+	var env *EnvelopeError
+	if !errors.As(err, &env) {
+		return a
+	}
+	switch {
+	case env.Level == LevelInterchange:
+		a.Error = env
+	// Parse stops at the first error, so it is in the last group or
+	// message read.
+	case env.Level == LevelGroup && len(a.Groups) > 0:
+		ga := a.Groups[len(a.Groups)-1]
+		ga.Codes = append(ga.Codes, env.Code)
+	case env.Level == LevelMessage && len(ic.Messages) > 0 && a.Message(ic.Messages[len(ic.Messages)-1]) != nil:
+		ma := a.Message(ic.Messages[len(ic.Messages)-1])
+		ma.Codes = append(ma.Codes, env.Code)
+	}
+	return a
+}
+
+// Message returns the acknowledgment of m, nil if m is not
+// acknowledged.
+func (a *Ack) Message(m *Message) *MessageAck {
+	for _, ma := range a.Messages {
+		if ma.Message == m {
+			return ma
+		}
+	}
+	return nil
+}
+
+// Empty reports whether there is nothing to acknowledge: the
+// interchange is sound and has only CONTRL messages.
+func (a *Ack) Empty() bool {
+	return a.Error == nil && len(a.Messages) == 0
+}
+
+// Status is the message's status.
+func (ma *MessageAck) Status() string {
+	switch {
+	case len(ma.Codes) == 0 && len(ma.Errors) == 0:
+		return Accepted
+	case len(ma.Codes) == 0 && ma.Taken:
+		return AcceptedWithErrors
+	}
+	return Rejected
+}
+
+// action is the UCM03 or UCF04 for status.
+func action(status string) string {
+	if status == Rejected {
+		return ActionRejected
+	}
+	return ActionAcknowledged
+}
+
+// WriteContrl writes the CONTRL in a: a UCI for the interchange and
+// unless it is rejected a UCF for each group and a UCM for each
+// message, with UCS and UCD segments for the segments in error.
+func WriteContrl(w *Writer, a *Ack) {
+	ic := a.Interchange
+	version, release := "D", "3"
+	if ic.Version >= "4" {
+		version, release = "4", "1"
+	}
+	w.Begin("CONTRL", version, release)
+	uci := []string{ic.Control, w.Composite(ic.Sender, ic.SenderQual), w.Composite(ic.Receiver, ic.ReceiverQual), ActionAcknowledged}
+	if a.Error != nil {
+		uci[3] = ActionRejected
+		uci = append(uci, a.Error.Code, a.Error.Segment)
+	}
+	w.Segment("UCI", uci...)
+	if a.Error != nil {
+		w.End()
+		return
+	}
+	writeMessages := func(g *Group, rejected bool) {
+		for _, ma := range a.Messages {
+			if ma.Message.Group != g {
+				continue
+			}
+			m := ma.Message
+			status := ma.Status()
+			if rejected {
+				status = Rejected
+			}
+			ucm := []string{m.Ref, w.Composite(m.Type, m.Version, m.Release, m.Agency), action(status)}
+			if len(ma.Codes) > 0 {
+				ucm = append(ucm, ma.Codes[0], "UNH")
+			}
+			w.Segment("UCM", ucm...)
+			writeSegmentErrors(w, ma.Errors)
+		}
+	}
+	if len(a.Groups) == 0 {
+		writeMessages(nil, false)
+	}
+	for _, ga := range a.Groups {
+		g := ga.Group
+		ucf := []string{g.Ref, g.Sender, g.Receiver, ActionAcknowledged}
+		if len(ga.Codes) > 0 {
+			ucf[3] = ActionRejected
+			ucf = append(ucf, ga.Codes[0], "UNG")
+		}
+		w.Segment("UCF", ucf...)
+		writeMessages(g, len(ga.Codes) > 0)
+	}
+	w.End()
+}
+
+// writeSegmentErrors writes errs as UCS segments, one for each segment
+// in error, each followed by a UCD for each of its elements in error.
+func writeSegmentErrors(w *Writer, errs SegmentErrors) {
+	last := 0
+	for _, e := range errs {
+		if e.Pos != last {
+			code := e.Code
+			if e.Element > 0 {
+				// The code goes on the UCD.
+				code = ""
+			}
+			w.Segment("UCS", strconv.Itoa(e.Pos), code)
+			last = e.Pos
+		}
+		if e.Element > 0 {
+			component := ""
+			if e.Component > 0 {
+				component = strconv.Itoa(e.Component)
+			}
+			w.Segment("UCD", e.Code, w.Composite(strconv.Itoa(e.Element), component))
+		}
+	}
+}
+
+// AckReport is what a partner's CONTRL says of an interchange we sent.
+type AckReport struct {
+	Control string // UCI01, the interchange's UNB05
+	Action  string // UCI04
+	Status  string // one of the statuses, from the actions
+	// Messages are the UCM03 actions of the messages acknowledged, by
+	// their references.
+	Messages map[string]string
+}
+
+// ReadContrl reads the CONTRL in m.
+func ReadContrl(m *Message) (*AckReport, error) {
+	if m.Type != "CONTRL" {
+		return nil, SegmentErrors{{Message: m.Ref, Pos: 1, Segment: "UNH", Code: codeValue, Element: 2, Msg: "not a CONTRL"}}
+	}
+	r := &AckReport{Messages: make(map[string]string)}
+	rejected := 0
+	for _, s := range m.Segments {
+		switch s.Tag {
+		case "UCI":
+			r.Control, r.Action = s.E(1), s.E(4)
+		case "UCM":
+			r.Messages[s.E(1)] = s.E(3)
+			if s.E(3) == ActionRejected {
+				rejected++
+			}
+		}
+	}
+	if r.Control == "" {
+		return nil, SegmentErrors{{Message: m.Ref, Pos: 2, Segment: "UCI", Code: codeMissing, Msg: "no UCI"}}
+	}
+	switch {
+	case r.Action == ActionRejected:
+		r.Status = Rejected
+	case rejected > 0 && rejected == len(r.Messages):
+		r.Status = Rejected
+	case rejected > 0:
+		r.Status = PartiallyAccepted
+	default:
+		r.Status = Accepted
+	}
+	return r, nil
+}
+
+// String describes r for people.
+func (r *AckReport) String() string {
+	status := statusNames[r.Status]
+	if r.Action == ActionReceived {
+		status = "received"
+	}
+	return fmt.Sprintf("interchange %s %s", r.Control, status)
+}
+
+// statusNames are the acknowledgment statuses in words.
+var statusNames = map[string]string{
+	Accepted:           "accepted",
+	AcceptedWithErrors: "accepted with errors",
+	PartiallyAccepted:  "partially accepted",
+	Rejected:           "rejected",
+}
@@ -0,0 +1,80 @@
+package edifact
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReadContrlStatus(t *testing.T) {
+	const uci = "UCI+101+ACME:ZZ+BASEEDI:ZZ+"
+	tests := []struct {
+		name     string
+		segs     []string
+		status   string
+		messages map[string]string
+		text     string
+	}{
+		{"acknowledged", []string{uci + "7"}, Accepted, map[string]string{},
+			"interchange 101 accepted"},
+		{"messages acknowledged", []string{uci + "7", "UCM+1+ORDERS:D:96A:UN+7", "UCM+2+ORDERS:D:96A:UN+7"}, Accepted,
+			map[string]string{"1": ActionAcknowledged, "2": ActionAcknowledged}, "interchange 101 accepted"},
+		{"one message rejected", []string{uci + "7", "UCM+1+ORDERS:D:96A:UN+7", "UCM+2+ORDERS:D:96A:UN+4+13+UNH", "UCS+3+13"}, PartiallyAccepted,
+			map[string]string{"1": ActionAcknowledged, "2": ActionRejected}, "interchange 101 partially accepted"},
+		{"every message rejected", []string{uci + "7", "UCM+1+ORDERS:D:96A:UN+4", "UCM+2+ORDERS:D:96A:UN+4"}, Rejected,
+			map[string]string{"1": ActionRejected, "2": ActionRejected}, "interchange 101 rejected"},
+		{"interchange rejected", []string{uci + "4+29+UNZ"}, Rejected, map[string]string{},
+			"interchange 101 rejected"},
+		{"received, not checked", []string{uci + "8"}, Accepted, map[string]string{},
+			"interchange 101 received"},
+		{"group rejected", []string{uci + "7", "UCF+7+ACME+BASEEDI+4+29+UNG", "UCM+1+ORDERS:D:96A:UN+4"}, Rejected,
+			map[string]string{"1": ActionRejected}, "interchange 101 rejected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testMessage(tt.segs...)
+			m.Type = "CONTRL"
+			r, err := ReadContrl(m)
+			if err != nil {
+				t.Fatalf("ReadContrl: %v", err)
+			}
+			if r.Control != "101" || r.Status != tt.status || !reflect.DeepEqual(r.Messages, tt.messages) {
+				t.Errorf("UCI %s, status %s, UCMs %v; want 101, %s, %v", r.Control, r.Status, r.Messages, tt.status, tt.messages)
+			}
+			if r.String() != tt.text {
+				t.Errorf("%q, want %q", r.String(), tt.text)
+			}
+		})
+	}
+}
+
+func TestReadContrlErrors(t *testing.T) {
+	m := testMessage("UCM+1+ORDERS:D:96A:UN+7")
+	m.Type = "CONTRL"
+	if r, err := ReadContrl(m); err == nil {
+		t.Errorf("ReadContrl without a UCI = %+v", r)
+	}
+	if r, err := ReadContrl(testMessage("UCI+101+ACME:ZZ+BASEEDI:ZZ+7")); err == nil {
+		t.Errorf("ReadContrl of an ORDERS = %+v", r)
+	}
+}
+
+func TestMessageAckStatus(t *testing.T) {
+	bad := SegmentErrors{{Message: "1", Pos: 3, Segment: "DTM", Code: codeValue, Element: 1, Component: 2}}
+	tests := []struct {
+		name   string
+		ma     MessageAck
+		status string
+		action string
+	}{
+		{"clean", MessageAck{}, Accepted, ActionAcknowledged},
+		{"segment errors", MessageAck{Errors: bad}, Rejected, ActionRejected},
+		{"segment errors, taken", MessageAck{Errors: bad, Taken: true}, AcceptedWithErrors, ActionAcknowledged},
+		{"envelope error", MessageAck{Codes: []string{codeCount}}, Rejected, ActionRejected},
+		{"envelope error, taken", MessageAck{Codes: []string{codeCount}, Errors: bad, Taken: true}, Rejected, ActionRejected},
+	}
+	for _, tt := range tests {
+		if got := tt.ma.Status(); got != tt.status || action(got) != tt.action {
+			t.Errorf("%s: status %s, action %s; want %s, %s", tt.name, got, action(got), tt.status, tt.action)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package edifact
+
+import (
+	"strconv"
+	"time"
+)
+
+// Despatch is what a DESADV despatch advice tells of: packages shipped
+// against one order.
+type Despatch struct {
+	Number   string // BGM02
+	Date     time.Time
+	Received time.Time // DTM+50, when the shipper had the goods; zero if not known
+	Carrier  string    // TDT05:4, the carrier's name
+	Tracking string    // RFF+CN, the carrier's reference
+	Order    string    // RFF+ON, the purchase order number
+	Project  string    // RFF+AEP
+	Contract string    // RFF+CT
+	Packages []Package
+}
+
+// Package is a CPS group of a DESADV, one package.
+type Package struct {
+	ID        string // GIN+ML, the package's marks and number
+	Type      string // PAC03, 7065, such as PX pallet or CT carton
+	Weight    string // MEA+PD+G, in pounds
+	Volume    string // MEA+PD+AAW, in cubic feet
+	Length    string // MEA+PD, in inches
+	Width     string
+	Height    string
+	Hazardous string // the UN number, if the package is hazardous
+	Items     []Item
+}
+
+// Item is a LIN group in a package.
+type Item struct {
+	Line        string // the purchase order line number
+	Code        string // the buyer's part number
+	Description string
+	Qty         string
+	UOM         string
+}
+
+// WriteDespatch writes the DESADV for d, from directory release, such
+// as 96A: a CPS for the shipment, then one for each package under it
+// with the items in it.
+func WriteDespatch(w *Writer, d Despatch, release string) {
+	w.Begin("DESADV", "D", release)
+	// 351: despatch advice, 9: original.
+	w.Segment("BGM", "351", d.Number, "9")
+	w.Segment("DTM", w.Composite("137", d.Date.Format("200601021504"), "203"))
+	if !d.Received.IsZero() {
+		w.Segment("DTM", w.Composite("50", d.Received.Format("20060102"), "102"))
+	}
+	for _, r := range []struct{ qual, v string }{{"ON", d.Order}, {"AEP", d.Project}, {"CT", d.Contract}, {"CN", d.Tracking}} {
+		if r.v != "" {
+			w.Segment("RFF", w.Composite(r.qual, r.v))
+		}
+	}
+	if d.Carrier != "" {
+		// 20: main carriage.
+		w.Segment("TDT", "20", "", "", "", w.Composite("", "", "", d.Carrier))
+	}
+
+	w.Segment("CPS", "1")
+	lines := 0
+	for i, p := range d.Packages {
+		w.Segment("CPS", strconv.Itoa(i+2), "1")
+		w.Segment("PAC", "1", "", p.Type)
+		if p.Weight != "" {
+			w.Segment("MEA", "PD", "G", w.Composite("LBR", p.Weight))
+		}
+		for _, m := range []struct{ qual, v string }{{"LN", p.Length}, {"WD", p.Width}, {"HT", p.Height}} {
+			if m.v != "" {
+				w.Segment("MEA", "PD", m.qual, w.Composite("INH", m.v))
+			}
+		}
+		if p.Volume != "" {
+			w.Segment("MEA", "PD", "AAW", w.Composite("FTQ", p.Volume))
+		}
+		if p.Hazardous != "" {
+			w.Segment("HAN", w.Composite("", "", "", "Hazardous UN"+p.Hazardous))
+		}
+		if p.ID != "" {
+			// 33E: marked with the shipper's own marks.
+			w.Segment("PCI", "33E")
+			w.Segment("GIN", "ML", p.ID)
+		}
+		for _, it := range p.Items {
+			lines++
+			w.Segment("LIN", it.Line, "", w.Composite(it.Code, "BP"))
+			if it.Description != "" {
+				w.Segment("IMD", "F", "", w.Composite("", "", "", it.Description))
+			}
+			w.Segment("QTY", w.Composite("12", it.Qty, it.UOM))
+			if d.Order != "" {
+				w.Segment("RFF", w.Composite("ON", d.Order, it.Line))
+			}
+		}
+	}
+	w.Segment("CNT", w.Composite("2", strconv.Itoa(lines)))
+	w.End()
+}
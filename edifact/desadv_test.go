@@ -0,0 +1,132 @@
+package edifact
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// messageSegments returns the segments of the one message in an
+// interchange written one segment to a line, UNH to UNT, after
+// checking that it parses.
+func messageSegments(t *testing.T, b []byte) []string {
+	t.Helper()
+	ic, err := Parse(b)
+	if err != nil {
+		t.Fatalf("the interchange does not parse: %v\n%s", err, b)
+	}
+	if len(ic.Messages) != 1 {
+		t.Fatalf("%d messages, want 1", len(ic.Messages))
+	}
+	var segs []string
+	in := false
+	for _, line := range strings.Split(string(b), "\n") {
+		seg := strings.TrimSuffix(line, "'")
+		in = in || strings.HasPrefix(seg, "UNH+")
+		if in {
+			segs = append(segs, seg)
+		}
+		if strings.HasPrefix(seg, "UNT+") {
+			break
+		}
+	}
+	return segs
+}
+
+func TestWriteDespatch(t *testing.T) {
+	date := time.Date(2024, 1, 3, 9, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		d       Despatch
+		release string
+		want    []string
+	}{
+		{"packages and items", Despatch{
+			Number: "SH1", Date: date, Received: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+			Carrier: "UPS", Tracking: "1Z9", Order: "PO123", Project: "G41", Contract: "C-9",
+			Packages: []Package{
+				{ID: "PKG1", Type: "PX", Weight: "120.5", Volume: "40", Length: "48", Width: "40", Height: "36", Hazardous: "1993",
+					Items: []Item{
+						{Line: "1", Code: "ABC-1", Description: "Widgets", Qty: "10", UOM: "EA"},
+						{Line: "2", Code: "DEF-2", Qty: "2.5", UOM: "LBR"},
+					}},
+				{Type: "CT"},
+			},
+		}, "96A", []string{
+			"UNH+1+DESADV:D:96A:UN",
+			"BGM+351+SH1+9",
+			"DTM+137:202401030930:203",
+			"DTM+50:20240102:102",
+			"RFF+ON:PO123",
+			"RFF+AEP:G41",
+			"RFF+CT:C-9",
+			"RFF+CN:1Z9",
+			"TDT+20++++:::UPS",
+			"CPS+1",
+			"CPS+2+1",
+			"PAC+1++PX",
+			"MEA+PD+G+LBR:120.5",
+			"MEA+PD+LN+INH:48",
+			"MEA+PD+WD+INH:40",
+			"MEA+PD+HT+INH:36",
+			"MEA+PD+AAW+FTQ:40",
+			"HAN+:::Hazardous UN1993",
+			"PCI+33E",
+			"GIN+ML+PKG1",
+			"LIN+1++ABC-1:BP",
+			"IMD+F++:::Widgets",
+			"QTY+12:10:EA",
+			"RFF+ON:PO123:1",
+			"LIN+2++DEF-2:BP",
+			"QTY+12:2.5:LBR",
+			"RFF+ON:PO123:2",
+			"CPS+3+1",
+			"PAC+1++CT",
+			"CNT+2:2",
+			"UNT+31+1",
+		}},
+		{"no packages", Despatch{Number: "SH2", Date: date}, "01B", []string{
+			"UNH+1+DESADV:D:01B:UN",
+			"BGM+351+SH2+9",
+			"DTM+137:202401030930:203",
+			"CPS+1",
+			"CNT+2:0",
+			"UNT+6+1",
+		}},
+		{"delimiters released", Despatch{
+			Number: "SH+3", Date: date, Order: "PO'4", Carrier: "R:L",
+			Packages: []Package{{ID: "A?1", Type: "CT",
+				Items: []Item{{Line: "1", Code: "ABC-1", Description: "Nuts+bolts", Qty: "4", UOM: "EA"}}}},
+		}, "96A", []string{
+			"UNH+1+DESADV:D:96A:UN",
+			"BGM+351+SH?+3+9",
+			"DTM+137:202401030930:203",
+			"RFF+ON:PO?'4",
+			"TDT+20++++:::R?:L",
+			"CPS+1",
+			"CPS+2+1",
+			"PAC+1++CT",
+			"PCI+33E",
+			"GIN+ML+A??1",
+			"LIN+1++ABC-1:BP",
+			"IMD+F++:::Nuts?+bolts",
+			"QTY+12:4:EA",
+			"RFF+ON:PO?'4:1",
+			"CNT+2:1",
+			"UNT+16+1",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewWriter(Envelope{
+				Syntax: "UNOC", Version: "3", SenderQual: "ZZ", Sender: "BASEEDI", ReceiverQual: "ZZ", Receiver: "ACME",
+				Control: 12, Date: date,
+			}, DefaultDelimiters("3"), true)
+			WriteDespatch(w, tt.d, tt.release)
+			if got := messageSegments(t, w.Bytes()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DESADV written as\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,455 @@
+/*
+Package edifact reads and writes UN/EDIFACT interchanges.
+
+An interchange may start with a UNA service string advice, which sets
+its delimiters: the component and element separators, the decimal
+mark, the release character, the repetition separator and the segment
+terminator. Without one the defaults of the syntax are used, ":+.? '"
+for version 3 and ":+.?*'" for version 4. A delimiter in the data is
+escaped with the release character. Line breaks after segment
+terminators are ignored.
+
+UNB and UNZ enclose the interchange, UNG and UNE the functional groups
+it may have, and UNH and UNT each message. Parse checks the envelopes:
+each trailer must be there, carry its header's reference and count
+what it encloses. An envelope that is wrong is an *EnvelopeError,
+carrying the syntax error code a CONTRL reports it with. Version 4
+repeats of an element are not split apart; none of the messages read
+here repeats one.
+
+A message's segments are left for a reader of that message, such as
+ReadOrder for ORDERS, which reports what is wrong with them as
+SegmentErrors.
+
+A Writer writes an interchange, releasing the delimiters in the data;
+its UNB05 is taken from x12.Controls, kept in the file of
+edifact.controlFile. WriteOrderResponse writes the ORDRSP answering
+an ORDERS, WriteDespatch the DESADV telling of a shipment and
+WriteContrl the CONTRL acknowledging an interchange, which ReadContrl
+reads when a partner sends one.
+*/
+package edifact
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Envelope levels of an EnvelopeError.
+const (
+	LevelInterchange = "interchange"
+	LevelGroup       = "group"
+	LevelMessage     = "message"
+)
+
+// Delimiters separate an interchange's segments, their elements and
+// the components of a composite element. Release escapes any of them
+// in the data.
+type Delimiters struct {
+	Component  byte
+	Element    byte
+	Decimal    byte
+	Release    byte // ' ' if there is none
+	Repetition byte // ' ' before version 4
+	Segment    byte
+}
+
+// DefaultDelimiters are the delimiters of syntax version, "3" or "4",
+// when there is no UNA.
+func DefaultDelimiters(version string) Delimiters {
+	d := Delimiters{Component: ':', Element: '+', Decimal: '.', Release: '?', Repetition: ' ', Segment: '\''}
+	if version >= "4" {
+		d.Repetition = '*'
+	}
+	return d
+}
+
+// released reports whether c is the release character; a UNA with a
+// space for it has none.
+func (d Delimiters) released(c byte) bool {
+	return c == d.Release && c != ' '
+}
+
+// Segment is one segment: its tag and elements, each a list of
+// components, Elements[0] being the first element after the tag.
+type Segment struct {
+	Tag      string
+	Elements [][]string
+	// Pos is the segment's position in its message, UNH being 1, or
+	// in the interchange for service segments, UNB being 1.
+	Pos int
+}
+
+// E returns the first component of element n, counting from 1 as the
+// standard does, or "" if the segment does not have it.
+func (s Segment) E(n int) string {
+	return s.C(n, 1)
+}
+
+// C returns component m of element n, both counting from 1, or "" if
+// the segment does not have it.
+func (s Segment) C(n int, m int) string {
+	if n < 1 || n > len(s.Elements) || m < 1 || m > len(s.Elements[n-1]) {
+		return ""
+	}
+	return s.Elements[n-1][m-1]
+}
+
+// Interchange is a UNB/UNZ envelope.
+type Interchange struct {
+	Delims       Delimiters
+	Syntax       string // UNB01:1, such as UNOC
+	Version      string // UNB01:2, 3 or 4
+	Sender       string // UNB02:1
+	SenderQual   string // UNB02:2
+	Receiver     string // UNB03:1
+	ReceiverQual string // UNB03:2
+	Date         time.Time
+	Control      string // UNB05
+	AckRequested bool   // UNB09, asking for a CONTRL
+	Test         bool   // UNB11
+	// Groups are the UNG/UNE groups, if the interchange has them.
+	Groups []*Group
+	// Messages are all its messages, in groups or not.
+	Messages []*Message
+}
+
+// Group is a UNG/UNE functional group.
+type Group struct {
+	Type     string // UNG01, the type of its messages
+	Sender   string // UNG02:1
+	Receiver string // UNG03:1
+	Ref      string // UNG05
+	Messages []*Message
+}
+
+// Message is a UNH/UNT message.
+type Message struct {
+	Ref     string // UNH01
+	Type    string // UNH02:1, such as ORDERS
+	Version string // UNH02:2, such as D
+	Release string // UNH02:3, such as 96A
+	Agency  string // UNH02:4, UN
+	Group   *Group // nil if the interchange has no groups
+	// Segments are those between UNH and UNT.
+	Segments []Segment
+}
+
+// EnvelopeError is an interchange whose envelopes are wrong.
+type EnvelopeError struct {
+	Level   string // LevelInterchange, LevelGroup or LevelMessage
+	Ref     string // the reference of the envelope at fault, if known
+	Pos     int    // the segment, counting from UNB; 0 if none
+	Segment string // its tag
+	// Code is the syntax error code, 0085, a CONTRL reports it with.
+	Code string
+	Msg  string
+}
+
+func (e *EnvelopeError) Error() string {
+	where := e.Level
+	if e.Ref != "" {
+		where += " " + e.Ref
+	}
+	if e.Pos > 0 {
+		where += fmt.Sprintf(", segment %d (%s)", e.Pos, e.Segment)
+	}
+	return fmt.Sprintf("edifact: %s: %s", where, e.Msg)
+}
+
+// SegmentError is a segment of a message in error.
+type SegmentError struct {
+	Message string // the message's reference
+	Pos     int    // the segment's position in the message, UNH being 1
+	Segment string
+	// Code is the syntax error code, 0085.
+	Code string
+	// Element and Component are the data element in error, counting
+	// from 1; Element is 0 if it is the segment as a whole.
+	Element   int
+	Component int
+	Msg       string
+}
+
+func (e *SegmentError) Error() string {
+	if e.Element > 0 {
+		return fmt.Sprintf("edifact: message %s, segment %d (%s%02d): %s", e.Message, e.Pos, e.Segment, e.Element, e.Msg)
+	}
+	return fmt.Sprintf("edifact: message %s, segment %d (%s): %s", e.Message, e.Pos, e.Segment, e.Msg)
+}
+
+// SegmentErrors are all the errors found in a message.
+type SegmentErrors []*SegmentError
+
+func (es SegmentErrors) Error() string {
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Syntax error codes, 0085, as used here.
+const (
+	codeVersion = "2"  // syntax version or level not supported
+	codeValue   = "12" // invalid value
+	codeMissing = "13" // missing
+	codeTag     = "22" // invalid service segment tag
+	codeRefs    = "28" // references do not match
+	codeCount   = "29" // control count does not match
+	codeMixed   = "30" // functional groups and messages mixed
+	codeOutside = "33" // invalid occurrence outside message or group
+	codeType    = "37" // invalid type of characters
+)
+
+// Parse reads the interchange in b, checking its envelopes. With an
+// *EnvelopeError it returns as much of the interchange as it read, the
+// group or message in error last, so that it can be acknowledged; the
+// interchange is nil if its UNB could not be read.
+func Parse(b []byte) (*Interchange, error) {
+	b = bytes.TrimLeft(b, " \t\r\n")
+	d := DefaultDelimiters("3")
+	una := false
+	if bytes.HasPrefix(b, []byte("UNA")) {
+		if len(b) < 9 {
+			return nil, &EnvelopeError{Level: LevelInterchange, Segment: "UNA", Code: codeTag, Msg: "UNA is cut short"}
+		}
+		d = Delimiters{Component: b[3], Element: b[4], Decimal: b[5], Release: b[6], Repetition: b[7], Segment: b[8]}
+		una = true
+		b = b[9:]
+	}
+	raws, rest := splitSegments(b, d)
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return nil, &EnvelopeError{Level: LevelInterchange, Code: codeTag, Msg: "last segment has no terminator"}
+	}
+	if len(raws) == 0 || !strings.HasPrefix(raws[0], "UNB") {
+		return nil, &EnvelopeError{Level: LevelInterchange, Code: codeTag, Msg: "does not start with UNA or UNB"}
+	}
+	unb := split(raws[0], d, 1)
+	ic := &Interchange{
+		Syntax:       unb.C(1, 1),
+		Version:      unb.C(1, 2),
+		Sender:       unb.C(2, 1),
+		SenderQual:   unb.C(2, 2),
+		Receiver:     unb.C(3, 1),
+		ReceiverQual: unb.C(3, 2),
+		Control:      unb.E(5),
+		AckRequested: unb.E(9) == "1",
+		Test:         unb.E(11) == "1",
+	}
+	if ic.Version != "3" && ic.Version != "4" && ic.Version != "1" && ic.Version != "2" {
+		return nil, &EnvelopeError{Level: LevelInterchange, Pos: 1, Segment: "UNB", Code: codeVersion, Msg: fmt.Sprintf("syntax version %q is not 1 to 4", ic.Version)}
+	}
+	if ic.Control == "" {
+		return nil, &EnvelopeError{Level: LevelInterchange, Pos: 1, Segment: "UNB", Code: codeMissing, Msg: "no control reference"}
+	}
+	if !una && ic.Version >= "4" {
+		d.Repetition = '*'
+	}
+	ic.Delims = d
+	bad := func(pos int, seg string, code string, format string, args ...any) error {
+		return &EnvelopeError{Level: LevelInterchange, Ref: ic.Control, Pos: pos, Segment: seg, Code: code, Msg: fmt.Sprintf(format, args...)}
+	}
+	var err error
+	if ic.Date, err = Date(unb.C(4, 1)+unb.C(4, 2), ""); err != nil {
+		return ic, bad(1, "UNB", codeValue, "bad date %s %s", unb.C(4, 1), unb.C(4, 2))
+	}
+	if ic.Sender == "" || ic.Receiver == "" {
+		return ic, bad(1, "UNB", codeMissing, "no sender or recipient")
+	}
+
+	var (
+		g    *Group
+		m    *Message
+		gPos int // where g started
+		mPos int // where m started
+		done bool
+	)
+	for i, raw := range raws[1:] {
+		pos := i + 2
+		s := split(raw, d, pos)
+		if done {
+			return ic, bad(pos, s.Tag, codeOutside, "segment after UNZ")
+		}
+		switch s.Tag {
+		case "UNB", "UNA":
+			return ic, bad(pos, s.Tag, codeTag, "more than one interchange")
+
+		case "UNG":
+			if m != nil {
+				return ic, &EnvelopeError{Level: LevelMessage, Ref: m.Ref, Pos: mPos, Segment: "UNH", Code: codeMissing, Msg: "no UNT before UNG"}
+			}
+			if g != nil {
+				return ic, &EnvelopeError{Level: LevelGroup, Ref: g.Ref, Pos: gPos, Segment: "UNG", Code: codeMissing, Msg: "no UNE before UNG"}
+			}
+			g, gPos = &Group{Type: s.E(1), Sender: s.C(2, 1), Receiver: s.C(3, 1), Ref: s.E(5)}, pos
+			ic.Groups = append(ic.Groups, g)
+			if len(ic.Messages) > 0 && len(ic.Groups) == 1 {
+				return ic, bad(pos, s.Tag, codeMixed, "functional groups and messages mixed")
+			}
+			if g.Ref == "" {
+				return ic, &EnvelopeError{Level: LevelGroup, Pos: pos, Segment: s.Tag, Code: codeMissing, Msg: "no group reference"}
+			}
+
+		case "UNE":
+			if g == nil {
+				return ic, bad(pos, s.Tag, codeOutside, "UNE outside a functional group")
+			}
+			if m != nil {
+				return ic, &EnvelopeError{Level: LevelMessage, Ref: m.Ref, Pos: mPos, Segment: "UNH", Code: codeMissing, Msg: "no UNT before UNE"}
+			}
+			if s.E(2) != g.Ref {
+				return ic, &EnvelopeError{Level: LevelGroup, Ref: g.Ref, Pos: pos, Segment: s.Tag, Code: codeRefs, Msg: fmt.Sprintf("UNE02 %s is not UNG05 %s", s.E(2), g.Ref)}
+			}
+			if n, err := strconv.Atoi(s.E(1)); err != nil || n != len(g.Messages) {
+				return ic, &EnvelopeError{Level: LevelGroup, Ref: g.Ref, Pos: pos, Segment: s.Tag, Code: codeCount, Msg: fmt.Sprintf("UNE01 counts %s messages, the group has %d", s.E(1), len(g.Messages))}
+			}
+			g = nil
+
+		case "UNH":
+			if m != nil {
+				return ic, &EnvelopeError{Level: LevelMessage, Ref: m.Ref, Pos: mPos, Segment: "UNH", Code: codeMissing, Msg: "no UNT before UNH"}
+			}
+			if len(ic.Groups) > 0 && g == nil {
+				return ic, bad(pos, s.Tag, codeMixed, "message outside a functional group")
+			}
+			m, mPos = &Message{
+				Ref:     s.E(1),
+				Type:    s.C(2, 1),
+				Version: s.C(2, 2),
+				Release: s.C(2, 3),
+				Agency:  s.C(2, 4),
+				Group:   g,
+			}, pos
+			ic.Messages = append(ic.Messages, m)
+			if g != nil {
+				g.Messages = append(g.Messages, m)
+			}
+			if m.Ref == "" || m.Type == "" {
+				return ic, &EnvelopeError{Level: LevelMessage, Ref: m.Ref, Pos: pos, Segment: s.Tag, Code: codeMissing, Msg: "no message reference or type"}
+			}
+
+		case "UNT":
+			if m == nil {
+				return ic, bad(pos, s.Tag, codeOutside, "UNT outside a message")
+			}
+			if s.E(2) != m.Ref {
+				return ic, &EnvelopeError{Level: LevelMessage, Ref: m.Ref, Pos: pos, Segment: s.Tag, Code: codeRefs, Msg: fmt.Sprintf("UNT02 %s is not UNH01 %s", s.E(2), m.Ref)}
+			}
+			// UNT01 counts UNH and UNT too.
+			if n, err := strconv.Atoi(s.E(1)); err != nil || n != len(m.Segments)+2 {
+				return ic, &EnvelopeError{Level: LevelMessage, Ref: m.Ref, Pos: pos, Segment: s.Tag, Code: codeCount, Msg: fmt.Sprintf("UNT01 counts %s segments, the message has %d", s.E(1), len(m.Segments)+2)}
+			}
+			m = nil
+
+		case "UNZ":
+			if m != nil {
+				return ic, &EnvelopeError{Level: LevelMessage, Ref: m.Ref, Pos: mPos, Segment: "UNH", Code: codeMissing, Msg: "no UNT before UNZ"}
+			}
+			if g != nil {
+				return ic, &EnvelopeError{Level: LevelGroup, Ref: g.Ref, Pos: gPos, Segment: "UNG", Code: codeMissing, Msg: "no UNE before UNZ"}
+			}
+			if s.E(2) != ic.Control {
+				return ic, bad(pos, s.Tag, codeRefs, "UNZ02 %s is not UNB05 %s", s.E(2), ic.Control)
+			}
+			// UNZ01 counts the groups, or the messages if there are none.
+			count, what := len(ic.Messages), "messages"
+			if len(ic.Groups) > 0 {
+				count, what = len(ic.Groups), "groups"
+			}
+			if n, err := strconv.Atoi(s.E(1)); err != nil || n != count {
+				return ic, bad(pos, s.Tag, codeCount, "UNZ01 counts %s, the interchange has %d %s", s.E(1), count, what)
+			}
+			done = true
+
+		default:
+			if m == nil {
+				return ic, bad(pos, s.Tag, codeOutside, "segment outside a message")
+			}
+			s.Pos = len(m.Segments) + 2
+			m.Segments = append(m.Segments, s)
+		}
+	}
+	if !done {
+		return ic, bad(0, "", codeMissing, "ends without UNZ")
+	}
+	return ic, nil
+}
+
+// splitSegments splits b at the segment terminators that are not
+// released, dropping the line breaks between segments. rest is what
+// follows the last terminator.
+func splitSegments(b []byte, d Delimiters) (segs []string, rest []byte) {
+	start := 0
+	for i := 0; i < len(b); i++ {
+		switch {
+		case d.released(b[i]):
+			i++
+		case b[i] == d.Segment:
+			seg := bytes.TrimLeft(b[start:i], " \t\r\n")
+			if len(seg) > 0 {
+				segs = append(segs, string(seg))
+			}
+			start = i + 1
+		}
+	}
+	return segs, b[start:]
+}
+
+// split splits a segment into its tag and elements, and the elements
+// into components, taking out the release characters.
+func split(raw string, d Delimiters, pos int) Segment {
+	var (
+		els  [][]string
+		comp []string
+		cur  []byte
+	)
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		switch {
+		case d.released(c) && i+1 < len(raw):
+			i++
+			cur = append(cur, raw[i])
+		case c == d.Element:
+			els = append(els, append(comp, string(cur)))
+			comp, cur = nil, nil
+		case c == d.Component:
+			comp = append(comp, string(cur))
+			cur = nil
+		default:
+			cur = append(cur, c)
+		}
+	}
+	els = append(els, append(comp, string(cur)))
+	tag := strings.TrimSpace(els[0][0])
+	return Segment{Tag: tag, Elements: els[1:], Pos: pos}
+}
+
+// Date reads an EDIFACT date and optional time run together: CCYYMMDD
+// or YYMMDD, then HHMM with optional seconds. format is the DTM format
+// code, 2379, "" for UNB's: 101 YYMMDD, 102 CCYYMMDD, 203 CCYYMMDDHHMM
+// and 204 CCYYMMDDHHMMSS.
+func Date(value string, format string) (time.Time, error) {
+	layouts := map[string]string{
+		"101": "060102",
+		"102": "20060102",
+		"203": "200601021504",
+		"204": "20060102150405",
+	}
+	if format != "" {
+		layout, ok := layouts[format]
+		if !ok {
+			return time.Time{}, fmt.Errorf("date format %s is not known", format)
+		}
+		return time.Parse(layout, value)
+	}
+	for _, layout := range []string{"0601021504", "200601021504", "060102", "20060102"} {
+		if len(value) == len(layout) {
+			return time.Parse(layout, value)
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad date %q", value)
+}
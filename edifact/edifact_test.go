@@ -0,0 +1,240 @@
+package edifact
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testOrder is an interchange of one ORDERS, written with the default
+// delimiters for the test's to replace.
+const testOrder = `UNB+UNOC:3+ACME:ZZ+BASEEDI:ZZ+240102:1230+101'
+UNH+1+ORDERS:D:96A:UN'
+BGM+220+PO123+9'
+DTM+137:20240102:102'
+RFF+CT:C-9'
+NAD+SU+V1::92++Widget Co+1 Main St+Houston+TX+77001+US'
+LIN+1++ABC-1:BP'
+QTY+21:10:EA'
+UNS+S'
+CNT+2:1'
+UNT+10+1'
+UNZ+1+101'
+`
+
+// testGrouped is testOrder with its message in a functional group.
+var testGrouped = strings.NewReplacer(
+	"UNH+1+", "UNG+ORDERS+ACME+BASEEDI+240102:1230+7+UN+D:96A'\nUNH+1+",
+	"UNZ+1+101'", "UNE+1+7'\nUNZ+1+101'",
+).Replace(testOrder)
+
+// testInterchange is body in delimiters d, with a UNA if una.
+func testInterchange(d Delimiters, una bool, body string) []byte {
+	body = strings.NewReplacer(
+		":", string(d.Component),
+		"+", string(d.Element),
+		"?", string(d.Release),
+		"'", string(d.Segment),
+	).Replace(body)
+	if !una {
+		return []byte(body)
+	}
+	return []byte("UNA" + string([]byte{d.Component, d.Element, d.Decimal, d.Release, d.Repetition, d.Segment}) + "\n" + body)
+}
+
+func TestParseDelimiters(t *testing.T) {
+	tests := []struct {
+		name    string
+		d       Delimiters
+		una     bool
+		version string
+		crlf    bool
+	}{
+		{"no UNA", DefaultDelimiters("3"), false, "3", false},
+		{"no UNA, version 4", DefaultDelimiters("4"), false, "4", false},
+		{"UNA of the defaults", DefaultDelimiters("3"), true, "3", false},
+		{"UNA of others", Delimiters{Component: '>', Element: '|', Decimal: ',', Release: '\\', Repetition: ' ', Segment: '~'}, true, "3", false},
+		{"UNA without a release character", Delimiters{Component: ':', Element: '+', Decimal: '.', Release: ' ', Repetition: ' ', Segment: '\''}, true, "3", false},
+		{"CRLF after segments", DefaultDelimiters("3"), false, "3", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testInterchange(tt.d, tt.una, strings.Replace(testOrder, "UNOC:3", "UNOC:"+tt.version, 1))
+			if tt.crlf {
+				b = []byte(strings.ReplaceAll(string(b), "\n", "\r\n"))
+			}
+			ic, err := Parse(b)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if ic.Delims != tt.d {
+				t.Errorf("delimiters %q, want %q", ic.Delims, tt.d)
+			}
+			if ic.Sender != "ACME" || ic.SenderQual != "ZZ" || ic.Control != "101" || ic.Version != tt.version {
+				t.Errorf("UNB read as sender %s:%s, control %s, version %s", ic.Sender, ic.SenderQual, ic.Control, ic.Version)
+			}
+			if !ic.Date.Equal(time.Date(2024, 1, 2, 12, 30, 0, 0, time.UTC)) {
+				t.Errorf("date %v", ic.Date)
+			}
+			if len(ic.Messages) != 1 {
+				t.Fatalf("%d messages, want 1", len(ic.Messages))
+			}
+			m := ic.Messages[0]
+			if m.Type != "ORDERS" || m.Version != "D" || m.Release != "96A" || len(m.Segments) != 8 ||
+				m.Segments[0].Tag != "BGM" || m.Segments[0].Pos != 2 {
+				t.Errorf("message %s %s %s has %d segments, the first %s at %d",
+					m.Type, m.Version, m.Release, len(m.Segments), m.Segments[0].Tag, m.Segments[0].Pos)
+			}
+		})
+	}
+}
+
+func TestParseRelease(t *testing.T) {
+	tests := []struct {
+		name string
+		d    Delimiters
+		una  bool
+		nad  string
+		want []string // NAD04 and NAD05
+	}{
+		{"released delimiters", DefaultDelimiters("3"), false,
+			"NAD+SU+V1::92++Widget?+Co?'s ?:Best+1 Main St??'", []string{"Widget+Co's :Best", "1 Main St?"}},
+		{"space for release", Delimiters{Component: ':', Element: '+', Decimal: '.', Release: ' ', Repetition: ' ', Segment: '\''}, true,
+			"NAD+SU+V1::92++Widget ?Co+1  Main St'", []string{"Widget ?Co", "1  Main St"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := strings.Replace(testOrder, "NAD+SU+V1::92++Widget Co+1 Main St+Houston+TX+77001+US'", tt.nad, 1)
+			var b []byte
+			if tt.una {
+				b = []byte("UNA" + string([]byte{tt.d.Component, tt.d.Element, tt.d.Decimal, tt.d.Release, tt.d.Repetition, tt.d.Segment}) + body)
+			} else {
+				b = []byte(body)
+			}
+			ic, err := Parse(b)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			nad := ic.Messages[0].Segments[3]
+			if nad.Tag != "NAD" || nad.E(4) != tt.want[0] || nad.E(5) != tt.want[1] {
+				t.Errorf("%s read as %q", nad.Tag, nad.Elements)
+			}
+		})
+	}
+}
+
+func TestParseEnvelopeErrors(t *testing.T) {
+	d := DefaultDelimiters("3")
+	tests := []struct {
+		name  string
+		b     string
+		level string
+		code  string
+		// partial is whether the interchange read so far comes back.
+		partial bool
+	}{
+		{"no UNB", "UNH+1+ORDERS:D:96A:UN'", LevelInterchange, codeTag, false},
+		{"UNA cut short", "UNA:+", LevelInterchange, codeTag, false},
+		{"no terminator", strings.TrimSuffix(testOrder, "'\n"), LevelInterchange, codeTag, false},
+		{"syntax version", strings.Replace(testOrder, "UNOC:3", "UNOC:5", 1), LevelInterchange, codeVersion, false},
+		{"no control reference", strings.Replace(testOrder, "1230+101'", "1230'", 1), LevelInterchange, codeMissing, false},
+		{"bad date", strings.Replace(testOrder, "240102:1230", "241302:1230", 1), LevelInterchange, codeValue, true},
+		{"second UNB", strings.Replace(testOrder, "UNZ+", "UNB+UNOC:3'\nUNZ+", 1), LevelInterchange, codeTag, true},
+		{"segment after UNZ", testOrder + "UNH+2+ORDERS:D:96A:UN'", LevelInterchange, codeOutside, true},
+		{"segment outside a message", strings.Replace(testOrder, "UNT+10+1'", "UNT+10+1'\nFTX+AAI'", 1), LevelInterchange, codeOutside, true},
+		{"UNZ reference", strings.Replace(testOrder, "UNZ+1+101", "UNZ+1+102", 1), LevelInterchange, codeRefs, true},
+		{"UNZ count", strings.Replace(testOrder, "UNZ+1+101", "UNZ+2+101", 1), LevelInterchange, codeCount, true},
+		{"no UNZ", strings.Replace(testOrder, "UNZ+1+101'\n", "", 1), LevelInterchange, codeMissing, true},
+		{"UNT reference", strings.Replace(testOrder, "UNT+10+1", "UNT+10+2", 1), LevelMessage, codeRefs, true},
+		{"UNT count", strings.Replace(testOrder, "UNT+10+1", "UNT+9+1", 1), LevelMessage, codeCount, true},
+		{"no UNT", strings.Replace(testOrder, "UNT+10+1'\n", "", 1), LevelMessage, codeMissing, true},
+		{"no message reference", strings.Replace(testOrder, "UNH+1+", "UNH++", 1), LevelMessage, codeMissing, true},
+		{"UNE reference", strings.Replace(testGrouped, "UNE+1+7", "UNE+1+8", 1), LevelGroup, codeRefs, true},
+		{"UNE count", strings.Replace(testGrouped, "UNE+1+7", "UNE+2+7", 1), LevelGroup, codeCount, true},
+		{"no UNE", strings.Replace(testGrouped, "UNE+1+7'\n", "", 1), LevelGroup, codeMissing, true},
+		{"groups and messages mixed", strings.Replace(testGrouped, "UNG+", "UNH+0+ORDERS:D:96A:UN'\nUNT+2+0'\nUNG+", 1), LevelInterchange, codeMixed, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ic, err := Parse(testInterchange(d, false, tt.b))
+			var env *EnvelopeError
+			if !errors.As(err, &env) {
+				t.Fatalf("Parse returned %v, want an *EnvelopeError", err)
+			}
+			if env.Level != tt.level || env.Code != tt.code {
+				t.Errorf("level %s code %s, want %s %s: %v", env.Level, env.Code, tt.level, tt.code, err)
+			}
+			if (ic != nil) != tt.partial {
+				t.Errorf("interchange returned: %v, want %v", ic != nil, tt.partial)
+			}
+		})
+	}
+}
+
+func TestContrlRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		status   string
+		messages map[string]string
+	}{
+		{"accepted", testOrder, Accepted, map[string]string{"1": ActionAcknowledged}},
+		{"message rejected", strings.Replace(testOrder, "UNT+10+1", "UNT+9+1", 1), Rejected, map[string]string{"1": ActionRejected}},
+		{"interchange rejected", strings.Replace(testOrder, "UNZ+1+101", "UNZ+2+101", 1), Rejected, map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ic, err := Parse([]byte(tt.body))
+			a := NewAck(ic, err)
+			w := NewWriter(Envelope{
+				Syntax: "UNOC", Version: "3", SenderQual: "ZZ", Sender: "BASEEDI", ReceiverQual: "ZZ", Receiver: "ACME",
+				Control: 5, Date: time.Date(2024, 1, 2, 12, 30, 0, 0, time.UTC),
+			}, DefaultDelimiters("3"), true)
+			WriteContrl(w, a)
+			out, err := Parse(w.Bytes())
+			if err != nil {
+				t.Fatalf("the CONTRL does not parse: %v", err)
+			}
+			r, err := ReadContrl(out.Messages[0])
+			if err != nil {
+				t.Fatalf("ReadContrl: %v", err)
+			}
+			if r.Control != "101" || r.Status != tt.status {
+				t.Errorf("UCI %s, status %s; want 101, %s", r.Control, r.Status, tt.status)
+			}
+			if len(r.Messages) != len(tt.messages) {
+				t.Errorf("UCMs %v, want %v", r.Messages, tt.messages)
+			}
+			for ref, action := range tt.messages {
+				if r.Messages[ref] != action {
+					t.Errorf("message %s: %q, want %q", ref, r.Messages[ref], action)
+				}
+			}
+		})
+	}
+}
+
+func TestDate(t *testing.T) {
+	tests := []struct {
+		value, format string
+		want          time.Time
+		err           bool
+	}{
+		{"240102", "", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), false},
+		{"2401021230", "", time.Date(2024, 1, 2, 12, 30, 0, 0, time.UTC), false},
+		{"202401021230", "", time.Date(2024, 1, 2, 12, 30, 0, 0, time.UTC), false},
+		{"20240102", "102", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), false},
+		{"240102", "101", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), false},
+		{"20240102123045", "204", time.Date(2024, 1, 2, 12, 30, 45, 0, time.UTC), false},
+		{"20240102", "101", time.Time{}, true},
+		{"20240102", "718", time.Time{}, true},
+		{"2024010", "", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := Date(tt.value, tt.format)
+		if (err != nil) != tt.err || !got.Equal(tt.want) {
+			t.Errorf("Date(%q, %q) = %v, %v; want %v, error %v", tt.value, tt.format, got, err, tt.want, tt.err)
+		}
+	}
+}
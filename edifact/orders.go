@@ -0,0 +1,329 @@
+package edifact
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Order is an ORDERS purchase order.
+type Order struct {
+	Ref string // the message's reference
+	// Function is BGM03, 1225: 9 original, 1 cancellation, 4 change,
+	// 5 replace, 6 confirmation, 7 duplicate.
+	Function string
+	Type     string // BGM01, 1001: 220 order, 221 blanket order and so on
+	Number   string // BGM02
+	Date     time.Time
+	Currency string            // CUX01:2
+	Refs     map[string]string // RFF by qualifier, such as CT contract and AEP project
+	// Dates are the DTM dates by qualifier, such as 2 delivery
+	// requested.
+	Dates    map[string]time.Time
+	Terms    string // TOD03:1, the Incoterms code
+	Location string // the LOC+1 after the TOD
+	// Description is the FTX+PUR text, describing the order as a whole.
+	Description string
+	Notes       []string // the other FTX texts
+	Parties     []Party
+	Lines       []Line
+	Count       int // CNT+2, the line items counted; 0 if not sent
+}
+
+// Party is a NAD group: who a party to the order is and where.
+type Party struct {
+	Code    string // NAD01, 3035: BY buyer, SU supplier, ST ship to, DP delivery party
+	ID      string // NAD02:1
+	Name    string
+	Address []string
+	City    string
+	State   string
+	Postal  string
+	Country string
+	Contact string // CTA02:2
+	Phone   string // the COM number qualified TE
+	Email   string // the COM number qualified EM
+}
+
+// Line is a LIN group, one line item.
+type Line struct {
+	Number string // LIN01
+	Qty    string // QTY+21
+	UOM    string
+	Price  string // PRI+AAA, or PRI+AAB if there is none
+	// IDs are the product IDs by item type, 7143: BP buyer's part, SA
+	// supplier's article, IN buyer's item, EN EAN and so on, from LIN03
+	// and the PIAs.
+	IDs          map[string]string
+	Descriptions []string // IMD free-form descriptions in turn
+	Dates        map[string]time.Time
+	Refs         map[string]string
+	Notes        []string
+}
+
+// The segments of each group after the one starting it.
+var (
+	nadGroup = []string{"LOC", "FII", "RFF", "DTM", "DOC", "CTA", "COM"}
+	todGroup = []string{"LOC"}
+)
+
+// ReadOrder reads the ORDERS in m.
+func ReadOrder(m *Message) (*Order, error) {
+	o := &Order{Ref: m.Ref, Refs: make(map[string]string), Dates: make(map[string]time.Time)}
+	var errs SegmentErrors
+	bad := func(s Segment, code string, element int, component int, format string, args ...any) {
+		errs = append(errs, &SegmentError{
+			Message:   m.Ref,
+			Pos:       s.Pos,
+			Segment:   s.Tag,
+			Code:      code,
+			Element:   element,
+			Component: component,
+			Msg:       fmt.Sprintf(format, args...),
+		})
+	}
+	// date reads a DTM's date, qualifier, value and format.
+	date := func(s Segment) (string, time.Time) {
+		d, err := Date(s.C(1, 2), s.C(1, 3))
+		if err != nil {
+			bad(s, codeValue, 1, 2, "bad date %q", s.C(1, 2))
+		}
+		return s.C(1, 1), d
+	}
+	// number reads a quantity or amount, either decimal mark allowed.
+	number := func(s Segment, element int, component int) string {
+		v := strings.Replace(s.C(element, component), ",", ".", 1)
+		if v == "" {
+			return v
+		}
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			bad(s, codeType, element, component, "%q is not a number", v)
+		}
+		return v
+	}
+
+	if m.Type != "ORDERS" {
+		return nil, SegmentErrors{{Message: m.Ref, Pos: 1, Segment: "UNH", Code: codeValue, Element: 2, Msg: "not an ORDERS"}}
+	}
+	segs := m.Segments
+	var bgm, cnt *Segment
+	for i := 0; i < len(segs); i++ {
+		s := segs[i]
+		switch s.Tag {
+		case "BGM":
+			if bgm != nil {
+				bad(s, codeOutside, 0, 0, "more than one BGM")
+				continue
+			}
+			bgm = &segs[i]
+			o.Type, o.Number, o.Function = s.C(1, 1), s.C(2, 1), s.E(3)
+			if o.Number == "" {
+				bad(s, codeMissing, 2, 1, "no order number")
+			}
+		case "DTM":
+			q, d := date(s)
+			if q == "137" {
+				o.Date = d
+			} else {
+				o.Dates[q] = d
+			}
+		case "CUX":
+			o.Currency = s.C(1, 2)
+		case "RFF":
+			o.Refs[s.C(1, 1)] = s.C(1, 2)
+		case "FTX":
+			if s.E(1) == "PUR" && o.Description == "" {
+				o.Description = text(s)
+			} else {
+				o.Notes = append(o.Notes, text(s))
+			}
+		case "NAD":
+			group := Loop(segs[i:], nadGroup)
+			o.Parties = append(o.Parties, party(group))
+			i += len(group) - 1
+		case "TOD":
+			group := Loop(segs[i:], todGroup)
+			o.Terms = s.C(3, 1)
+			for _, s := range group[1:] {
+				if s.E(1) == "1" {
+					o.Location = place(s)
+				}
+			}
+			i += len(group) - 1
+		case "LIN":
+			group := lineGroup(segs[i:])
+			l := Line{
+				Number: s.E(1),
+				IDs:    make(map[string]string),
+				Dates:  make(map[string]time.Time),
+				Refs:   make(map[string]string),
+			}
+			if s.C(3, 1) != "" {
+				l.IDs[s.C(3, 2)] = s.C(3, 1)
+			}
+			for _, s := range group[1:] {
+				switch s.Tag {
+				case "PIA":
+					// PIA02 to PIA06 are the IDs, each ID:type.
+					for e := 2; e <= len(s.Elements); e++ {
+						if s.C(e, 1) != "" {
+							l.IDs[s.C(e, 2)] = s.C(e, 1)
+						}
+					}
+				case "IMD":
+					if d := s.C(3, 4) + s.C(3, 5); d != "" {
+						l.Descriptions = append(l.Descriptions, d)
+					}
+				case "QTY":
+					if s.C(1, 1) == "21" {
+						l.Qty, l.UOM = number(s, 1, 2), s.C(1, 3)
+					}
+				case "PRI":
+					if s.C(1, 1) == "AAA" || (s.C(1, 1) == "AAB" && l.Price == "") {
+						l.Price = number(s, 1, 2)
+					}
+				case "DTM":
+					q, d := date(s)
+					l.Dates[q] = d
+				case "RFF":
+					l.Refs[s.C(1, 1)] = s.C(1, 2)
+				case "FTX":
+					l.Notes = append(l.Notes, text(s))
+				}
+			}
+			if l.Qty == "" {
+				bad(s, codeMissing, 0, 0, "line %s has no ordered quantity", l.Number)
+			}
+			o.Lines = append(o.Lines, l)
+			i += len(group) - 1
+		case "CNT":
+			if s.C(1, 1) != "2" {
+				continue
+			}
+			cnt = &segs[i]
+			n, err := strconv.Atoi(s.C(1, 2))
+			if err != nil {
+				bad(s, codeType, 1, 2, "%q is not a count", s.C(1, 2))
+			}
+			o.Count = n
+		}
+	}
+	if bgm == nil {
+		bad(Segment{Tag: "BGM", Pos: 2}, codeMissing, 0, 0, "no BGM")
+	}
+	if len(o.Lines) == 0 {
+		bad(Segment{Tag: "LIN", Pos: len(segs) + 2}, codeMissing, 0, 0, "no line items")
+	}
+	if cnt != nil && o.Count != len(o.Lines) {
+		bad(*cnt, codeValue, 1, 2, "CNT counts %d line items, the order has %d", o.Count, len(o.Lines))
+	}
+	if errs != nil {
+		return o, errs
+	}
+	return o, nil
+}
+
+// party reads a NAD group.
+func party(group []Segment) Party {
+	nad := group[0]
+	p := Party{Code: nad.E(1), ID: nad.C(2, 1)}
+	// NAD04 is the name, NAD03 the name and address unstructured.
+	var name []string
+	for c := 1; c <= 5; c++ {
+		if n := nad.C(4, c); n != "" {
+			name = append(name, n)
+		}
+	}
+	p.Name = strings.Join(name, " ")
+	if p.Name == "" {
+		p.Name = nad.C(3, 1)
+	}
+	for c := 1; c <= 4; c++ {
+		if a := nad.C(5, c); a != "" {
+			p.Address = append(p.Address, a)
+		}
+	}
+	p.City, p.State, p.Postal, p.Country = nad.E(6), nad.C(7, 1), nad.E(8), nad.E(9)
+	for _, s := range group[1:] {
+		switch s.Tag {
+		case "CTA":
+			if p.Contact == "" {
+				p.Contact = s.C(2, 2)
+			}
+		case "COM":
+			switch s.C(1, 2) {
+			case "TE":
+				p.Phone = s.C(1, 1)
+			case "EM":
+				p.Email = s.C(1, 1)
+			}
+		}
+	}
+	return p
+}
+
+// Party returns the first party with one of codes, in the order the
+// codes are given.
+func (o *Order) Party(codes ...string) (Party, bool) {
+	for _, c := range codes {
+		for _, p := range o.Parties {
+			if p.Code == c {
+				return p, true
+			}
+		}
+	}
+	return Party{}, false
+}
+
+// Loop returns the group starting at segs[0]: it and the segments
+// after it whose tags are in members.
+func Loop(segs []Segment, members []string) []Segment {
+	n := 1
+	for n < len(segs) && in(segs[n].Tag, members) {
+		n++
+	}
+	return segs[:n]
+}
+
+// lineGroup returns the LIN group starting at segs[0], which runs to
+// the next LIN or the UNS.
+func lineGroup(segs []Segment) []Segment {
+	n := 1
+	for n < len(segs) && segs[n].Tag != "LIN" && segs[n].Tag != "UNS" {
+		n++
+	}
+	return segs[:n]
+}
+
+// text is an FTX's free text, FTX04, its components one line each
+// and joined with spaces, the empty ones left out.
+func text(s Segment) string {
+	if len(s.Elements) < 4 {
+		return ""
+	}
+	var lines []string
+	for _, c := range s.Elements[3] {
+		if c != "" {
+			lines = append(lines, c)
+		}
+	}
+	return strings.Join(lines, " ")
+}
+
+// place is a LOC's place: its name, LOC02:4, or its code.
+func place(s Segment) string {
+	if s.C(2, 4) != "" {
+		return s.C(2, 4)
+	}
+	return s.C(2, 1)
+}
+
+func in(tag string, tags []string) bool {
+	for _, v := range tags {
+		if v == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,241 @@
+package edifact
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testMessage is an ORDERS of the segments given, written with the
+// default delimiters.
+func testMessage(segs ...string) *Message {
+	m := &Message{Ref: "1", Type: "ORDERS", Version: "D", Release: "96A", Agency: "UN"}
+	d := DefaultDelimiters("3")
+	for _, raw := range segs {
+		m.Segments = append(m.Segments, split(raw, d, len(m.Segments)+2))
+	}
+	return m
+}
+
+func TestReadOrder(t *testing.T) {
+	o, err := ReadOrder(testMessage(
+		"BGM+220+PO123+9",
+		"DTM+137:20240102:102",
+		"DTM+2:20240201:102",
+		"CUX+2:USD:9",
+		"RFF+CT:C-9",
+		"FTX+PUR+++Order of:widgets",
+		"FTX+AAI+++Ring first",
+		"NAD+SU+V1::92++Widget Co+1 Main St:Suite 2+Houston+TX+77001+US",
+		"CTA+IC+:Pat",
+		"COM+555-0100:TE",
+		"NAD+BY+B1::92++Acme",
+		"TOD+6++FCA",
+		"LOC+1+HOU::6:Houston",
+		"LIN+1++ABC-1:BP",
+		"PIA+1+W-1:SA",
+		"IMD+F++:::Widgets",
+		"QTY+21:10:EA",
+		"PRI+AAB:3",
+		"PRI+AAA:2,5",
+		"DTM+2:20240215:102",
+		"LIN+2",
+		"QTY+21:4:LB",
+		"UNS+S",
+		"CNT+2:2",
+	))
+	if err != nil {
+		t.Fatalf("ReadOrder: %v", err)
+	}
+	switch {
+	case o.Number != "PO123" || o.Type != "220" || o.Function != "9":
+		t.Errorf("BGM read as %s %s %s", o.Type, o.Number, o.Function)
+	case !o.Date.Equal(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)) || !o.Dates["2"].Equal(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)):
+		t.Errorf("date %v, dates %v", o.Date, o.Dates)
+	case o.Currency != "USD" || o.Refs["CT"] != "C-9":
+		t.Errorf("currency %s, refs %v", o.Currency, o.Refs)
+	case o.Description != "Order of widgets" || len(o.Notes) != 1 || o.Notes[0] != "Ring first":
+		t.Errorf("description %q, notes %q", o.Description, o.Notes)
+	case o.Terms != "FCA" || o.Location != "Houston":
+		t.Errorf("terms %s at %s", o.Terms, o.Location)
+	case len(o.Parties) != 2:
+		t.Errorf("parties %+v", o.Parties)
+	case len(o.Lines) != 2 || o.Count != 2:
+		t.Fatalf("%d lines, CNT %d", len(o.Lines), o.Count)
+	}
+	if p, ok := o.Party("ST", "SU"); !ok || p.Name != "Widget Co" || p.ID != "V1" || len(p.Address) != 2 ||
+		p.City != "Houston" || p.Postal != "77001" || p.Contact != "Pat" || p.Phone != "555-0100" {
+		t.Errorf("supplier read as %+v", p)
+	}
+	l := o.Lines[0]
+	if l.Qty != "10" || l.UOM != "EA" || l.Price != "2.5" || l.IDs["BP"] != "ABC-1" || l.IDs["SA"] != "W-1" ||
+		len(l.Descriptions) != 1 || l.Descriptions[0] != "Widgets" || !l.Dates["2"].Equal(time.Date(2024, 2, 15, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("line 1 read as %+v", l)
+	}
+	if l := o.Lines[1]; l.Number != "2" || l.Qty != "4" || len(l.IDs) != 0 {
+		t.Errorf("line 2 read as %+v", l)
+	}
+}
+
+func TestReadOrderErrors(t *testing.T) {
+	type want struct {
+		pos       int
+		segment   string
+		code      string
+		element   int
+		component int
+	}
+	tests := []struct {
+		name string
+		m    *Message
+		want []want
+	}{
+		{"no order number", testMessage("BGM+220++9", "LIN+1", "QTY+21:1:EA"),
+			[]want{{2, "BGM", codeMissing, 2, 1}}},
+		{"bad date", testMessage("BGM+220+PO1+9", "DTM+137:2024013:102", "LIN+1", "QTY+21:1:EA"),
+			[]want{{3, "DTM", codeValue, 1, 2}}},
+		{"date format not known", testMessage("BGM+220+PO1+9", "DTM+137:20240102:718", "LIN+1", "QTY+21:1:EA"),
+			[]want{{3, "DTM", codeValue, 1, 2}}},
+		{"quantity not a number", testMessage("BGM+220+PO1+9", "LIN+1", "QTY+21:ten:EA"),
+			[]want{{4, "QTY", codeType, 1, 2}}},
+		{"price not a number", testMessage("BGM+220+PO1+9", "LIN+1", "QTY+21:1:EA", "PRI+AAA:1.2.3"),
+			[]want{{5, "PRI", codeType, 1, 2}}},
+		{"no quantity", testMessage("BGM+220+PO1+9", "LIN+1", "QTY+12:1:EA"),
+			[]want{{3, "LIN", codeMissing, 0, 0}}},
+		{"two BGMs", testMessage("BGM+220+PO1+9", "BGM+220+PO2+9", "LIN+1", "QTY+21:1:EA"),
+			[]want{{3, "BGM", codeOutside, 0, 0}}},
+		{"CNT count", testMessage("BGM+220+PO1+9", "LIN+1", "QTY+21:1:EA", "UNS+S", "CNT+2:2"),
+			[]want{{6, "CNT", codeValue, 1, 2}}},
+		{"CNT not a count", testMessage("BGM+220+PO1+9", "LIN+1", "QTY+21:1:EA", "UNS+S", "CNT+2:x"),
+			[]want{{6, "CNT", codeType, 1, 2}, {6, "CNT", codeValue, 1, 2}}},
+		{"no BGM", testMessage("LIN+1", "QTY+21:1:EA"),
+			[]want{{2, "BGM", codeMissing, 0, 0}}},
+		{"no lines", testMessage("BGM+220+PO1+9", "DTM+137:20240102:102"),
+			[]want{{4, "LIN", codeMissing, 0, 0}}},
+		{"every error", testMessage("BGM+220++9", "DTM+137:x:102", "LIN+1", "QTY+21:x:EA"),
+			[]want{{2, "BGM", codeMissing, 2, 1}, {3, "DTM", codeValue, 1, 2}, {5, "QTY", codeType, 1, 2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadOrder(tt.m)
+			var errs SegmentErrors
+			if !errors.As(err, &errs) {
+				t.Fatalf("ReadOrder returned %v, want SegmentErrors", err)
+			}
+			if len(errs) != len(tt.want) {
+				t.Fatalf("%d errors, want %d: %v", len(errs), len(tt.want), err)
+			}
+			for i, w := range tt.want {
+				e := errs[i]
+				got := want{e.Pos, e.Segment, e.Code, e.Element, e.Component}
+				if got != w || e.Message != "1" {
+					t.Errorf("error %d is %+v in message %s, want %+v", i, got, e.Message, w)
+				}
+			}
+		})
+	}
+}
+
+func TestReadOrderNotOrders(t *testing.T) {
+	m := testMessage("BGM+220+PO1+9", "LIN+1", "QTY+21:1:EA")
+	m.Type = "ORDCHG"
+	if o, err := ReadOrder(m); o != nil || err == nil {
+		t.Errorf("ReadOrder of an ORDCHG = %v, %v", o, err)
+	}
+}
+
+func TestOrderResponseRoundTrip(t *testing.T) {
+	m := testMessage(
+		"BGM+220+PO123+9",
+		"DTM+137:20240102:102",
+		"RFF+CT:C-9",
+		"CUX+2:USD:9",
+		"LIN+1++W-1:SA",
+		"PIA+1+ABC-1:BP",
+		"QTY+21:10:EA",
+		"DTM+2:20240201:102",
+		"LIN+2",
+		"QTY+21:4:LB",
+		"UNS+S",
+		"CNT+2:2",
+	)
+	o, err := ReadOrder(m)
+	if err != nil {
+		t.Fatalf("ReadOrder: %v", err)
+	}
+	noRelease := Delimiters{Component: ':', Element: '+', Decimal: '.', Release: ' ', Repetition: ' ', Segment: '\''}
+	tests := []struct {
+		name   string
+		d      Delimiters
+		r      OrderResponse
+		want   string // the message read back
+		lines  int
+		action string
+		qty    string
+	}{
+		{"accepted", DefaultDelimiters("3"), OrderResponse{Type: ResponseAccepted, Message: "Order taken"},
+			"Order taken", 2, ItemAccepted, "10"},
+		{"rejected", DefaultDelimiters("3"), OrderResponse{Type: ResponseRejected, Message: "Contract+C-9's ?closed:\nsorry"},
+			"Contract+C-9's ?closed: sorry", 2, ItemNotAccepted, "0"},
+		{"no release character", noRelease, OrderResponse{Type: ResponseRejected, Message: "Contract+C-9's ?closed:"},
+			"Contract C-9 s ?closed ", 2, ItemNotAccepted, "0"},
+		{"acknowledged", DefaultDelimiters("3"), OrderResponse{Type: ResponseAcknowledged, Message: strings.Repeat("x", 6*ftxLen)},
+			strings.Repeat("x", 6*ftxLen), 0, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.r.Date = time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)
+			w := NewWriter(Envelope{
+				Syntax: "UNOC", Version: "3", SenderQual: "ZZ", Sender: "BASEEDI", ReceiverQual: "ZZ", Receiver: "ACME",
+				Control: 12, Date: time.Date(2024, 1, 3, 9, 0, 0, 0, time.UTC),
+			}, tt.d, false)
+			WriteOrderResponse(w, o, m, tt.r)
+			ic, err := Parse(w.Bytes())
+			if err != nil {
+				t.Fatalf("the ORDRSP does not parse: %v", err)
+			}
+			if ic.Receiver != "ACME" || ic.Control != "12" || ic.Delims != tt.d || len(ic.Messages) != 1 {
+				t.Fatalf("interchange to %s, control %s, delimiters %q, %d messages", ic.Receiver, ic.Control, ic.Delims, len(ic.Messages))
+			}
+			rsp := ic.Messages[0]
+			if rsp.Type != "ORDRSP" || rsp.Version != "D" || rsp.Release != "96A" {
+				t.Errorf("message %s %s %s", rsp.Type, rsp.Version, rsp.Release)
+			}
+			var msg string
+			var lins, qtys []Segment
+			for _, s := range rsp.Segments {
+				switch s.Tag {
+				case "BGM":
+					if s.E(2) != "PO123" || s.E(4) != tt.r.Type {
+						t.Errorf("BGM %q", s.Elements)
+					}
+				case "FTX":
+					// The message is cut into components where it
+					// runs long, not at words.
+					msg += strings.Join(s.Elements[3], "")
+				case "LIN":
+					lins = append(lins, s)
+				case "QTY":
+					qtys = append(qtys, s)
+				}
+			}
+			if msg != tt.want {
+				t.Errorf("FTX carries %q, want %q", msg, tt.want)
+			}
+			if len(lins) != tt.lines || len(qtys) != tt.lines {
+				t.Fatalf("%d LIN and %d QTY, want %d", len(lins), len(qtys), tt.lines)
+			}
+			if tt.lines == 0 {
+				return
+			}
+			// The buyer's part comes first whatever order it came in.
+			if l := lins[0]; l.E(1) != "1" || l.E(2) != tt.action || l.C(3, 1) != "ABC-1" || l.C(3, 2) != "BP" {
+				t.Errorf("LIN %q", l.Elements)
+			}
+			if q := qtys[0]; q.C(1, 2) != tt.qty || q.C(1, 3) != "EA" {
+				t.Errorf("QTY %q", q.Elements)
+			}
+		})
+	}
+}
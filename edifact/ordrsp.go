@@ -0,0 +1,118 @@
+package edifact
+
+import (
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Response types, BGM04, 4343.
+const (
+	ResponseAccepted     = "AP" // accepted, lines acknowledged without change
+	ResponseRejected     = "RE" // rejected, with the lines rejected
+	ResponseAcknowledged = "AB" // acknowledged, no detail or change
+)
+
+// Line item actions, LIN02, 1229.
+const (
+	ItemAccepted    = "5" // accepted without amendment
+	ItemNotAccepted = "7" // not accepted
+)
+
+// ftxLen is the longest component of an FTX04; an FTX has five.
+const ftxLen = 512
+
+// OrderResponse is the answer to an order, for its ORDRSP.
+type OrderResponse struct {
+	Type    string // BGM04, one of the Response constants
+	Message string // the answer in words, sent as FTX segments
+	Date    time.Time
+}
+
+// WriteOrderResponse writes the ORDRSP answering o, from the directory
+// release o was sent in. The lines are left out of one that is only
+// ResponseAcknowledged.
+func WriteOrderResponse(w *Writer, o *Order, m *Message, r OrderResponse) {
+	w.Begin("ORDRSP", m.Version, m.Release)
+	// BGM03 is 29 accepted without amendment, 27 not accepted or 9
+	// original.
+	function := "9"
+	switch r.Type {
+	case ResponseAccepted:
+		function = "29"
+	case ResponseRejected:
+		function = "27"
+	}
+	w.Segment("BGM", "231", o.Number, function, r.Type)
+	w.Segment("DTM", w.Composite("137", r.Date.Format("20060102"), "102"))
+	w.Segment("RFF", w.Composite("ON", o.Number))
+	if !o.Date.IsZero() {
+		w.Segment("DTM", w.Composite("171", o.Date.Format("20060102"), "102"))
+	}
+	for _, q := range []string{"AEP", "CT"} {
+		if v := o.Refs[q]; v != "" {
+			w.Segment("RFF", w.Composite(q, v))
+		}
+	}
+	if o.Currency != "" {
+		w.Segment("CUX", w.Composite("2", o.Currency, "9"))
+	}
+	for msg := r.Message; msg != ""; {
+		// Each FTX carries five components of text.
+		var parts []string
+		for len(parts) < 5 && msg != "" {
+			n := len(msg)
+			if n > ftxLen {
+				n = ftxLen
+			}
+			parts = append(parts, msg[:n])
+			msg = msg[n:]
+		}
+		w.Segment("FTX", "AAI", "", "", w.Composite(parts...))
+	}
+	if r.Type != ResponseAcknowledged {
+		action := ItemAccepted
+		if r.Type == ResponseRejected {
+			action = ItemNotAccepted
+		}
+		for _, l := range o.Lines {
+			lin := []string{l.Number, action}
+			ids := idOrder(l.IDs)
+			if len(ids) > 0 {
+				lin = append(lin, w.Composite(l.IDs[ids[0]], ids[0]))
+			}
+			w.Segment("LIN", lin...)
+			qty := l.Qty
+			if action == ItemNotAccepted {
+				qty = "0"
+			}
+			w.Segment("QTY", w.Composite("21", qty, l.UOM))
+			if d, ok := l.Dates["2"]; ok && action == ItemAccepted {
+				// 2: the delivery date, as asked.
+				w.Segment("DTM", w.Composite("2", d.Format("20060102"), "102"))
+			}
+		}
+		w.Segment("UNS", "S")
+		w.Segment("CNT", w.Composite("2", strconv.Itoa(len(o.Lines))))
+	}
+	w.End()
+}
+
+// idOrder is the order product IDs are written in: the usual item
+// types first, then any others.
+func idOrder(ids map[string]string) []string {
+	var qs []string
+	for _, q := range []string{"BP", "SA", "IN", "MF", "EN"} {
+		if _, ok := ids[q]; ok {
+			qs = append(qs, q)
+		}
+	}
+	var rest []string
+	for q := range ids {
+		if !in(q, qs) {
+			rest = append(rest, q)
+		}
+	}
+	sort.Strings(rest)
+	return append(qs, rest...)
+}
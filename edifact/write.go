@@ -0,0 +1,158 @@
+package edifact
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sep stands for the component separator in what Composite returns,
+// which Segment writes as the separator once the data is escaped.
+const sep = "\x1f"
+
+// Envelope is what a Writer puts on the UNB segment.
+type Envelope struct {
+	Syntax       string // UNB01:1, such as UNOC
+	Version      string // UNB01:2, 3 or 4
+	SenderQual   string // UNB02:2
+	Sender       string // UNB02:1
+	ReceiverQual string // UNB03:2
+	Receiver     string // UNB03:1
+	Control      int    // UNB05
+	AckRequested bool   // UNB09, asking for a CONTRL
+	Test         bool   // UNB11
+	Date         time.Time
+}
+
+// Writer writes an interchange of messages without functional groups.
+type Writer struct {
+	env        Envelope
+	d          Delimiters
+	lineBreaks bool
+	b          bytes.Buffer
+	msgs       int
+	msg        string // the reference of the open message, "" if none
+	segs       int    // segments in the open message
+}
+
+// NewWriter starts an interchange, writing its UNA and UNB. With
+// lineBreaks each segment is followed by a newline, for people to read.
+func NewWriter(env Envelope, d Delimiters, lineBreaks bool) *Writer {
+	w := &Writer{env: env, d: d, lineBreaks: lineBreaks}
+	rep := d.Repetition
+	if env.Version < "4" {
+		rep = ' '
+	}
+	w.b.Write([]byte{'U', 'N', 'A', d.Component, d.Element, d.Decimal, d.Release, rep, d.Segment})
+	if lineBreaks {
+		w.b.WriteByte('\n')
+	}
+	// Version 4 dates have the century.
+	date := env.Date.Format("060102")
+	if env.Version >= "4" {
+		date = env.Date.Format("20060102")
+	}
+	unb := []string{
+		w.Composite(env.Syntax, env.Version),
+		w.Composite(env.Sender, env.SenderQual),
+		w.Composite(env.Receiver, env.ReceiverQual),
+		w.Composite(date, env.Date.Format("1504")),
+		strconv.Itoa(env.Control),
+		"", "", "", "", "", "",
+	}
+	if env.AckRequested {
+		unb[8] = "1"
+	}
+	if env.Test {
+		unb[10] = "1"
+	}
+	w.write("UNB", unb...)
+	return w
+}
+
+// Begin starts a message of type typ, such as ORDRSP, from directory
+// version and release, such as D and 96A, numbering the messages 1, 2
+// and on.
+func (w *Writer) Begin(typ string, version string, release string) {
+	if w.msg != "" {
+		w.End()
+	}
+	w.msgs++
+	w.msg = strconv.Itoa(w.msgs)
+	w.segs = 0
+	w.Segment("UNH", w.msg, w.Composite(typ, version, release, "UN"))
+}
+
+// Segment writes a segment in the open message. Trailing empty
+// elements are left off, and delimiters in the data are released.
+func (w *Writer) Segment(tag string, elements ...string) {
+	w.segs++
+	w.write(tag, elements...)
+}
+
+// Composite joins the components of a composite element.
+func (w *Writer) Composite(components ...string) string {
+	for len(components) > 0 && components[len(components)-1] == "" {
+		components = components[:len(components)-1]
+	}
+	return strings.Join(components, sep)
+}
+
+// End ends the open message, writing its UNT.
+func (w *Writer) End() {
+	if w.msg == "" {
+		return
+	}
+	w.Segment("UNT", strconv.Itoa(w.segs+1), w.msg)
+	w.msg = ""
+}
+
+// Bytes ends the open message and the interchange and returns it.
+func (w *Writer) Bytes() []byte {
+	w.End()
+	w.write("UNZ", strconv.Itoa(w.msgs), strconv.Itoa(w.env.Control))
+	return w.b.Bytes()
+}
+
+func (w *Writer) write(tag string, elements ...string) {
+	for len(elements) > 0 && elements[len(elements)-1] == "" {
+		elements = elements[:len(elements)-1]
+	}
+	w.b.WriteString(tag)
+	for _, e := range elements {
+		w.b.WriteByte(w.d.Element)
+		for i, c := range strings.Split(e, sep) {
+			if i > 0 {
+				w.b.WriteByte(w.d.Component)
+			}
+			w.b.WriteString(w.escape(c))
+		}
+	}
+	w.b.WriteByte(w.d.Segment)
+	if w.lineBreaks {
+		w.b.WriteByte('\n')
+	}
+}
+
+// escape releases the delimiters in s and replaces its line breaks,
+// which the syntax levels do not have, with spaces. Without a release
+// character, a space in the UNA, the delimiters become spaces too.
+func (w *Writer) escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		delim := c == w.d.Element || c == w.d.Component || c == w.d.Segment ||
+			c == w.d.Repetition && c != ' ' && w.env.Version >= "4"
+		switch {
+		case c == '\n' || c == '\r':
+			c = ' '
+		case w.d.Release == ' ' && delim:
+			c = ' '
+		case w.d.Release != ' ' && (delim || c == w.d.Release):
+			b.WriteByte(w.d.Release)
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
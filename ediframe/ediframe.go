@@ -0,0 +1,116 @@
+/*
+Package ediframe is the batched wire format for sending orders to the
+application host.
+
+Protocol version 1 is the original one: every key=value record is its
+own clientedi.Send, and the order ends with an EDIEOF record. Version 2
+packs many records into one frame:
+
+	EDIFRAME LLLLLLLL NNNNN CCCCCCCC payload
+
+without the spaces, where LLLLLLLL is the payload length in bytes,
+NNNNN the number of records and CCCCCCCC the CRC-32 (IEEE) of the
+payload in hex. The payload is the records separated by RS (0x1e).
+The order still ends with a plain EDIEOF record and the host replies
+the same way in both versions.
+
+Version 1 is the default. For a host configured with version 2 the
+client sends a Hello record after it connects. A host that speaks
+version 2 replies with its own Hello; an older host files it away as
+one more key=value record and stays silent, so the client drops that
+connection and connects again to speak version 1.
+*/
+package ediframe
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Version is the highest protocol version we speak.
+	Version = 2
+
+	magic     = "EDIFRAME"
+	headerLen = len(magic) + 8 + 5 + 8
+	sep       = "\x1e"
+	hello     = "EDIPROTO="
+
+	// MaxRecords is the most records one frame can carry.
+	MaxRecords = 99999
+)
+
+// ErrFrame is returned for a frame that is damaged in transit.
+var ErrFrame = errors.New("ediframe: bad frame")
+
+// Hello returns the record that offers protocol version v.
+func Hello(v int) string {
+	return hello + strconv.Itoa(v)
+}
+
+// ParseHello returns the version in a Hello record, or 1 if rec is not one.
+func ParseHello(rec string) int {
+	if !strings.HasPrefix(rec, hello) {
+		return 1
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(rec[len(hello):]))
+	if err != nil || v < 1 {
+		return 1
+	}
+	return v
+}
+
+// IsFrame reports whether s is a version 2 frame.
+func IsFrame(s string) bool {
+	return strings.HasPrefix(s, magic)
+}
+
+// Encode packs records into one frame. Records must not contain RS.
+func Encode(records []string) (string, error) {
+	if len(records) > MaxRecords {
+		return "", fmt.Errorf("ediframe: %d records, at most %d fit in a frame", len(records), MaxRecords)
+	}
+	for _, r := range records {
+		if strings.Contains(r, sep) {
+			return "", fmt.Errorf("ediframe: record %q contains a separator", r)
+		}
+	}
+	payload := strings.Join(records, sep)
+	if len(payload) > 99999999 {
+		return "", fmt.Errorf("ediframe: payload of %d bytes is too long", len(payload))
+	}
+	return fmt.Sprintf("%s%08d%05d%08x%s", magic, len(payload), len(records),
+		crc32.ChecksumIEEE([]byte(payload)), payload), nil
+}
+
+// Decode unpacks a frame made by Encode.
+func Decode(frame string) ([]string, error) {
+	if len(frame) < headerLen || !IsFrame(frame) {
+		return nil, ErrFrame
+	}
+	h := frame[len(magic):headerLen]
+	size, err1 := strconv.Atoi(h[0:8])
+	count, err2 := strconv.Atoi(h[8:13])
+	sum, err3 := strconv.ParseUint(h[13:21], 16, 32)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, ErrFrame
+	}
+	payload := frame[headerLen:]
+	if len(payload) != size || crc32.ChecksumIEEE([]byte(payload)) != uint32(sum) {
+		return nil, ErrFrame
+	}
+	if count == 0 {
+		if size > 0 {
+			return nil, ErrFrame
+		}
+		return nil, nil
+	}
+	records := strings.Split(payload, sep)
+	if len(records) != count {
+		return nil, ErrFrame
+	}
+	return records, nil
+}
@@ -0,0 +1,112 @@
+package ediframe
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHello(t *testing.T) {
+	tests := []struct {
+		rec  string
+		want int
+	}{
+		{Hello(2), 2},
+		{Hello(Version), Version},
+		{"EDIPROTO=3 ", 3},
+		{"EDIPROTO=0", 1},
+		{"EDIPROTO=x", 1},
+		{"EDIPROTO=", 1},
+		{"PONUMBER=EDIPROTO=2", 1},
+		{"EDIEOF", 1},
+	}
+	for _, tt := range tests {
+		if got := ParseHello(tt.rec); got != tt.want {
+			t.Errorf("ParseHello(%q) = %d, want %d", tt.rec, got, tt.want)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []string
+	}{
+		{"one record", []string{"PONUMBER=PO123"}},
+		{"many records", []string{"PONUMBER=PO123", "LINE=1", "ITEM=ABC-1", "QTY=10", "DESC=Widgets, blue = 2"}},
+		{"empty records", []string{"", "A=1", ""}},
+		{"line breaks", []string{"NOTE=first\nsecond", "A=\r\n"}},
+		{"no records", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame, err := Encode(tt.records)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			if !IsFrame(frame) {
+				t.Errorf("%q is not taken for a frame", frame)
+			}
+			got, err := Decode(frame)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.records) {
+				t.Errorf("Decode = %q, want %q", got, tt.records)
+			}
+		})
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	many := make([]string, MaxRecords+1)
+	tests := []struct {
+		name    string
+		records []string
+	}{
+		{"separator in a record", []string{"A=1", "B=2" + sep + "C=3"}},
+		{"too many records", many},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if frame, err := Encode(tt.records); err == nil {
+				t.Errorf("Encode = %.40q, want an error", frame)
+			}
+		})
+	}
+	if _, err := Encode(many[:MaxRecords]); err != nil {
+		t.Errorf("Encode of %d records: %v", MaxRecords, err)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	frame, err := Encode([]string{"PONUMBER=PO123", "QTY=10"})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	payload := frame[headerLen:]
+	tests := []struct {
+		name  string
+		frame string
+	}{
+		{"not a frame", "PONUMBER=PO123"},
+		{"header cut short", frame[:headerLen-1]},
+		{"payload cut short", frame[:len(frame)-1]},
+		{"payload too long", frame + "x"},
+		{"payload changed", strings.Replace(frame, "PO123", "PO124", 1)},
+		{"length not a number", magic + "0000001x" + frame[len(magic)+8:]},
+		{"count not a number", magic + frame[len(magic):len(magic)+8] + "0000x" + frame[len(magic)+13:]},
+		{"CRC not hex", frame[:headerLen-8] + "zzzzzzzz" + payload},
+		{"count wrong", magic + frame[len(magic):len(magic)+8] + "00003" + frame[len(magic)+13:]},
+		{"records but no count", fmt.Sprintf("%s%08d%05d%s%s", magic, len(payload), 0, frame[len(magic)+13:headerLen], payload)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if records, err := Decode(tt.frame); !errors.Is(err, ErrFrame) {
+				t.Errorf("Decode = %q, %v; want ErrFrame", records, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package edihttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cloud3000/BaseEDI/ediconfig"
+	"github.com/cloud3000/BaseEDI/editls"
+)
+
+// TestTimeout bounds one connectivity test, longer than a health check
+// as a test may log in.
+const TestTimeout = 30 * time.Second
+
+// ListenAdmin starts the admin listener for program, if the
+// configuration gives it an address, with HTTPS if it has admin TLS.
+// A bare port listens on loopback. Nothing is served until the service
+// adds its handlers with Handle, and then only to operators; cfg is
+// read on each request, so operators changed on a reload count at once.
+func ListenAdmin(program string, cfg func() ediconfig.Admin) (*Server, error) {
+	admin := cfg()
+	addr := admin.Listen[program]
+	if addr == "" {
+		return nil, nil
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if admin.TLS != nil {
+		ts, err := editls.New(*admin.TLS, func(err error) {
+			slog.Error("Admin certificate reload failed", "err", err)
+		})
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l = tls.NewListener(l, ts.Config())
+	}
+	s := &Server{mux: http.NewServeMux(), l: l}
+	s.serve(authenticate(cfg, s.mux))
+	slog.Info("Admin listening", "addr", l.Addr().String(), "tls", admin.TLS != nil)
+	return s, nil
+}
+
+// AdminURL is the URL of path on program's admin address in cfg, ""
+// if it serves none. A bare port or wildcard host is reached on
+// loopback.
+func AdminURL(cfg ediconfig.Admin, program string, path string) string {
+	addr := cfg.Listen[program]
+	if addr == "" {
+		return ""
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil &&
+		(host == "" || host == "0.0.0.0" || host == "::") {
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+	if cfg.TLS != nil {
+		return "https://" + addr + path
+	}
+	return "http://" + addr + path
+}
+
+// AdminGet gets u, on another service's admin address, for the
+// operator whose request r is. The operator's name and token go with
+// it and, with admin TLS, the service's own admin certificate, for an
+// operator who came in with a client certificate; admin.tls.clientCA
+// must then have issued it. Every service serves that one certificate,
+// so the other service is taken only if it presents it too.
+func AdminGet(cfg ediconfig.Admin, r *http.Request, u string, timeout time.Duration) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	tr := &http.Transport{DisableKeepAlives: true}
+	if cfg.TLS != nil {
+		cert, err := tls.LoadX509KeyPair(cfg.TLS.Cert, cfg.TLS.Key)
+		if err != nil {
+			return nil, err
+		}
+		own := cert.Certificate[0]
+		tr.TLSClientConfig = &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{cert},
+			// AdminURL may give a loopback address the certificate
+			// does not name; the certificate itself is checked.
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+				if len(raw) == 0 || !bytes.Equal(raw[0], own) {
+					return errors.New("edihttp: the admin certificate is not ours")
+				}
+				return nil
+			},
+		}
+	}
+	c := http.Client{Timeout: timeout, Transport: tr}
+	return c.Do(req)
+}
+
+type operatorKey struct{}
+
+// Operator is who made an admin request, as authenticate found.
+func Operator(r *http.Request) string {
+	op, _ := r.Context().Value(operatorKey{}).(string)
+	return op
+}
+
+// authenticate passes on the requests that come from an operator: one
+// with a verified client certificate, or with an operator's name and
+// token. With no operators and no client certificates configured the
+// admin address is on loopback and a request from loopback is taken
+// as from "local".
+func authenticate(cfg func() ediconfig.Admin, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op := operator(cfg(), r)
+		if op == "" {
+			slog.Warn("Admin: unauthorized", "remote", r.RemoteAddr, "path", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Basic realm="edi"`)
+			http.Error(w, "unauthorized: give an operator name and token", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), operatorKey{}, op)))
+	})
+}
+
+func operator(cfg ediconfig.Admin, r *http.Request) string {
+	if r.TLS != nil {
+		if name := editls.Client(*r.TLS); name != "" {
+			return name
+		}
+	}
+	if name, token, ok := r.BasicAuth(); ok {
+		for _, o := range cfg.Operators {
+			if name == o.Name && subtle.ConstantTimeCompare([]byte(token), []byte(o.Token)) == 1 {
+				return o.Name
+			}
+		}
+		return ""
+	}
+	if len(cfg.Operators) > 0 || (cfg.TLS != nil && cfg.TLS.ClientCA != "") {
+		return ""
+	}
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if !ediconfig.Loopback(host) {
+		return ""
+	}
+	return "local"
+}
+
+// ConfigHandler serves the configuration the service is running with,
+// masked as ediconfig's Dump does.
+func ConfigHandler(get func() *ediconfig.Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := get().Dump()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(append(b, '\n'))
+	})
+}
+
+// TestHandler runs the connectivity tests tests returns, for the
+// configuration of the moment, giving each TestTimeout, and answers as
+// /readyz does.
+func TestHandler(tests func() []Check) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteResults(w, RunChecks(tests(), TestTimeout))
+	})
+}
+
+// SameOrigin reports whether a request that changes something may be
+// taken: not from a browser, or from a browser on a page of the same
+// address. It keeps other sites from posting to the admin interfaces
+// through an operator's browser.
+func SameOrigin(r *http.Request) bool {
+	if r.Header.Get("Sec-Fetch-Site") == "cross-site" {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
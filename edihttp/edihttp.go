@@ -0,0 +1,109 @@
+/*
+Package edihttp is the HTTP side of the services: the address each
+listens on, from the http section of the configuration, and the
+handlers every one of them serves: /metrics, and /healthz and /readyz
+with the checks the service adds.
+
+/healthz runs the Live checks, whether the service itself is working;
+a monitor restarts it when they fail. /readyz runs those and the Ready
+checks, whether the things it depends on are there; a load balancer
+sends it no work while they fail. Both answer 200 or 503 with each
+check's result as JSON.
+
+The dashboard and the admin interfaces edictl uses change and resend
+documents, so they are served apart, on the admin address ListenAdmin
+starts, and only to operators: each request must name one, with a
+token or a client certificate, and Operator tells the handlers who.
+ConfigHandler and TestHandler are for the admin interfaces: the
+configuration in effect, and connectivity tests run from where the
+service runs.
+
+A service with no address configured serves no HTTP; a nil *Server
+takes Handle, Live, Ready and Close and does nothing with them.
+*/
+package edihttp
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/cloud3000/BaseEDI/ediconfig"
+	"github.com/cloud3000/BaseEDI/metrics"
+)
+
+// Server is one service's HTTP listener.
+type Server struct {
+	mux    *http.ServeMux
+	srv    *http.Server
+	l      net.Listener
+	checks checks
+}
+
+// Listen starts the HTTP listener for program, if the configuration
+// gives it an address, serving /metrics, /healthz and /readyz. The
+// service adds its checks with Live and Ready, and its own handlers
+// with Handle.
+func Listen(program string, cfg ediconfig.HTTP) (*Server, error) {
+	addr := cfg.Listen[program]
+	if addr == "" {
+		return nil, nil
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{mux: http.NewServeMux(), l: l}
+	s.mux.Handle("/metrics", metrics.Handler())
+	s.mux.Handle("/healthz", s.healthHandler(false))
+	s.mux.Handle("/readyz", s.healthHandler(true))
+	s.serve(s.mux)
+	slog.Info("HTTP listening", "addr", l.Addr().String())
+	return s, nil
+}
+
+// serve serves h on s.l until Close.
+func (s *Server) serve(h http.Handler) {
+	// Requests see their context cancelled when Close starts, so
+	// streams such as edictl's tail end rather than hold it up.
+	ctx, cancel := context.WithCancel(context.Background())
+	s.srv = &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	s.srv.RegisterOnShutdown(cancel)
+	go func() {
+		if err := s.srv.Serve(s.l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP server failed", "addr", s.l.Addr().String(), "err", err)
+		}
+	}()
+}
+
+// Handle adds a handler, as http.ServeMux.Handle.
+func (s *Server) Handle(pattern string, h http.Handler) {
+	if s != nil {
+		s.mux.Handle(pattern, h)
+	}
+}
+
+// Addr is the address the server listens on.
+func (s *Server) Addr() string {
+	if s == nil {
+		return ""
+	}
+	return s.l.Addr().String()
+}
+
+// Close stops the listener, giving requests in hand timeout to finish.
+func (s *Server) Close(timeout time.Duration) error {
+	if s == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.srv.Shutdown(ctx)
+}
@@ -0,0 +1,192 @@
+package edihttp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// CheckTimeout bounds one check. A check still running then has
+// failed; dial timeouts should be shorter.
+const CheckTimeout = 5 * time.Second
+
+// writeOK is W_OK, access(2) asking about write permission.
+const writeOK = 2
+
+// Check is one thing a service depends on. Fn returns nil while the
+// dependency is fine.
+type Check struct {
+	Name string
+	Fn   func() error
+}
+
+// Result is one check in the /healthz and /readyz replies.
+type Result struct {
+	Name     string  `json:"name"`
+	Status   string  `json:"status"` // ok or fail
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"seconds"`
+}
+
+type checks struct {
+	mu    sync.Mutex
+	live  []Check
+	ready []Check
+}
+
+// Live adds a check to /healthz: something that failing means the
+// service is stuck and should be restarted, such as its watcher.
+// Live checks are part of /readyz as well.
+func (s *Server) Live(name string, fn func() error) {
+	if s == nil {
+		return
+	}
+	s.checks.mu.Lock()
+	s.checks.live = append(s.checks.live, Check{name, fn})
+	s.checks.mu.Unlock()
+}
+
+// Ready adds a check to /readyz only: something the service needs to
+// get documents through, such as the host, that a restart will not
+// fix.
+func (s *Server) Ready(name string, fn func() error) {
+	if s == nil {
+		return
+	}
+	s.checks.mu.Lock()
+	s.checks.ready = append(s.checks.ready, Check{name, fn})
+	s.checks.mu.Unlock()
+}
+
+// healthHandler runs the live checks, and the ready ones too if ready
+// is set, and answers 200 if they all pass, 503 if not, with each
+// result as JSON.
+func (s *Server) healthHandler(ready bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.checks.mu.Lock()
+		cs := append([]Check(nil), s.checks.live...)
+		if ready {
+			cs = append(cs, s.checks.ready...)
+		}
+		s.checks.mu.Unlock()
+		WriteResults(w, RunChecks(cs, CheckTimeout))
+	})
+}
+
+// WriteResults answers 200 if every check passed, 503 if not, with
+// each result as JSON.
+func WriteResults(w http.ResponseWriter, results []Result) {
+	reply := struct {
+		Status string   `json:"status"`
+		Checks []Result `json:"checks"`
+	}{"ok", results}
+	code := http.StatusOK
+	for _, res := range results {
+		if res.Status != "ok" {
+			reply.Status, code = "fail", http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(reply)
+}
+
+// RunChecks runs the checks side by side, giving each timeout.
+func RunChecks(cs []Check, timeout time.Duration) []Result {
+	results := make([]Result, len(cs))
+	var wg sync.WaitGroup
+	for i, c := range cs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			started := time.Now()
+			done := make(chan error, 1)
+			go func() { done <- c.Fn() }()
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(timeout):
+				err = fmt.Errorf("no answer in %v", timeout)
+			}
+			results[i] = Result{Name: c.Name, Status: "ok", Duration: time.Since(started).Seconds()}
+			if err != nil {
+				results[i].Status, results[i].Error = "fail", err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// Heartbeat shows that a loop, such as a service's watcher, is still
+// going round.
+type Heartbeat struct {
+	last    atomic.Int64 // unix nanoseconds
+	stopped atomic.Bool
+}
+
+// Beat records that the loop came round.
+func (h *Heartbeat) Beat() {
+	h.last.Store(time.Now().UnixNano())
+}
+
+// Stop records that the loop has ended.
+func (h *Heartbeat) Stop() {
+	h.stopped.Store(true)
+}
+
+// Check returns a check that fails once the loop has stopped, or has
+// not beaten for max. Zero max only looks for a stop.
+func (h *Heartbeat) Check(max time.Duration) func() error {
+	return func() error {
+		if h.stopped.Load() {
+			return errors.New("stopped")
+		}
+		last := h.last.Load()
+		if last == 0 {
+			return errors.New("not started")
+		}
+		if since := time.Since(time.Unix(0, last)); max > 0 && since > max {
+			return fmt.Errorf("no sign of life for %v", since.Round(time.Second))
+		}
+		return nil
+	}
+}
+
+// Writable checks that each of dirs can be written to. It makes no
+// file, a watched directory would see it arrive.
+func Writable(dirs ...string) error {
+	var errs []error
+	for _, dir := range dirs {
+		if err := syscall.Access(dir, writeOK); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", dir, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// DiskFree checks that the filesystem holding each of dirs has at least
+// minMB megabytes free for unprivileged users.
+func DiskFree(minMB int, dirs ...string) error {
+	var errs []error
+	for _, dir := range dirs {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(dir, &st); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", dir, err))
+			continue
+		}
+		free := st.Bavail * uint64(st.Bsize) / (1 << 20)
+		if free < uint64(minMB) {
+			errs = append(errs, fmt.Errorf("%s: %d MB free, want %d", dir, free, minMB))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,172 @@
+/*
+Package edilog sets up structured logging for the BaseEDI programs.
+
+Each program calls Setup once at start. Records go to stderr as text,
+to a file as JSON lines, or to syslog, as the log section of the
+configuration says, and carry the program name.
+
+A document gets a correlation ID when it arrives. The services log
+with it and pass it to the programs they start in the environment
+variable EDI_CORRELATION_ID; Setup picks it up there, so every record
+and ledger entry for a document can be found by one ID.
+*/
+package edilog
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/blackjack/syslog"
+	"github.com/cloud3000/BaseEDI/ediconfig"
+)
+
+// EnvID is the environment variable the correlation ID is passed in.
+const EnvID = "EDI_CORRELATION_ID"
+
+var level = new(slog.LevelVar)
+
+// Setup makes the default logger for program from cfg. The returned
+// func closes the log file, if there is one.
+func Setup(program string, cfg ediconfig.Log) (func() error, error) {
+	if err := SetLevel(cfg.Level); err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	closer := func() error { return nil }
+	// Opened whatever the sink, the syslog notify backend uses it too.
+	syslog.Openlog(program, syslog.LOG_PID, syslog.LOG_USER)
+	switch cfg.Sink {
+	case "json":
+		f, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		h, closer = slog.NewJSONHandler(f, opts), f.Close
+	case "syslog":
+		h = &syslogHandler{opts: opts}
+	default:
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	logger := slog.New(h).With("program", program)
+	if id := os.Getenv(EnvID); id != "" {
+		logger = logger.With("id", id)
+	}
+	slog.SetDefault(logger)
+	return closer, nil
+}
+
+// SetLevel changes the level records are logged at: debug, info,
+// warn or error.
+func SetLevel(name string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(name)); err != nil {
+		return fmt.Errorf("edilog: %v", err)
+	}
+	level.Set(l)
+	return nil
+}
+
+// NewID returns a new correlation ID.
+func NewID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ID is the correlation ID this process was started with, "" if none.
+func ID() string {
+	return os.Getenv(EnvID)
+}
+
+// Env is the environment for a child process working on the document
+// with correlation ID id.
+func Env(id string) []string {
+	env := []string{}
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, EnvID+"=") {
+			env = append(env, e)
+		}
+	}
+	return append(env, EnvID+"="+id)
+}
+
+// Fatal logs msg at error level and exits 1.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// syslogHandler sends records to syslog as the message followed by
+// key=value pairs, at the priority matching their level.
+type syslogHandler struct {
+	opts   *slog.HandlerOptions
+	prefix string // attrs from With, already formatted
+	group  string
+	mu     sync.Mutex
+}
+
+func (h *syslogHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.opts.Level.Level()
+}
+
+func (h *syslogHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(r.Message)
+	b.WriteString(h.prefix)
+	r.Attrs(func(a slog.Attr) bool {
+		writeAttr(&b, h.group, a)
+		return true
+	})
+	prio := syslog.LOG_INFO
+	switch {
+	case r.Level >= slog.LevelError:
+		prio = syslog.LOG_ERR
+	case r.Level >= slog.LevelWarn:
+		prio = syslog.LOG_WARNING
+	case r.Level < slog.LevelInfo:
+		prio = syslog.LOG_DEBUG
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	syslog.Syslog(prio, b.String())
+	return nil
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b strings.Builder
+	b.WriteString(h.prefix)
+	for _, a := range attrs {
+		writeAttr(&b, h.group, a)
+	}
+	return &syslogHandler{opts: h.opts, prefix: b.String(), group: h.group}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{opts: h.opts, prefix: h.prefix, group: h.group + name + "."}
+}
+
+func writeAttr(w io.StringWriter, group string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		for _, ga := range a.Value.Group() {
+			writeAttr(w, group+a.Key+".", ga)
+		}
+		return
+	}
+	v := a.Value.String()
+	if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+		v = fmt.Sprintf("%q", v)
+	}
+	w.WriteString(" " + group + a.Key + "=" + v)
+}
@@ -0,0 +1,227 @@
+/*
+Package editls puts TLS, and optionally client certificates, on the
+private_input_service listeners and the services' admin listeners.
+
+The certificate, key and client CA files are checked for changes at
+most once a second while handshakes come in, so a renewed certificate
+is picked up without restarting the service. A file that fails to load
+keeps the last good one in use.
+*/
+package editls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/cloud3000/BaseEDI/ediconfig"
+)
+
+// checkEvery is how often the files are looked at for changes.
+const checkEvery = time.Second
+
+// ErrNotAllowed means a verified client is not in AllowClients.
+var ErrNotAllowed = errors.New("client certificate not allowed")
+
+// Server holds the current certificate and client CAs for a listener.
+type Server struct {
+	cfg ediconfig.TLS
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	mtimes  [3]time.Time // cert, key, client CA
+	checked time.Time
+	onError func(error)
+}
+
+// New loads the files named in cfg. onError, which may be nil, hears
+// about reloads that fail.
+func New(cfg ediconfig.TLS, onError func(error)) (*Server, error) {
+	s := &Server{cfg: cfg, onError: onError}
+	if err := s.load(s.stat()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Listen listens on addr and wraps accepted connections in TLS.
+func (s *Server) Listen(network string, addr string) (net.Listener, error) {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, s.Config()), nil
+}
+
+// Config is the tls.Config for a listener. Each handshake gets the
+// certificate and client CAs current at the time.
+func (s *Server) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.current(), nil
+		},
+	}
+}
+
+// Update switches to the files and allowlist in cfg, for a
+// configuration reload. On error the old ones stay in use.
+func (s *Server) Update(cfg ediconfig.TLS) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.cfg
+	s.cfg = cfg
+	s.checked = time.Now()
+	if err := s.load(s.stat()); err != nil {
+		s.cfg = old
+		return err
+	}
+	return nil
+}
+
+func (s *Server) current() *tls.Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.checked) >= checkEvery {
+		s.checked = time.Now()
+		if m := s.stat(); m != s.mtimes {
+			if err := s.load(m); err != nil && s.onError != nil {
+				s.onError(err)
+			}
+		}
+	}
+	c := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*s.cert},
+	}
+	if s.pool != nil {
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+		c.ClientCAs = s.pool
+		allow := s.cfg.AllowClients
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verify(cs, allow)
+		}
+	}
+	return c
+}
+
+// stat returns the modification times of the files, zero for any
+// that cannot be read.
+func (s *Server) stat() [3]time.Time {
+	var m [3]time.Time
+	for i, name := range []string{s.cfg.Cert, s.cfg.Key, s.cfg.ClientCA} {
+		if name == "" {
+			continue
+		}
+		if fi, err := os.Stat(name); err == nil {
+			m[i] = fi.ModTime()
+		}
+	}
+	return m
+}
+
+// load reads the files, s.mu held. Nothing changes if any of them fail.
+func (s *Server) load(mtimes [3]time.Time) error {
+	cert, err := tls.LoadX509KeyPair(s.cfg.Cert, s.cfg.Key)
+	if err != nil {
+		return fmt.Errorf("editls: %v", err)
+	}
+	var pool *x509.CertPool
+	if s.cfg.ClientCA != "" {
+		pem, err := os.ReadFile(s.cfg.ClientCA)
+		if err != nil {
+			return fmt.Errorf("editls: %v", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("editls: %s: no certificates", s.cfg.ClientCA)
+		}
+	}
+	s.cert, s.pool, s.mtimes = &cert, pool, mtimes
+	return nil
+}
+
+// Check loads the files named in cfg as New does, and reports a
+// certificate that is not yet or no longer valid. It is for edictl
+// test.
+func Check(cfg ediconfig.TLS) error {
+	s := &Server{cfg: cfg}
+	if err := s.load(s.stat()); err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(s.cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("editls: %s: %v", cfg.Cert, err)
+	}
+	if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return fmt.Errorf("editls: %s is valid from %s to %s", cfg.Cert,
+			leaf.NotBefore.Format(time.RFC3339), leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// verify checks a verified client against the allowlist.
+func verify(cs tls.ConnectionState, allow []string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return ErrNotAllowed
+	}
+	if len(allow) == 0 {
+		return nil
+	}
+	for _, name := range Names(cs.PeerCertificates[0]) {
+		for _, pat := range allow {
+			if ok, _ := path.Match(pat, name); ok {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrNotAllowed, Names(cs.PeerCertificates[0])[0])
+}
+
+// Names returns the names a client certificate identifies itself by,
+// the common name first.
+func Names(cert *x509.Certificate) []string {
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	return names
+}
+
+// Identity completes the handshake on a TLS connection and returns
+// the client identity: the certificate common name, or its first other
+// name when the common name is empty. It is "" for a connection that
+// is not TLS or a client that sent no certificate.
+func Identity(conn net.Conn) (string, error) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	if err := tc.Handshake(); err != nil {
+		return "", err
+	}
+	return Client(tc.ConnectionState()), nil
+}
+
+// Client is the client identity in a finished handshake, as Identity
+// returns it.
+func Client(cs tls.ConnectionState) string {
+	if len(cs.PeerCertificates) == 0 {
+		return ""
+	}
+	for _, name := range Names(cs.PeerCertificates[0]) {
+		if name != "" {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,227 @@
+/*
+Package errdir keeps the documents that failed, in ./errors.
+
+The file in the directory is the latest attempt at a document. When a
+file of the same name fails again, or an operator puts one back to be
+reprocessed, the earlier attempt is not overwritten: it moves to the
+versions directory as name.1, name.2 and so on, the highest number the
+most recent.
+*/
+package errdir
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Versions is the directory under the errors directory earlier
+// attempts are kept in.
+const Versions = "versions"
+
+var (
+	ErrName     = errors.New("bad file name")
+	ErrNotFound = errors.New("no such file in errors")
+	ErrBusy     = errors.New("a file of that name is already in the inbox")
+)
+
+// Dir is an errors directory.
+type Dir struct {
+	path string
+}
+
+// New returns the errors directory at path. It is made when the
+// first file is put in it.
+func New(path string) *Dir {
+	return &Dir{path: path}
+}
+
+// Path is the directory's path.
+func (d *Dir) Path() string {
+	return d.path
+}
+
+// File is a file in the directory or one of its earlier versions.
+type File struct {
+	Name     string    `json:"name"`
+	Version  int       `json:"version,omitempty"` // 0 for the latest
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// Put moves the file at src into the directory under its own name,
+// keeping a file already there as a version. It returns the new path.
+func (d *Dir) Put(src string) (string, error) {
+	name := filepath.Base(src)
+	if err := os.MkdirAll(d.path, 0755); err != nil {
+		return "", err
+	}
+	if err := d.keep(name); err != nil {
+		return "", err
+	}
+	dst := filepath.Join(d.path, name)
+	return dst, os.Rename(src, dst)
+}
+
+// List returns the files in the directory, the most recent first.
+func (d *Dir) List() ([]File, error) {
+	ents, err := os.ReadDir(d.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []File
+	for _, ent := range ents {
+		info, err := ent.Info()
+		if err != nil || !info.Mode().IsRegular() || strings.HasPrefix(ent.Name(), ".") {
+			continue
+		}
+		list = append(list, File{Name: ent.Name(), Size: info.Size(), Modified: info.ModTime()})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Modified.After(list[j].Modified) })
+	return list, nil
+}
+
+// Versions returns the earlier attempts at name, the most recent
+// first.
+func (d *Dir) Versions(name string) ([]File, error) {
+	if !goodName(name) {
+		return nil, ErrName
+	}
+	ents, err := os.ReadDir(filepath.Join(d.path, Versions))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []File
+	for _, ent := range ents {
+		n := versionOf(name, ent.Name())
+		if n == 0 {
+			continue
+		}
+		info, err := ent.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		list = append(list, File{Name: name, Version: n, Size: info.Size(), Modified: info.ModTime()})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version > list[j].Version })
+	return list, nil
+}
+
+// Open returns the path of name, or of its earlier version if version
+// is not 0, checking that it is there.
+func (d *Dir) Open(name string, version int) (string, error) {
+	if !goodName(name) {
+		return "", ErrName
+	}
+	p := filepath.Join(d.path, name)
+	if version != 0 {
+		p = filepath.Join(d.path, Versions, name+"."+strconv.Itoa(version))
+	}
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) || (err == nil && !info.Mode().IsRegular()) {
+		return "", ErrNotFound
+	}
+	return p, err
+}
+
+// Reprocess puts name back in inbox to be imported again, keeping the
+// failed attempt as a version. If edited is not nil it is put in the
+// inbox in place of the failed file.
+func (d *Dir) Reprocess(name string, edited []byte, inbox string) error {
+	src, err := d.Open(name, 0)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(inbox, name)
+	if _, err := os.Stat(dst); err == nil {
+		return ErrBusy
+	}
+	if edited == nil {
+		if edited, err = os.ReadFile(src); err != nil {
+			return err
+		}
+	}
+	// Written beside the errors and renamed in, so the watcher sees
+	// the whole file arrive at once.
+	tmp := filepath.Join(d.path, ".reprocess-"+name)
+	if err := os.WriteFile(tmp, edited, 0644); err != nil {
+		return err
+	}
+	if err := d.keep(name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Discard moves name out of the directory to the directory to, adding
+// a time to the name if to already has one. It returns the new path.
+func (d *Dir) Discard(name string, to string) (string, error) {
+	src, err := d.Open(name, 0)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(to, 0755); err != nil {
+		return "", err
+	}
+	dst := filepath.Join(to, name)
+	if _, err := os.Stat(dst); err == nil {
+		dst += "." + time.Now().Format("20060102150405")
+	}
+	return dst, os.Rename(src, dst)
+}
+
+// keep moves the file called name, if there is one, to the next
+// version.
+func (d *Dir) keep(name string) error {
+	src := filepath.Join(d.path, name)
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return nil
+	}
+	dir := filepath.Join(d.path, Versions)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	last, err := d.Versions(name)
+	if err != nil {
+		return err
+	}
+	n := 1
+	if len(last) > 0 {
+		n = last[0].Version + 1
+	}
+	return os.Rename(src, filepath.Join(dir, name+"."+strconv.Itoa(n)))
+}
+
+// versionOf is the version number of file if it is a version of name,
+// otherwise 0.
+func versionOf(name string, file string) int {
+	if !strings.HasPrefix(file, name+".") {
+		return 0
+	}
+	n, err := strconv.Atoi(file[len(name)+1:])
+	if err != nil || n < 1 {
+		return 0
+	}
+	return n
+}
+
+// goodName reports whether name is a plain file name, not a path or a
+// hidden file.
+func goodName(name string) bool {
+	return name != "" && name == filepath.Base(name) && !strings.HasPrefix(name, ".") && name != Versions
+}
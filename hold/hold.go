@@ -0,0 +1,280 @@
+/*
+Package hold pauses trading partners.
+
+While a partner is paused a service parks the partner's files in its
+hold directory instead of handling them. Resuming the partner moves
+them back to the directory the service watches, oldest first, to go
+through as if they had just arrived.
+
+Each service has its own hold directory, ./held/<service>, and keeps
+the partners it has paused there in paused.json, so a pause outlasts
+a restart. edictl pauses and resumes a partner in every service through
+the Handler each serves at /admin/partners.
+*/
+package hold
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloud3000/BaseEDI/edihttp"
+)
+
+// stateFile is where a hold directory keeps the paused partners.
+const stateFile = "paused.json"
+
+var ErrPartner = errors.New("bad partner name")
+
+// Pause is one partner paused.
+type Pause struct {
+	Partner string    `json:"partner"`
+	Since   time.Time `json:"since"`
+	By      string    `json:"by,omitempty"`
+	Held    int       `json:"held"` // files parked
+}
+
+// Holds is a service's paused partners and the files parked for them.
+type Holds struct {
+	dir string
+
+	mu     sync.Mutex
+	paused map[string]Pause
+}
+
+// Dir is the hold directory for program.
+func Dir(program string) string {
+	return filepath.Join("./held", program)
+}
+
+// Open reads the partners paused in dir.
+func Open(dir string) (*Holds, error) {
+	h := &Holds{dir: dir, paused: make(map[string]Pause)}
+	b, err := os.ReadFile(filepath.Join(dir, stateFile))
+	switch {
+	case os.IsNotExist(err):
+		return h, nil
+	case err != nil:
+		return nil, err
+	}
+	var list []Pause
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath.Join(dir, stateFile), err)
+	}
+	for _, p := range list {
+		h.paused[p.Partner] = p
+	}
+	return h, nil
+}
+
+// Paused reports whether partner is paused.
+func (h *Holds) Paused(partner string) bool {
+	if partner == "" {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, ok := h.paused[partner]
+	return ok
+}
+
+// Park moves file into partner's hold, returning its new path.
+func (h *Holds) Park(file string, partner string) (string, error) {
+	dir := filepath.Join(h.dir, partner)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	// The time keeps two files of one name apart and puts them back
+	// in the order they came.
+	dst := filepath.Join(dir, fmt.Sprintf("%d_%s", time.Now().UnixNano(), filepath.Base(file)))
+	return dst, os.Rename(file, dst)
+}
+
+// Pause pauses partner. by is who asked, for the list.
+func (h *Holds) Pause(partner string, by string) error {
+	if !goodPartner(partner) {
+		return ErrPartner
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.paused[partner]; ok {
+		return nil
+	}
+	h.paused[partner] = Pause{Partner: partner, Since: time.Now(), By: by}
+	if err := h.save(); err != nil {
+		delete(h.paused, partner)
+		return err
+	}
+	return nil
+}
+
+// Resume lifts partner's pause and moves the files parked for it to
+// dir. A file whose name is already in dir stays parked, to go on the
+// next Resume; those are returned in left.
+func (h *Holds) Resume(partner string, dir string) (moved []string, left []string, err error) {
+	if !goodPartner(partner) {
+		return nil, nil, ErrPartner
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if p, ok := h.paused[partner]; ok {
+		delete(h.paused, partner)
+		if err := h.save(); err != nil {
+			h.paused[partner] = p
+			return nil, nil, err
+		}
+	}
+	for _, f := range h.parked(partner) {
+		_, name, _ := strings.Cut(f, "_")
+		dst := filepath.Join(dir, name)
+		if _, err := os.Stat(dst); err == nil {
+			left = append(left, name)
+			continue
+		}
+		if err := os.Rename(filepath.Join(h.dir, partner, f), dst); err != nil {
+			slog.Error("hold: failed to put back", "partner", partner, "file", name, "err", err)
+			left = append(left, name)
+			continue
+		}
+		moved = append(moved, name)
+	}
+	return moved, left, nil
+}
+
+// List returns the paused partners, with how many files each has
+// parked.
+func (h *Holds) List() []Pause {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var list []Pause
+	for _, p := range h.paused {
+		p.Held = len(h.parked(p.Partner))
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Partner < list[j].Partner })
+	return list
+}
+
+// parked is the files parked for partner, oldest first.
+func (h *Holds) parked(partner string) []string {
+	ents, _ := os.ReadDir(filepath.Join(h.dir, partner))
+	var files []string
+	for _, e := range ents {
+		if e.Type().IsRegular() && strings.Contains(e.Name(), "_") {
+			files = append(files, e.Name())
+		}
+	}
+	// The names start with the time parked, all the same length.
+	sort.Strings(files)
+	return files
+}
+
+// save writes the paused partners. h.mu held.
+func (h *Holds) save() error {
+	if err := os.MkdirAll(h.dir, 0755); err != nil {
+		return err
+	}
+	list := make([]Pause, 0, len(h.paused))
+	for _, p := range h.paused {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Partner < list[j].Partner })
+	b, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(h.dir, "."+stateFile)
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(h.dir, stateFile))
+}
+
+// goodPartner reports whether name can be a partner, and a directory
+// in the hold.
+func goodPartner(name string) bool {
+	return name != "" && name == filepath.Base(name) && !strings.HasPrefix(name, ".")
+}
+
+// Handler serves the admin interface to the holds, putting resumed
+// files back in inbox:
+//
+//	GET  /admin/partners                  the paused partners
+//	POST /admin/partners/<name>/pause
+//	POST /admin/partners/<name>/resume
+func (h *Holds) Handler(inbox string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/partners"), "/")
+		if rest == "" {
+			if r.Method != http.MethodGet {
+				w.Header().Set("Allow", http.MethodGet)
+				http.Error(w, "use GET", http.StatusMethodNotAllowed)
+				return
+			}
+			writeJSON(w, h.List())
+			return
+		}
+		partner, action, _ := strings.Cut(rest, "/")
+		if action != "pause" && action != "resume" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if !edihttp.SameOrigin(r) {
+			http.Error(w, "cross-origin request refused", http.StatusForbidden)
+			return
+		}
+		by := edihttp.Operator(r) + " from " + r.RemoteAddr
+		if action == "pause" {
+			if err := h.Pause(partner, by); err != nil {
+				http.Error(w, err.Error(), status(err))
+				return
+			}
+			slog.Info("Partner paused", "partner", partner, "by", by)
+			writeJSON(w, struct {
+				Partner string `json:"partner"`
+				Paused  bool   `json:"paused"`
+			}{partner, true})
+			return
+		}
+		moved, left, err := h.Resume(partner, inbox)
+		if err != nil {
+			http.Error(w, err.Error(), status(err))
+			return
+		}
+		slog.Info("Partner resumed", "partner", partner, "by", by, "released", len(moved), "left", len(left))
+		writeJSON(w, struct {
+			Partner  string   `json:"partner"`
+			Paused   bool     `json:"paused"`
+			Released []string `json:"released"`
+			Left     []string `json:"left,omitempty"`
+		}{partner, false, moved, left})
+	})
+}
+
+func status(err error) int {
+	if errors.Is(err, ErrPartner) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
@@ -0,0 +1,125 @@
+/*
+File: host_simulator.go
+
+Stands in for the private network when there is no 192.168.1.240.
+
+	-mode host   listens like the application host on port 30770,
+	             takes orders from XML_PO_import and replies with
+	             -action and -response.
+
+	-mode mmts   connects to the MR port of private_input_service
+	             like MMTS does and replays the -script record stream.
+
+The -delay, -reply-delay, -disconnect-after, -refuse and -error flags
+inject the faults the real machines show on a bad day.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/cloud3000/BaseEDI/hostsim"
+)
+
+var (
+	mode     = flag.String("mode", "host", "host or mmts")
+	listen   = flag.String("listen", ":30770", "host: The address to listen on")
+	action   = flag.String("action", "ACCEPTED", "host: The action to reply with")
+	response = flag.String("response", "", "host: The response to reply with")
+	protocol = flag.Int("protocol", 2, "host: The highest protocol to speak, 1 is an old host")
+	mrAddr   = flag.String("mr", "127.0.0.1:30771", "mmts: The MR port to connect to")
+	script   = flag.String("script", "", "mmts: The record script to replay")
+	repeat   = flag.Int("repeat", 1, "mmts: Times to replay the script")
+
+	delay           = flag.Duration("delay", 0, "Wait this long before each record")
+	replyDelay      = flag.Duration("reply-delay", 0, "host: Wait this long before replying")
+	disconnectAfter = flag.Int("disconnect-after", 0, "Drop the connection after this many records")
+	refuse          = flag.Bool("refuse", false, "host: Close connections as soon as they are accepted")
+	failWith        = flag.String("error", "", "host: Reply ERROR with this response")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s: [flags]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	faults := hostsim.Faults{
+		RecordDelay:     *delay,
+		ReplyDelay:      *replyDelay,
+		DisconnectAfter: *disconnectAfter,
+		Refuse:          *refuse,
+		Error:           *failWith,
+	}
+
+	switch *mode {
+	case "host":
+		h := &hostsim.Host{
+			Action:   *action,
+			Response: *response,
+			Protocol: *protocol,
+			Faults:   faults,
+		}
+		if *response == "" {
+			h.Reply = func(o hostsim.Order) (string, string) {
+				return *action, "Order " + o.Value("Ordno") + " " + *action
+			}
+		}
+		if err := h.Listen(*listen); err != nil {
+			fmt.Fprintf(os.Stderr, "listen: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Simulated host listening on %s\n", h.Addr())
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		orders := 0
+		ticker := time.NewTicker(time.Second)
+		for {
+			select {
+			case <-sig:
+				h.Close()
+				fmt.Printf("%d orders received\n", len(h.Orders()))
+				return
+			case <-ticker.C:
+				all := h.Orders()
+				for _, o := range all[orders:] {
+					fmt.Printf("%s order %s from %s: %d records, protocol %d, complete %v\n",
+						o.Received.Format("15:04:05"), o.Value("Ordno"), o.Remote,
+						len(o.Records), o.Protocol, o.Complete)
+				}
+				orders = len(all)
+			}
+		}
+
+	case "mmts":
+		if *script == "" {
+			flag.Usage()
+			os.Exit(1)
+		}
+		s, err := hostsim.LoadScript(*script)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *script, err)
+			os.Exit(1)
+		}
+		m := &hostsim.MMTS{Addr: *mrAddr, Faults: faults}
+		for i := 0; i < *repeat; i++ {
+			n, err := m.Send(s)
+			fmt.Printf("receipt %d: %d records sent to %s\n", i+1, n, *mrAddr)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				os.Exit(1)
+			}
+		}
+
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,216 @@
+/*
+Package hostpool picks the application host an order is sent to.
+
+Endpoints come from the hosts section of the configuration. Their
+health is kept in a small state file so the short lived XML_PO_import
+runs and the long running prober in public_input_service share what
+they learn: an endpoint that refused a connection is tried last until
+DownFor has passed or a probe finds it up again.
+*/
+package hostpool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/cloud3000/BaseEDI/ediconfig"
+)
+
+// Health is what we last learned about one endpoint.
+type Health struct {
+	Up      bool      `json:"up"`
+	Checked time.Time `json:"checked"`
+	Err     string    `json:"err,omitempty"`
+}
+
+// Pool is the set of configured endpoints and their health.
+type Pool struct {
+	cfg ediconfig.Hosts
+}
+
+// New returns a pool for the hosts configuration.
+func New(cfg ediconfig.Hosts) *Pool {
+	return &Pool{cfg: cfg}
+}
+
+// Route returns the endpoints to try for an order, in order. A matching
+// route gives its own endpoints, otherwise it is the failover order
+// followed by any endpoints it leaves out. Endpoints known to be down
+// are moved to the end rather than dropped, a down host is still
+// better than no host.
+func (p *Pool) Route(contract string, project string) []ediconfig.Endpoint {
+	var names []string
+	routed := false
+	for _, r := range p.cfg.Routes {
+		if match(r.ContractNumber, contract) && match(r.ProjectNumber, project) {
+			names = r.Endpoints
+			routed = true
+			break
+		}
+	}
+	if !routed {
+		names = append(names, p.cfg.Failover...)
+		for _, ep := range p.cfg.Endpoints {
+			names = append(names, ep.Name)
+		}
+	}
+
+	var eps []ediconfig.Endpoint
+	seen := make(map[string]bool)
+	for _, n := range names {
+		if ep, ok := p.endpoint(n); ok && !seen[n] {
+			eps = append(eps, ep)
+			seen[n] = true
+		}
+	}
+
+	state := p.load()
+	var up, down []ediconfig.Endpoint
+	for _, ep := range eps {
+		if h, ok := state[ep.Name]; ok && !h.Up && time.Since(h.Checked) < p.cfg.DownFor.Duration {
+			down = append(down, ep)
+		} else {
+			up = append(up, ep)
+		}
+	}
+	return append(up, down...)
+}
+
+// MarkDown records a failed connection to the endpoint.
+func (p *Pool) MarkDown(name string, err error) {
+	p.set(name, Health{Up: false, Checked: time.Now(), Err: err.Error()})
+}
+
+// MarkUp records a good connection to the endpoint.
+func (p *Pool) MarkUp(name string) {
+	p.set(name, Health{Up: true, Checked: time.Now()})
+}
+
+// Health returns the last known health of every endpoint.
+func (p *Pool) Health() map[string]Health {
+	return p.load()
+}
+
+// ProbeAll probes every endpoint once and records the results.
+func (p *Pool) ProbeAll() {
+	for _, ep := range p.cfg.Endpoints {
+		if err := Probe(ep.Addr, p.cfg.ProbeTimeout.Duration); err != nil {
+			p.MarkDown(ep.Name, err)
+		} else {
+			p.MarkUp(ep.Name)
+		}
+	}
+}
+
+// Reachable probes every endpoint, records the results, and returns
+// nil if any of them is up, since Route fails over to it.
+func (p *Pool) Reachable() error {
+	if len(p.cfg.Endpoints) == 0 {
+		return errors.New("no endpoints configured")
+	}
+	var errs []error
+	for _, ep := range p.cfg.Endpoints {
+		if err := Probe(ep.Addr, p.cfg.ProbeTimeout.Duration); err != nil {
+			p.MarkDown(ep.Name, err)
+			errs = append(errs, fmt.Errorf("%s: %v", ep.Name, err))
+		} else {
+			p.MarkUp(ep.Name)
+			return nil
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Run probes the endpoints every ProbeInterval until stop is closed.
+// It returns at once if probing is turned off.
+func (p *Pool) Run(stop <-chan struct{}) {
+	if p.cfg.ProbeInterval.Duration <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.cfg.ProbeInterval.Duration)
+	defer ticker.Stop()
+	for {
+		p.ProbeAll()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Probe checks that addr accepts TCP connections.
+func Probe(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (p *Pool) endpoint(name string) (ediconfig.Endpoint, bool) {
+	for _, ep := range p.cfg.Endpoints {
+		if ep.Name == name {
+			return ep, true
+		}
+	}
+	return ediconfig.Endpoint{}, false
+}
+
+func (p *Pool) load() map[string]Health {
+	state := make(map[string]Health)
+	if p.cfg.StateFile == "" {
+		return state
+	}
+	b, err := os.ReadFile(p.cfg.StateFile)
+	if err != nil {
+		return state
+	}
+	json.Unmarshal(b, &state)
+	return state
+}
+
+// set updates one endpoint in the state file. Writers take a lock on
+// a file beside it, so programs marking endpoints at once do not lose
+// each other's updates, and the file is replaced with a rename so
+// readers never see half of it.
+func (p *Pool) set(name string, h Health) {
+	if p.cfg.StateFile == "" {
+		return
+	}
+	lock, err := os.OpenFile(p.cfg.StateFile+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	state := p.load()
+	state[name] = h
+	b, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return
+	}
+	tmp := fmt.Sprintf("%s.%d", p.cfg.StateFile, os.Getpid())
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return
+	}
+	os.Rename(tmp, p.cfg.StateFile)
+}
+
+func match(pattern string, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, value)
+	return ok
+}
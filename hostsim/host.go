@@ -0,0 +1,208 @@
+/*
+Package hostsim stands in for the machines on the private network so
+XML_PO_import and XML_MR_Receipt can be run without them.
+
+Host plays the application host XML_PO_import sends orders to: it
+takes the key=value records (or ediframe frames) up to EDIEOF and
+replies with an action and a response. MMTS plays the material
+management system: it connects to the MR port of
+private_input_service and replays a scripted record stream.
+
+Both sides speak through the same socket libraries as the real
+programs, serveredi on the accepting end and clientedi on the
+connecting end. Faults lets a test slow them down, make them fail or
+drop the connection part way.
+*/
+package hostsim
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cloud3000/BaseEDI/ediframe"
+	"github.com/cloud3000/ediserversocks" // serveredi EDI Socket server lib
+)
+
+// Faults are the misbehaviours a simulator can be told to show.
+type Faults struct {
+	RecordDelay     time.Duration // Wait before each record is taken or sent.
+	ReplyDelay      time.Duration // Wait before replying to EDIEOF.
+	DisconnectAfter int           // Drop the connection after this many records, 0 never.
+	Refuse          bool          // Close every connection as soon as it is accepted.
+	Error           string        // Reply with action ERROR and this response.
+}
+
+// Order is what the host received in one session.
+type Order struct {
+	Remote   string
+	Protocol int
+	Records  []string
+	Complete bool // EDIEOF was received
+	Received time.Time
+}
+
+// Value returns the value of the first record named key.
+func (o Order) Value(key string) string {
+	for _, r := range o.Records {
+		if k, v := split(r); k == key {
+			return v
+		}
+	}
+	return ""
+}
+
+// Host is a simulated application host.
+type Host struct {
+	Action   string // Reply to every order, "ACCEPTED" if empty.
+	Response string
+	// Reply, when set, picks the reply for each order instead.
+	Reply func(Order) (action string, response string)
+	// Protocol is the highest version spoken. 1 behaves like an old
+	// host and ignores the protocol offer.
+	Protocol int
+	Faults   Faults
+
+	mu     sync.Mutex
+	l      net.Listener
+	orders []Order
+}
+
+// Listen starts the host on addr and serves in the background.
+func (h *Host) Listen(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.l = l
+	h.mu.Unlock()
+	go h.serve(l)
+	return nil
+}
+
+// Addr is the address the host listens on.
+func (h *Host) Addr() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.l == nil {
+		return ""
+	}
+	return h.l.Addr().String()
+}
+
+// Close stops the host.
+func (h *Host) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.l == nil {
+		return nil
+	}
+	return h.l.Close()
+}
+
+// Orders returns the orders received so far.
+func (h *Host) Orders() []Order {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Order(nil), h.orders...)
+}
+
+// SetFaults changes the faults for the next connections.
+func (h *Host) SetFaults(f Faults) {
+	h.mu.Lock()
+	h.Faults = f
+	h.mu.Unlock()
+}
+
+func (h *Host) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		go h.session(conn)
+	}
+}
+
+func (h *Host) session(conn net.Conn) {
+	defer conn.Close()
+	h.mu.Lock()
+	f := h.Faults
+	h.mu.Unlock()
+	if f.Refuse {
+		return
+	}
+
+	o := Order{Remote: conn.RemoteAddr().String(), Protocol: 1, Received: time.Now()}
+	defer h.record(&o)
+	for {
+		time.Sleep(f.RecordDelay)
+		data, status := serveredi.Recv(conn)
+		if status.Number != 0 {
+			return
+		}
+		rec := data[0:status.Len]
+		if rec == "EDIEOF" {
+			o.Complete = true
+			break
+		}
+		switch {
+		case ediframe.ParseHello(rec) > 1 && h.Protocol > 1:
+			o.Protocol = h.Protocol
+			if o.Protocol > ediframe.Version {
+				o.Protocol = ediframe.Version
+			}
+			serveredi.Send(conn, ediframe.Hello(o.Protocol))
+			continue
+		case ediframe.IsFrame(rec) && h.Protocol > 1:
+			recs, err := ediframe.Decode(rec)
+			if err != nil {
+				f.Error = err.Error()
+			}
+			o.Records = append(o.Records, recs...)
+		default:
+			o.Records = append(o.Records, rec)
+		}
+		if f.DisconnectAfter > 0 && len(o.Records) >= f.DisconnectAfter {
+			return
+		}
+	}
+
+	time.Sleep(f.ReplyDelay)
+	action, response := h.reply(o, f)
+	if status := serveredi.Send(conn, action); status.Number != 0 {
+		return
+	}
+	serveredi.Send(conn, response)
+}
+
+func (h *Host) reply(o Order, f Faults) (string, string) {
+	switch {
+	case f.Error != "":
+		return "ERROR", f.Error
+	case h.Reply != nil:
+		return h.Reply(o)
+	case h.Action != "":
+		return h.Action, h.Response
+	}
+	return "ACCEPTED", "Order " + o.Value("Ordno") + " accepted"
+}
+
+func (h *Host) record(o *Order) {
+	h.mu.Lock()
+	h.orders = append(h.orders, *o)
+	h.mu.Unlock()
+}
+
+func split(rec string) (string, string) {
+	for i := 0; i < len(rec); i++ {
+		if rec[i] == '=' {
+			return rec[:i], rec[i+1:]
+		}
+	}
+	return rec, ""
+}
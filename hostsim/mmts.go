@@ -0,0 +1,118 @@
+package hostsim
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cloud3000/ediclientsocks" // clientedi Client socket lib
+)
+
+// Step is one line of an MMTS script.
+type Step struct {
+	Record     string        // key=value record to send
+	Delay      time.Duration // or a pause
+	Disconnect bool          // or drop the connection
+}
+
+// Script is a record stream MMTS sends for one receipt.
+//
+// A script file has one key=value record per line, as MMTS sends them:
+//
+//	PKGDETL-PKG-NO=000001
+//	MRHEAD-PO-NO=P2-G-H41-701052
+//	MRDETL-MR-ITEM-NO=1
+//	@delay 2s
+//	MRDETL-RECV-QTY=     1.00
+//	@disconnect
+//
+// Lines starting with # are comments. @delay pauses the stream and
+// @disconnect drops the connection. EDIEOF is sent at the end of the
+// script unless the script sends it itself or disconnects first.
+type Script []Step
+
+// ParseScript reads a script.
+func ParseScript(r io.Reader) (Script, error) {
+	var s Script
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		t := strings.TrimSpace(line)
+		switch {
+		case t == "" || strings.HasPrefix(t, "#"):
+		case strings.HasPrefix(t, "@delay"):
+			d, err := time.ParseDuration(strings.TrimSpace(t[len("@delay"):]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			s = append(s, Step{Delay: d})
+		case t == "@disconnect":
+			s = append(s, Step{Disconnect: true})
+		case strings.HasPrefix(t, "@"):
+			return nil, fmt.Errorf("line %d: unknown directive %s", n, t)
+		default:
+			// Keep the value as written, MMTS pads numbers with spaces.
+			s = append(s, Step{Record: line})
+		}
+	}
+	return s, sc.Err()
+}
+
+// LoadScript reads a script file.
+func LoadScript(name string) (Script, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseScript(f)
+}
+
+// MMTS is a simulated material management system.
+type MMTS struct {
+	Addr   string // The MR port of private_input_service.
+	Faults Faults
+}
+
+// Send connects to the MR port and plays the script. It returns how
+// many records were sent.
+func (m *MMTS) Send(s Script) (int, error) {
+	conn, status := clientedi.Connect(m.Addr)
+	if status.Number != 0 {
+		return 0, fmt.Errorf("connect %s: %s (%d)", m.Addr, status.Message, status.Number)
+	}
+	sent := 0
+	eof := false
+	for _, st := range s {
+		switch {
+		case st.Delay > 0:
+			time.Sleep(st.Delay)
+			continue
+		case st.Disconnect:
+			conn.Close()
+			return sent, nil
+		}
+		if m.Faults.DisconnectAfter > 0 && sent >= m.Faults.DisconnectAfter {
+			conn.Close()
+			return sent, nil
+		}
+		time.Sleep(m.Faults.RecordDelay)
+		if status := clientedi.Send(conn, st.Record); status.Number != 0 {
+			conn.Close()
+			return sent, fmt.Errorf("send: %s (%d)", status.Message, status.Number)
+		}
+		sent++
+		eof = st.Record == "EDIEOF"
+	}
+	if !eof {
+		if status := clientedi.Send(conn, "EDIEOF"); status.Number != 0 {
+			conn.Close()
+			return sent, fmt.Errorf("send: %s (%d)", status.Message, status.Number)
+		}
+	}
+	clientedi.Disconnect(conn)
+	return sent, nil
+}
@@ -0,0 +1,268 @@
+//go:build integration
+
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloud3000/BaseEDI/ediconfig"
+	"github.com/cloud3000/BaseEDI/hostsim"
+	"github.com/cloud3000/BaseEDI/smtpsink"
+)
+
+// env is one set of running services and the fakes around them,
+// all in a temporary directory and on loopback ports.
+type env struct {
+	root    string
+	bin     string
+	cfgPath string
+
+	in      string // watched by public_input_service
+	out     string // written by the importers, watched by public_output_service
+	inSvc   string // working directory of public_input_service
+	privSvc string // working directory of private_input_service
+	outSvc  string // working directory of public_output_service
+	upload  string // where the sftp server puts what it is sent
+	acks    string // the x12.ackFile the services share
+
+	smtp   *smtpsink.Sink
+	sftp   *sftpServer
+	host   *hostsim.Host
+	old    *hostsim.Host // an older host, speaking protocol 1 only
+	mrAddr string
+	procs  []*exec.Cmd
+}
+
+func newEnv(bin string) (*env, error) {
+	root, err := os.MkdirTemp("", "baseedi")
+	if err != nil {
+		return nil, err
+	}
+	e := &env{
+		root:    root,
+		bin:     bin,
+		cfgPath: filepath.Join(root, "edi.json"),
+		in:      filepath.Join(root, "in"),
+		out:     filepath.Join(root, "out"),
+		inSvc:   filepath.Join(root, "public_input"),
+		privSvc: filepath.Join(root, "private_input"),
+		outSvc:  filepath.Join(root, "public_output"),
+		upload:  filepath.Join(root, "sftp"),
+		acks:    filepath.Join(root, "x12acks.json"),
+	}
+	for _, d := range []string{
+		e.in, e.out,
+		filepath.Join(e.inSvc, "processed"), filepath.Join(e.inSvc, "errors"),
+		e.privSvc,
+		filepath.Join(e.outSvc, "processed"),
+		filepath.Join(e.upload, "dir1", "dir2"),
+	} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, err
+		}
+	}
+	// The services start their children from ./bin.
+	for _, d := range []string{e.inSvc, e.privSvc, e.outSvc} {
+		if err := os.Symlink(bin, filepath.Join(d, "bin")); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func (e *env) start() error {
+	var err error
+	if e.smtp, err = smtpsink.Start("127.0.0.1:0"); err != nil {
+		return err
+	}
+	if e.sftp, err = startSFTP(e.upload, "edi", "edisecret"); err != nil {
+		return err
+	}
+	e.host = &hostsim.Host{Protocol: 2}
+	if err = e.host.Listen("127.0.0.1:0"); err != nil {
+		return err
+	}
+	e.old = &hostsim.Host{Protocol: 1}
+	if err = e.old.Listen("127.0.0.1:0"); err != nil {
+		return err
+	}
+	mrport, err := freePort()
+	if err != nil {
+		return err
+	}
+	cmdport, err := freePort()
+	if err != nil {
+		return err
+	}
+	e.mrAddr = "127.0.0.1:" + mrport
+	if err := e.writeConfig(mrport, cmdport); err != nil {
+		return err
+	}
+
+	if err := e.run(e.inSvc, "public_input_service",
+		"-p", e.in, "-config", e.cfgPath,
+		"-retries", "1", "-retry-delay", "2s", "-job-timeout", "30s", "true"); err != nil {
+		return err
+	}
+	if err := e.run(e.privSvc, "private_input_service",
+		"-config", e.cfgPath, "-record-timeout", "3s", "-session-timeout", "20s"); err != nil {
+		return err
+	}
+	if err := e.run(e.outSvc, "public_output_service",
+		"-p", e.out, "-config", e.cfgPath, "true"); err != nil {
+		return err
+	}
+
+	// Give the watchers a moment and wait for the MR port.
+	return waitFor(10*time.Second, func() bool {
+		c, err := net.Dial("tcp", e.mrAddr)
+		if err != nil {
+			return false
+		}
+		c.Close()
+		return true
+	})
+}
+
+func (e *env) writeConfig(mrport string, cmdport string) error {
+	smtphost, smtpport, _ := net.SplitHostPort(e.smtp.Addr())
+	cfg := ediconfig.Default()
+	// Orders of contract OLD* go to the old host as a protocol 1
+	// endpoint, LEGACY* to it as one set to offer protocol 2.
+	cfg.Hosts.Endpoints = []ediconfig.Endpoint{
+		{Name: "sim", Addr: e.host.Addr(), Protocol: 2},
+		{Name: "old", Addr: e.old.Addr(), Protocol: 1},
+		{Name: "legacy", Addr: e.old.Addr(), Protocol: 2},
+	}
+	cfg.Hosts.Routes = []ediconfig.Route{
+		{ContractNumber: "OLD*", Endpoints: []string{"old"}},
+		{ContractNumber: "LEGACY*", Endpoints: []string{"legacy"}},
+		{Endpoints: []string{"sim"}},
+	}
+	// Receipts of contract X41* go to ZENITH as an 856, E41* to EUROCO
+	// as a DESADV. Every service shares the control and ack files.
+	cfg.X12.SenderQual, cfg.X12.Sender = "ZZ", "BASEEDI"
+	cfg.X12.ControlFile = filepath.Join(e.root, "x12control.json")
+	cfg.X12.AckFile = e.acks
+	cfg.X12.Partners = []ediconfig.X12Partner{
+		{Name: "ZENITH", Qual: "ZZ", ID: "ZENITH", Receipts: "856", Contracts: []string{"X41*"}},
+	}
+	cfg.EDIFACT.SenderQual, cfg.EDIFACT.Sender = "ZZZ", "BASEEDI"
+	cfg.EDIFACT.ControlFile = filepath.Join(e.root, "edifactcontrol.json")
+	cfg.EDIFACT.Partners = []ediconfig.EDIFACTPartner{
+		{Name: "EUROCO", Qual: "ZZZ", ID: "EUROCO", Receipts: "desadv", Contracts: []string{"E41*"}},
+	}
+	cfg.Hosts.StateFile = filepath.Join(e.root, "hoststate.json")
+	cfg.Hosts.DownFor = ediconfig.Duration{Duration: time.Second}
+	cfg.Mail = ediconfig.Mail{Server: smtphost, Port: ":" + smtpport, User: "edi", Password: "edi"}
+	cfg.Dirs = ediconfig.Dirs{POResponses: e.out + "/", MRReceipts: e.out + "/"}
+	cfg.Private = ediconfig.Private{Host: "127.0.0.1", MRPort: mrport, CmdPort: cmdport}
+	cfg.Outbound = ediconfig.Outbound{
+		Host:     "127.0.0.1",
+		Port:     e.sftp.port(),
+		User:     "edi",
+		Password: "edisecret",
+		Dirs:     []string{"dir1", "dir2"},
+		Options:  []string{"StrictHostKeyChecking=no", "UserKnownHostsFile=/dev/null"},
+	}
+	b, err := json.MarshalIndent(cfg, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(e.cfgPath, b, 0644)
+}
+
+// run starts one of the services, its output goes to root/name.log.
+func (e *env) run(dir string, name string, args ...string) error {
+	log, err := os.Create(filepath.Join(e.root, name+".log"))
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(filepath.Join(e.bin, name), args...)
+	cmd.Dir = dir
+	cmd.Stdout = log
+	cmd.Stderr = log
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start %s: %v", name, err)
+	}
+	e.procs = append(e.procs, cmd)
+	return nil
+}
+
+func (e *env) stop(keep bool) {
+	for _, p := range e.procs {
+		p.Process.Kill()
+		p.Wait()
+	}
+	if e.host != nil {
+		e.host.Close()
+	}
+	if e.old != nil {
+		e.old.Close()
+	}
+	if e.sftp != nil {
+		e.sftp.close()
+	}
+	if e.smtp != nil {
+		e.smtp.Close()
+	}
+	if !keep {
+		os.RemoveAll(e.root)
+	}
+}
+
+// drop puts a file in the watched directory in one rename, the way a
+// partner's upload lands, and returns its path.
+func (e *env) drop(name string, data []byte) (string, error) {
+	tmp := filepath.Join(e.root, name)
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return "", err
+	}
+	dst := filepath.Join(e.in, name)
+	return dst, os.Rename(tmp, dst)
+}
+
+// find returns the files in dir whose names start with prefix.
+func find(dir string, prefix string) []string {
+	ents, _ := os.ReadDir(dir)
+	var names []string
+	for _, ent := range ents {
+		if strings.HasPrefix(ent.Name(), prefix) {
+			names = append(names, filepath.Join(dir, ent.Name()))
+		}
+	}
+	return names
+}
+
+func exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+func waitFor(timeout time.Duration, cond func() bool) error {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v", timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
+
+func freePort() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port), nil
+}
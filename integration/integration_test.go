@@ -0,0 +1,81 @@
+//go:build integration
+
+/*
+Package integration is the end to end check of the five programs. It
+starts public_input_service, private_input_service and
+public_output_service in a temporary directory, with a simulated host,
+a local SMTP sink and a local sftp server on loopback ports, then drives
+XML, X12 and EDIFACT orders and MR sessions through them and checks the
+files, acknowledgments, receipts, emails and uploads they produce.
+
+It is behind the integration build tag, so go test ./... leaves it out.
+Build the programs into one directory first, then:
+
+	go test -tags integration -count=1 ./integration -bin /path/to/bin
+
+-run TestScenarios/<name> runs some of the scenarios, -keep keeps the
+temporary directory and service logs. expect and sftp must be on the
+PATH for public_output_service.
+*/
+package integration
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var (
+	bin      = flag.String("bin", "../bin", "Directory with the built programs")
+	testdata = flag.String("testdata", "testdata", "Directory with the sample documents")
+	keep     = flag.Bool("keep", false, "Keep the temporary directory and service logs")
+)
+
+// services is the environment every scenario runs in.
+var services *env
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	dir, err := filepath.Abs(*bin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-bin: %v\n", err)
+		os.Exit(2)
+	}
+	if *testdata, err = filepath.Abs(*testdata); err != nil {
+		fmt.Fprintf(os.Stderr, "-testdata: %v\n", err)
+		os.Exit(2)
+	}
+
+	e, err := newEnv(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "setup: %v\n", err)
+		os.Exit(2)
+	}
+	if err := e.start(); err != nil {
+		fmt.Fprintf(os.Stderr, "start: %v\n", err)
+		e.stop(true)
+		fmt.Fprintf(os.Stderr, "logs are in %s\n", e.root)
+		os.Exit(2)
+	}
+	services = e
+
+	code := m.Run()
+	e.stop(*keep || code != 0)
+	if code != 0 {
+		fmt.Printf("logs are in %s\n", e.root)
+	}
+	os.Exit(code)
+}
+
+func TestScenarios(t *testing.T) {
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			services.smtp.Reset()
+			if err := s.run(services); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
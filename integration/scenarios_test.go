@@ -0,0 +1,527 @@
+//go:build integration
+
+package integration
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cloud3000/BaseEDI/acks"
+	"github.com/cloud3000/BaseEDI/edifact"
+	"github.com/cloud3000/BaseEDI/hostsim"
+	"github.com/cloud3000/BaseEDI/x12"
+)
+
+const wait = 30 * time.Second
+
+type scenario struct {
+	name string
+	run  func(e *env) error
+}
+
+var scenarios = []scenario{
+	{"po_accepted", poAccepted},
+	{"po_host_error", poHostError},
+	{"po_bad_xml", poBadXML},
+	{"po_not_xml", poNotXML},
+	{"po_host_down_retry", poHostDownRetry},
+	{"po_x12_protocols", poX12Protocols},
+	{"po_x12", poX12},
+	{"po_edifact", poEDIFACT},
+	{"mr_receipt", mrReceipt},
+	{"mr_x12_856", mrX12ASN},
+	{"mr_edifact_desadv", mrDESADV},
+	{"mr_disconnect", mrDisconnect},
+	{"mr_timeout", mrTimeout},
+}
+
+const poFile = "PO_ACMESHIP_G41_P2-G-H41-701052.xml"
+
+// poResponse is the part of the PO response we check.
+type poResponse struct {
+	MessageID string `xml:"MessageID,attr"`
+	Order     struct {
+		OrderNumber string `xml:"orderNumber,attr"`
+		Action      string `xml:"action,attr"`
+		Response    string `xml:"Response"`
+	} `xml:"Order"`
+}
+
+// importPO drops the sample PO under name and waits for it to be
+// processed, answered, and the answer sent to the customer.
+func importPO(e *env, name string, action string) error {
+	po, err := os.ReadFile(filepath.Join(*testdata, poFile))
+	if err != nil {
+		return err
+	}
+	if _, err := e.drop(name, po); err != nil {
+		return err
+	}
+	if _, ok := e.smtp.WaitFor("[EDI] File Received: "+name, wait); !ok {
+		return fmt.Errorf("no File Received email")
+	}
+	if err := waitFor(wait, func() bool {
+		return exists(filepath.Join(e.inSvc, "processed", name))
+	}); err != nil {
+		return fmt.Errorf("%s not moved to processed: %v", name, err)
+	}
+
+	const resp = "RESPONSE_ACMESHIP_G41_PO_RESPONSE_P2-G-H41-701052.xml"
+	if err := checkResponse(filepath.Join(e.outSvc, "processed", resp), action); err != nil {
+		return err
+	}
+	if !exists(filepath.Join(e.upload, "dir1", "dir2", resp)) {
+		return fmt.Errorf("%s not uploaded", resp)
+	}
+	if _, ok := e.smtp.WaitFor("[EDI] PO Import Status: "+action, wait); !ok {
+		return fmt.Errorf("no PO Import Status email")
+	}
+	if _, ok := e.smtp.WaitFor("[EDI] Response Transfer: ", wait); !ok {
+		return fmt.Errorf("no Response Transfer email")
+	}
+	return nil
+}
+
+// checkResponse waits for the response to be sent and checks its action.
+func checkResponse(name string, action string) error {
+	if err := waitFor(wait, func() bool { return exists(name) }); err != nil {
+		return fmt.Errorf("%s not sent: %v", filepath.Base(name), err)
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	var r poResponse
+	if err := xml.Unmarshal(b, &r); err != nil {
+		return fmt.Errorf("%s: %v", filepath.Base(name), err)
+	}
+	if r.Order.Action != action {
+		return fmt.Errorf("%s: action %q, want %q", filepath.Base(name), r.Order.Action, action)
+	}
+	return nil
+}
+
+func poAccepted(e *env) error {
+	if err := importPO(e, poFile, "ACCEPTED"); err != nil {
+		return err
+	}
+	orders := e.host.Orders()
+	if len(orders) == 0 {
+		return fmt.Errorf("host received no order")
+	}
+	o := orders[len(orders)-1]
+	switch {
+	case !o.Complete:
+		return fmt.Errorf("order not terminated with EDIEOF")
+	case o.Value("Ordno") != "P2-G-H41-701052":
+		return fmt.Errorf("host got Ordno %q", o.Value("Ordno"))
+	case o.Protocol != 2:
+		return fmt.Errorf("host spoke protocol %d, want 2", o.Protocol)
+	}
+	return nil
+}
+
+func poHostError(e *env) error {
+	e.host.SetFaults(hostsim.Faults{Error: "Contract G41 is closed"})
+	defer e.host.SetFaults(hostsim.Faults{})
+	return importPO(e, "PO_ACMESHIP_G41_P2-G-H41-701052-2.xml", "ERROR")
+}
+
+func poBadXML(e *env) error {
+	const name = "PO_ACMESHIP_G41_P2-G-H41-709999.xml"
+	if _, err := e.drop(name, []byte("<fXML><Order orderNumber=\"P2-G-H41-709999\">")); err != nil {
+		return err
+	}
+	if err := waitFor(wait, func() bool {
+		return exists(filepath.Join(e.inSvc, "errors", name))
+	}); err != nil {
+		return fmt.Errorf("%s not moved to errors: %v", name, err)
+	}
+	if _, ok := e.smtp.WaitFor("[EDI] XML IMPORT ERROR", wait); !ok {
+		return fmt.Errorf("no XML IMPORT ERROR email")
+	}
+	if _, ok := e.smtp.WaitFor("[EDI] PO Import Status: ERROR", wait); !ok {
+		return fmt.Errorf("no PO Import Status: ERROR email")
+	}
+	return waitFor(wait, func() bool {
+		return len(find(filepath.Join(e.upload, "dir1", "dir2"),
+			"RESPONSE_ACMESHIP_G41_PO_RESPONSE_P2-G-H41-709999")) == 1
+	})
+}
+
+func poNotXML(e *env) error {
+	const name = "PO_ACMESHIP_G41_P2-G-H41-701052.txt"
+	if _, err := e.drop(name, []byte("not a purchase order\n")); err != nil {
+		return err
+	}
+	if _, ok := e.smtp.WaitFor("[EDI] File NOT PROCESSED: "+name, wait); !ok {
+		return fmt.Errorf("no File NOT PROCESSED email")
+	}
+	return waitFor(wait, func() bool {
+		return exists(filepath.Join(e.inSvc, "errors", name))
+	})
+}
+
+// poHostDownRetry takes the host away, checks the order is parked for
+// a retry, and brings the host back in time for the retry to work.
+func poHostDownRetry(e *env) error {
+	addr := e.host.Addr()
+	e.host.Close()
+	const name = "PO_ACMESHIP_G41_P2-G-H41-701052-3.xml"
+	po, err := os.ReadFile(filepath.Join(*testdata, poFile))
+	if err != nil {
+		return err
+	}
+	if _, err := e.drop(name, po); err != nil {
+		return err
+	}
+	if _, ok := e.smtp.WaitFor("[EDI] XML IMPORT RETRY: "+name, wait); !ok {
+		return fmt.Errorf("no XML IMPORT RETRY email")
+	}
+	if err := e.host.Listen(addr); err != nil {
+		return err
+	}
+	return waitFor(wait, func() bool {
+		return exists(filepath.Join(e.inSvc, "processed", name))
+	})
+}
+
+// poX12Protocols sends an interchange of three orders: to the protocol
+// 2 host, to the old host as a protocol 1 endpoint, and to the old host
+// as an endpoint offering protocol 2. Each must be sent in the protocol
+// its own endpoint ends up with.
+func poX12Protocols(e *env) error {
+	if err := dropDoc(e, "PO_ACMESHIP_G41_X12-PROTOCOLS.x12"); err != nil {
+		return err
+	}
+	for _, want := range []struct {
+		host     *hostsim.Host
+		order    string
+		protocol int
+	}{
+		{e.host, "X12-G41-1", 2},
+		{e.old, "X12-OLD-1", 1},
+		{e.old, "X12-LEGACY-1", 1},
+	} {
+		if err := hostOrder(want.host, want.order, want.protocol); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// poX12 sends an 850 and checks the 997 and 855 answering it are
+// uploaded, then acknowledges the 855 with a 997 of ours and checks
+// that settles what is owed.
+func poX12(e *env) error {
+	if err := dropDoc(e, "PO_ACMESHIP_G41_X12-ORDER.x12"); err != nil {
+		return err
+	}
+	if err := hostOrder(e.host, "X12-G41-2", 2); err != nil {
+		return err
+	}
+	_, b, err := uploaded(e, "RESPONSE_ACMESHIP_ACME_ACK_000000202.x12")
+	if err != nil {
+		return err
+	}
+	ic, err := x12.Parse(b)
+	if err != nil {
+		return fmt.Errorf("997: %v", err)
+	}
+	if len(ic.Groups) != 1 || ic.Groups[0].Code != "FA" || len(ic.Groups[0].Sets) != 1 {
+		return fmt.Errorf("997 is not one FA group of one set")
+	}
+	if ak9 := x12Segment(ic.Groups[0].Sets[0], "AK9"); ak9.E(1) != x12.Accepted || ak9.E(2) != "1" {
+		return fmt.Errorf("997 %v, want the one order accepted", ak9)
+	}
+
+	doc, b, err := uploaded(e, "RESPONSE_ACMESHIP_G41_PO_RESPONSE_X12-G41-2.x12")
+	if err != nil {
+		return err
+	}
+	if ic, err = x12.Parse(b); err != nil {
+		return fmt.Errorf("855: %v", err)
+	}
+	if len(ic.Groups) != 1 || ic.Groups[0].Code != "PR" || len(ic.Groups[0].Sets) != 1 || ic.Receiver != "ACME" {
+		return fmt.Errorf("855 is not one PR group of one set to ACME")
+	}
+	g := ic.Groups[0]
+	if bak := x12Segment(g.Sets[0], "BAK"); bak.E(2) != x12.AckDetail || bak.E(3) != "X12-G41-2" {
+		return fmt.Errorf("855 %v, want the order acknowledged", bak)
+	}
+
+	if err := waitFor(wait, func() bool { _, ok := ackOf(e, doc); return ok }); err != nil {
+		return fmt.Errorf("no acknowledgment owed of %s: %v", doc, err)
+	}
+	ack := fmt.Sprintf("ISA*00*          *00*          *ZZ*ACME           *ZZ*BASEEDI        *240102*1230*U*00401*000000203*0*P*:~\n"+
+		"GS*FA*ACME*BASEEDI*20240102*1230*9*X*004010~\nST*997*0001~\nAK1*PR*%s~\nAK2*855*%s~\nAK5*A~\nAK9*A*1*1*1~\n"+
+		"SE*6*0001~\nGE*1*9~\nIEA*1*000000203~\n", g.Control, g.Sets[0].Control)
+	if _, err := e.drop("PO_ACMESHIP_G41_X12-ACK.x12", []byte(ack)); err != nil {
+		return err
+	}
+	return waitFor(wait, func() bool {
+		o, _ := ackOf(e, doc)
+		return o.Status == x12.Accepted
+	})
+}
+
+// poEDIFACT sends an ORDERS and checks the CONTRL and ORDRSP answering
+// it are uploaded.
+func poEDIFACT(e *env) error {
+	if err := dropDoc(e, "PO_ACMESHIP_G41_EDIFACT-ORDER.edi"); err != nil {
+		return err
+	}
+	if err := hostOrder(e.host, "EDI-G41-1", 2); err != nil {
+		return err
+	}
+	_, b, err := uploaded(e, "RESPONSE_ACMESHIP_EUROCO_CONTRL_301.edi")
+	if err != nil {
+		return err
+	}
+	m, err := edifactMessage(b, "EUROCO", "CONTRL")
+	if err != nil {
+		return err
+	}
+	r, err := edifact.ReadContrl(m)
+	if err != nil {
+		return fmt.Errorf("CONTRL: %v", err)
+	}
+	if r.Control != "301" || r.Status != edifact.Accepted {
+		return fmt.Errorf("CONTRL says %s", r)
+	}
+
+	_, b, err = uploaded(e, "RESPONSE_ACMESHIP_G41_PO_RESPONSE_EDI-G41-1.edi")
+	if err != nil {
+		return err
+	}
+	if m, err = edifactMessage(b, "EUROCO", "ORDRSP"); err != nil {
+		return err
+	}
+	for _, seg := range m.Segments {
+		if seg.Tag == "BGM" && seg.E(2) != "EDI-G41-1" {
+			return fmt.Errorf("ORDRSP answers %s", seg.E(2))
+		}
+	}
+	return nil
+}
+
+// dropDoc drops the sample document name and waits for it to be
+// processed.
+func dropDoc(e *env, name string) error {
+	b, err := os.ReadFile(filepath.Join(*testdata, name))
+	if err != nil {
+		return err
+	}
+	if _, err := e.drop(name, b); err != nil {
+		return err
+	}
+	if err := waitFor(wait, func() bool {
+		return exists(filepath.Join(e.inSvc, "processed", name))
+	}); err != nil {
+		return fmt.Errorf("%s not moved to processed: %v", name, err)
+	}
+	return nil
+}
+
+// hostOrder checks host received order whole, in protocol.
+func hostOrder(host *hostsim.Host, order string, protocol int) error {
+	for _, o := range host.Orders() {
+		if o.Value("Ordno") != order {
+			continue
+		}
+		if !o.Complete || o.Protocol != protocol {
+			return fmt.Errorf("order %s: complete %v in protocol %d, want protocol %d", order, o.Complete, o.Protocol, protocol)
+		}
+		return nil
+	}
+	return fmt.Errorf("order %s not received as records", order)
+}
+
+// uploaded waits for the one file whose name starts with prefix to be
+// uploaded, and returns its name and contents.
+func uploaded(e *env, prefix string) (string, []byte, error) {
+	dir := filepath.Join(e.upload, "dir1", "dir2")
+	if err := waitFor(wait, func() bool { return len(find(dir, prefix)) == 1 }); err != nil {
+		return "", nil, fmt.Errorf("%s not uploaded: %v", prefix, err)
+	}
+	name := find(dir, prefix)[0]
+	b, err := os.ReadFile(name)
+	return filepath.Base(name), b, err
+}
+
+// x12Segment returns the first segment of set with the ID id.
+func x12Segment(set *x12.Transaction, id string) x12.Segment {
+	for _, seg := range set.Segments {
+		if seg.ID == id {
+			return seg
+		}
+	}
+	return x12.Segment{}
+}
+
+// edifactMessage parses the interchange b, which must be one message
+// of type typ to receiver.
+func edifactMessage(b []byte, receiver string, typ string) (*edifact.Message, error) {
+	ic, err := edifact.Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", typ, err)
+	}
+	if ic.Receiver != receiver || len(ic.Messages) != 1 || ic.Messages[0].Type != typ {
+		return nil, fmt.Errorf("interchange to %s of %d messages, want one %s to %s", ic.Receiver, len(ic.Messages), typ, receiver)
+	}
+	return ic.Messages[0], nil
+}
+
+// ackOf returns the acknowledgment owed of the document sent as doc.
+func ackOf(e *env, doc string) (acks.Owed, bool) {
+	all, _ := acks.Open(e.acks).All()
+	for _, o := range all {
+		if o.Doc == doc {
+			return o, true
+		}
+	}
+	return acks.Owed{}, false
+}
+
+func mrReceipt(e *env) error {
+	if err := sendScript(e, "receipt.mmts"); err != nil {
+		return err
+	}
+	if _, ok := e.smtp.WaitFor("[EDI] MR Response  PkgID: 000001", wait); !ok {
+		return fmt.Errorf("no MR Response email")
+	}
+	dir := filepath.Join(e.upload, "dir1", "dir2")
+	const prefix = "customer_MR_G41_P2-G-H41-701052_RECEIPTS_"
+	if err := waitFor(wait, func() bool { return len(find(dir, prefix)) == 1 }); err != nil {
+		return fmt.Errorf("receipt not uploaded: %v", err)
+	}
+	b, err := os.ReadFile(find(dir, prefix)[0])
+	if err != nil {
+		return err
+	}
+	var r struct {
+		Lines []struct {
+			LineNumber string `xml:"lineNumber,attr"`
+			Qty        string `xml:"transactionquanity,attr"`
+		} `xml:"Package>Order>Line"`
+		TotalLineItems string `xml:"Summary>TotalLineItems"`
+	}
+	if err := xml.Unmarshal(b, &r); err != nil {
+		return err
+	}
+	if r.TotalLineItems != "2" || len(r.Lines) != 2 || r.Lines[1].Qty != "12.00" {
+		return fmt.Errorf("receipt has %s lines %+v", r.TotalLineItems, r.Lines)
+	}
+	return nil
+}
+
+// mrX12ASN sends a receipt of a contract ZENITH takes as an 856, and
+// checks the 856 is uploaded and then owed a 997.
+func mrX12ASN(e *env) error {
+	const order = "P2-X-H41-701060"
+	if err := sendReceipt(e, "X41", order); err != nil {
+		return err
+	}
+	doc, b, err := uploaded(e, "ZENITH_MR_X41_"+order+"_ASN_")
+	if err != nil {
+		return err
+	}
+	ic, err := x12.Parse(b)
+	if err != nil {
+		return fmt.Errorf("856: %v", err)
+	}
+	if ic.Receiver != "ZENITH" || len(ic.Groups) != 1 || ic.Groups[0].Code != "SH" || len(ic.Groups[0].Sets) != 1 {
+		return fmt.Errorf("856 is not one SH group of one set to ZENITH")
+	}
+	if prf := x12Segment(ic.Groups[0].Sets[0], "PRF"); prf.E(1) != order {
+		return fmt.Errorf("856 %v, want order %s", prf, order)
+	}
+	return waitFor(wait, func() bool {
+		o, ok := ackOf(e, doc)
+		return ok && o.Code == "SH" && o.Partner == "ZENITH"
+	})
+}
+
+// mrDESADV sends a receipt of a contract EUROCO takes as a DESADV,
+// and checks the DESADV is uploaded.
+func mrDESADV(e *env) error {
+	const order = "P2-E-H41-701061"
+	if err := sendReceipt(e, "E41", order); err != nil {
+		return err
+	}
+	_, b, err := uploaded(e, "EUROCO_MR_E41_"+order+"_DESADV_")
+	if err != nil {
+		return err
+	}
+	m, err := edifactMessage(b, "EUROCO", "DESADV")
+	if err != nil {
+		return err
+	}
+	for _, seg := range m.Segments {
+		if seg.Tag == "RFF" && seg.E(1) == "ON" && len(seg.Elements[0]) > 1 && seg.Elements[0][1] == order {
+			return nil
+		}
+	}
+	return fmt.Errorf("DESADV has no RFF+ON of order %s", order)
+}
+
+// sendReceipt sends receipt.mmts as a receipt of contract and order.
+func sendReceipt(e *env, contract string, order string) error {
+	s, err := hostsim.LoadScript(filepath.Join(*testdata, "receipt.mmts"))
+	if err != nil {
+		return err
+	}
+	for i, st := range s {
+		switch {
+		case strings.HasPrefix(st.Record, "POHEAD-PROJECT-CODE="):
+			s[i].Record = "POHEAD-PROJECT-CODE=" + contract
+		case strings.HasPrefix(st.Record, "MRHEAD-PO-NO="):
+			s[i].Record = "MRHEAD-PO-NO=" + order
+		}
+	}
+	m := &hostsim.MMTS{Addr: e.mrAddr}
+	_, err = m.Send(s)
+	return err
+}
+
+func mrDisconnect(e *env) error {
+	if err := sendScript(e, "disconnect.mmts"); err != nil {
+		return err
+	}
+	if _, ok := e.smtp.WaitFor("[EDI] MR_Receipt Network Error", wait); !ok {
+		return fmt.Errorf("no MR_Receipt Network Error email")
+	}
+	return noReceipt(e, "P2-G-H41-701053")
+}
+
+func mrTimeout(e *env) error {
+	if err := sendScript(e, "stall.mmts"); err != nil && !strings.Contains(err.Error(), "send") {
+		return err
+	}
+	if _, ok := e.smtp.WaitFor("[EDI] MR_Receipt Timeout", wait); !ok {
+		return fmt.Errorf("no MR_Receipt Timeout email")
+	}
+	return noReceipt(e, "P2-G-H41-701054")
+}
+
+func sendScript(e *env, name string) error {
+	s, err := hostsim.LoadScript(filepath.Join(*testdata, name))
+	if err != nil {
+		return err
+	}
+	m := &hostsim.MMTS{Addr: e.mrAddr}
+	_, err = m.Send(s)
+	return err
+}
+
+func noReceipt(e *env, order string) error {
+	time.Sleep(2 * time.Second)
+	if n := find(e.out, "customer_MR_G41_"+order); len(n) != 0 {
+		return fmt.Errorf("receipt written for a broken session: %v", n)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+//go:build integration
+
+package integration
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpServer is the customer's sftp server, serving root on loopback.
+type sftpServer struct {
+	l    net.Listener
+	root string
+}
+
+func startSFTP(root string, user string, password string) (*sftpServer, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == user && string(pass) == password {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %q", c.User())
+		},
+	}
+	cfg.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &sftpServer{l: l, root: root}
+	go s.serve(cfg)
+	return s, nil
+}
+
+func (s *sftpServer) port() int {
+	return s.l.Addr().(*net.TCPAddr).Port
+}
+
+func (s *sftpServer) close() {
+	s.l.Close()
+}
+
+func (s *sftpServer) serve(cfg *ssh.ServerConfig) {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.session(conn, cfg)
+	}
+}
+
+func (s *sftpServer) session(conn net.Conn, cfg *ssh.ServerConfig) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "session only")
+			continue
+		}
+		ch, in, err := nc.Accept()
+		if err != nil {
+			return
+		}
+		go func(in <-chan *ssh.Request) {
+			for req := range in {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 &&
+					string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+			}
+		}(in)
+		srv, err := sftp.NewServer(ch, sftp.WithServerWorkingDirectory(s.root))
+		if err != nil {
+			ch.Close()
+			continue
+		}
+		go func() {
+			srv.Serve()
+			srv.Close()
+		}()
+	}
+}
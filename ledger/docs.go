@@ -0,0 +1,120 @@
+package ledger
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Doc is the history of one document: the entries with one
+// correlation ID, so an order and the response written for it, or for
+// entries without an ID those with one file name.
+type Doc struct {
+	ID      string  `json:"id,omitempty"`
+	Entries []Entry `json:"entries"` // oldest first
+	Keys    Keys    `json:"keys"`    // from every entry, later ones winning
+}
+
+// Docs groups entries into documents, the most recently changed first.
+func Docs(entries []Entry) []*Doc {
+	byKey := make(map[string]*Doc)
+	var docs []*Doc
+	for _, e := range entries {
+		key := "id:" + e.ID
+		if e.ID == "" {
+			key = "doc:" + e.Doc
+		}
+		d := byKey[key]
+		if d == nil {
+			d = &Doc{ID: e.ID}
+			byKey[key] = d
+			docs = append(docs, d)
+		}
+		d.Entries = append(d.Entries, e)
+		if e.Keys != nil {
+			d.Keys.merge(*e.Keys)
+		}
+	}
+	for _, d := range docs {
+		sort.SliceStable(d.Entries, func(i, j int) bool { return d.Entries[i].Time.Before(d.Entries[j].Time) })
+	}
+	sort.SliceStable(docs, func(i, j int) bool { return docs[i].Last().After(docs[j].Last()) })
+	return docs
+}
+
+func (k *Keys) merge(o Keys) {
+	if o.Order != "" {
+		k.Order = o.Order
+	}
+	if o.Project != "" {
+		k.Project = o.Project
+	}
+	if o.Message != "" {
+		k.Message = o.Message
+	}
+	if o.Partner != "" {
+		k.Partner = o.Partner
+	}
+}
+
+// Name is the file the document arrived or was written as.
+func (d *Doc) Name() string {
+	return d.Entries[0].Doc
+}
+
+// Kind is the kind of the document's first entry.
+func (d *Doc) Kind() string {
+	return d.Entries[0].Kind
+}
+
+// State is the latest state recorded.
+func (d *Doc) State() string {
+	return d.Entries[len(d.Entries)-1].State
+}
+
+// Last is when the latest state was recorded.
+func (d *Doc) Last() time.Time {
+	return d.Entries[len(d.Entries)-1].Time
+}
+
+// At returns the latest entry of kind in state, nil if there is none.
+// An empty kind matches any.
+func (d *Doc) At(kind string, state string) *Entry {
+	for i := len(d.Entries) - 1; i >= 0; i-- {
+		e := &d.Entries[i]
+		if e.State == state && (kind == "" || e.Kind == kind) {
+			return e
+		}
+	}
+	return nil
+}
+
+// Match reports whether the document's field contains q, ignoring
+// case. field is order, project, message or partner; empty looks in
+// all of them, the file names and the ID.
+func (d *Doc) Match(field string, q string) bool {
+	q = strings.ToLower(strings.TrimSpace(q))
+	if q == "" {
+		return true
+	}
+	in := func(s string) bool { return strings.Contains(strings.ToLower(s), q) }
+	switch field {
+	case "order":
+		return in(d.Keys.Order)
+	case "project":
+		return in(d.Keys.Project)
+	case "message":
+		return in(d.Keys.Message)
+	case "partner":
+		return in(d.Keys.Partner)
+	}
+	if in(d.ID) || in(d.Keys.Order) || in(d.Keys.Project) || in(d.Keys.Message) || in(d.Keys.Partner) {
+		return true
+	}
+	for _, e := range d.Entries {
+		if in(e.Doc) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package ledger
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// index is the last entry of each document in one ledger file, and
+// the last correlation ID recorded for it, as of offset. Each lookup
+// reads only what was appended since the one before; the file being
+// replaced, or cut shorter by rotation, reads it afresh.
+type index struct {
+	mu     sync.Mutex
+	file   os.FileInfo
+	offset int64
+	last   map[string]Entry
+	ids    map[string]string
+}
+
+var (
+	indexesMu sync.Mutex
+	indexes   = make(map[string]*index)
+)
+
+// indexOf returns the index of the ledger at path, shared by every
+// lookup in the process.
+func indexOf(path string) *index {
+	indexesMu.Lock()
+	defer indexesMu.Unlock()
+	x := indexes[path]
+	if x == nil {
+		x = &index{}
+		indexes[path] = x
+	}
+	return x
+}
+
+// update reads the entries appended to path since the last update.
+// The caller holds x.mu.
+func (x *index) update(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if x.file == nil || !os.SameFile(x.file, fi) || fi.Size() < x.offset {
+		x.offset = 0
+		x.last = make(map[string]Entry)
+		x.ids = make(map[string]string)
+	}
+	x.file = fi
+	if _, err := f.Seek(x.offset, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReaderSize(f, 64*1024)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			// A line without its newline is still being written; it
+			// is read whole next time.
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		x.offset += int64(len(line))
+		var e Entry
+		if json.Unmarshal(line, &e) != nil {
+			continue
+		}
+		x.last[e.Doc] = e
+		if e.ID != "" {
+			x.ids[e.Doc] = e.ID
+		}
+	}
+}
@@ -0,0 +1,261 @@
+/*
+Package ledger records what happened to each document.
+
+Every service appends one JSON line per state change: a PO received,
+sent to the host, moved to processed or errors; a receipt written; a
+response uploaded. The lines are buffered and flushed every second and
+when the service shuts down. Several services may append to the same
+file, each flush is a single write to a file opened for append.
+
+Last and IDOf look a document up in an index kept for the life of the
+process, which reads only what was appended since the lookup before.
+The services keep the ledger open for appending, so it is rotated by
+copying and truncating it; the index is then read afresh, as it is for
+a ledger replaced between runs.
+*/
+package ledger
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// flushEvery is how long an entry may sit in the buffer.
+const flushEvery = time.Second
+
+// Document kinds.
+const (
+	PO       = "po"       // purchase order from the customer
+	Response = "response" // PO response for the customer
+	Receipt  = "receipt"  // MR receipt for the customer
+)
+
+// States a document moves through.
+const (
+	Received    = "received"    // arrived in the inbox
+	Importing   = "importing"   // XML_PO_import started
+	Parsed      = "parsed"      // read by XML_PO_import, keys known
+	Processed   = "processed"   // moved to processed
+	Failed      = "error"       // moved to errors
+	Retry       = "retry"       // parked in retry
+	Interrupted = "interrupted" // stopped by shutdown, picked up on restart
+	Written     = "written"     // response or receipt file written
+	Sent        = "sent"        // uploaded to the customer
+	SendFailed  = "send-failed" // upload failed
+	Reprocess   = "reprocess"   // put back in the inbox by an operator
+	Discarded   = "discarded"   // taken out of errors by an operator
+	Held        = "held"        // parked while its partner is paused
+	Resend      = "resend"      // put back in the outbox by an operator
+	// Acknowledged means the partner's 997 or 999 for it came, with
+	// its status as the detail.
+	Acknowledged = "acknowledged"
+	AckOverdue   = "ack-overdue" // the partner's 997 or 999 is late
+)
+
+// Keys are what operators look a document up by.
+type Keys struct {
+	Order   string `json:"order,omitempty"`
+	Project string `json:"project,omitempty"`
+	Message string `json:"message,omitempty"` // MessageID
+	Partner string `json:"partner,omitempty"`
+}
+
+// Entry is one line of the ledger.
+type Entry struct {
+	Time    time.Time `json:"time"`
+	ID      string    `json:"id,omitempty"` // correlation ID, see package edilog
+	Service string    `json:"service"`
+	Kind    string    `json:"kind"`
+	Doc     string    `json:"doc"` // file name, without the directory
+	State   string    `json:"state"`
+	Detail  string    `json:"detail,omitempty"`
+	Keys    *Keys     `json:"keys,omitempty"`
+}
+
+// Ledger appends entries to a file. A nil *Ledger records nothing,
+// for programs run without one.
+type Ledger struct {
+	service string
+
+	mu   sync.Mutex
+	f    *os.File
+	w    *bufio.Writer
+	err  error // first write error, reported by Flush
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Open opens the ledger at path for appending. Entries are recorded
+// as coming from service.
+func Open(path string, service string) (*Ledger, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l := &Ledger{
+		service: service,
+		f:       f,
+		w:       bufio.NewWriterSize(f, 64*1024),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go l.flusher()
+	return l, nil
+}
+
+// Record appends an entry for doc. id is the document's correlation
+// ID, "" if it has none.
+func (l *Ledger) Record(id string, kind string, doc string, state string, detail string) {
+	l.record(id, kind, doc, state, detail, nil)
+}
+
+// RecordKeys is Record for an entry that also gives the keys the
+// document is known by.
+func (l *Ledger) RecordKeys(id string, kind string, doc string, state string, detail string, keys Keys) {
+	l.record(id, kind, doc, state, detail, &keys)
+}
+
+func (l *Ledger) record(id string, kind string, doc string, state string, detail string, keys *Keys) {
+	if l == nil {
+		return
+	}
+	b, _ := json.Marshal(Entry{
+		Time:    time.Now(),
+		ID:      id,
+		Service: l.service,
+		Kind:    kind,
+		Doc:     doc,
+		State:   state,
+		Detail:  detail,
+		Keys:    keys,
+	})
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return
+	}
+	// Keep each flush whole lines so other writers never split one.
+	if l.w.Available() < len(b)+1 && l.w.Buffered() > 0 {
+		l.flush()
+	}
+	l.w.Write(append(b, '\n'))
+}
+
+// Flush writes out buffered entries.
+func (l *Ledger) Flush() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.flush()
+}
+
+func (l *Ledger) flush() error {
+	if l.f == nil {
+		return l.err
+	}
+	if err := l.w.Flush(); err != nil && l.err == nil {
+		l.err = err
+	}
+	return l.err
+}
+
+// Close flushes the ledger and closes the file.
+func (l *Ledger) Close() error {
+	if l == nil {
+		return nil
+	}
+	close(l.stop)
+	<-l.done
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.flush()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
+
+func (l *Ledger) flusher() {
+	defer close(l.done)
+	t := time.NewTicker(flushEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			l.Flush()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// Read returns every entry in the ledger at path, oldest first.
+// A line that does not parse, such as one cut short by a crash, is
+// skipped.
+func Read(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []Entry
+	err = Scan(f, func(e Entry) bool {
+		entries = append(entries, e)
+		return true
+	})
+	return entries, err
+}
+
+// Scan calls fn for each entry read from r until fn returns false.
+func Scan(r io.Reader, fn func(Entry) bool) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		var e Entry
+		if json.Unmarshal(s.Bytes(), &e) != nil {
+			continue
+		}
+		if !fn(e) {
+			return nil
+		}
+	}
+	if err := s.Err(); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// IDOf returns the correlation ID last recorded for doc in the ledger
+// at path, "" if there is none. public_output_service uses it to carry
+// the ID of an order on to the upload of its response.
+func IDOf(path string, doc string) string {
+	x := indexOf(path)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.update(path) != nil {
+		return ""
+	}
+	return x.ids[doc]
+}
+
+// Last returns the last entry recorded for doc in the ledger at path,
+// false if there is none. public_input_service uses it to give a file
+// an operator put back the correlation ID it had before.
+func Last(path string, doc string) (Entry, bool) {
+	x := indexOf(path)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.update(path) != nil {
+		return Entry{}, false
+	}
+	e, ok := x.last[doc]
+	return e, ok
+}
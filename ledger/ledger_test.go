@@ -0,0 +1,101 @@
+package ledger
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// appendLines appends s to the ledger at path as another writer would.
+func appendLines(t *testing.T, path string, s string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func line(id string, doc string, state string) string {
+	b, _ := json.Marshal(Entry{ID: id, Kind: PO, Doc: doc, State: state})
+	return string(b) + "\n"
+}
+
+func TestLookups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.jsonl")
+	tests := []struct {
+		name   string
+		change func()
+		doc    string
+		state  string // of the last entry, "" for none
+		id     string
+	}{
+		{"no ledger", func() {}, "a.xml", "", ""},
+		{"first entries", func() {
+			appendLines(t, path, line("id1", "a.xml", Received)+line("", "b.xml", Received))
+		}, "a.xml", Received, "id1"},
+		{"appended", func() {
+			appendLines(t, path, line("id1", "a.xml", Processed))
+		}, "a.xml", Processed, "id1"},
+		{"last entry without an ID", func() {
+			appendLines(t, path, line("", "a.xml", Reprocess))
+		}, "a.xml", Reprocess, "id1"},
+		{"bad line skipped", func() {
+			appendLines(t, path, "{not json\n"+line("id2", "b.xml", Failed))
+		}, "b.xml", Failed, "id2"},
+		{"line half written", func() {
+			l := line("id3", "b.xml", Sent)
+			appendLines(t, path, l[:10])
+		}, "b.xml", Failed, "id2"},
+		{"line finished", func() {
+			l := line("id3", "b.xml", Sent)
+			appendLines(t, path, l[10:])
+		}, "b.xml", Sent, "id3"},
+		{"truncated by rotation", func() {
+			if err := os.Truncate(path, 0); err != nil {
+				t.Fatal(err)
+			}
+			appendLines(t, path, line("id4", "c.xml", Received))
+		}, "a.xml", "", ""},
+		{"read afresh", func() {}, "c.xml", Received, "id4"},
+		{"replaced", func() {
+			tmp := path + ".new"
+			appendLines(t, tmp, line("id5", "c.xml", Written)+line("id5", "c.xml", Sent)+line("id6", "d.xml", Received))
+			if err := os.Rename(tmp, path); err != nil {
+				t.Fatal(err)
+			}
+		}, "c.xml", Sent, "id5"},
+	}
+	for _, tt := range tests {
+		tt.change()
+		e, ok := Last(path, tt.doc)
+		if ok != (tt.state != "") || e.State != tt.state {
+			t.Errorf("%s: Last(%s) = %s, %v; want %q", tt.name, tt.doc, e.State, ok, tt.state)
+		}
+		if id := IDOf(path, tt.doc); id != tt.id {
+			t.Errorf("%s: IDOf(%s) = %q, want %q", tt.name, tt.doc, id, tt.id)
+		}
+	}
+}
+
+func TestRecordLookup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.jsonl")
+	l, err := Open(path, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Record("id1", PO, "a.xml", Received, "")
+	l.Flush()
+	if e, ok := Last(path, "a.xml"); !ok || e.Service != "test" || e.State != Received {
+		t.Errorf("Last = %+v, %v", e, ok)
+	}
+	l.Record("id1", PO, "a.xml", Processed, "")
+	l.Close()
+	if e, ok := Last(path, "a.xml"); !ok || e.State != Processed {
+		t.Errorf("Last after another entry = %+v, %v", e, ok)
+	}
+}
@@ -0,0 +1,376 @@
+/*
+Package metrics keeps the programs' counters, gauges and histograms
+and serves them in the Prometheus text format.
+
+Metrics are declared once, as package variables, and registered in
+one registry per process:
+
+	var received = metrics.NewCounter("edi_files_received_total",
+		"Inbound files, by partner.", "partner")
+
+	received.Inc("ACMESHIP")
+
+The services serve the registry on /metrics, see package edihttp.
+XML_PO_import and XML_MR_Receipt live for one document, so they hand
+their counts to the service that started them instead: the service
+names a file in EDI_METRICS_FILE, the child Exports to it before it
+exits and the service Imports it.
+*/
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// EnvFile is the environment variable a child is told to Export to.
+const EnvFile = "EDI_METRICS_FILE"
+
+// DefBuckets are the histogram buckets for durations in seconds, from
+// a millisecond to ten minutes.
+var DefBuckets = []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 30, 60, 300, 600}
+
+// Metric types.
+const (
+	counter   = "counter"
+	gauge     = "gauge"
+	histogram = "histogram"
+)
+
+// family is one named metric and its series, one for each set of
+// label values.
+type family struct {
+	Name    string    `json:"name"`
+	Help    string    `json:"help"`
+	Type    string    `json:"type"`
+	Labels  []string  `json:"labels,omitempty"`
+	Buckets []float64 `json:"buckets,omitempty"`
+	Series  []*series `json:"series"`
+
+	mu     sync.Mutex
+	byKey  map[string]*series
+	funcOf func() float64 // a gauge read when scraped
+}
+
+type series struct {
+	Values []string  `json:"values,omitempty"`
+	Value  float64   `json:"value,omitempty"`  // counter or gauge
+	Counts []float64 `json:"counts,omitempty"` // histogram, per bucket and +Inf
+	Sum    float64   `json:"sum,omitempty"`
+	Count  float64   `json:"count,omitempty"`
+}
+
+var registry = struct {
+	sync.Mutex
+	byName map[string]*family
+}{byName: make(map[string]*family)}
+
+// register adds f, or returns the family already registered by its
+// name. Declaring a metric twice with different labels is a
+// programming error and panics.
+func register(f *family) *family {
+	registry.Lock()
+	defer registry.Unlock()
+	if old, ok := registry.byName[f.Name]; ok {
+		if old.Type != f.Type || strings.Join(old.Labels, ",") != strings.Join(f.Labels, ",") {
+			panic(fmt.Sprintf("metrics: %s registered twice", f.Name))
+		}
+		return old
+	}
+	f.byKey = make(map[string]*series)
+	registry.byName[f.Name] = f
+	return f
+}
+
+// with returns the series for the label values, made on first use.
+// f.mu held.
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.Labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d labels, got %d", f.Name, len(f.Labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s := f.byKey[key]
+	if s == nil {
+		s = &series{Values: append([]string(nil), values...)}
+		if f.Type == histogram {
+			s.Counts = make([]float64, len(f.Buckets)+1)
+		}
+		f.byKey[key] = s
+		f.Series = append(f.Series, s)
+	}
+	return s
+}
+
+// Counter only goes up.
+type Counter struct{ f *family }
+
+// NewCounter registers a counter with the given label names.
+func NewCounter(name string, help string, labels ...string) *Counter {
+	return &Counter{register(&family{Name: name, Help: help, Type: counter, Labels: labels})}
+}
+
+// Inc adds one to the series with the label values.
+func (c *Counter) Inc(values ...string) { c.Add(1, values...) }
+
+// Add adds v, which must not be negative.
+func (c *Counter) Add(v float64, values ...string) {
+	c.f.mu.Lock()
+	c.f.with(values).Value += v
+	c.f.mu.Unlock()
+}
+
+// Gauge goes up and down.
+type Gauge struct{ f *family }
+
+// NewGauge registers a gauge with the given label names.
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	return &Gauge{register(&family{Name: name, Help: help, Type: gauge, Labels: labels})}
+}
+
+// NewGaugeFunc registers a gauge without labels whose value is fn's
+// when it is scraped.
+func NewGaugeFunc(name string, help string, fn func() float64) {
+	f := register(&family{Name: name, Help: help, Type: gauge})
+	f.mu.Lock()
+	f.funcOf = fn
+	f.mu.Unlock()
+}
+
+// Set sets the series with the label values to v.
+func (g *Gauge) Set(v float64, values ...string) {
+	g.f.mu.Lock()
+	g.f.with(values).Value = v
+	g.f.mu.Unlock()
+}
+
+// Add adds v, which may be negative.
+func (g *Gauge) Add(v float64, values ...string) {
+	g.f.mu.Lock()
+	g.f.with(values).Value += v
+	g.f.mu.Unlock()
+}
+
+// Histogram counts observations, such as durations, into buckets.
+type Histogram struct{ f *family }
+
+// NewHistogram registers a histogram with the given upper bounds,
+// DefBuckets if nil, and label names.
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	return &Histogram{register(&family{Name: name, Help: help, Type: histogram, Labels: labels, Buckets: buckets})}
+}
+
+// Observe counts v in the series with the label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+	s := h.f.with(values)
+	i := sort.SearchFloat64s(h.f.Buckets, v)
+	s.Counts[i]++
+	s.Sum += v
+	s.Count++
+}
+
+// families returns the registered families sorted by name.
+func families() []*family {
+	registry.Lock()
+	defer registry.Unlock()
+	fs := make([]*family, 0, len(registry.byName))
+	for _, f := range registry.byName {
+		fs = append(fs, f)
+	}
+	sort.Slice(fs, func(i, j int) bool { return fs[i].Name < fs[j].Name })
+	return fs
+}
+
+// Write writes every metric in the Prometheus text format.
+func Write(w io.Writer) error {
+	for _, f := range families() {
+		if _, err := io.WriteString(w, f.text()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// text is f in the text format, "" while it has no series.
+func (f *family) text() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.funcOf != nil {
+		f.with(nil).Value = f.funcOf()
+	}
+	if len(f.Series) == 0 {
+		return ""
+	}
+	ss := append([]*series(nil), f.Series...)
+	sort.Slice(ss, func(i, j int) bool {
+		return strings.Join(ss[i].Values, "\xff") < strings.Join(ss[j].Values, "\xff")
+	})
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.Name, escape(f.Help, false), f.Name, f.Type)
+	for _, s := range ss {
+		if f.Type != histogram {
+			fmt.Fprintf(&b, "%s%s %s\n", f.Name, labels(f.Labels, s.Values, "", ""), number(s.Value))
+			continue
+		}
+		cum := 0.0
+		for i, le := range f.Buckets {
+			cum += s.Counts[i]
+			fmt.Fprintf(&b, "%s_bucket%s %s\n", f.Name, labels(f.Labels, s.Values, "le", number(le)), number(cum))
+		}
+		fmt.Fprintf(&b, "%s_bucket%s %s\n", f.Name, labels(f.Labels, s.Values, "le", "+Inf"), number(s.Count))
+		fmt.Fprintf(&b, "%s_sum%s %s\n", f.Name, labels(f.Labels, s.Values, "", ""), number(s.Sum))
+		fmt.Fprintf(&b, "%s_count%s %s\n", f.Name, labels(f.Labels, s.Values, "", ""), number(s.Count))
+	}
+	return b.String()
+}
+
+// Handler serves Write.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Write(w)
+	})
+}
+
+func labels(names []string, values []string, extra string, extraValue string) string {
+	if len(names) == 0 && extra == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("{")
+	for i, n := range names {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(n + `="` + escape(values[i], true) + `"`)
+	}
+	if extra != "" {
+		if len(names) > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(extra + `="` + extraValue + `"`)
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+func escape(s string, quote bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quote {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
+
+func number(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Export writes the counters and histograms to the file named in
+// EDI_METRICS_FILE, for the service that started this process. It
+// does nothing when the variable is not set.
+func Export() error {
+	name := os.Getenv(EnvFile)
+	if name == "" {
+		return nil
+	}
+	var out []json.RawMessage
+	for _, f := range families() {
+		if f.Type == gauge {
+			// A child's gauges mean nothing once it has gone.
+			continue
+		}
+		f.mu.Lock()
+		b, err := json.Marshal(f)
+		f.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		out = append(out, b)
+	}
+	b, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, b, 0600)
+}
+
+// Import adds the counts a child Exported to name to this process's,
+// and removes the file. A child that exported nothing, having died
+// first, is not an error. A metric the child declared differently,
+// a binary from another release, is skipped.
+func Import(name string) error {
+	b, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	os.Remove(name)
+	var in []*family
+	if err := json.Unmarshal(b, &in); err != nil {
+		return fmt.Errorf("metrics: %s: %v", name, err)
+	}
+	for _, c := range in {
+		f := adopt(c)
+		if f == nil {
+			continue
+		}
+		f.mu.Lock()
+		for _, cs := range c.Series {
+			if len(cs.Values) != len(f.Labels) {
+				continue
+			}
+			s := f.with(cs.Values)
+			s.Value += cs.Value
+			for i := range s.Counts {
+				if i < len(cs.Counts) {
+					s.Counts[i] += cs.Counts[i]
+				}
+			}
+			s.Sum += cs.Sum
+			s.Count += cs.Count
+		}
+		f.mu.Unlock()
+	}
+	return nil
+}
+
+// adopt returns the family to add an imported one to, registering it
+// if this process has not, or nil if it does not match.
+func adopt(c *family) *family {
+	if c.Type == gauge {
+		return nil
+	}
+	registry.Lock()
+	f, ok := registry.byName[c.Name]
+	registry.Unlock()
+	if !ok {
+		return register(&family{Name: c.Name, Help: c.Help, Type: c.Type, Labels: c.Labels, Buckets: c.Buckets})
+	}
+	if f.Type != c.Type || strings.Join(f.Labels, ",") != strings.Join(c.Labels, ",") ||
+		len(f.Buckets) != len(c.Buckets) {
+		return nil
+	}
+	return f
+}
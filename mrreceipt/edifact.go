@@ -0,0 +1,93 @@
+package mrreceipt
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cloud3000/BaseEDI/ediconfig"
+	"github.com/cloud3000/BaseEDI/edifact"
+	"github.com/cloud3000/BaseEDI/x12"
+)
+
+// edifactPackageTypes are the PAC03 package type codes, UN/ECE
+// recommendation 21, for MMTS package descriptions.
+var edifactPackageTypes = map[string]string{
+	"BOX":    "BX",
+	"BUNDLE": "BE",
+	"CARTON": "CT",
+	"CRATE":  "CR",
+	"DRUM":   "DR",
+	"PALLET": "PX",
+	"SKID":   "PX",
+}
+
+// edifactReceipt writes the receipt as the DESADV partner p takes,
+// named <partner>_MR_<contract>_<order>_DESADV_<time>.edi.
+func (s *Session) edifactReceipt(resp *MRresponse, p ediconfig.EDIFACTPartner) error {
+	t := time.Now()
+	pkg := resp.mrpackage
+	order := strings.Replace(pkg.ordernumber, "/", "_", -1)
+	newfn := fmt.Sprintf("%s%s_MR_%s_%s_DESADV_%s.edi", s.Dir, p.Name, pkg.contractnumber, order, t.Format("20060102150405"))
+	message := fmt.Sprintf("%s_%s_DESADV_%s", pkg.contractnumber, pkg.ordernumber, t.Format("20060102150405"))
+	s.log().Debug("Building MR DESADV", "partner", p.Name)
+
+	d := edifact.Despatch{
+		Number:   pkg.pkgid + t.Format("20060102150405"),
+		Date:     t,
+		Carrier:  pkg.carrier,
+		Tracking: pkg.trackingno,
+		Order:    pkg.ordernumber,
+		Project:  pkg.projectnumber,
+		Contract: pkg.contractnumber,
+	}
+	if r, err := x12.Date(pkg.daterecv, ""); err == nil {
+		d.Received = r
+	}
+	typ := edifactPackageTypes[strings.ToUpper(strings.TrimSpace(pkg.packagetype))]
+	if typ == "" {
+		typ = "PK"
+	}
+	ep := edifact.Package{
+		ID:        pkg.pkgid,
+		Type:      typ,
+		Weight:    strings.TrimSpace(pkg.pkgmeaweight),
+		Length:    strings.TrimSpace(pkg.pkgmealength),
+		Width:     strings.TrimSpace(pkg.pkgmeawidth),
+		Height:    strings.TrimSpace(pkg.pkgmeaheight),
+		Hazardous: pkg.hazcode,
+	}
+	if v := pkg.volume(); v > 0 {
+		ep.Volume = fmt.Sprintf("%.2f", v)
+	}
+	for _, l := range resp.mrline {
+		ep.Items = append(ep.Items, edifact.Item{
+			Line:        l.lineNumber,
+			Code:        l.materialItemCode,
+			Description: l.materialShortDescription,
+			Qty:         quantity(l.transactionquanity),
+			UOM:         l.unitofmeasure,
+		})
+	}
+	d.Packages = []edifact.Package{ep}
+
+	cfg := s.EDIFACT
+	env := edifact.Envelope{
+		Syntax:       cfg.Syntax,
+		Version:      cfg.Version,
+		SenderQual:   cfg.SenderQual,
+		Sender:       cfg.Sender,
+		ReceiverQual: p.Qual,
+		Receiver:     p.ID,
+		AckRequested: cfg.AckRequested,
+		Date:         t,
+	}
+	var err error
+	if env.Control, _, err = x12.OpenControls(s.EDIFACT.ControlFile).Next(); err != nil {
+		s.log().Error("Failed to number the DESADV", "err", err)
+		return err
+	}
+	w := edifact.NewWriter(env, edifact.DefaultDelimiters(env.Version), cfg.LineBreaks)
+	edifact.WriteDespatch(w, d, cfg.Release)
+	return s.written(newfn, w.Bytes(), message, resp)
+}
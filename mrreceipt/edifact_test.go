@@ -0,0 +1,105 @@
+package mrreceipt
+
+import (
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/cloud3000/BaseEDI/ediconfig"
+	"github.com/cloud3000/BaseEDI/edifact"
+	"github.com/cloud3000/BaseEDI/x12"
+)
+
+func TestEDIFACTReceipt(t *testing.T) {
+	tests := []struct {
+		packagetype string
+		pac         string // PAC03
+	}{
+		{"PALLET", "PX"},
+		{" carton ", "CT"},
+		{"ENVELOPE", "PK"},
+		{"", "PK"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.packagetype, func(t *testing.T) {
+			dir := t.TempDir()
+			controls := filepath.Join(dir, "edifactcontrol.json")
+			last, _, err := x12.OpenControls(controls).Next()
+			if err != nil {
+				t.Fatalf("Next: %v", err)
+			}
+			conn, peer := net.Pipe()
+			defer conn.Close()
+			defer peer.Close()
+			s := &Session{
+				Conn: conn,
+				Dir:  dir + "/",
+				// The X12 control file is not the one EDIFACT is
+				// numbered from.
+				X12: ediconfig.X12{ControlFile: filepath.Join(dir, "x12control.json")},
+				EDIFACT: ediconfig.EDIFACT{
+					Syntax: "UNOC", Version: "3", Release: "96A", SenderQual: "ZZZ", Sender: "BASEEDI",
+					ControlFile: controls, LineBreaks: true,
+				},
+			}
+			resp := &MRresponse{
+				mrpackage: repspackage{
+					pkgid: "PKG1", packagetype: tt.packagetype, carrier: "UPS", trackingno: "1Z9", daterecv: "240102",
+					pkgmeaweight: " 120.5", pkgmealength: "48", pkgmeawidth: "40", pkgmeaheight: "36",
+					ordernumber: "PO/123", projectnumber: "G41", contractnumber: "G41-9",
+				},
+				mrline: []respline{
+					{lineNumber: "1", materialItemCode: "ABC-1", materialShortDescription: "Widgets", transactionquanity: "  12.00", unitofmeasure: "EA"},
+				},
+			}
+			p := ediconfig.EDIFACTPartner{Name: "ACME", Qual: "ZZZ", ID: "ACMEID"}
+			if err := s.edifactReceipt(resp, p); err != nil {
+				t.Fatalf("edifactReceipt: %v", err)
+			}
+			if ok, _ := path.Match(dir+"/ACME_MR_G41-9_PO_123_DESADV_*.edi", s.File); !ok {
+				t.Errorf("written to %s", s.File)
+			}
+			if _, err := os.Stat(s.X12.ControlFile); !os.IsNotExist(err) {
+				t.Errorf("the X12 control file was used: %v", err)
+			}
+			b, err := os.ReadFile(s.File)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ic, err := edifact.Parse(b)
+			if err != nil {
+				t.Fatalf("Parse: %v\n%s", err, b)
+			}
+			if ic.Control != strconv.Itoa(last+1) || ic.Receiver != "ACMEID" || len(ic.Messages) != 1 {
+				t.Fatalf("UNB05 %s to %s, %d messages; want %d to ACMEID, 1", ic.Control, ic.Receiver, len(ic.Messages), last+1)
+			}
+			got := map[string]edifact.Segment{}
+			for _, seg := range ic.Messages[0].Segments {
+				if _, ok := got[seg.Tag]; !ok {
+					got[seg.Tag] = seg
+				}
+			}
+			if pac := got["PAC"].E(3); pac != tt.pac {
+				t.Errorf("PAC03 %q, want %q", pac, tt.pac)
+			}
+			if qty := got["QTY"].Elements[0]; len(qty) < 3 || qty[1] != "12" || qty[2] != "EA" {
+				t.Errorf("QTY %v, want 12 EA", qty)
+			}
+			if dtm := got["DTM"]; dtm.E(1) != "137" {
+				t.Errorf("first DTM %v, want the message date", dtm.Elements)
+			}
+			var received []string
+			for _, seg := range ic.Messages[0].Segments {
+				if seg.Tag == "DTM" && seg.E(1) == "50" {
+					received = seg.Elements[0]
+				}
+			}
+			if len(received) < 2 || received[1] != "20240102" {
+				t.Errorf("received DTM %v, want 20240102", received)
+			}
+		})
+	}
+}
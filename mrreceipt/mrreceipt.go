@@ -0,0 +1,481 @@
+/*
+Package mrreceipt receives a material receipt from MMTS and writes
+the XML MR Receipt file for the customer, or for a partner who takes
+X12 an 856 advance ship notice or an 861 receiving advice, and for one
+who takes EDIFACT a DESADV despatch advice.
+
+MMTS sends one ITEM=value record at a time over an EDI socket and
+ends the session with EDIEOF. A Session is one such connection. It
+used to be all of XML_MR_Receipt, which private_input_service started
+for every connection. private_input_service now runs sessions in its
+own goroutines and XML_MR_Receipt is kept for -isolate mode.
+*/
+package mrreceipt
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloud3000/BaseEDI/ediconfig"
+	"github.com/cloud3000/BaseEDI/ledger"
+	"github.com/cloud3000/BaseEDI/notify"
+	"github.com/cloud3000/ediserversocks" // serveredi EDI Socket server lib
+)
+
+// ErrTimeout means MMTS went quiet and the session timed out,
+// nothing was written and MMTS may send the receipt again.
+var ErrTimeout = errors.New("MR session timed out")
+
+// Session is one MR receipt connection from MMTS.
+type Session struct {
+	Conn net.Conn
+	Dir  string // where receipt files are written, ends in a slash
+	// Client is the identity from the client certificate, "" without one.
+	Client string
+	// ID is the correlation ID of the receipt, see package edilog.
+	ID string
+
+	RecordTimeout  time.Duration // deadline for each record
+	SessionTimeout time.Duration // deadline for the whole session
+
+	// Notifier, which may be nil, hears about receipts and failures.
+	Notifier notify.Notifier
+
+	// Ledger, which may be nil, records the receipt written or the
+	// session that failed.
+	Ledger *ledger.Ledger
+
+	// X12 names the partners whose receipts are sent as X12, and how
+	// it is written. The zero value writes every receipt as XML.
+	X12 ediconfig.X12
+
+	// EDIFACT names the partners whose receipts are sent as EDIFACT,
+	// after those in X12, and how it is written.
+	EDIFACT ediconfig.EDIFACT
+
+	// File is the receipt file written, set once Run succeeds.
+	File string
+
+	resp    MRresponse
+	lineidx int
+	keys    ledger.Keys // of the receipt written
+}
+
+type credent struct {
+	domain   string
+	identity string
+}
+
+type repsattribute struct {
+	attrval string
+	name    string
+}
+
+type repspackage struct {
+	pkgno          string
+	pkgid          string
+	parentpkgid    string
+	action         string
+	trackingno     string // MR-NO
+	origtrackingno string
+	packagetype    string
+	pkgname        string
+	carrier        string
+	atpacker       string
+	daterecv       string // MRHEAD-DATE-RECV as MMTS sends it, YYMMDD
+	datepacked     string
+	hazcode        string
+	// Package unit of measure
+	pkguomweight string
+	pkguomlength string
+	pkguomwidth  string
+	pkguomheight string
+	pkguomvolume string
+	// Measured unit values
+	pkgmeaweight string
+	pkgmealength string
+	pkgmeawidth  string
+	pkgmeaheight string
+	pkgmeavolume string
+	//
+	ordernumber    string
+	projectnumber  string
+	contractnumber string
+}
+
+type respline struct {
+	lineNumber               string
+	sublineNumber            string
+	transactionquanity       string
+	packlistquanity          string
+	damagedquanity           string
+	materialItemCode         string // 91G5999000378
+	materialItemSize         string // 48x32x15
+	materialType             string // >B<
+	materialShortDescription string // >ASSEMBLY, LCD, 20X4, ALPH-NUM, W/ CBL</MaterialShortDescription>
+	uom                      string // >EA</UnitOfMeasure>
+	unitofmeasure            string // >EA</UnitOfMeasure>
+	shippingQty              string // >1</ShippingQty>
+	shippingUOM              string // >EAS</ShippingUOM>
+	dateAtPacker             string //>05JAN17</DateAtPacker>
+	IsAsset                  string
+	assetNo                  string // </Asset>
+	assetuid                 string
+	SerialNumber             string
+	Manufacture              string
+	ModelNo                  string
+	Sensitive                string
+	ClientReportTable        string
+	UIDSerialNumber          string
+	UIDType                  string
+}
+
+// MRresponse is the XML structure for the material receipt.
+type MRresponse struct {
+	message   string
+	timestamp string
+	version   string
+	from      credent
+	to        credent
+	attr      []repsattribute
+	mrpackage repspackage
+	mrline    []respline
+	Summary   struct {
+		TotalLineItems string `xml:"TotalLineItems"`
+		TotalPackages  string `xml:"TotalPackages"`
+	} `xml:"Summary"`
+}
+
+func (s *Session) notify(ev notify.Event) {
+	if s.Notifier != nil {
+		ev.ID = s.ID
+		s.Notifier.Notify(ev)
+	}
+}
+
+// log is the logger for the session's records.
+func (s *Session) log() *slog.Logger {
+	return slog.With("id", s.ID, "client", s.client())
+}
+
+// Run receives the receipt and writes the file. The connection is
+// closed when Run returns. A session that timed out returns ErrTimeout,
+// any error has already been sent to the Notifier.
+func (s *Session) Run() error {
+	err := s.run()
+	if err != nil {
+		// There is no file to name a failed session by.
+		s.Ledger.Record(s.ID, ledger.Receipt, fmt.Sprintf("MR from %s", s.client()), ledger.Failed, err.Error())
+	} else {
+		s.Ledger.RecordKeys(s.ID, ledger.Receipt, path.Base(s.File), ledger.Written, s.client(), s.keys)
+	}
+	return err
+}
+
+func (s *Session) run() error {
+	conn := s.Conn
+	mrResp := &s.resp
+	var locaddr = conn.LocalAddr()
+	var remaddr = conn.RemoteAddr()
+	s.log().Info("MR request received", "local", locaddr.String(), "remote", remaddr.String())
+	var received int
+	mrResp.from.domain = "customer.com"
+	mrResp.from.identity = "MaterialManager@customer.com"
+	mrResp.to.domain = "customer.com"
+	mrResp.to.identity = "MaterialManager@customer.com"
+	mrResp.attr = append(mrResp.attr,
+		repsattribute{
+			name:    "SourceSystem",
+			attrval: "MatMan",
+		})
+	mrResp.attr = append(mrResp.attr,
+		repsattribute{
+			name:    "SourceSystemVersion",
+			attrval: " ",
+		})
+
+	mrResp.mrpackage.action = "Receipt"
+	sessionDeadline := time.Now().Add(s.SessionTimeout)
+	// Now we start receiving datastr records from MMTS in this for loop
+	for received = 0; ; received++ {
+		// Each record must arrive within RecordTimeout, and all of them
+		// before the session deadline.
+		deadline := time.Now().Add(s.RecordTimeout)
+		if sessionDeadline.Before(deadline) {
+			deadline = sessionDeadline
+		}
+		conn.SetDeadline(deadline)
+		datastr, status := serveredi.Recv(conn)
+		if status.Number != 0 {
+			timedout := !time.Now().Before(deadline)
+			errstr := fmt.Sprintf("%s Error=%d", status.Message, status.Number)
+			s.log().Error("MR receive failed", "errno", status.Number, "err", status.Message,
+				"timedout", timedout, "records", received)
+			etype, esub := notify.MRNetwork, "[EDI] MR_Receipt Network Error"
+			if timedout {
+				etype, esub = notify.MRTimeout, "[EDI] MR_Receipt Timeout"
+				status.Message = fmt.Sprintf("%s (no data from %v %s, %d records received)",
+					status.Message, remaddr, s.Client, received)
+			}
+			s.notify(notify.Event{
+				Type:    etype,
+				Subject: esub,
+				Fields: notify.F(
+					"Operation", status.Op,
+					"Error Number", strconv.Itoa(status.Number),
+					"Error Message", status.Message),
+			})
+			serveredi.Disconnect(conn)
+			if timedout {
+				return ErrTimeout
+			}
+			return errors.New(errstr)
+		}
+		// MMTS will tell us when it's done sending data
+		if datastr[0:status.Len] == "EDIEOF" {
+			break
+		}
+
+		// Data records from MMTS contain data item and data value
+		// separated by '=', so we will split these in two.
+		netvalSplit := strings.Split(datastr[0:status.Len], "=")
+		if len(netvalSplit) != 2 {
+			continue
+		}
+		s.record(netvalSplit[0], netvalSplit[1])
+	}
+	s.log().Info("MR records received", "records", received)
+	serveredi.Disconnect(conn)
+	mrResp.Summary.TotalLineItems = fmt.Sprintf("%d", s.lineidx)
+	mrResp.Summary.TotalPackages = "1"
+	if p, ok := s.X12.Partner(mrResp.mrpackage.contractnumber); ok && p.Receipts != "xml" {
+		return s.x12Receipt(mrResp, p)
+	}
+	if p, ok := s.EDIFACT.Partner(mrResp.mrpackage.contractnumber); ok && p.Receipts != "xml" {
+		return s.edifactReceipt(mrResp, p)
+	}
+	return s.xmlResponce(mrResp)
+}
+
+// record loads one data item from MMTS into the receipt.
+func (s *Session) record(item string, value string) {
+	mrResp := &s.resp
+	//
+	//		Based on data item name, we will start
+	//    loading the XML structure with data values.
+	//
+	//		mrResp.mrpackage.parentpkgid = "CCMR1701057775"
+	//		mrResp.mrpackage.trackingno = "CCMR1701057775"
+	//if item == "PKGDETL-MR-NO" {
+	//	mrResp.mrpackage.parentpkgid = value
+	//	mrResp.mrpackage.trackingno = value
+	//}
+
+	//		mrResp.mrpackage.pkgid = "000001" //
+	if item == "PKGDETL-PKG-NO" {
+		mrResp.mrpackage.pkgid = value
+		mrResp.mrpackage.trackingno = value
+	}
+
+	if item == "PKGDETL-PackageNumber" {
+		mrResp.mrpackage.pkgno = value
+	}
+
+	//		mrResp.mrpackage.packagetype = "PALLET"
+	//		mrResp.mrpackage.pkgname = "PALLET"
+	if item == "PKG-DESCRIPTION" {
+		mrResp.mrpackage.packagetype = value
+		mrResp.mrpackage.pkgname = value
+	}
+
+	//		mrResp.mrpackage.carrier = "FEDEX"
+	if item == "MRHEAD-CARRIER" {
+		mrResp.mrpackage.carrier = value
+	}
+
+	//	mrResp.mrpackage.atpacker = "27JAN17"
+	if item == "MRHEAD-DATE-RECV" {
+		mrResp.mrpackage.atpacker = dateFromMMTS(value)
+		mrResp.mrpackage.daterecv = value
+	}
+
+	// MRHEAD-UN-NO=199600
+	if item == "MRHEAD-UN-NO" {
+		haz := strings.Replace(value, "000000", "", -1)
+		if len(haz) > 1 {
+			mrResp.mrpackage.hazcode = haz
+		}
+	}
+
+	// POHEAD-REQ-NO=L414100153
+	if item == "POHEAD-REQ-NO" {
+		mrResp.mrpackage.projectnumber = value
+	}
+
+	// POHEAD-PROJECT-CODE=G41
+	if item == "POHEAD-PROJECT-CODE" {
+		mrResp.mrpackage.contractnumber = value
+	}
+
+	// MRHEAD-PO-NO=P2-G-H41-701052
+	// mrResp.mrpackage.ordernumber = "P2-PC-H03-231100"
+	if item == "MRHEAD-PO-NO" {
+		mrResp.mrpackage.ordernumber = value
+	}
+
+	//PKGDETL-LENGTH
+	if item == "PKGDETL-LENGTH" {
+		mrResp.mrpackage.pkgmealength = value
+	}
+	//PKGDETL-WIDTH
+	if item == "PKGDETL-WIDTH" {
+		mrResp.mrpackage.pkgmeawidth = value
+	}
+	//PKGDETL-HEIGHT
+	if item == "PKGDETL-HEIGHT" {
+		mrResp.mrpackage.pkgmeaheight = value
+	}
+	//PKGDETL-TOT-LBS
+	if item == "PKGDETL-TOT-LBS" {
+		mrResp.mrpackage.pkgmeaweight = value
+	}
+
+	if item == "MRDETL-MR-ITEM-NO" {
+		s.lineidx++
+		mrResp.mrline = append(mrResp.mrline, respline{})
+		mrResp.mrline[s.lineidx-1].dateAtPacker = mrResp.mrpackage.atpacker
+		mrResp.mrline[s.lineidx-1].damagedquanity = "0"
+	}
+	if !strings.HasPrefix(item, "MRDETL-") && !strings.HasPrefix(item, "PODET") {
+		return
+	}
+	if s.lineidx == 0 {
+		// A line item before MRDETL-MR-ITEM-NO has no line to go on.
+		s.log().Warn("MR item before the first MRDETL-MR-ITEM-NO ignored", "item", item)
+		return
+	}
+	line := &mrResp.mrline[s.lineidx-1]
+
+	// MRDETL-ITEM-REF=    1
+	// mrResp.mrline[0].lineNumber = 1
+	if item == "MRDETL-ITEM-REF" {
+		line.lineNumber = strings.TrimSpace(value)
+	}
+
+	// MRDETL-RECV-QTY=     1.00
+	// mrResp.mrline[0].transactionquanity = 1
+	if item == "MRDETL-RECV-QTY" {
+		line.transactionquanity = strings.TrimSpace(value)
+		line.packlistquanity = strings.TrimSpace(value)
+		line.shippingQty = strings.TrimSpace(value)
+	}
+
+	// PODETL-ITEMNO=91G5999000378
+	if item == "PODETL-ITEMNO" {
+		line.materialItemCode = value
+	}
+
+	// PODETL-ITEMNO-DESCR=ASSEMBLY, LCD, 20X4, ALPH-NUM, W/ CBLMAINSTREAM REEFER MRU
+	if item == "PODETL-ITEMNO-DESCR" {
+		line.materialShortDescription = value
+	}
+	if item == "PODETD-MaterialItemSize" {
+		line.materialItemSize = value
+	}
+	// mrResp.mrline[1].materialType = "B"
+	if item == "PODETD-MaterialType" {
+		line.materialType = value
+	}
+
+	if item == "PODETL-UNIT-MEA" {
+		line.unitofmeasure = value
+		line.uom = ""
+	}
+
+	if item == "PODETL-UOM" {
+		line.uom = value
+	}
+	//line.sublineNumber = "0"
+
+	if item == "PODETL-IsAsset" {
+		line.IsAsset = value
+	}
+	if item == "PODETL-assetNo" {
+		line.assetNo = value
+	}
+	if item == "PODETL-assetUID" {
+		line.assetuid = value
+	}
+	if item == "PODETL-SerialNumber" {
+		line.SerialNumber = value
+	}
+	if item == "PODETL-Manufacture" {
+		line.Manufacture = value
+	}
+	if item == "PODETL-ModelNo" {
+		line.ModelNo = value
+	}
+	if item == "PODETL-Sensitive" {
+		line.Sensitive = value
+	}
+	if item == "PODETL-ClientReportTable" {
+		line.ClientReportTable = value
+	}
+	if item == "PODETL-UIDSerialNumber" {
+		line.UIDSerialNumber = value
+	}
+	if item == "PODETL-UIDType" {
+		line.UIDType = value
+	}
+}
+
+func dateFromMMTS(mmtsdate string) string {
+	if len(mmtsdate) < 6 {
+		return mmtsdate
+	}
+	yr := mmtsdate[0:2]
+	mo := mmtsdate[2:4]
+	da := mmtsdate[4:6]
+	switch mo {
+	case "01":
+		return fmt.Sprintf("%s%s%s", da, "JAN", yr)
+	case "02":
+		return fmt.Sprintf("%s%s%s", da, "FEB", yr)
+	case "03":
+		return fmt.Sprintf("%s%s%s", da, "MAR", yr)
+	case "04":
+		return fmt.Sprintf("%s%s%s", da, "APR", yr)
+	case "05":
+		return fmt.Sprintf("%s%s%s", da, "MAY", yr)
+	case "06":
+		return fmt.Sprintf("%s%s%s", da, "JUN", yr)
+	case "07":
+		return fmt.Sprintf("%s%s%s", da, "JUL", yr)
+	case "08":
+		return fmt.Sprintf("%s%s%s", da, "AUG", yr)
+	case "09":
+		return fmt.Sprintf("%s%s%s", da, "SEP", yr)
+	case "10":
+		return fmt.Sprintf("%s%s%s", da, "OCT", yr)
+	case "11":
+		return fmt.Sprintf("%s%s%s", da, "NOV", yr)
+	case "12":
+		return fmt.Sprintf("%s%s%s", da, "DEC", yr)
+	default:
+		return fmt.Sprintf("%s%s%s", da, "???", yr)
+	}
+}
+
+// client names who sent the receipt for the notifications.
+func (s *Session) client() string {
+	if s.Client == "" {
+		return fmt.Sprintf("%v", s.Conn.RemoteAddr())
+	}
+	return fmt.Sprintf("%s (%v)", s.Client, s.Conn.RemoteAddr())
+}
@@ -0,0 +1,290 @@
+package mrreceipt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloud3000/BaseEDI/ledger"
+	"github.com/cloud3000/BaseEDI/notify"
+)
+
+// xmlResponce writes the receipt file into s.Dir.
+func (s *Session) xmlResponce(resp *MRresponse) error {
+	type packageuom struct {
+		XMLName    xml.Name `xml:"PackageUOM"`
+		UOM        string   `xml:"uom,attr"`
+		PackageUOM string   `xml:",chardata"`
+	}
+
+	type attributes struct {
+		XMLName   xml.Name `xml:"Attribute"`
+		Name      string   `xml:"name,attr"`
+		Attribute string   `xml:",chardata"`
+	}
+
+	type repsattribute struct {
+		name    string
+		attrval string
+	}
+
+	type unitofmeasure struct {
+		XMLName       xml.Name `xml:"UnitOfMeasure"`
+		Uom           string   `xml:",attr"`
+		UnitOfMeasure string   `xml:",chardata"`
+	}
+	type lineasset struct {
+		XMLName           xml.Name `xml:"Asset"`
+		AssetNo           string   `xml:"assetNo,attr"`
+		AssetUID          string   `xml:"assetUID,attr"`
+		SerialNumber      string   `xml:",chardata"`
+		Manufacture       string   `xml:",chardata"`
+		ModelNo           string   `xml:",chardata"`
+		Sensitive         string   `xml:",chardata"`
+		UIDSerialNumber   string   `xml:",chardata"`
+		ClientReportTable string   `xml:",chardata"`
+		UIDType           string   `xml:",chardata"`
+	}
+
+	type lnstruct struct {
+		LineNumber               string `xml:"lineNumber,attr"`
+		SublineNumber            string `xml:"sublineNumber,attr"`
+		Transactionquanity       string `xml:"transactionquanity,attr"`
+		Packlistquanity          string `xml:"packlistquanity,attr"`
+		Damagedquanity           string `xml:"damagedquanity,attr"`
+		MaterialItemCode         string `xml:"MaterialItemCode"`
+		MaterialItemSize         string `xml:"MaterialItemSize"`
+		MaterialType             string `xml:"MaterialType"`
+		ExternalSubItemNumber    string `xml:"ExternalSubItemNumber"`
+		MaterialShortDescription string `xml:"MaterialShortDescription"`
+		UnitOfMeasure            packageuom
+		ShippingQty              string `xml:"ShippingQty"`
+		ShippingUOM              string `xml:"ShippingUOM"`
+		DateAtPacker             string `xml:"DateAtPacker"`
+		Asset                    lineasset
+	}
+
+	type fXML struct {
+		MessageID string `xml:"MessageID,attr"`
+		Timestamp string `xml:"timestamp,attr"`
+		Version   string `xml:"version,attr"`
+		Header    struct {
+			From struct {
+				Credential struct {
+					Domain   string `xml:"domain,attr"`
+					Identity string `xml:"Identity"`
+				} `xml:"Credential"`
+			} `xml:"From"`
+			To struct {
+				Credential struct {
+					Domain   string `xml:"domain,attr"`
+					Identity string `xml:"Identity"`
+				} `xml:"Credential"`
+			} `xml:"To"`
+			Attributes struct {
+				Attribute []attributes
+			}
+		} `xml:"Header"`
+		Package struct {
+			PackageID              string `xml:"packageID,attr"`
+			ParentpackageID        string `xml:"parentpackageID,attr"`
+			Action                 string `xml:"action,attr"`
+			PackageNumber          string `xml:"PackageNumber"`
+			WebLink                string `xml:"WebLink"`
+			SRN                    string `xml:"SRN"`
+			TrackingNo             string `xml:"TrackingNo"`
+			OriginalTrackingNo     string `xml:"OriginalTrackingNo"`
+			PackageType            string `xml:"PackageType"`
+			InvoiceNo              string `xml:"InvoiceNo"`
+			PackageName            string `xml:"PackageName"`
+			Carrier                string `xml:"Carrier"`
+			CarrierDocumentNo      string `xml:"CarrierDocumentNo"`
+			AtPacker               string `xml:"AtPacker"`
+			DatePacked             string `xml:"DatePacked"`
+			DepartureDate          string `xml:"DepartureDate"`
+			DestinationArrivalDate string `xml:"DestinationArrivalDate"`
+			DateCustoms            string `xml:"DateCustoms"`
+			DateMisc1              string `xml:"DateMisc1"`
+			DateMisc2              string `xml:"DateMisc2"`
+			DateMisc3              string `xml:"DateMisc3"`
+			SealNo                 string `xml:"SealNo"`
+			UNHazard               struct {
+				Unhazcode string `xml:"unhazcode,attr"`
+			} `xml:"UNHazard"`
+			// Weight, length, width, height and volume, in that order.
+			// encoding/xml will not marshal five fields of one element name.
+			PackageUOM           []packageuom
+			PackageMeasureWeight string `xml:"PackageMeasureWeight"`
+			PackageMeasureLength string `xml:"PackageMeasureLength"`
+			PackageMeasureWidth  string `xml:"PackageMeasureWidth"`
+			PackageMeasureHeight string `xml:"PackageMeasureHeight"`
+			PackageMeasureVolume string `xml:"PackageMeasureVolume"`
+
+			Order struct {
+				OrderNumber    string     `xml:"orderNumber,attr"`
+				ProjectNumber  string     `xml:"ProjectNumber"`
+				ContractNumber string     `xml:"ContractNumber"`
+				Line           []lnstruct `xml:"Line"`
+			} `xml:"Order"`
+		} `xml:"Package"`
+		Summary struct {
+			TotalLineItems string `xml:"TotalLineItems"`
+			TotalPackages  string `xml:"TotalPackages"`
+		} `xml:"Summary"`
+	}
+
+	s.log().Debug("Building MR response")
+	var vol float32
+	rdata := &fXML{}
+	t := time.Now()
+	rdata.MessageID = resp.message
+	rdata.Timestamp = t.Format("2006-01-02T15:04:05")
+	rdata.Version = "1.0"
+	rdata.Header.From.Credential.Domain = resp.from.domain
+	rdata.Header.From.Credential.Identity = resp.from.identity
+	rdata.Header.To.Credential.Domain = resp.to.domain
+	rdata.Header.To.Credential.Identity = resp.to.identity
+
+	for rat := range resp.attr {
+		rdata.Header.Attributes.Attribute = append(rdata.Header.Attributes.Attribute,
+			attributes{
+				Attribute: resp.attr[rat].attrval,
+				Name:      resp.attr[rat].name,
+			})
+	}
+
+	rdata.Package.Action = resp.mrpackage.action
+	rdata.Package.PackageID = resp.mrpackage.pkgid
+	rdata.Package.PackageNumber = resp.mrpackage.pkgno
+	rdata.Package.ParentpackageID = resp.mrpackage.parentpkgid
+	rdata.Package.TrackingNo = resp.mrpackage.trackingno
+	rdata.Package.PackageType = resp.mrpackage.packagetype
+	rdata.Package.PackageName = resp.mrpackage.pkgname
+	rdata.Package.Carrier = resp.mrpackage.carrier
+	rdata.Package.AtPacker = resp.mrpackage.atpacker
+	rdata.Package.DatePacked = resp.mrpackage.datepacked
+	rdata.Package.UNHazard.Unhazcode = resp.mrpackage.hazcode
+	rdata.Package.PackageUOM = []packageuom{
+		{UOM: "LB"},
+		{UOM: "IN"},
+		{UOM: "IN"},
+		{UOM: "IN"},
+		{UOM: "FT3"},
+	}
+	rdata.Package.PackageMeasureWeight = strings.TrimSpace(resp.mrpackage.pkgmeaweight)
+	rdata.Package.PackageMeasureLength = strings.TrimSpace(resp.mrpackage.pkgmealength)
+	rdata.Package.PackageMeasureWidth = strings.TrimSpace(resp.mrpackage.pkgmeawidth)
+	rdata.Package.PackageMeasureHeight = strings.TrimSpace(resp.mrpackage.pkgmeaheight)
+	vol = resp.mrpackage.volume()
+	s.log().Debug("MR package measured", "volume", vol)
+	rdata.Package.PackageMeasureVolume = fmt.Sprintf("%6.6f", vol)
+	rdata.Package.Order.OrderNumber = resp.mrpackage.ordernumber
+	rdata.Package.Order.ProjectNumber = resp.mrpackage.projectnumber
+	rdata.Package.Order.ContractNumber = resp.mrpackage.contractnumber
+
+	for lnidx := range resp.mrline {
+		rdata.Package.Order.Line = append(rdata.Package.Order.Line,
+			lnstruct{
+				LineNumber:               resp.mrline[lnidx].lineNumber,
+				Transactionquanity:       resp.mrline[lnidx].transactionquanity,
+				SublineNumber:            "0",
+				Packlistquanity:          resp.mrline[lnidx].packlistquanity,
+				Damagedquanity:           resp.mrline[lnidx].damagedquanity,
+				MaterialItemCode:         resp.mrline[lnidx].materialItemCode,
+				MaterialItemSize:         resp.mrline[lnidx].materialItemSize,
+				MaterialShortDescription: resp.mrline[lnidx].materialShortDescription,
+				ShippingQty:              resp.mrline[lnidx].shippingQty,
+				DateAtPacker:             resp.mrline[lnidx].dateAtPacker,
+				UnitOfMeasure: packageuom{
+					PackageUOM: resp.mrline[lnidx].unitofmeasure,
+					UOM:        resp.mrline[lnidx].uom},
+				MaterialType: resp.mrline[lnidx].materialType,
+			})
+	}
+	rdata.Summary.TotalLineItems = resp.Summary.TotalLineItems
+	rdata.Summary.TotalPackages = resp.Summary.TotalPackages
+	//
+	// Set Filename with full path
+	cpath := s.Dir
+	newfn := fmt.Sprintf("%scustomer_MR_%s_%s_RECEIPTS_%s.xml",
+		cpath,
+		resp.mrpackage.contractnumber,
+		strings.Replace(resp.mrpackage.ordernumber, "/", "_", -1),
+		t.Format("20060102150405"))
+
+	rdata.MessageID = fmt.Sprintf("%s_%s_RECEIPTS_%s",
+		resp.mrpackage.contractnumber,
+		resp.mrpackage.ordernumber,
+		t.Format("2006010215040"))
+
+	if m, err2 := xml.MarshalIndent(rdata, "", "\t"); err2 != nil {
+		s.notify(notify.Event{
+			Type:    notify.MRError,
+			Subject: "[EDI] MR Response Error: ",
+			Partner: notify.PartnerOf(newfn),
+			Fields: notify.F(
+				"Transfer Filename", path.Base(newfn),
+				"MR-PkgID#", resp.mrpackage.pkgid,
+				"Error", fmt.Sprintf("xml.MarshalIndent FAILED:%s ", err2.Error())),
+		})
+		return err2
+	} else {
+		xmlheader := fmt.Sprintf("<?xml version=\"1.0\" encoding=\"ISO-8859-1\" ?>\n")
+		m = append([]byte(xmlheader), m...)
+		return s.written(newfn, []byte(fmt.Sprintf("%s\n\n\n", m)), rdata.MessageID, resp)
+	}
+}
+
+// written writes the receipt file newfn, b, and tells who is to know.
+func (s *Session) written(newfn string, b []byte, message string, resp *MRresponse) error {
+	s.keys = ledger.Keys{
+		Order:   resp.mrpackage.ordernumber,
+		Project: resp.mrpackage.projectnumber,
+		Message: message,
+		Partner: notify.PartnerOf(newfn),
+	}
+	ioerr := os.WriteFile(newfn, b, 0644)
+	if ioerr != nil {
+		s.log().Error("Failed to write MR receipt", "file", newfn, "err", ioerr)
+		s.notify(notify.Event{
+			Type:    notify.MRError,
+			Subject: "[EDI] MR Response Error: ",
+			Partner: notify.PartnerOf(newfn),
+			Fields: notify.F(
+				"Transfer Filename", path.Base(newfn),
+				"MR-PkgID#", resp.mrpackage.pkgid,
+				"Error", fmt.Sprintf("os.WriteFile FAILED: %s ", ioerr.Error())),
+		})
+		return ioerr
+	}
+	s.notify(notify.Event{
+		Type:    notify.MRReceipt,
+		Subject: fmt.Sprintf("[EDI] MR Response  PkgID: %s", resp.mrpackage.pkgid),
+		Partner: notify.PartnerOf(newfn),
+		Fields: notify.F(
+			"Transfer Filename", path.Base(newfn),
+			"MR-PkgID#", resp.mrpackage.pkgid,
+			"Status", "Response file created Successfully.",
+			"Client", s.client()),
+		Attachments: []notify.Attachment{{Path: newfn}},
+	})
+	s.File = newfn
+	s.log().Info("MR receipt written", "file", newfn)
+	return nil
+}
+
+// volume is the package's volume in cubic feet, from its measures in
+// inches.
+func (p *repspackage) volume() float32 {
+	w, _ := strconv.ParseFloat(strings.TrimSpace(p.pkgmeawidth), 64)
+	l, _ := strconv.ParseFloat(strings.TrimSpace(p.pkgmealength), 64)
+	h, _ := strconv.ParseFloat(strings.TrimSpace(p.pkgmeaheight), 64)
+	wft := float32(w / 12)
+	lft := float32(l / 12)
+	hft := float32(h / 12)
+	return float32(lft * wft * hft)
+}
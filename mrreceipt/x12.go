@@ -0,0 +1,168 @@
+package mrreceipt
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cloud3000/BaseEDI/ediconfig"
+	"github.com/cloud3000/BaseEDI/x12"
+)
+
+// packageTypes are the TD101 packaging codes for MMTS package
+// descriptions.
+var packageTypes = map[string]string{
+	"BOX":    "BOX",
+	"BUNDLE": "BDL",
+	"CARTON": "CTN",
+	"CRATE":  "CRT",
+	"DRUM":   "DRM",
+	"PALLET": "PLT",
+	"SKID":   "SKD",
+}
+
+// x12Receipt writes the receipt as the X12 document partner p takes,
+// an 856 advance ship notice or an 861 receiving advice.
+func (s *Session) x12Receipt(resp *MRresponse, p ediconfig.X12Partner) error {
+	if p.Receipts == "861" {
+		return s.x12Advice(resp, p)
+	}
+	return s.x12ASN(resp, p)
+}
+
+// x12ASN writes the receipt as an 856, named
+// <partner>_MR_<contract>_<order>_ASN_<time>.x12.
+func (s *Session) x12ASN(resp *MRresponse, p ediconfig.X12Partner) error {
+	t := time.Now()
+	pkg := resp.mrpackage
+	order := strings.Replace(pkg.ordernumber, "/", "_", -1)
+	newfn := fmt.Sprintf("%s%s_MR_%s_%s_ASN_%s.x12", s.Dir, p.Name, pkg.contractnumber, order, t.Format("20060102150405"))
+	message := fmt.Sprintf("%s_%s_ASN_%s", pkg.contractnumber, pkg.ordernumber, t.Format("20060102150405"))
+	s.log().Debug("Building MR 856", "partner", p.Name)
+
+	ship := x12.Shipment{
+		ID:       pkg.pkgid + t.Format("20060102150405"),
+		Date:     t,
+		Carrier:  pkg.carrier,
+		Tracking: pkg.trackingno,
+		Order:    pkg.ordernumber,
+		Project:  pkg.projectnumber,
+		Contract: pkg.contractnumber,
+	}
+	if d, err := x12.Date(pkg.daterecv, ""); err == nil {
+		ship.Received = d
+	}
+	typ := packageTypes[strings.ToUpper(strings.TrimSpace(pkg.packagetype))]
+	if typ == "" {
+		typ = "PKG"
+	}
+	xp := x12.Package{
+		ID:        pkg.pkgid,
+		Type:      typ,
+		Weight:    strings.TrimSpace(pkg.pkgmeaweight),
+		Length:    strings.TrimSpace(pkg.pkgmealength),
+		Width:     strings.TrimSpace(pkg.pkgmeawidth),
+		Height:    strings.TrimSpace(pkg.pkgmeaheight),
+		Hazardous: pkg.hazcode,
+	}
+	if v := pkg.volume(); v > 0 {
+		xp.Volume = fmt.Sprintf("%.2f", v)
+	}
+	for _, l := range resp.mrline {
+		xp.Items = append(xp.Items, x12.Item{
+			Line:        l.lineNumber,
+			Code:        l.materialItemCode,
+			Description: l.materialShortDescription,
+			Qty:         quantity(l.transactionquanity),
+			UOM:         l.unitofmeasure,
+		})
+	}
+	ship.Packages = []x12.Package{xp}
+
+	w, err := s.x12Writer(p, "SH")
+	if err != nil {
+		s.log().Error("Failed to number the 856", "err", err)
+		return err
+	}
+	x12.WriteASN(w, ship)
+	return s.written(newfn, w.Bytes(), message, resp)
+}
+
+// x12Advice writes the receipt as an 861, named
+// <partner>_MR_<contract>_<order>_RA_<time>.x12. The damaged quantity
+// of each line is rejected and the rest accepted.
+func (s *Session) x12Advice(resp *MRresponse, p ediconfig.X12Partner) error {
+	t := time.Now()
+	pkg := resp.mrpackage
+	order := strings.Replace(pkg.ordernumber, "/", "_", -1)
+	newfn := fmt.Sprintf("%s%s_MR_%s_%s_RA_%s.x12", s.Dir, p.Name, pkg.contractnumber, order, t.Format("20060102150405"))
+	message := fmt.Sprintf("%s_%s_RA_%s", pkg.contractnumber, pkg.ordernumber, t.Format("20060102150405"))
+	s.log().Debug("Building MR 861", "partner", p.Name)
+
+	a := x12.Advice{
+		ID:       pkg.pkgid + t.Format("20060102150405"),
+		Date:     t,
+		Carrier:  pkg.carrier,
+		Tracking: pkg.trackingno,
+		Order:    pkg.ordernumber,
+		Project:  pkg.projectnumber,
+		Contract: pkg.contractnumber,
+	}
+	if d, err := x12.Date(pkg.daterecv, ""); err == nil {
+		a.Received = d
+	}
+	for _, l := range resp.mrline {
+		a.Lines = append(a.Lines, x12.AdviceLine{
+			Line:        l.lineNumber,
+			Code:        l.materialItemCode,
+			Description: l.materialShortDescription,
+			UOM:         l.unitofmeasure,
+			Shipped:     quantity(l.packlistquanity),
+			Received:    quantity(l.transactionquanity),
+			Damaged:     quantity(l.damagedquanity),
+		})
+	}
+
+	w, err := s.x12Writer(p, "RC")
+	if err != nil {
+		s.log().Error("Failed to number the 861", "err", err)
+		return err
+	}
+	x12.WriteAdvice(w, a)
+	return s.written(newfn, w.Bytes(), message, resp)
+}
+
+// x12Writer starts an interchange to partner p of functional group
+// code, taking its control numbers.
+func (s *Session) x12Writer(p ediconfig.X12Partner, code string) (*x12.Writer, error) {
+	cfg := s.X12
+	env := x12.Envelope{
+		SenderQual:   cfg.SenderQual,
+		Sender:       cfg.Sender,
+		ReceiverQual: p.Qual,
+		Receiver:     p.ID,
+		AppReceiver:  p.AppID,
+		Version:      cfg.Version,
+		Usage:        cfg.Usage,
+		Code:         code,
+		Date:         time.Now(),
+	}
+	if env.SenderQual == "" {
+		env.SenderQual = "ZZ"
+	}
+	var err error
+	if env.Control, env.Group, err = x12.OpenControls(cfg.ControlFile).Next(); err != nil {
+		return nil, err
+	}
+	return x12.NewWriter(env, x12.DelimitersOf(cfg.Delimiters), cfg.LineBreaks), nil
+}
+
+// quantity trims the padding and the zero decimals MMTS sends
+// quantities with: "    12.00" is 12.
+func quantity(q string) string {
+	q = strings.TrimSpace(q)
+	if strings.Contains(q, ".") {
+		q = strings.TrimRight(strings.TrimRight(q, "0"), ".")
+	}
+	return q
+}
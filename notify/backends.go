@@ -0,0 +1,270 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blackjack/syslog"
+)
+
+// sendTimeout bounds one delivery attempt.
+const sendTimeout = 30 * time.Second
+
+// checkTimeout bounds a Check.
+const checkTimeout = 3 * time.Second
+
+// SMTP mails events. STARTTLS is used when the server offers it, and
+// PLAIN authentication when User is set.
+type SMTP struct {
+	Server   string
+	Port     string // ":587"
+	User     string
+	Password string
+}
+
+// Notify sends ev as one message to all of ev.To.
+func (s *SMTP) Notify(ev Event) error {
+	if len(ev.To) == 0 {
+		return fmt.Errorf("smtp: %s has no recipients", ev.Type)
+	}
+	conn, err := net.DialTimeout("tcp", s.Server+s.Port, sendTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(sendTimeout))
+	c, err := smtp.NewClient(conn, s.Server)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: s.Server}); err != nil {
+			return err
+		}
+	}
+	if s.User != "" {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err := c.Auth(smtp.PlainAuth("", s.User, s.Password, s.Server)); err != nil {
+				return err
+			}
+		}
+	}
+	sender := s.User
+	if sender == "" {
+		sender = ev.From
+	}
+	if err := c.Mail(sender); err != nil {
+		return err
+	}
+	for _, to := range ev.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(Message(ev)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Check connects to the server and waits for its greeting, for the
+// services' readiness checks.
+func (s *SMTP) Check() error {
+	conn, err := net.DialTimeout("tcp", s.Server+s.Port, checkTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(checkTimeout))
+	c, err := smtp.NewClient(conn, s.Server)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	return c.Quit()
+}
+
+// Message is ev as a mail message: plain text, text and HTML
+// alternatives when the event has HTML, and multipart/mixed with the
+// documents when it has attachments.
+func Message(ev Event) []byte {
+	var b bytes.Buffer
+	b.WriteString("To: " + strings.Join(ev.To, ", ") + "\r\n")
+	b.WriteString("From: " + ev.From + "\r\n")
+	b.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", ev.Subject) + "\r\n")
+	b.WriteString("Date: " + ev.Time.Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	if len(ev.Attachments) == 0 {
+		writeBody(&b, ev)
+		return b.Bytes()
+	}
+	mw := multipart.NewWriter(&b)
+	b.WriteString("Content-Type: multipart/mixed; boundary=" + mw.Boundary() + "\r\n\r\n")
+	var part bytes.Buffer
+	writeBody(&part, ev)
+	header, body, _ := bytes.Cut(part.Bytes(), []byte("\r\n\r\n"))
+	w, _ := mw.CreatePart(mimeHeader(string(header)))
+	w.Write(body)
+	for _, a := range ev.Attachments {
+		ctype := mime.TypeByExtension(path.Ext(a.Name))
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", ctype)
+		h.Set("Content-Transfer-Encoding", "base64")
+		h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Name}))
+		w, _ := mw.CreatePart(h)
+		enc := base64.StdEncoding.EncodeToString(a.Data)
+		for len(enc) > 76 {
+			w.Write([]byte(enc[:76] + "\r\n"))
+			enc = enc[76:]
+		}
+		w.Write([]byte(enc + "\r\n"))
+	}
+	mw.Close()
+	return b.Bytes()
+}
+
+// writeBody writes the Content-Type header, a blank line and the text,
+// or the text and HTML as alternatives.
+func writeBody(b *bytes.Buffer, ev Event) {
+	if ev.HTML == "" {
+		b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		writeQP(b, ev.Body)
+		return
+	}
+	mw := multipart.NewWriter(b)
+	b.WriteString("Content-Type: multipart/alternative; boundary=" + mw.Boundary() + "\r\n\r\n")
+	for _, p := range []struct{ ctype, text string }{
+		{"text/plain; charset=utf-8", ev.Body},
+		{"text/html; charset=utf-8", ev.HTML},
+	} {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", p.ctype)
+		h.Set("Content-Transfer-Encoding", "quoted-printable")
+		w, _ := mw.CreatePart(h)
+		var part bytes.Buffer
+		writeQP(&part, p.text)
+		w.Write(part.Bytes())
+	}
+	mw.Close()
+}
+
+func writeQP(b *bytes.Buffer, text string) {
+	qp := quotedprintable.NewWriter(b)
+	qp.Write([]byte(text))
+	qp.Close()
+	b.WriteString("\r\n")
+}
+
+// mimeHeader parses the header lines writeBody wrote.
+func mimeHeader(s string) textproto.MIMEHeader {
+	h := textproto.MIMEHeader{}
+	for _, line := range strings.Split(s, "\r\n") {
+		if k, v, ok := strings.Cut(line, ": "); ok {
+			h.Set(k, v)
+		}
+	}
+	return h
+}
+
+// Webhook posts each event to URL as JSON. Any status other than 2xx
+// is a failure.
+type Webhook struct {
+	URL     string
+	Headers map[string]string
+}
+
+// Notify posts ev.
+func (w *Webhook) Notify(ev Event) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := (&http.Client{Timeout: sendTimeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook: %s: %s", w.URL, resp.Status)
+	}
+	return nil
+}
+
+// Syslog logs the event type and subject, at LOG_ERR for a severe
+// event and LOG_INFO otherwise.
+type Syslog struct{}
+
+// Notify logs ev.
+func (Syslog) Notify(ev Event) error {
+	prio := syslog.LOG_INFO
+	if Severe(ev.Type) {
+		prio = syslog.LOG_ERR
+	}
+	if ev.ID != "" {
+		syslog.Syslogf(prio, "%s: %s: %s id=%s", ev.Source, ev.Type, ev.Subject, ev.ID)
+		return nil
+	}
+	syslog.Syslogf(prio, "%s: %s: %s", ev.Source, ev.Type, ev.Subject)
+	return nil
+}
+
+// File appends each event to Path as a JSON line.
+type File struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// Notify appends ev.
+func (f *File) Notify(ev Event) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fh, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fh.Write(append(b, '\n'))
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
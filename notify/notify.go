@@ -0,0 +1,489 @@
+/*
+Package notify sends the programs' notifications.
+
+A program builds a Dispatcher from the notify section of the
+configuration and hands it Events. The routes pick which backends
+each event type goes to, and to whom; each backend has its own queue
+and worker, so a slow mail server holds up nothing but the mail. A
+delivery that fails is tried again with a growing delay.
+
+The backends are SMTP mail, an HTTP webhook, syslog and a file of JSON
+lines. With no routes configured every event is mailed to the
+program's built-in recipient, as the programs did before. In tests,
+point the mail settings at an smtpsink.Sink to see what was sent.
+*/
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloud3000/BaseEDI/ediconfig"
+	"github.com/cloud3000/BaseEDI/metrics"
+)
+
+// Event types. Routes match them with path.Match patterns, so "po.*"
+// is every PO event.
+const (
+	POReceived    = "po.received"    // file arrived in the inbox
+	PORejected    = "po.rejected"    // not an XML file
+	POStatus      = "po.status"      // imported, the host replied
+	POAsset       = "po.asset"       // asset line in an order
+	PORetry       = "po.retry"       // host timeout, will be tried again
+	POError       = "po.error"       // import failed, moved to errors
+	PONetwork     = "po.network"     // host connection failed
+	ResponseError = "response.error" // PO response could not be written
+	MRReceipt     = "mr.receipt"     // MR receipt written
+	MRError       = "mr.error"       // MR session or receipt failed
+	MRTimeout     = "mr.timeout"     // MR session timed out
+	MRNetwork     = "mr.network"     // MR connection failed
+	SendOK        = "send.ok"        // document sent to the customer
+	SendError     = "send.error"     // sending a document failed
+	ServiceError  = "service.error"  // a service itself is in trouble
+	AckRejected   = "ack.rejected"   // a partner's 997 or 999 rejected what we sent
+	AckOverdue    = "ack.overdue"    // a partner's 997 or 999 is late
+)
+
+// ErrQueueFull means a backend's queue had no room for an event.
+var ErrQueueFull = errors.New("notify: queue full")
+
+// Event is one notification. A program sets the Type, Subject and
+// either Fields or a Body; the templates, if any, then make the
+// Subject, Body and HTML that are sent.
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`            // the program that sent it
+	ID      string    `json:"id,omitempty"`      // correlation ID, see package edilog
+	Partner string    `json:"partner,omitempty"` // see PartnerOf
+	From    string    `json:"from,omitempty"`
+	To      []string  `json:"to,omitempty"`
+	Subject string    `json:"subject"`
+	Body    string    `json:"body"`
+	HTML    string    `json:"-"`
+	Fields  []Field   `json:"fields,omitempty"`
+	// Attachments are the documents the event is about. Only routes
+	// with attach set send them.
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// Count is the number of events a digest or suppression summary
+	// stands for, 0 for an ordinary event.
+	Count int `json:"count,omitempty"`
+}
+
+// Attachment is a document attached to an event. Data is read from
+// Path when the event is queued, as the file may be moved soon after.
+type Attachment struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Data []byte `json:"-"`
+}
+
+// Severe reports whether an event type is a failure, for backends
+// that have a priority to set.
+func Severe(typ string) bool {
+	for _, s := range []string{".error", ".network", ".timeout", ".retry", ".rejected", ".overdue"} {
+		if strings.HasSuffix(typ, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Notifier delivers events.
+type Notifier interface {
+	Notify(ev Event) error
+}
+
+// Defaults are what a program fills in for the configuration: its
+// name, mail sender and recipient, and its built-in SMTP server.
+type Defaults struct {
+	Source string
+	From   string
+	To     string
+	Mail   ediconfig.Mail
+}
+
+// Dispatcher routes events to backends through their queues.
+type Dispatcher struct {
+	mu        sync.RWMutex
+	defaults  Defaults
+	routes    []ediconfig.NotifyRoute
+	backends  map[string]*queue
+	templates string
+	policies  []ediconfig.NotifyPolicy
+	spool     string
+
+	// closeMu orders put's pending.Add against Close, so nothing is
+	// added once Close has started waiting.
+	closeMu sync.Mutex
+	closing chan struct{}
+	once    sync.Once
+	pending sync.WaitGroup // deliveries not finished
+}
+
+// New starts a Dispatcher for cfg. The backends "mail" (the mail
+// section, over the program's built-in server) and "syslog" always
+// exist; cfg may add more or redefine them.
+func New(cfg ediconfig.Notify, def Defaults) (*Dispatcher, error) {
+	d := &Dispatcher{closing: make(chan struct{})}
+	if err := d.Update(cfg, def); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Update switches to the backends and routes in cfg, for a
+// configuration reload. Events already queued are delivered by the
+// old backends. On error nothing changes.
+func (d *Dispatcher) Update(cfg ediconfig.Notify, def Defaults) error {
+	routes := cfg.Routes
+	if len(routes) == 0 {
+		routes = []ediconfig.NotifyRoute{{Events: []string{"*"}, Backends: []string{"mail"}}}
+	}
+	size, retries, delay := cfg.QueueSize, cfg.Retries, cfg.RetryDelay.Duration
+	if size <= 0 {
+		size = 100
+	}
+	if retries < 0 {
+		retries = 0
+	}
+	if delay <= 0 {
+		delay = 30 * time.Second
+	}
+	defs := map[string]ediconfig.NotifyBackend{
+		"mail":   {Type: "smtp"},
+		"syslog": {Type: "syslog"},
+	}
+	for name, b := range cfg.Backends {
+		defs[name] = b
+	}
+	backends := make(map[string]*queue)
+	for name, b := range defs {
+		n, err := backend(b, def.Mail)
+		if err != nil {
+			return fmt.Errorf("notify: backend %q: %v", name, err)
+		}
+		backends[name] = &queue{
+			name:    name,
+			n:       n,
+			c:       make(chan delivery, size),
+			retries: retries,
+			delay:   delay,
+			d:       d,
+		}
+	}
+	for _, r := range routes {
+		for _, name := range r.Backends {
+			if backends[name] == nil {
+				return fmt.Errorf("notify: route names unknown backend %q", name)
+			}
+		}
+	}
+	for _, q := range backends {
+		go q.work()
+	}
+	d.mu.Lock()
+	old := d.backends
+	d.defaults, d.routes, d.backends, d.templates = def, routes, backends, cfg.Templates
+	d.policies, d.spool = cfg.Policies, cfg.Spool
+	d.mu.Unlock()
+	// Nothing can be put on the old queues now, let them drain.
+	for _, q := range old {
+		close(q.c)
+	}
+	return nil
+}
+
+// backend builds the Notifier for one configured backend.
+func backend(b ediconfig.NotifyBackend, mail ediconfig.Mail) (Notifier, error) {
+	switch b.Type {
+	case "smtp":
+		m := mail
+		if b.Mail != nil {
+			m.Server, m.Port, m.User, m.Password = b.Mail.Settings(m.Server, m.Port, m.User, m.Password)
+		}
+		return &SMTP{Server: m.Server, Port: m.Port, User: m.User, Password: m.Password}, nil
+	case "webhook":
+		if b.URL == "" {
+			return nil, fmt.Errorf("webhook needs a url")
+		}
+		return &Webhook{URL: b.URL, Headers: b.Headers}, nil
+	case "syslog":
+		return Syslog{}, nil
+	case "file":
+		if b.Path == "" {
+			return nil, fmt.Errorf("file needs a path")
+		}
+		return &File{Path: b.Path}, nil
+	}
+	return nil, fmt.Errorf("unknown type %q", b.Type)
+}
+
+// Notify queues ev for every backend its routes name, or keeps it for
+// a digest as its policy says. It does not wait for delivery. The
+// error is ErrQueueFull if a backend had no room; the other backends
+// still get the event.
+func (d *Dispatcher) Notify(ev Event) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if ev.Source == "" {
+		ev.Source = d.defaults.Source
+	}
+	if ev.From == "" {
+		ev.From = d.defaults.From
+	}
+	if len(ev.To) == 0 && d.defaults.To != "" {
+		ev.To = []string{d.defaults.To}
+	}
+	if p := d.policy(ev.Type); p != nil && ev.Count == 0 {
+		send, summaries := d.hold(p, ev)
+		var err error
+		for _, s := range summaries {
+			if serr := d.route(s); serr != nil {
+				err = serr
+			}
+		}
+		if !send {
+			return err
+		}
+		if rerr := d.route(ev); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	return d.route(ev)
+}
+
+// Check checks that the backends the routes use can be reached. Only
+// mail servers are checked; an event for a backend that is down waits
+// in its queue.
+func (d *Dispatcher) Check() error {
+	d.mu.RLock()
+	used := make(map[string]Notifier)
+	for _, r := range d.routes {
+		for _, name := range r.Backends {
+			used[name] = d.backends[name].n
+		}
+	}
+	d.mu.RUnlock()
+	var errs []error
+	for name, n := range used {
+		if c, ok := n.(interface{ Check() error }); ok {
+			if err := c.Check(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// route queues ev for the backends its routes name. d.mu held.
+func (d *Dispatcher) route(ev Event) error {
+	var err error
+	var plain, attached *Event
+	sent := make(map[string]bool)
+	for _, r := range d.routes {
+		if !match(r.Events, ev.Type) {
+			continue
+		}
+		var e Event
+		if r.Attach {
+			if attached == nil {
+				a := d.prepare(ev, true)
+				attached = &a
+			}
+			e = *attached
+		} else {
+			if plain == nil {
+				p := d.prepare(ev, false)
+				plain = &p
+			}
+			e = *plain
+		}
+		if len(r.To) > 0 {
+			e.To = r.To
+		}
+		for _, name := range r.Backends {
+			key := fmt.Sprintf("%s\x00%s\x00%v", name, strings.Join(e.To, ","), r.Attach)
+			if sent[key] {
+				continue
+			}
+			sent[key] = true
+			if qerr := d.backends[name].put(e); qerr != nil {
+				err = qerr
+			}
+		}
+	}
+	return err
+}
+
+// prepare reads the attachments, or drops them, and renders the
+// templates for ev.
+func (d *Dispatcher) prepare(ev Event, attach bool) Event {
+	var docs []Attachment
+	if attach {
+		for _, a := range ev.Attachments {
+			if a.Data == nil {
+				b, err := os.ReadFile(a.Path)
+				if err != nil {
+					slog.Warn("notify: attachment", "err", err)
+					continue
+				}
+				a.Data = b
+			}
+			if a.Name == "" {
+				a.Name = path.Base(a.Path)
+			}
+			docs = append(docs, a)
+		}
+	}
+	ev.Attachments = docs
+	render(d.templates, &ev)
+	return ev
+}
+
+// As returns a Notifier that fills in from and to, where an event
+// leaves them empty, instead of the program's defaults.
+func (d *Dispatcher) As(from string, to string) Notifier {
+	return as{d, from, to}
+}
+
+type as struct {
+	d    *Dispatcher
+	from string
+	to   string
+}
+
+func (a as) Notify(ev Event) error {
+	if ev.From == "" {
+		ev.From = a.from
+	}
+	if len(ev.To) == 0 {
+		ev.To = []string{a.to}
+	}
+	return a.d.Notify(ev)
+}
+
+func match(patterns []string, typ string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, typ); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Close stops taking events and waits up to timeout for the queued
+// ones to be delivered. Deliveries waiting to be retried are tried
+// once more straight away.
+func (d *Dispatcher) Close(timeout time.Duration) error {
+	d.closeMu.Lock()
+	d.once.Do(func() { close(d.closing) })
+	d.closeMu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		d.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("notify: gave up on undelivered notifications after %v", timeout)
+	}
+}
+
+var (
+	mSent    = metrics.NewCounter("edi_notify_sent_total", "Notifications delivered, by backend.", "backend")
+	mFailed  = metrics.NewCounter("edi_notify_failures_total", "Notifications given up on after the retries, by backend.", "backend")
+	mRetried = metrics.NewCounter("edi_notify_retries_total", "Notification deliveries that failed and will be retried, by backend.", "backend")
+	mDropped = metrics.NewCounter("edi_notify_dropped_total", "Notifications dropped on a full queue, by backend.", "backend")
+	mQueued  = metrics.NewGauge("edi_notify_queue_depth", "Notifications waiting in each backend's queue.", "backend")
+)
+
+// delivery is one event on its way to one backend.
+type delivery struct {
+	ev      Event
+	attempt int
+}
+
+// queue feeds one backend.
+type queue struct {
+	name    string
+	n       Notifier
+	c       chan delivery
+	retries int
+	delay   time.Duration
+	d       *Dispatcher
+}
+
+func (q *queue) put(ev Event) error {
+	q.d.closeMu.Lock()
+	select {
+	case <-q.d.closing:
+		q.d.closeMu.Unlock()
+		return fmt.Errorf("notify: closed")
+	default:
+	}
+	q.d.pending.Add(1)
+	q.d.closeMu.Unlock()
+	select {
+	case q.c <- delivery{ev: ev}:
+		mQueued.Set(float64(len(q.c)), q.name)
+		return nil
+	default:
+		q.d.pending.Done()
+		mDropped.Inc(q.name)
+		slog.Warn("notify: queue full, dropped", "backend", q.name, "event", ev.Type, "id", ev.ID, "subject", ev.Subject)
+		return ErrQueueFull
+	}
+}
+
+func (q *queue) work() {
+	for dl := range q.c {
+		mQueued.Set(float64(len(q.c)), q.name)
+		q.send(dl)
+	}
+}
+
+// send makes one attempt. A failure is retried from its own goroutine
+// so the rest of the queue keeps moving.
+func (q *queue) send(dl delivery) {
+	err := q.n.Notify(dl.ev)
+	if err == nil {
+		mSent.Inc(q.name)
+		q.d.pending.Done()
+		return
+	}
+	dl.attempt++
+	if dl.attempt > q.retries {
+		mFailed.Inc(q.name)
+		slog.Error("notify: giving up", "backend", q.name, "event", dl.ev.Type, "id", dl.ev.ID, "subject", dl.ev.Subject, "err", err)
+		q.d.pending.Done()
+		return
+	}
+	mRetried.Inc(q.name)
+	slog.Warn("notify: delivery failed", "backend", q.name, "event", dl.ev.Type, "id", dl.ev.ID, "err", err, "retry", dl.attempt, "of", q.retries)
+	wait := q.delay << (dl.attempt - 1)
+	go func() {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-q.d.closing:
+		}
+		q.send(dl)
+	}()
+}
@@ -0,0 +1,37 @@
+package notify
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCloseWhileNotifying(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		d, out := testDispatcher(t, nil)
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for n := 0; n < 20; n++ {
+					// After Close an event is refused, never lost
+					// half way.
+					d.Notify(Event{Type: POStatus, Subject: "imported"})
+				}
+			}()
+		}
+		if err := d.Close(5 * time.Second); err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+		if err := d.Notify(Event{Type: POStatus, Subject: "late"}); err == nil {
+			t.Error("Notify after Close took the event")
+		}
+		for _, s := range sent(t, d, out) {
+			if s != "imported" {
+				t.Errorf("sent %q", s)
+			}
+		}
+	}
+}
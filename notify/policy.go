@@ -0,0 +1,296 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cloud3000/BaseEDI/ediconfig"
+)
+
+// flushEvery is how often Run looks for digests and summaries due.
+const flushEvery = time.Minute
+
+// The spool holds what the policies have kept back. XML_PO_import runs
+// once per order, so the digests and counts live in files, under a
+// lock, where the next run and the services can find them:
+//
+//	<spool>/lock
+//	<spool>/digest/<event type>.jsonl  events waiting for their digest
+//	<spool>/suppress.json              counts of repeated events
+
+// suppressed counts the events with one type and subject in a window.
+type suppressed struct {
+	Event Event     `json:"event"` // the first, the summary goes where it went
+	Until time.Time `json:"until"`
+	Count int       `json:"count"` // events seen in the window
+	Held  int       `json:"held"`  // of which not sent
+	Last  time.Time `json:"last"`
+}
+
+// policy returns the policy for an event type, nil to send it straight
+// away. d.mu held.
+func (d *Dispatcher) policy(typ string) *ediconfig.NotifyPolicy {
+	for i, p := range d.policies {
+		if match(p.Events, typ) {
+			if (p.Deliver == "" || p.Deliver == "immediate") && p.SuppressAfter == 0 {
+				return nil
+			}
+			return &d.policies[i]
+		}
+	}
+	return nil
+}
+
+// hold applies p to ev. It reports whether ev should be sent now, and
+// returns any summary of a suppression window that ev has closed. If
+// the spool cannot be used ev is sent; twice is better than never.
+// d.mu held.
+func (d *Dispatcher) hold(p *ediconfig.NotifyPolicy, ev Event) (bool, []Event) {
+	unlock, err := d.lockSpool()
+	if err != nil {
+		slog.Warn("notify: spool", "err", err)
+		return true, nil
+	}
+	defer unlock()
+	if p.Deliver == "hourly" || p.Deliver == "daily" {
+		if ev.Body == "" {
+			ev.Body = ev.Text()
+		}
+		b, _ := json.Marshal(ev)
+		f, err := os.OpenFile(d.digestFile(ev.Type), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err == nil {
+			_, err = f.Write(append(b, '\n'))
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			slog.Warn("notify: spool", "err", err)
+			return true, nil
+		}
+		return false, nil
+	}
+
+	counts := d.readSuppressed()
+	key := ev.Type + "\x00" + ev.Subject
+	var summaries []Event
+	st := counts[key]
+	if st != nil && !ev.Time.Before(st.Until) {
+		if st.Held > 0 {
+			summaries = append(summaries, summary(st))
+		}
+		st = nil
+	}
+	if st == nil {
+		st = &suppressed{Event: ev, Until: ev.Time.Add(p.Window.Duration)}
+		st.Event.Attachments = nil
+		counts[key] = st
+	}
+	st.Count++
+	st.Last = ev.Time
+	send := st.Count <= p.SuppressAfter
+	if !send {
+		st.Held++
+	}
+	if err := d.writeSuppressed(counts); err != nil {
+		slog.Warn("notify: spool", "err", err)
+		return true, summaries
+	}
+	return send, summaries
+}
+
+// Run sends the digests and suppression summaries as they fall due,
+// until Close. The long running services call it; more than one may,
+// the spool is locked while it is read.
+func (d *Dispatcher) Run() {
+	t := time.NewTicker(flushEvery)
+	defer t.Stop()
+	for {
+		d.flush(time.Now())
+		select {
+		case <-t.C:
+		case <-d.closing:
+			return
+		}
+	}
+}
+
+// flush sends what is due at now.
+func (d *Dispatcher) flush(now time.Time) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.spool == "" {
+		return
+	}
+	unlock, err := d.lockSpool()
+	if err != nil {
+		slog.Warn("notify: spool", "err", err)
+		return
+	}
+	var due []Event
+	names, _ := filepath.Glob(filepath.Join(d.spool, "digest", "*.jsonl"))
+	for _, name := range names {
+		evs := readDigest(name)
+		if len(evs) == 0 {
+			os.Remove(name)
+			continue
+		}
+		typ := strings.TrimSuffix(filepath.Base(name), ".jsonl")
+		// A policy taken out of the configuration lets its digest go.
+		p := d.policy(typ)
+		if p != nil && (p.Deliver == "hourly" || p.Deliver == "daily") && now.Before(next(p, evs[0].Time)) {
+			continue
+		}
+		if err := os.Remove(name); err != nil {
+			slog.Warn("notify: spool", "err", err)
+			continue
+		}
+		due = append(due, digest(typ, evs, now))
+	}
+	counts := d.readSuppressed()
+	changed := false
+	for key, st := range counts {
+		if now.Before(st.Until) {
+			continue
+		}
+		if st.Held > 0 {
+			due = append(due, summary(st))
+		}
+		delete(counts, key)
+		changed = true
+	}
+	if changed {
+		if err := d.writeSuppressed(counts); err != nil {
+			slog.Warn("notify: spool", "err", err)
+		}
+	}
+	unlock()
+	for _, ev := range due {
+		d.route(ev)
+	}
+}
+
+// next is when a digest whose first event came at t is sent.
+func next(p *ediconfig.NotifyPolicy, t time.Time) time.Time {
+	if p.Deliver == "hourly" {
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location()).Add(time.Hour)
+	}
+	at, _ := time.Parse("15:04", p.At)
+	b := time.Date(t.Year(), t.Month(), t.Day(), at.Hour(), at.Minute(), 0, 0, t.Location())
+	if !b.After(t) {
+		b = b.AddDate(0, 0, 1)
+	}
+	return b
+}
+
+// digest makes one event of the events collected for typ.
+func digest(typ string, evs []Event, now time.Time) Event {
+	ev := evs[len(evs)-1]
+	ev.Time = now
+	ev.Count = len(evs)
+	ev.Subject = fmt.Sprintf("[EDI] Digest: %d %s since %s", len(evs), typ,
+		evs[0].Time.Format("2006-01-02 15:04"))
+	ev.Fields, ev.Attachments, ev.HTML = nil, nil, ""
+	var b strings.Builder
+	for _, e := range evs {
+		b.WriteString(e.Time.Format("2006-01-02 15:04:05") + "  " + e.Subject + "\n")
+		for _, line := range strings.Split(strings.TrimRight(e.Body, "\n"), "\n") {
+			b.WriteString("    " + line + "\n")
+		}
+		b.WriteString("\n")
+	}
+	ev.Body = b.String()
+	return ev
+}
+
+// summary tells of the events a suppression window held back.
+func summary(st *suppressed) Event {
+	ev := st.Event
+	ev.Time = time.Now()
+	ev.Count = st.Held
+	ev.Subject = fmt.Sprintf("[EDI] %d more suppressed: %s", st.Held, st.Event.Subject)
+	ev.Body, ev.HTML = "", ""
+	ev.Fields = F(
+		"Event", st.Event.Type,
+		"Subject", st.Event.Subject,
+		"Sent", strconv.Itoa(st.Count-st.Held),
+		"Suppressed", strconv.Itoa(st.Held),
+		"First", st.Event.Time.Format("2006-01-02 15:04:05"),
+		"Last", st.Last.Format("2006-01-02 15:04:05"))
+	return ev
+}
+
+func (d *Dispatcher) digestFile(typ string) string {
+	return filepath.Join(d.spool, "digest", filepath.Base(typ)+".jsonl")
+}
+
+// lockSpool takes the spool lock, shared with the other programs.
+func (d *Dispatcher) lockSpool() (func(), error) {
+	if err := os.MkdirAll(filepath.Join(d.spool, "digest"), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(d.spool, "lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// readSuppressed returns the suppression counts, none if the file is
+// missing or damaged. Spool locked.
+func (d *Dispatcher) readSuppressed() map[string]*suppressed {
+	counts := make(map[string]*suppressed)
+	b, err := os.ReadFile(filepath.Join(d.spool, "suppress.json"))
+	if err == nil {
+		json.Unmarshal(b, &counts)
+	}
+	return counts
+}
+
+// writeSuppressed replaces the suppression counts. Spool locked.
+func (d *Dispatcher) writeSuppressed(counts map[string]*suppressed) error {
+	b, err := json.MarshalIndent(counts, "", "\t")
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(d.spool, "suppress.json")
+	if err := os.WriteFile(name+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// readDigest returns the events in a digest file. A line cut short by
+// a crash is skipped.
+func readDigest(name string) []Event {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var evs []Event
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for s.Scan() {
+		var ev Event
+		if json.Unmarshal(s.Bytes(), &ev) == nil {
+			evs = append(evs, ev)
+		}
+	}
+	return evs
+}
@@ -0,0 +1,295 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloud3000/BaseEDI/ediconfig"
+)
+
+// testDispatcher routes every event to a file backend, with policies
+// and a spool of its own.
+func testDispatcher(t *testing.T, policies []ediconfig.NotifyPolicy) (*Dispatcher, string) {
+	t.Helper()
+	dir := t.TempDir()
+	out := filepath.Join(dir, "sent.jsonl")
+	d, err := New(ediconfig.Notify{
+		Backends: map[string]ediconfig.NotifyBackend{"out": {Type: "file", Path: out}},
+		Routes:   []ediconfig.NotifyRoute{{Backends: []string{"out"}}},
+		Policies: policies,
+		Spool:    filepath.Join(dir, "spool"),
+	}, Defaults{Source: "test"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return d, out
+}
+
+// sent closes d and returns what it delivered, each as its subject
+// and, for a digest or summary, the events it stands for.
+func sent(t *testing.T, d *Dispatcher, out string) []string {
+	t.Helper()
+	if err := d.Close(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(out)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var ev Event
+		if err := json.Unmarshal(s.Bytes(), &ev); err != nil {
+			t.Fatalf("%s: %v", s.Text(), err)
+		}
+		if ev.Count > 0 {
+			got = append(got, fmt.Sprintf("%s (%d)", ev.Subject, ev.Count))
+		} else {
+			got = append(got, ev.Subject)
+		}
+	}
+	return got
+}
+
+func TestPolicies(t *testing.T) {
+	day := func(hhmm string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", hhmm, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	// step notifies an event of type typ at a time, or with flush set
+	// sends what is due then.
+	type step struct {
+		at      string
+		typ     string
+		subject string
+		flush   bool
+	}
+	ev := func(at, typ, subject string) step { return step{at: at, typ: typ, subject: subject} }
+	flush := func(at string) step { return step{at: at, flush: true} }
+	tests := []struct {
+		name     string
+		policies []ediconfig.NotifyPolicy
+		steps    []step
+		want     []string
+	}{
+		{"immediate", []ediconfig.NotifyPolicy{{Events: []string{"po.*"}, Deliver: "immediate"}},
+			[]step{ev("2024-01-02 10:00", POError, "bad order")},
+			[]string{"bad order"}},
+		{"no policy for the type", []ediconfig.NotifyPolicy{{Events: []string{"mr.*"}, Deliver: "hourly"}},
+			[]step{ev("2024-01-02 10:00", POError, "bad order")},
+			[]string{"bad order"}},
+		{"hourly digest", []ediconfig.NotifyPolicy{{Events: []string{"po.*"}, Deliver: "hourly"}},
+			[]step{
+				ev("2024-01-02 10:10", POError, "bad order"),
+				ev("2024-01-02 10:40", POError, "another bad order"),
+				flush("2024-01-02 10:59"),
+				flush("2024-01-02 11:00"),
+				flush("2024-01-02 12:00"),
+			},
+			[]string{"[EDI] Digest: 2 po.error since 2024-01-02 10:10 (2)"}},
+		{"a digest for each type", []ediconfig.NotifyPolicy{{Events: []string{"po.*"}, Deliver: "hourly"}},
+			[]step{
+				ev("2024-01-02 10:10", POError, "bad order"),
+				ev("2024-01-02 10:20", PORetry, "host down"),
+				flush("2024-01-02 11:00"),
+			},
+			// The digests go in the order of their files' names.
+			[]string{"[EDI] Digest: 1 po.error since 2024-01-02 10:10 (1)", "[EDI] Digest: 1 po.retry since 2024-01-02 10:20 (1)"}},
+		{"daily digest", []ediconfig.NotifyPolicy{{Events: []string{"po.*"}, Deliver: "daily", At: "07:30"}},
+			[]step{
+				ev("2024-01-02 08:00", POError, "bad order"),
+				flush("2024-01-02 23:59"),
+				flush("2024-01-03 07:29"),
+				flush("2024-01-03 07:30"),
+			},
+			[]string{"[EDI] Digest: 1 po.error since 2024-01-02 08:00 (1)"}},
+		{"daily digest the same day", []ediconfig.NotifyPolicy{{Events: []string{"po.*"}, Deliver: "daily", At: "07:30"}},
+			[]step{
+				ev("2024-01-02 06:00", POError, "bad order"),
+				flush("2024-01-02 07:30"),
+			},
+			[]string{"[EDI] Digest: 1 po.error since 2024-01-02 06:00 (1)"}},
+		{"suppressed", []ediconfig.NotifyPolicy{{Events: []string{"po.*"}, SuppressAfter: 2, Window: ediconfig.Duration{Duration: time.Hour}}},
+			[]step{
+				ev("2024-01-02 10:00", PONetwork, "host down"),
+				ev("2024-01-02 10:01", PONetwork, "host down"),
+				ev("2024-01-02 10:02", PONetwork, "host down"),
+				ev("2024-01-02 10:03", PONetwork, "host down"),
+				flush("2024-01-02 10:59"),
+				flush("2024-01-02 11:00"),
+			},
+			[]string{"host down", "host down", "[EDI] 2 more suppressed: host down (2)"}},
+		{"window closed by the next event", []ediconfig.NotifyPolicy{{Events: []string{"po.*"}, SuppressAfter: 1, Window: ediconfig.Duration{Duration: time.Hour}}},
+			[]step{
+				ev("2024-01-02 10:00", PONetwork, "host down"),
+				ev("2024-01-02 10:30", PONetwork, "host down"),
+				ev("2024-01-02 11:00", PONetwork, "host down"),
+				ev("2024-01-02 11:10", PONetwork, "host down"),
+			},
+			[]string{"host down", "[EDI] 1 more suppressed: host down (1)", "host down"}},
+		{"nothing held, no summary", []ediconfig.NotifyPolicy{{Events: []string{"po.*"}, SuppressAfter: 2, Window: ediconfig.Duration{Duration: time.Hour}}},
+			[]step{
+				ev("2024-01-02 10:00", PONetwork, "host down"),
+				ev("2024-01-02 10:01", PONetwork, "host down"),
+				flush("2024-01-02 11:00"),
+				ev("2024-01-02 11:01", PONetwork, "host down"),
+			},
+			[]string{"host down", "host down", "host down"}},
+		{"subjects counted apart", []ediconfig.NotifyPolicy{{Events: []string{"po.*"}, SuppressAfter: 1, Window: ediconfig.Duration{Duration: time.Hour}}},
+			[]step{
+				ev("2024-01-02 10:00", PONetwork, "host down"),
+				ev("2024-01-02 10:01", PONetwork, "host unreachable"),
+				ev("2024-01-02 10:02", PONetwork, "host down"),
+				ev("2024-01-02 10:03", POError, "host down"),
+			},
+			[]string{"host down", "host unreachable", "host down"}},
+		{"first policy that matches", []ediconfig.NotifyPolicy{
+			{Events: []string{"po.error"}, Deliver: "immediate"},
+			{Events: []string{"po.*"}, Deliver: "hourly"},
+		},
+			[]step{
+				ev("2024-01-02 10:00", POError, "bad order"),
+				ev("2024-01-02 10:01", PORetry, "host down"),
+			},
+			[]string{"bad order"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, out := testDispatcher(t, tt.policies)
+			for _, s := range tt.steps {
+				if s.flush {
+					d.flush(day(s.at))
+					continue
+				}
+				if err := d.Notify(Event{Type: s.typ, Time: day(s.at), Subject: s.subject, Body: s.subject}); err != nil {
+					t.Fatalf("Notify: %v", err)
+				}
+			}
+			if got := sent(t, d, out); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sent %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSummary(t *testing.T) {
+	d, out := testDispatcher(t, []ediconfig.NotifyPolicy{
+		{Events: []string{"po.*"}, SuppressAfter: 1, Window: ediconfig.Duration{Duration: time.Hour}},
+	})
+	start := time.Date(2024, 1, 2, 10, 0, 0, 0, time.Local)
+	for i := 0; i < 4; i++ {
+		d.Notify(Event{Type: PONetwork, Time: start.Add(time.Duration(i) * time.Minute), Subject: "host down", To: []string{"ops@example.com"}})
+	}
+	d.flush(start.Add(time.Hour))
+	sent(t, d, out)
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d sent, want the first and a summary", len(lines))
+	}
+	var ev Event
+	if err := json.Unmarshal([]byte(lines[1]), &ev); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"Event":      PONetwork,
+		"Subject":    "host down",
+		"Sent":       "1",
+		"Suppressed": "3",
+		"First":      "2024-01-02 10:00:00",
+		"Last":       "2024-01-02 10:03:00",
+	}
+	for name, value := range want {
+		if got := ev.Field(name); got != value {
+			t.Errorf("summary %s = %q, want %q", name, got, value)
+		}
+	}
+	if ev.Type != PONetwork || len(ev.To) != 1 || ev.To[0] != "ops@example.com" {
+		t.Errorf("summary is a %s to %q, want it where the first went", ev.Type, ev.To)
+	}
+	// The window is gone from the spool once summed up.
+	if counts := d.readSuppressed(); len(counts) != 0 {
+		t.Errorf("suppression counts left: %v", counts)
+	}
+}
+
+func TestDigestBody(t *testing.T) {
+	at := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+	ev := digest(POError, []Event{
+		{Type: POError, Time: at, Subject: "bad order", Body: "Order: PO1\nError: no lines\n"},
+		{Type: POError, Time: at.Add(time.Minute), Subject: "another", Body: "Order: PO2"},
+	}, at.Add(time.Hour))
+	want := "2024-01-02 10:00:00  bad order\n    Order: PO1\n    Error: no lines\n\n" +
+		"2024-01-02 10:01:00  another\n    Order: PO2\n\n"
+	if ev.Body != want || ev.Count != 2 || !ev.Time.Equal(at.Add(time.Hour)) {
+		t.Errorf("digest %d at %v:\n%s\nwant:\n%s", ev.Count, ev.Time, ev.Body, want)
+	}
+}
+
+func TestNext(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	tests := []struct {
+		deliver, at string
+		first       string
+		want        string
+	}{
+		{"hourly", "", "2024-01-02 10:00", "2024-01-02 11:00"},
+		{"hourly", "", "2024-01-02 10:59", "2024-01-02 11:00"},
+		{"hourly", "", "2024-01-02 23:30", "2024-01-03 00:00"},
+		{"daily", "07:30", "2024-01-02 06:00", "2024-01-02 07:30"},
+		{"daily", "07:30", "2024-01-02 07:30", "2024-01-03 07:30"},
+		{"daily", "07:30", "2024-01-02 08:00", "2024-01-03 07:30"},
+		{"daily", "", "2024-01-02 08:00", "2024-01-03 00:00"},
+	}
+	for _, tt := range tests {
+		p := &ediconfig.NotifyPolicy{Deliver: tt.deliver, At: tt.at}
+		if got := next(p, at(tt.first)); !got.Equal(at(tt.want)) {
+			t.Errorf("%s %s digest begun %s sent %v, want %s", tt.deliver, tt.at, tt.first, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyTakenOut(t *testing.T) {
+	policies := []ediconfig.NotifyPolicy{{Events: []string{"po.*"}, Deliver: "daily", At: "07:30"}}
+	d, out := testDispatcher(t, policies)
+	now := time.Date(2024, 1, 2, 8, 0, 0, 0, time.Local)
+	d.Notify(Event{Type: POError, Time: now, Subject: "bad order"})
+	d.flush(now.Add(time.Hour))
+	cfg := ediconfig.Notify{
+		Backends: map[string]ediconfig.NotifyBackend{"out": {Type: "file", Path: out}},
+		Routes:   []ediconfig.NotifyRoute{{Backends: []string{"out"}}},
+		Spool:    d.spool,
+	}
+	if err := d.Update(cfg, Defaults{Source: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	d.flush(now.Add(time.Hour))
+	want := []string{"[EDI] Digest: 1 po.error since 2024-01-02 08:00 (1)"}
+	if got := sent(t, d, out); !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,147 @@
+package notify
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Field is one labelled value of an event, such as the order number.
+type Field struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// F makes Fields from name, value pairs.
+func F(pairs ...string) []Field {
+	var fields []Field
+	for i := 0; i+1 < len(pairs); i += 2 {
+		fields = append(fields, Field{Name: pairs[i], Value: pairs[i+1]})
+	}
+	return fields
+}
+
+// Field returns the value of the named field, "" if the event has
+// none. Templates use it as {{.Field "Order"}}.
+func (ev Event) Field(name string) string {
+	for _, f := range ev.Fields {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Text lays the fields out one per line with the labels lined up, the
+// way the programs have always written their mail, and ends with the
+// date and time of the event. Lines after the first of a value are
+// indented to line up under it.
+func (ev Event) Text() string {
+	fields := append(ev.Fields[:len(ev.Fields):len(ev.Fields)],
+		Field{Name: "Date Time", Value: ev.Time.Format("2006-01-02 15:04:05")})
+	width := 0
+	for _, f := range fields {
+		if len(f.Name) > width {
+			width = len(f.Name)
+		}
+	}
+	var b strings.Builder
+	for _, f := range fields {
+		value := strings.ReplaceAll(f.Value, "\n", "\n"+strings.Repeat(" ", width+2))
+		b.WriteString(strings.Repeat(" ", width-len(f.Name)) + f.Name + ": " + value + "\n")
+	}
+	return b.String()
+}
+
+// PartnerOf returns the trading partner a document belongs to, from
+// its file name: ACMESHIP for PO_ACMESHIP_... and RESPONSE_ACMESHIP_...,
+// customer for customer_MR_.... It is "" for a name it does not know.
+func PartnerOf(name string) string {
+	parts := strings.Split(path.Base(name), "_")
+	if len(parts) < 3 {
+		return ""
+	}
+	switch {
+	case parts[0] == "PO" || parts[0] == "RESPONSE":
+		return parts[1]
+	case parts[1] == "MR":
+		return parts[0]
+	}
+	return ""
+}
+
+// render makes the subject, text and HTML of ev from the templates in
+// dir. Each is looked for in turn as
+//
+//	dir/<partner>/<event type>.subject, .txt or .html
+//	dir/<partner>/default.subject, .txt or .html
+//	dir/<event type>.subject, .txt or .html
+//	dir/default.subject, .txt or .html
+//
+// The first file found is used. Without a subject or text template the
+// event keeps its own, and without an HTML template the mail is plain
+// text. Templates see the Event, after Body has been filled in from the
+// fields, so a template may wrap {{.Body}} or pick out {{.Field "Order"}}.
+func render(dir string, ev *Event) {
+	if ev.Body == "" && len(ev.Fields) > 0 {
+		ev.Body = ev.Text()
+	}
+	if dir == "" {
+		return
+	}
+	if s, ok := execute(dir, ev, ".subject"); ok {
+		ev.Subject = strings.TrimSpace(strings.SplitN(s, "\n", 2)[0])
+	}
+	// Both bodies see the built-in one.
+	data := *ev
+	if s, ok := execute(dir, &data, ".txt"); ok {
+		ev.Body = s
+	}
+	if s, ok := execute(dir, &data, ".html"); ok {
+		ev.HTML = s
+	}
+}
+
+// execute runs the first template found for ev with the given
+// extension. A template that does not parse or run is logged and
+// skipped, the built-in message is better than none.
+func execute(dir string, ev *Event, ext string) (string, bool) {
+	var names []string
+	if p := ev.Partner; p != "" && p != "." && p != ".." && !strings.ContainsAny(p, `/\`) {
+		names = append(names, filepath.Join(dir, p, ev.Type+ext), filepath.Join(dir, p, "default"+ext))
+	}
+	names = append(names, filepath.Join(dir, ev.Type+ext), filepath.Join(dir, "default"+ext))
+	for _, name := range names {
+		b, err := os.ReadFile(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			slog.Warn("notify: template", "err", err)
+			return "", false
+		}
+		var out bytes.Buffer
+		if ext == ".html" {
+			var t *htmltemplate.Template
+			if t, err = htmltemplate.New(name).Parse(string(b)); err == nil {
+				err = t.Execute(&out, ev)
+			}
+		} else {
+			var t *template.Template
+			if t, err = template.New(name).Parse(string(b)); err == nil {
+				err = t.Execute(&out, ev)
+			}
+		}
+		if err != nil {
+			slog.Warn("notify: template", "err", err)
+			return "", false
+		}
+		return out.String(), true
+	}
+	return "", false
+}
@@ -0,0 +1,539 @@
+/*
+Package poapi is the HTTPS API partners submit purchase orders through,
+alongside dropping files in the watched directory.
+
+A partner POSTs the fXML order to /api/v1/orders with its bearer token.
+Each order becomes a job, kept in a directory of its own under the api
+jobs directory, and is imported by the service as a dropped file would
+be, the response being written into the job directory instead of the
+outbox. With ?wait=30s the request waits up to that long, at most
+api.maxWait, and returns the response XML; otherwise, or when the
+import takes longer, it returns 202 and the job, to be polled:
+
+	GET /api/v1/jobs/<id>           the job as JSON
+	GET /api/v1/jobs/<id>/response  the response XML once there is one
+
+The job ID is also the order's correlation ID, see package edilog.
+Jobs survive a restart: those not finished are imported again.
+*/
+package poapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloud3000/BaseEDI/ediconfig"
+	"github.com/cloud3000/BaseEDI/edilog"
+	"github.com/cloud3000/BaseEDI/editls"
+	"github.com/cloud3000/BaseEDI/ledger"
+)
+
+const (
+	// maxOrder is the largest order accepted, in bytes.
+	maxOrder = 10 << 20
+	// queueSize is the jobs that may wait for a worker.
+	queueSize = 256
+	// pruneEvery is how often finished jobs past api.keep are removed.
+	pruneEvery = time.Hour
+)
+
+// Job states.
+const (
+	Queued  = "queued"  // waiting for a worker
+	Running = "running" // being imported
+	Retry   = "retry"   // the host timed out, to be tried again
+	Done    = "done"    // imported, the response is there
+	Failed  = "failed"  // not imported; there may be an error response
+)
+
+// ErrInterrupted is what Import returns when shutdown stopped it.
+var ErrInterrupted = errors.New("import interrupted by shutdown")
+
+// Job is one submitted order.
+type Job struct {
+	ID        string     `json:"id"`
+	Partner   string     `json:"partner"`
+	State     string     `json:"state"`
+	Submitted time.Time  `json:"submitted"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Tries     int        `json:"tries"`
+	Error     string     `json:"error,omitempty"`
+	// Response is the response file in the job directory, "" until
+	// the import writes one.
+	Response string `json:"response,omitempty"`
+
+	dir  string
+	done chan struct{} // closed when the job finishes
+}
+
+// Dir is the job's directory, where the response is to be written.
+func (j *Job) Dir() string { return j.dir }
+
+// File is the order, in the job directory. Its name starts
+// PO_<partner>_ like a dropped file's.
+func (j *Job) File() string {
+	return filepath.Join(j.dir, "PO_"+j.Partner+"_API_"+j.ID+".xml")
+}
+
+// Options are what the service gives the API.
+type Options struct {
+	// Config returns the api section, read again for each request so
+	// a reload changes the partners.
+	Config func() ediconfig.API
+	// TLS serves the certificate in api.tls.
+	TLS *editls.Server
+	// Import runs the import of a job's order, writing any response
+	// into j.Dir(). retry says the host could not be reached and the
+	// order may be tried again; err is why the import failed, or
+	// ErrInterrupted.
+	Import func(j *Job) (retry bool, err error)
+	// Retries and RetryDelay say how often and when an order is tried
+	// again after the host timed out.
+	Retries    int
+	RetryDelay time.Duration
+	// Book records submissions and their outcome, may be nil.
+	Book *ledger.Ledger
+}
+
+// Server is the running API.
+type Server struct {
+	opts  Options
+	dir   string
+	srv   *http.Server
+	queue chan *Job
+
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	closing bool
+
+	workers sync.WaitGroup
+	stop    chan struct{}
+}
+
+// Listen loads the jobs in api.jobs, starts the workers and serves the
+// API on api.listen. It returns nil if the API is turned off.
+func Listen(opts Options) (*Server, error) {
+	cfg := opts.Config()
+	if cfg.Listen == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(cfg.Jobs, 0755); err != nil {
+		return nil, err
+	}
+	s := &Server{
+		opts:  opts,
+		dir:   cfg.Jobs,
+		queue: make(chan *Job, queueSize),
+		jobs:  make(map[string]*Job),
+		stop:  make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	l, err := opts.TLS.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/orders", s.submit)
+	mux.HandleFunc("/api/v1/jobs/", s.job)
+	s.srv = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+	for i := 0; i < cfg.Workers; i++ {
+		s.workers.Add(1)
+		go s.work()
+	}
+	go s.prune()
+	go func() {
+		if err := s.srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("API server failed", "addr", cfg.Listen, "err", err)
+		}
+	}()
+	slog.Info("API listening", "addr", l.Addr().String())
+	return s, nil
+}
+
+// Close stops taking orders and waits for the imports running, which
+// the service stops by its own shutdown timeout. It returns how many
+// jobs are left to finish on the next start.
+func (s *Server) Close(timeout time.Duration) int {
+	if s == nil {
+		return 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	s.srv.Shutdown(ctx)
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+	close(s.stop)
+	s.workers.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := 0
+	for _, j := range s.jobs {
+		if j.Finished == nil {
+			pending++
+		}
+	}
+	return pending
+}
+
+// load reads the jobs left by the last run and queues those that had
+// not finished.
+func (s *Server) load() error {
+	ents, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, ent := range ents {
+		if !ent.IsDir() {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(s.dir, ent.Name(), "job.json"))
+		if err != nil {
+			continue
+		}
+		j := &Job{}
+		if err := json.Unmarshal(b, j); err != nil || j.ID != ent.Name() {
+			slog.Warn("API: skipping damaged job", "dir", ent.Name(), "err", err)
+			continue
+		}
+		j.dir = filepath.Join(s.dir, j.ID)
+		j.done = make(chan struct{})
+		s.jobs[j.ID] = j
+		if j.Finished != nil {
+			close(j.done)
+			continue
+		}
+		j.State = Queued
+		select {
+		case s.queue <- j:
+		default:
+			return fmt.Errorf("api: more than %d jobs left to finish", queueSize)
+		}
+	}
+	return nil
+}
+
+// save writes the job's state to its directory. s.mu held.
+func (s *Server) save(j *Job) {
+	b, _ := json.MarshalIndent(j, "", "\t")
+	name := filepath.Join(j.dir, "job.json")
+	err := os.WriteFile(name+".tmp", b, 0644)
+	if err == nil {
+		err = os.Rename(name+".tmp", name)
+	}
+	if err != nil {
+		slog.Error("API: failed to save job", "id", j.ID, "err", err)
+	}
+}
+
+func (s *Server) work() {
+	defer s.workers.Done()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case j := <-s.queue:
+			s.run(j)
+		}
+	}
+}
+
+// run imports one job.
+func (s *Server) run(j *Job) {
+	s.mu.Lock()
+	j.State = Running
+	j.Tries++
+	s.save(j)
+	s.mu.Unlock()
+
+	retry, err := s.opts.Import(j)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.Response = response(j.dir)
+	switch {
+	case errors.Is(err, ErrInterrupted):
+		// Shutdown cut it off; the next start has it again.
+		j.State = Queued
+		j.Tries--
+		s.save(j)
+		return
+	case retry && err != nil && j.Tries <= s.opts.Retries:
+		j.State = Retry
+		j.Error = err.Error()
+		s.save(j)
+		time.AfterFunc(s.opts.RetryDelay, func() { s.requeue(j) })
+		return
+	case err != nil:
+		j.State = Failed
+		j.Error = err.Error()
+		if retry {
+			j.Error = fmt.Sprintf("gave up after %d tries, %v", j.Tries, err)
+			s.opts.Book.Record(j.ID, ledger.PO, filepath.Base(j.File()), ledger.Failed, j.Error)
+		}
+	default:
+		j.State = Done
+		j.Error = ""
+	}
+	now := time.Now()
+	j.Finished = &now
+	s.save(j)
+	close(j.done)
+}
+
+// requeue queues a job waiting for its retry.
+func (s *Server) requeue(j *Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return
+	}
+	select {
+	case s.queue <- j:
+		j.State = Queued
+		s.save(j)
+	default:
+		time.AfterFunc(s.opts.RetryDelay, func() { s.requeue(j) })
+	}
+}
+
+// response returns the response file the import wrote into dir, "" if
+// there is none.
+func response(dir string) string {
+	names, _ := filepath.Glob(filepath.Join(dir, "RESPONSE_*.xml"))
+	if len(names) == 0 {
+		return ""
+	}
+	return filepath.Base(names[len(names)-1])
+}
+
+// prune removes the finished jobs older than api.keep.
+func (s *Server) prune() {
+	t := time.NewTicker(pruneEvery)
+	defer t.Stop()
+	for {
+		s.mu.Lock()
+		keep := s.opts.Config().Keep.Duration
+		for id, j := range s.jobs {
+			if j.Finished != nil && time.Since(*j.Finished) > keep {
+				os.RemoveAll(j.dir)
+				delete(s.jobs, id)
+			}
+		}
+		s.mu.Unlock()
+		select {
+		case <-t.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// partner returns the partner the request's bearer token belongs to,
+// "" if it belongs to none.
+func (s *Server) partner(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return ""
+	}
+	for _, p := range s.opts.Config().Partners {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(p.Token)) == 1 {
+			return p.Name
+		}
+	}
+	return ""
+}
+
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	partner := s.partner(r)
+	if partner == "" {
+		slog.Warn("API: unauthorized", "remote", r.RemoteAddr, "path", r.URL.Path)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="edi"`)
+		writeError(w, http.StatusUnauthorized, "missing or unknown bearer token")
+		return "", false
+	}
+	return partner, true
+}
+
+// submit takes an order: POST /api/v1/orders[?wait=30s].
+func (s *Server) submit(w http.ResponseWriter, r *http.Request) {
+	partner, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	wait, err := waitFor(r.URL.Query().Get("wait"), s.opts.Config().MaxWait.Duration)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxOrder))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	if len(strings.TrimSpace(string(b))) == 0 {
+		writeError(w, http.StatusBadRequest, "empty order")
+		return
+	}
+
+	id := edilog.NewID()
+	j := &Job{
+		ID:        id,
+		Partner:   partner,
+		State:     Queued,
+		Submitted: time.Now(),
+		dir:       filepath.Join(s.dir, id),
+		done:      make(chan struct{}),
+	}
+	lg := slog.With("id", id, "partner", partner)
+	if err := os.MkdirAll(j.dir, 0755); err != nil {
+		lg.Error("API: failed to make job", "err", err)
+		writeError(w, http.StatusInternalServerError, "cannot store the order")
+		return
+	}
+	if err := os.WriteFile(j.File(), b, 0644); err != nil {
+		lg.Error("API: failed to store order", "err", err)
+		os.RemoveAll(j.dir)
+		writeError(w, http.StatusInternalServerError, "cannot store the order")
+		return
+	}
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		os.RemoveAll(j.dir)
+		writeError(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	}
+	select {
+	case s.queue <- j:
+	default:
+		s.mu.Unlock()
+		os.RemoveAll(j.dir)
+		w.Header().Set("Retry-After", "60")
+		writeError(w, http.StatusServiceUnavailable, "too many orders waiting, try again later")
+		return
+	}
+	s.jobs[id] = j
+	s.save(j)
+	s.mu.Unlock()
+	lg.Info("Order submitted", "bytes", len(b), "remote", r.RemoteAddr, "wait", wait)
+	s.opts.Book.RecordKeys(id, ledger.PO, filepath.Base(j.File()), ledger.Received, "api", ledger.Keys{Partner: partner})
+
+	if wait > 0 {
+		select {
+		case <-j.done:
+		case <-time.After(wait):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	s.reply(w, j, true)
+}
+
+// job serves GET /api/v1/jobs/<id> and /api/v1/jobs/<id>/response.
+func (s *Server) job(w http.ResponseWriter, r *http.Request) {
+	partner, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	rest := strings.TrimPrefix(r.URL.Path, "/api/v1/jobs/")
+	id, what, _ := strings.Cut(rest, "/")
+	s.mu.Lock()
+	j := s.jobs[id]
+	s.mu.Unlock()
+	// Another partner's job is as good as missing.
+	if j == nil || j.Partner != partner || (what != "" && what != "response") {
+		writeError(w, http.StatusNotFound, "no such job")
+		return
+	}
+	s.reply(w, j, what == "response")
+}
+
+// reply answers with the response XML if wantXML and the job has one,
+// otherwise with the job as JSON: 200 when finished, 202 while not.
+func (s *Server) reply(w http.ResponseWriter, j *Job, wantXML bool) {
+	s.mu.Lock()
+	snap := *j
+	s.mu.Unlock()
+	w.Header().Set("X-EDI-Job", snap.ID)
+	w.Header().Set("X-EDI-State", snap.State)
+	if wantXML && snap.Finished != nil && snap.Response != "" {
+		f, err := os.Open(filepath.Join(snap.dir, snap.Response))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "response lost")
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/xml; charset=ISO-8859-1")
+		w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(snap.Response))
+		io.Copy(w, f)
+		return
+	}
+	code := http.StatusOK
+	if snap.Finished == nil {
+		code = http.StatusAccepted
+		w.Header().Set("Location", "/api/v1/jobs/"+snap.ID)
+		w.Header().Set("Retry-After", "5")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(snap)
+}
+
+// waitFor parses the wait parameter, a duration or seconds, capped at
+// max.
+func waitFor(v string, max time.Duration) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		n, nerr := strconv.Atoi(v)
+		if nerr != nil || n < 0 {
+			return 0, fmt.Errorf("wait %q is not a duration", v)
+		}
+		d = time.Duration(n) * time.Second
+	}
+	if d > max {
+		d = max
+	}
+	return d, nil
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{msg})
+}
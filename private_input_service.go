@@ -4,165 +4,581 @@ package main
 
 Listens on multiple ports for request from the private network.
 You could also run this facing the public Internet, but
-some addtional security may be needed.
+some addtional security may be needed: see the private.tls
+setting for TLS and client certificates.
 
 */
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
 	"net"
-	"net/smtp"
+	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/blackjack/syslog"
+	"github.com/cloud3000/BaseEDI/admit"
+	"github.com/cloud3000/BaseEDI/dashboard"
+	"github.com/cloud3000/BaseEDI/ediconfig"
+	"github.com/cloud3000/BaseEDI/edihttp"
+	"github.com/cloud3000/BaseEDI/edilog"
+	"github.com/cloud3000/BaseEDI/editls"
+	"github.com/cloud3000/BaseEDI/ledger"
+	"github.com/cloud3000/BaseEDI/metrics"
+	"github.com/cloud3000/BaseEDI/mrreceipt"
+	"github.com/cloud3000/BaseEDI/notify"
 )
 
 const (
-	serverhost = "nnn.nnn.nnn.nnn" // This is localhost public IP.
 	servertype = "tcp"
-	mrport     = "30771"                // Incomming requests for Materail Receipts
 	mrprocess  = "./bin/XML_MR_Receipt" // MR request handler.
-	cmdport    = "30772"
 	custemail  = "cust@theirdomain.com"
 	mgremail   = "edimgr@yourdomain.com"
 	smtpuser   = "michael@cloud3000.com"
 	smtppass   = "**********"
 	smtpserv   = "cloud3000.com"
 	smtpport   = ":587"
+
+	// exitRetry is the XML_MR_Receipt exit status for a timed out session.
+	exitRetry = 75
+
+	// MR receipts written in-process are sent as XML_MR_Receipt does.
+	mremailfrom = "customer@cloud3000.com"
+	mremailto   = "edimgr@cloud3000.com"
 )
 
-func ediEmail(mailfrom string, mailto string, mailsub string, mailmsg string) int {
-	// Set up authentication information.
-	auth := smtp.PlainAuth("", smtpuser, smtppass, smtpserv)
-	// Connect to the server, authenticate, set the sender and recipient,
-	// and send the email all in one step.
-	to := []string{mailto}
-	msg := []byte("To: " + mailto + "\r\n" +
-		"From: " + mailfrom + "\r\n" +
-		"Subject: " + mailsub + "\r\n" +
-		"\r\n" +
-		mailmsg + "\r\n")
-	err := smtp.SendMail(smtpserv+smtpport, auth, smtpuser, to, msg)
-	if err != nil {
-		fmt.Printf("%v\n", err)
+var (
+	configPath      = flag.String("config", ediconfig.DefaultPath, "The configuration file, also passed to "+mrprocess)
+	recordTimeout   = flag.Duration("record-timeout", time.Minute, "Deadline for each MR record, passed to "+mrprocess)
+	sessionTimeout  = flag.Duration("session-timeout", 10*time.Minute, "Deadline for each MR session, passed to "+mrprocess)
+	maxSessions     = flag.Int("max-sessions", 64, "MR sessions handled at once")
+	maxQueued       = flag.Int("max-queued", 64, "MR connections waiting for a session, more are turned away")
+	queueTimeout    = flag.Duration("queue-timeout", time.Minute, "How long an MR connection waits for a session")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "How long SIGTERM waits for MR sessions to finish")
+	isolate         = flag.Bool("isolate", false, "Run each MR session in its own "+mrprocess+" process")
+)
+
+// config is replaced as a whole when SIGHUP reloads the file.
+var config *ediconfig.Live
+
+// tlsServer is nil unless the configuration has a private.tls section.
+var tlsServer *editls.Server
+
+// admission decides which MR connections get a session.
+var admission *admit.Controller
+
+// book is the document ledger, nil if it could not be opened.
+var book *ledger.Ledger
+
+// notifier sends the service's notifications and the MR sessions'.
+var notifier *notify.Dispatcher
+
+var (
+	// inflight counts MR connections from Accept until their session ends.
+	inflight sync.WaitGroup
+	// abort is closed when shutdown gives up waiting for sessions.
+	abort = make(chan struct{})
+	// interrupted counts the sessions cut off by shutdown.
+	interrupted atomic.Int32
+	// accepting is stopped when listenMR returns, and acceptFailed
+	// counts the accepts that have failed in a row, for /healthz.
+	accepting    edihttp.Heartbeat
+	acceptFailed atomic.Int32
+	// running holds a dashboard.MRSession for each session, by ID.
+	running sync.Map
+)
+
+var (
+	mSessions = metrics.NewCounter("edi_mr_sessions_total",
+		"MR sessions finished, by result: written, failed, timeout or refused.", "result")
+	mSessionTime = metrics.NewHistogram("edi_mr_session_seconds", "How long MR sessions took.", nil)
+)
+
+// notifyDefaults are the notification settings built into the service.
+func notifyDefaults(cfg *ediconfig.Config) notify.Defaults {
+	serv, port, user, pass := cfg.Mail.Settings(smtpserv, smtpport, smtpuser, smtppass)
+	return notify.Defaults{
+		Source: "private_input_service",
+		From:   custemail,
+		To:     mgremail,
+		Mail:   ediconfig.Mail{Server: serv, Port: port, User: user, Password: pass},
 	}
-	return 0
 }
 
-func listenMR(conntype string, connhost string, connport string) {
+// listen listens on addr, with TLS when it is configured.
+func listen(conntype string, addr string) (net.Listener, error) {
+	if tlsServer != nil {
+		return tlsServer.Listen(conntype, addr)
+	}
+	return net.Listen(conntype, addr)
+}
 
-	// Listen for incoming connections.
-	l, err := net.Listen(conntype, connhost+":"+connport)
-	if err != nil {
-		fmt.Println("Error listening:", err.Error())
-		os.Exit(1)
-	}
-	// Close the listener when the application closes.
-	defer l.Close()
-	fmt.Println("Listening on " + connhost + ":" + connport)
-	syslog.Syslogf(syslog.LOG_INFO, "Listening on: %s:%s ", connhost, connport)
-	for {
+// listenMR accepts MR connections on l until it is closed.
+func listenMR(l net.Listener) {
+	accepting.Beat()
+	defer accepting.Stop()
+	for failed := 0; ; {
 		// Listen for an incoming connection.
 		conn, err := l.Accept()
 		if err != nil {
-			fmt.Println("Error accepting: ", err.Error())
-			os.Exit(1)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Out of file descriptors and the like, back off and
+			// try again rather than take the listener down.
+			failed++
+			acceptFailed.Store(int32(failed))
+			slog.Error("MR accept failed", "err", err, "failed", failed)
+			time.Sleep(admit.AcceptBackoff(failed))
+			continue
+		}
+		failed = 0
+		acceptFailed.Store(0)
+		if err := admission.Check(conn.RemoteAddr()); err != nil {
+			refuseMR(conn, err)
+			continue
 		}
 		// Handle connections in a new goroutine.
-		go runMR(conn)
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			release, err := admission.Acquire()
+			if err != nil {
+				refuseMR(conn, err)
+				return
+			}
+			defer release()
+			// The receipt is known by this ID from here on.
+			id := edilog.NewID()
+			slog.Info("MR connection", "id", id, "remote", conn.RemoteAddr().String())
+			start := time.Now()
+			mode := "in-process"
+			if *isolate {
+				mode = "isolated"
+			}
+			running.Store(id, dashboard.MRSession{ID: id, Remote: conn.RemoteAddr().String(), Mode: mode, Started: start})
+			defer running.Delete(id)
+			var result string
+			if *isolate {
+				result = runMR(conn, id)
+			} else {
+				result = serveMR(conn, id)
+			}
+			mSessions.Inc(result)
+			mSessionTime.Observe(time.Since(start).Seconds())
+		}()
+	}
+}
+
+// healthChecks adds the service's checks to /healthz and /readyz.
+func healthChecks(web *edihttp.Server) {
+	web.Live("listener", listenerCheck())
+	web.Ready("smtp", notifier.Check)
+	web.Ready("disk", func() error {
+		return edihttp.DiskFree(config.Get().HTTP.MinFreeMB, ".", config.Get().Dirs.MRReceipts)
+	})
+	web.Ready("dirs", func() error {
+		return edihttp.Writable(config.Get().Dirs.MRReceipts)
+	})
+}
+
+// listenerCheck fails once the MR listener has stopped, or while its
+// accepts fail.
+func listenerCheck() func() error {
+	alive := accepting.Check(0)
+	return func() error {
+		if n := acceptFailed.Load(); n > 0 {
+			return fmt.Errorf("%d MR accepts failed in a row", n)
+		}
+		return alive()
+	}
+}
+
+// connectivityTests are what edictl test tries from here: the MR
+// listener, the TLS files, the allowlist and the mail servers.
+func connectivityTests() []edihttp.Check {
+	cfg := config.Get()
+	return []edihttp.Check{
+		{Name: "mr listener " + cfg.Private.Host + ":" + cfg.Private.MRPort, Fn: listenerCheck()},
+		{Name: "tls", Fn: func() error {
+			if cfg.Private.TLS == nil {
+				return nil
+			}
+			return editls.Check(*cfg.Private.TLS)
+		}},
+		{Name: "allowlist", Fn: func() error {
+			_, err := admit.New(cfg.Private, 1, 0, 0)
+			return err
+		}},
+		{Name: "smtp", Fn: notifier.Check},
+	}
+}
+
+// sessionsHandler serves the MR sessions running, for the dashboard.
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	st := dashboard.MRStatus{Max: *maxSessions, Sessions: []dashboard.MRSession{}}
+	st.Active, st.Queued = admission.Active()
+	running.Range(func(_, v any) bool {
+		st.Sessions = append(st.Sessions, v.(dashboard.MRSession))
+		return true
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// abortOn calls stop if the shutdown deadline passes before the
+// session is done. The returned func says the session is done.
+func abortOn(stop func()) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-abort:
+			interrupted.Add(1)
+			stop()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// refuseMR turns an MR connection away.
+func refuseMR(conn net.Conn, err error) {
+	conn.Close()
+	slog.Warn("MR connection refused", "remote", conn.RemoteAddr().String(), "err", err)
+	mSessions.Inc("refused")
+}
+
+// sessionResult is the edi_mr_sessions_total result for a session
+// that ended with err.
+func sessionResult(err error) string {
+	switch {
+	case err == nil:
+		return "written"
+	case err == mrreceipt.ErrTimeout:
+		return "timeout"
+	}
+	return "failed"
+}
+
+// serveMR runs one MR session in this process and returns its result.
+// A panic ends the session, not the service.
+func serveMR(conn net.Conn, id string) (result string) {
+	defer func() {
+		if r := recover(); r != nil {
+			result = "failed"
+			conn.Close()
+			slog.Error("MR session panic", "id", id, "remote", conn.RemoteAddr().String(),
+				"panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			notifier.Notify(notify.Event{
+				Type:    notify.MRError,
+				ID:      id,
+				Subject: "[EDI] private_input ERROR, MR session failed.",
+				Fields: notify.F(
+					"Remote Addr", conn.RemoteAddr().String(),
+					"Error", fmt.Sprint(r)),
+			})
+		}
+	}()
+	// Finish the TLS handshake first so the session knows who it is
+	// talking to. A client the allowlist turns away stops here.
+	conn.SetDeadline(time.Now().Add(*recordTimeout))
+	client, err := editls.Identity(conn)
+	if err != nil {
+		conn.Close()
+		slog.Warn("MR handshake failed", "id", id, "remote", conn.RemoteAddr().String(), "err", err)
+		return "refused"
+	}
+	defer abortOn(func() { conn.Close() })()
+	cfg := config.Get()
+	session := &mrreceipt.Session{
+		Conn:           conn,
+		Client:         client,
+		ID:             id,
+		Dir:            cfg.Dirs.MRReceipts,
+		RecordTimeout:  *recordTimeout,
+		SessionTimeout: *sessionTimeout,
+		Notifier:       notifier.As(mremailfrom, mremailto),
+		Ledger:         book,
+		X12:            cfg.X12,
+		EDIFACT:        cfg.EDIFACT,
+	}
+	// The session has reported anything that went wrong.
+	err = session.Run()
+	if err != nil {
+		slog.Warn("MR session failed", "id", id, "remote", conn.RemoteAddr().String(), "err", err)
 	}
+	return sessionResult(err)
 }
 
-func runMR(conn net.Conn) { // This a go routine thread ea. 'go runMR'
+// runMR runs one MR session in a child process, for -isolate, and
+// returns its result. The child logs with the session's correlation
+// ID and leaves its counts for this process to add to its own.
+func runMR(conn net.Conn, id string) string {
 
 	// here we are preparing to pass the socket FD to the child process
 	conn2, _ := conn.(*net.TCPConn).File()
 	defer conn2.Close()
+	defer conn.Close()
 	d := conn2.Fd()
-	//
-	// We'll give the child process 3 seconds (4ever)
-	// to grap the socket, b4 we close our end of it.
-	time.AfterFunc(3*time.Second, func() {
-		fmt.Printf("close conn: %s\n", conn.RemoteAddr())
-		conn.Close()
-	})
 
 	init := mrprocess
 	// the FD on the cmdline, does not work.
-	initArgs := []string{strconv.Itoa(int(d))}
+	initArgs := []string{
+		"-config=" + *configPath,
+		"-record-timeout=" + recordTimeout.String(),
+		"-session-timeout=" + sessionTimeout.String(),
+		strconv.Itoa(int(d))}
 	// For some reason the child always gets the socket in FD 3
 
 	cmd := exec.Command(init, initArgs...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	mfile := filepath.Join(os.TempDir(), "edi-metrics-"+id+".json")
+	cmd.Env = append(edilog.Env(id), metrics.EnvFile+"="+mfile)
 	cmd.ExtraFiles = []*os.File{conn2}
+	lg := slog.With("id", id, "child", init)
 
 	if err := cmd.Start(); err != nil {
-		fmt.Printf("Start %s error: %v\n", init, err)
-		efrom := custemail
-		eto := mgremail
-		esub := "[EDI] private_input ERROR, starting child process."
-		emsg := fmt.Sprintf(
-			"Child Process: %s\n"+
-				"        Error: %s\n"+
-				"    Date Time: %s\n",
-			init,
-			err.Error(),
-			time.Now().Format("2006-01-02, 15:04:05"))
-		ediEmail(efrom, eto, esub, emsg)
-		os.Exit(1)
-	}
-
-	if err := cmd.Wait(); err != nil {
-		fmt.Printf("Wait %s error: %v\n", init, err)
-		efrom := custemail
-		eto := mgremail
-		esub := "[EDI] private_input ERROR, death of child process."
-		emsg := fmt.Sprintf(
-			"Child Process: %s\n"+
-				"        Error: %s\n"+
-				"    Date Time: %s\n",
-			init,
-			fmt.Sprintf("Returned a bad exit status, %s", err.Error()),
-			time.Now().Format("2006-01-02, 15:04:05"))
-		ediEmail(efrom, eto, esub, emsg)
-		os.Exit(1)
+		lg.Error("Failed to start MR child", "err", err)
+		notifier.Notify(notify.Event{
+			Type:    notify.ServiceError,
+			ID:      id,
+			Subject: "[EDI] private_input ERROR, starting child process.",
+			Fields: notify.F(
+				"Child Process", init,
+				"Error", err.Error()),
+		})
+		return "failed"
+	}
+	// The child has its own copy of the socket now.
+	conn2.Close()
+	conn.Close()
+
+	// The child enforces its own deadlines, this is the backstop
+	// for a child that is stuck somewhere other than a socket read.
+	killer := time.AfterFunc(*sessionTimeout+time.Minute, func() {
+		lg.Warn("Session deadline passed, killing MR child", "pid", cmd.Process.Pid)
+		cmd.Process.Kill()
+	})
+	defer killer.Stop()
+	defer abortOn(func() { cmd.Process.Kill() })()
+
+	err := cmd.Wait()
+	if merr := metrics.Import(mfile); merr != nil {
+		lg.Warn("Failed to read MR child metrics", "err", merr)
 	}
+	if err != nil {
+		lg.Error("MR child failed", "err", err)
+		result := "failed"
+		etype, esub := notify.MRError, "[EDI] private_input ERROR, death of child process."
+		if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() == exitRetry {
+			result = "timeout"
+			etype, esub = notify.MRTimeout, "[EDI] private_input ERROR, MR session timed out."
+		}
+		notifier.Notify(notify.Event{
+			Type:    etype,
+			ID:      id,
+			Subject: esub,
+			Fields: notify.F(
+				"Child Process", init,
+				"Error", fmt.Sprintf("Returned a bad exit status, %s", err.Error())),
+		})
+		// One failed session must not take the listener down with it.
+		return result
+	}
+	return "written"
 }
 
 // Handles incoming main requests.
 func handleRequest(conn net.Conn) {
 	// ToDo.. someday this may be used as a command interface to this process
 	// commands: status, reset, stop (waits for children), abort (like kill -9)
-	fmt.Printf("Connect from %v to NOP handler", conn.LocalAddr())
+	slog.Debug("Connect to NOP handler", "remote", conn.RemoteAddr().String())
 	conn.Close()
 }
 
 func main() {
-	go listenMR(servertype, serverhost, mrport)
-	// Listen for incoming connections.
-	l, err := net.Listen(servertype, serverhost+":"+cmdport)
+	flag.Parse()
+	var err error
+	if config, err = ediconfig.NewLive(*configPath); err != nil {
+		edilog.Fatal("Configuration error", "err", err)
+	}
+	cfg := config.Get()
+	closeLog, err := edilog.Setup("private_input_service", cfg.Log)
 	if err != nil {
-		fmt.Printf("net.Listen Port Error: %s \n", err.Error())
-		os.Exit(1)
+		edilog.Fatal("Failed to open log", "err", err)
 	}
-	// Close the listener when the application closes.
-	defer l.Close()
-
-	fmt.Println("Listening on " + serverhost + ":" + cmdport)
-	syslog.Syslogf(syslog.LOG_INFO, "Listening on: %s:%s ", serverhost, cmdport)
-	for {
-		// Listen for an incoming connection.
-		conn, err := l.Accept()
+	slog.Info("private_input_service started")
+	if notifier, err = notify.New(cfg.Notify, notifyDefaults(cfg)); err != nil {
+		edilog.Fatal("Notify error", "err", err)
+	}
+	// Send the digests and summaries the notify policies hold back.
+	go notifier.Run()
+	admission, err = admit.New(cfg.Private, *maxSessions, *maxQueued, *queueTimeout)
+	if err != nil {
+		edilog.Fatal("Admission error", "err", err)
+	}
+	metrics.NewGaugeFunc("edi_mr_sessions_active", "MR sessions running.", func() float64 {
+		active, _ := admission.Active()
+		return float64(active)
+	})
+	metrics.NewGaugeFunc("edi_mr_sessions_queued", "MR connections waiting for a session.", func() float64 {
+		_, queued := admission.Active()
+		return float64(queued)
+	})
+	if cfg.Private.TLS != nil {
+		// A TLS session cannot be handed to a child process.
+		if *isolate {
+			edilog.Fatal("-isolate cannot be used with private.tls")
+		}
+		tlsServer, err = editls.New(*cfg.Private.TLS, func(err error) {
+			slog.Error("TLS reload failed", "err", err)
+		})
 		if err != nil {
-			fmt.Println("Error accepting: ", err.Error())
-			break
+			edilog.Fatal("TLS error", "err", err)
 		}
-		// Handle connections in a new goroutine.
-		go handleRequest(conn)
 	}
+	if book, err = ledger.Open(cfg.Ledger, "private_input_service"); err != nil {
+		edilog.Fatal("Ledger error", "err", err)
+	}
+	// serverhost is the public IP to listen on, empty for all of them.
+	serverhost := cfg.Private.Host
+	var listeners []net.Listener
+	for _, port := range []string{cfg.Private.MRPort, cfg.Private.CmdPort} {
+		// Listen for incoming connections.
+		l, err := listen(servertype, serverhost+":"+port)
+		if err != nil {
+			edilog.Fatal("Listen failed", "addr", serverhost+":"+port, "err", err)
+		}
+		slog.Info("Listening", "addr", serverhost+":"+port)
+		listeners = append(listeners, l)
+	}
+	web, err := edihttp.Listen("private_input_service", cfg.HTTP)
+	if err != nil {
+		edilog.Fatal("Failed to start HTTP", "err", err)
+	}
+	healthChecks(web)
+	// The MR sessions show who is connected, and edictl's interfaces
+	// are for operators only.
+	admin, err := edihttp.ListenAdmin("private_input_service", func() ediconfig.Admin { return config.Get().Admin })
+	if err != nil {
+		edilog.Fatal("Failed to start the admin interface", "err", err)
+	}
+	admin.Handle("/sessions", http.HandlerFunc(sessionsHandler))
+	admin.Handle("/admin/config", edihttp.ConfigHandler(config.Get))
+	admin.Handle("/admin/test", edihttp.TestHandler(connectivityTests))
+	go listenMR(listeners[0])
+	go func(l net.Listener) {
+		for {
+			// Listen for an incoming connection.
+			conn, err := l.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					slog.Error("Accept failed", "err", err)
+				}
+				return
+			}
+			// Handle connections in a new goroutine.
+			go handleRequest(conn)
+		}
+	}(listeners[1])
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	for sig := range sigs {
+		if sig == syscall.SIGHUP {
+			reload()
+			continue
+		}
+		slog.Info("Shutting down", "signal", sig)
+		break
+	}
+	signal.Stop(sigs)
+
+	// Stop accepting, turn away the queued connections and give the
+	// sessions running until the deadline to finish.
+	for _, l := range listeners {
+		l.Close()
+	}
+	admission.Close()
+	drained := make(chan struct{})
+	go func() {
+		inflight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(*shutdownTimeout):
+		close(abort)
+		<-drained
+	}
+	status := 0
+	if n := interrupted.Load(); n > 0 {
+		// MMTS sends a cut off receipt again, as after a timeout.
+		slog.Warn("MR sessions cut off by shutdown", "sessions", n)
+		status = exitRetry
+	}
+	admin.Close(*shutdownTimeout)
+	web.Close(*shutdownTimeout)
+	if err := notifier.Close(*shutdownTimeout); err != nil {
+		slog.Error("Failed to flush notifications", "err", err)
+	}
+	if err := book.Close(); err != nil {
+		slog.Error("Ledger error", "err", err)
+		status = 1
+	}
+	slog.Info("private_input_service ended", "status", status)
+	closeLog()
+	os.Exit(status)
+}
+
+// reload reads the configuration file again for SIGHUP. The new
+// configuration is only put in use once the admission, TLS and
+// notification settings have all taken it; if one fails, those already
+// switched go back to the old settings. The listen addresses only
+// change on a restart.
+func reload() {
+	old := config.Get()
+	cfg, err := ediconfig.Load(*configPath)
+	if err != nil {
+		slog.Error("Reload failed", "err", err)
+		return
+	}
+	tlsChanged := tlsServer != nil && cfg.Private.TLS != nil
+	if err = admission.Update(cfg.Private); err == nil && tlsChanged {
+		if err = tlsServer.Update(*cfg.Private.TLS); err != nil {
+			tlsChanged = false
+		}
+	}
+	if err == nil {
+		err = notifier.Update(cfg.Notify, notifyDefaults(cfg))
+	}
+	if err != nil {
+		admission.Update(old.Private)
+		if tlsChanged && old.Private.TLS != nil {
+			tlsServer.Update(*old.Private.TLS)
+		}
+		slog.Error("Reload failed, keeping the old configuration", "err", err)
+		return
+	}
+	config.Store(cfg)
+	// The level follows the file; the sink needs a restart.
+	edilog.SetLevel(cfg.Log.Level)
+	if cfg.Private.Host != old.Private.Host || cfg.Private.MRPort != old.Private.MRPort ||
+		cfg.Private.CmdPort != old.Private.CmdPort || (cfg.Private.TLS == nil) != (old.Private.TLS == nil) {
+		slog.Warn("Reload: listener changes take effect on restart")
+	}
+	slog.Info("Reloaded", "config", *configPath)
 }
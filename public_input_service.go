@@ -7,6 +7,10 @@ and instantly starts the XML_PO_import on the clients behalf.
 The basic structure of the program was writen by and copied from
 the original author of fsnotify
 
+SIGTERM or SIGINT lets the import in progress finish, or parks its
+file in ./retry after -shutdown-timeout, and exits 0, or 75 when a
+file was parked. SIGHUP reloads the configuration file.
+
 */
 package main
 
@@ -16,19 +20,30 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
-	"net/smtp"
+	"log/slog"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
+	"path/filepath"
 	"reflect"
 	"regexp"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/blackjack/syslog"
+	"github.com/cloud3000/BaseEDI/dashboard"
+	"github.com/cloud3000/BaseEDI/ediconfig"
+	"github.com/cloud3000/BaseEDI/edihttp"
+	"github.com/cloud3000/BaseEDI/edilog"
+	"github.com/cloud3000/BaseEDI/editls"
+	"github.com/cloud3000/BaseEDI/errdir"
+	"github.com/cloud3000/BaseEDI/hold"
+	"github.com/cloud3000/BaseEDI/hostpool"
+	"github.com/cloud3000/BaseEDI/ledger"
+	"github.com/cloud3000/BaseEDI/metrics"
+	"github.com/cloud3000/BaseEDI/notify"
+	"github.com/cloud3000/BaseEDI/poapi"
 	"github.com/fsnotify/fsnotify"
 )
 
@@ -37,12 +52,22 @@ var (
 	term      = flag.Bool("t", false, "Just run in the terminal (instead of an acme win)")
 	exclude   = flag.String("x", "", "Exclude files and directories matching this regular expression")
 	watchPath = flag.String("p", ".", "The path to watch")
+
+	configPath = flag.String("config", ediconfig.DefaultPath, "The configuration file, also passed to XML_PO_import")
+
+	jobTimeout = flag.Duration("job-timeout", 15*time.Minute, "Kill XML_PO_import if it runs longer than this")
+	retries    = flag.Int("retries", 3, "Times to retry a file after a host timeout")
+	retryDelay = flag.Duration("retry-delay", 5*time.Minute, "How long a file waits in ./retry before it is tried again")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "How long SIGTERM waits for XML_PO_import to finish")
 )
 
 var excludeRe *regexp.Regexp
 
 const (
 	rebuildDelay = 200 * time.Millisecond
+	// beatEvery is how often an idle watcher shows it is alive.
+	beatEvery = 10 * time.Second
 
 	// The name of the syscall.SysProcAttr.Setpgid field.
 	setpgidName = "Setpgid"
@@ -52,11 +77,45 @@ const (
 	smtppass    = "fghrty456"
 	smtpserv    = "cloud3000.com"
 	smtpport    = ":587"
+
+	// exitRetry is the XML_PO_import exit status for a host timeout.
+	exitRetry = 75
 )
 
 var (
 	hasSetPGID bool
 	killChan   = make(chan time.Time, 1)
+	// config is replaced as a whole when SIGHUP reloads the file.
+	config *ediconfig.Live
+	// book is the document ledger.
+	book *ledger.Ledger
+	// notifier sends the service's notifications.
+	notifier *notify.Dispatcher
+	// failedDocs is ./errors, where files that failed are kept.
+	failedDocs = errdir.New("./errors")
+	// holds parks the orders of paused partners.
+	holds *hold.Holds
+
+	// stopping is closed on SIGTERM. sendChanges finishes the file in
+	// hand, or parks it in ./retry if that takes too long, and closes
+	// stopped.
+	stopping    = make(chan struct{})
+	stopped     = make(chan struct{})
+	interrupted bool
+
+	// retryCount is the number of retries of each file, by file name.
+	// Only sendChanges touches it.
+	retryCount = make(map[string]int)
+
+	// watcher beats each time sendChanges comes round, for /healthz.
+	watcher edihttp.Heartbeat
+)
+
+var (
+	mReceived = metrics.NewCounter("edi_files_received_total", "Inbound files, by partner.", "partner")
+	mFiles    = metrics.NewCounter("edi_files_processed_total",
+		"Inbound files finished, by partner and result: processed, failed, rejected, retry, interrupted or held.", "partner", "result")
+	mImport = metrics.NewHistogram("edi_import_seconds", "How long XML_PO_import ran.", nil)
 )
 
 type ui interface {
@@ -71,23 +130,29 @@ func (w writerUI) redisplay(f func(io.Writer)) { f(w) }
 
 func (w writerUI) rerun() <-chan struct{} { return nil }
 
-func ediEmail(mailfrom string, mailto string, mailsub string, mailmsg string) int {
-	// Set up authentication information.
-	auth := smtp.PlainAuth("", smtpuser, smtppass, smtpserv)
-
-	// Connect to the server, authenticate, set the sender and recipient,
-	// and send the email all in one step.
-	to := []string{mailto}
-	msg := []byte("To: " + mailto + "\r\n" +
-		"From: " + mailfrom + "\r\n" +
-		"Subject: " + mailsub + "\r\n" +
-		"\r\n" +
-		mailmsg + "\r\n")
-	err := smtp.SendMail(smtpserv+smtpport, auth, smtpuser, to, msg)
-	if err != nil {
-		fmt.Printf("%v\n", err)
+// notifyFile sends a notification about an inbound file, with the
+// file attached. The file is read before notifyFile returns, so it may
+// be moved straight after. id is the file's correlation ID.
+func notifyFile(id string, typ string, subject string, name string, fields []notify.Field) {
+	notifier.Notify(notify.Event{
+		Type:        typ,
+		ID:          id,
+		Subject:     subject,
+		Partner:     notify.PartnerOf(name),
+		Fields:      fields,
+		Attachments: []notify.Attachment{{Path: name}},
+	})
+}
+
+// notifyDefaults are the notification settings built into the service.
+func notifyDefaults(cfg *ediconfig.Config) notify.Defaults {
+	serv, port, user, pass := cfg.Mail.Settings(smtpserv, smtpport, smtpuser, smtppass)
+	return notify.Defaults{
+		Source: "public_input_service",
+		From:   custemail,
+		To:     mgremail,
+		Mail:   ediconfig.Mail{Server: serv, Port: port, User: user, Password: pass},
 	}
-	return 0
 }
 
 func main() {
@@ -96,34 +161,141 @@ func main() {
 		flag.PrintDefaults()
 	}
 	flag.Parse()
-	syslog.Openlog("public_input_service", syslog.LOG_PID, syslog.LOG_USER)
-	syslog.Syslog(syslog.LOG_INFO, "public_input_service started")
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var err error
+	if config, err = ediconfig.NewLive(*configPath); err != nil {
+		edilog.Fatal("Failed to load configuration", "err", err)
+	}
+	closeLog, err := edilog.Setup("public_input_service", config.Get().Log)
+	if err != nil {
+		edilog.Fatal("Failed to open log", "err", err)
+	}
+	if *debug {
+		edilog.SetLevel("debug")
+	}
+	slog.Info("public_input_service started")
 
 	t := reflect.TypeOf(syscall.SysProcAttr{})
 	f, ok := t.FieldByName(setpgidName)
 	if ok && f.Type.Kind() == reflect.Bool {
-		debugPrint("syscall.SysProcAttr.Setpgid exists and is a bool")
+		slog.Debug("syscall.SysProcAttr.Setpgid exists and is a bool")
 		hasSetPGID = true
 	} else if ok {
-		debugPrint("syscall.SysProcAttr.Setpgid exists but is a %s, not a bool", f.Type.Kind())
+		slog.Debug("syscall.SysProcAttr.Setpgid is not a bool", "kind", f.Type.Kind())
 	} else {
-		debugPrint("syscall.SysProcAttr.Setpgid does not exist")
+		slog.Debug("syscall.SysProcAttr.Setpgid does not exist")
 	}
 
-	if flag.NArg() == 0 {
-		flag.Usage()
-		os.Exit(1)
+	if book, err = ledger.Open(config.Get().Ledger, "public_input_service"); err != nil {
+		edilog.Fatal("Failed to open ledger", "err", err)
+	}
+	if notifier, err = notify.New(config.Get().Notify, notifyDefaults(config.Get())); err != nil {
+		edilog.Fatal("Failed to start notifications", "err", err)
+	}
+	if holds, err = hold.Open(hold.Dir("public_input_service")); err != nil {
+		edilog.Fatal("Failed to read paused partners", "err", err)
+	}
+	web, err := edihttp.Listen("public_input_service", config.Get().HTTP)
+	if err != nil {
+		edilog.Fatal("Failed to start HTTP", "err", err)
+	}
+	healthChecks(web)
+	// The dashboard and edictl's interfaces are for operators only,
+	// apart from what the load balancer reaches.
+	admin, err := edihttp.ListenAdmin("public_input_service", func() ediconfig.Admin { return config.Get().Admin })
+	if err != nil {
+		edilog.Fatal("Failed to start the admin interface", "err", err)
 	}
+	admin.Handle("/admin/partners", holds.Handler(*watchPath))
+	admin.Handle("/admin/partners/", holds.Handler(*watchPath))
+	admin.Handle("/admin/config", edihttp.ConfigHandler(config.Get))
+	admin.Handle("/admin/test", edihttp.TestHandler(connectivityTests))
+	admin.Handle("/", dashboard.New(dashboard.Options{
+		Ledger:    func() string { return config.Get().Ledger },
+		Book:      book,
+		Errors:    failedDocs,
+		Inbox:     *watchPath,
+		Discarded: "./discarded",
+		Sessions: func() string {
+			return edihttp.AdminURL(config.Get().Admin, "private_input_service", "/sessions")
+		},
+		Admin: func() ediconfig.Admin { return config.Get().Admin },
+	}))
+	api, err := startAPI()
+	if err != nil {
+		edilog.Fatal("Failed to start the API", "err", err)
+	}
+	// Send the digests and summaries the notify policies hold back.
+	go notifier.Run()
+	// Keep the host health current for XML_PO_import.
+	probeStop := make(chan struct{})
+	go hostpool.New(config.Get().Hosts).Run(probeStop)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 
 	myui := ui(writerUI{os.Stdout})
 
 	timer := time.NewTimer(0)
 	changes := startWatching(*watchPath)
+	resumeRetries()
 	lastRun := time.Time{}
 	lastChange := time.Now()
 
 	for {
 		select {
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				cfg, err := config.Reload()
+				if err != nil {
+					slog.Error("Reload failed, keeping the old configuration", "err", err)
+					continue
+				}
+				close(probeStop)
+				probeStop = make(chan struct{})
+				go hostpool.New(cfg.Hosts).Run(probeStop)
+				if err := notifier.Update(cfg.Notify, notifyDefaults(cfg)); err != nil {
+					slog.Error("Reload failed, keeping the old notifications", "err", err)
+				}
+				// The level follows the file; the sink needs a restart.
+				edilog.SetLevel(cfg.Log.Level)
+				if *debug {
+					edilog.SetLevel("debug")
+				}
+				slog.Info("Reloaded", "config", *configPath)
+				continue
+			}
+			slog.Info("Shutting down", "signal", sig)
+			close(stopping)
+			<-stopped
+			close(probeStop)
+			status := 0
+			if interrupted {
+				// The file is in ./retry and goes again on the next start.
+				status = exitRetry
+			}
+			if n := api.Close(*shutdownTimeout); n > 0 {
+				// API jobs not finished are run again on the next start.
+				slog.Warn("API jobs left to finish", "jobs", n)
+				status = exitRetry
+			}
+			admin.Close(*shutdownTimeout)
+			web.Close(*shutdownTimeout)
+			if err := notifier.Close(*shutdownTimeout); err != nil {
+				slog.Error("Failed to flush notifications", "err", err)
+			}
+			if err := book.Close(); err != nil {
+				slog.Error("Failed to flush ledger", "err", err)
+				status = 1
+			}
+			slog.Info("public_input_service ended", "status", status)
+			closeLog()
+			os.Exit(status)
+
 		case lastChange = <-changes:
 			timer.Reset(rebuildDelay)
 
@@ -148,16 +320,14 @@ func run(myui ui) time.Time {
 			reflect.ValueOf(&attr).Elem().FieldByName(setpgidName).SetBool(true)
 			cmd.SysProcAttr = &attr
 		}
-		io.WriteString(out, "Args: "+strings.Join(flag.Args(), " ")+"\n")
+		slog.Debug("Running", "args", strings.Join(flag.Args(), " "))
 		start := time.Now()
 		if err := cmd.Start(); err != nil {
-			io.WriteString(out, "fatal: "+err.Error()+"\n")
-			os.Exit(1)
+			edilog.Fatal("Failed to run", "args", strings.Join(flag.Args(), " "), "err", err)
 		}
 		if s := wait(start, cmd); s != 0 {
-			io.WriteString(out, "exit status "+strconv.Itoa(s)+"\n")
+			slog.Warn("Command failed", "args", strings.Join(flag.Args(), " "), "status", s)
 		}
-		io.WriteString(out, time.Now().String()+"\n")
 	})
 
 	return time.Now()
@@ -178,10 +348,10 @@ func wait(start time.Time, cmd *exec.Cmd) int {
 				p = -p
 			}
 			if n == 0 {
-				debugPrint("Sending SIGTERM")
+				slog.Debug("Sending SIGTERM", "pid", p)
 				syscall.Kill(p, syscall.SIGTERM)
 			} else {
-				debugPrint("Sending SIGKILL")
+				slog.Debug("Sending SIGKILL", "pid", p)
 				syscall.Kill(p, syscall.SIGKILL)
 			}
 			n++
@@ -203,7 +373,7 @@ func wait(start time.Time, cmd *exec.Cmd) int {
 func kill() {
 	select {
 	case killChan <- time.Now():
-		debugPrint("Killing")
+		slog.Debug("Killing")
 	}
 }
 
@@ -215,7 +385,7 @@ func startWatching(p string) <-chan time.Time {
 
 	switch isdir, err := isDir(p); {
 	case err != nil:
-		log.Fatalf("Failed to watch %s: %s", p, err)
+		edilog.Fatal("Failed to watch", "path", p, "err", err)
 	case isdir:
 		watchDir(w, p)
 	default:
@@ -229,44 +399,73 @@ func startWatching(p string) <-chan time.Time {
 	return changes
 }
 
+// healthChecks adds the service's checks to /healthz and /readyz.
+func healthChecks(web *edihttp.Server) {
+	// A file in hand holds the watcher up to -job-timeout.
+	alive := watcher.Check(*jobTimeout + time.Minute)
+	web.Live("watcher", func() error {
+		if _, err := os.Stat(*watchPath); err != nil {
+			return err
+		}
+		return alive()
+	})
+	web.Ready("host", func() error {
+		return hostpool.New(config.Get().Hosts).Reachable()
+	})
+	web.Ready("smtp", notifier.Check)
+	web.Ready("disk", func() error {
+		return edihttp.DiskFree(config.Get().HTTP.MinFreeMB, ".", *watchPath, config.Get().Dirs.POResponses)
+	})
+	web.Ready("dirs", func() error {
+		return edihttp.Writable(*watchPath, "./processed", "./errors", config.Get().Dirs.POResponses)
+	})
+}
+
+// connectivityTests are what edictl test tries from here: each host
+// endpoint and the mail servers.
+func connectivityTests() []edihttp.Check {
+	var tests []edihttp.Check
+	for _, ep := range config.Get().Hosts.Endpoints {
+		tests = append(tests, edihttp.Check{Name: "host " + ep.Name + " " + ep.Addr, Fn: func() error {
+			return hostpool.Probe(ep.Addr, edihttp.CheckTimeout)
+		}})
+	}
+	return append(tests, edihttp.Check{Name: "smtp", Fn: notifier.Check})
+}
+
 func sendChanges(w *fsnotify.Watcher, changes chan<- time.Time) {
+	defer close(stopped)
+	defer w.Close()
+	defer watcher.Stop()
+	beat := time.NewTicker(beatEvery)
+	defer beat.Stop()
 	for {
+		watcher.Beat()
 		select {
+		case <-stopping:
+			return
+
+		case <-beat.C:
+
 		case err := <-w.Errors:
-			log.Fatalf("Watcher error: %s\n", err)
+			edilog.Fatal("Watcher error", "err", err)
 
 		case ev := <-w.Events:
 			if excludeRe != nil && excludeRe.MatchString(ev.Name) {
-				debugPrint("ignoring event for excluded %s", ev.Name)
+				slog.Debug("Ignoring event for excluded file", "path", ev.Name)
 				continue
 			}
 			etime, err := modTime(ev.Name)
 			if err != nil {
-				log.Printf("Failed to get event time: %s", err)
+				slog.Warn("Failed to get event time", "err", err)
 				continue
 			}
-			debugPrint("%s at %s", ev, etime)
-			debugPrint(" Operation: %s ", ev.Op)
-			if ev.Op&fsnotify.Write != 0 {
-				io.WriteString(os.Stdout, "WRITE"+"\n")
-			}
-			if ev.Op&fsnotify.Chmod != 0 {
-				io.WriteString(os.Stdout, "CHMOD"+"\n")
-			}
-			if ev.Op&fsnotify.Remove != 0 {
-				io.WriteString(os.Stdout, "REMOVE"+"\n")
-			}
-			if ev.Op&fsnotify.Rename != 0 {
-				io.WriteString(os.Stdout, "RENAME"+"\n")
-			}
-			if ev.Op&fsnotify.Create != 0 {
-			}
+			slog.Debug("Event", "path", ev.Name, "op", ev.Op, "time", etime)
 
 			if ev.Op&fsnotify.Create != 0 {
-				io.WriteString(os.Stdout, "CREATE"+"\n")
 				switch isdir, err := isDir(ev.Name); {
 				case err != nil:
-					log.Printf("Couldn't check if %s is a directory: %s", ev.Name, err)
+					slog.Warn("Couldn't check for a directory", "path", ev.Name, "err", err)
 					continue
 
 				case isdir:
@@ -278,86 +477,288 @@ func sendChanges(w *fsnotify.Watcher, changes chan<- time.Time) {
 				myext := path.Ext(ev.Name)
 
 				myfile := strings.Replace(path.Base(ev.Name), "/", "_", 1)
-				fmt.Printf("\ndir=%v \nfile=%v \nextension=%v\n", mydir, myfile, myext)
-				syslog.Syslogf(syslog.LOG_INFO, "\ndir=%v \nfile=%v \nextension=%v\n", mydir, myfile, myext)
-				if myext == ".xml" {
-					efrom := custemail
-					eto := mgremail
-					esub := "[EDI] File Received: " + myfile
-					emsg := fmt.Sprintf(
-						"      Filename: %s\n"+
-							"Status Message: %s\n"+
-							"     Date Time: %s\n",
-						ev.Name,
-						"File being passed to XML_PO_import.",
-						time.Now().Format("2006-01-02, 15:04:05"))
-
-					ediEmail(efrom, eto, esub, emsg)
+				// Everything done for this file, here and in
+				// XML_PO_import, carries its correlation ID.
+				cid := edilog.NewID()
+				// A file an operator put back, held while its partner
+				// was paused, back from ./retry or left over from a
+				// shutdown goes on with its history.
+				if e, ok := ledger.Last(config.Get().Ledger, myfile); ok && e.ID != "" &&
+					(e.State == ledger.Reprocess || e.State == ledger.Held ||
+						e.State == ledger.Retry || e.State == ledger.Interrupted) {
+					cid = e.ID
+				}
+				lg := slog.With("id", cid, "file", myfile)
+				lg.Info("File received", "dir", mydir, "extension", myext)
+				partner := notify.PartnerOf(myfile)
+				mReceived.Inc(partner)
+				if importable[myext] {
+					book.RecordKeys(cid, ledger.PO, myfile, ledger.Received, "", ledger.Keys{Partner: partner})
+					if holds.Paused(partner) {
+						held, err := holds.Park(ev.Name, partner)
+						if err != nil {
+							lg.Error("Failed to hold file for paused partner", "partner", partner, "err", err)
+						} else {
+							lg.Info("Partner paused, file held", "partner", partner, "to", held)
+							book.Record(cid, ledger.PO, myfile, ledger.Held, held)
+							mFiles.Inc(partner, "held")
+							continue
+						}
+					}
+					notifyFile(cid, notify.POReceived, "[EDI] File Received: "+myfile, ev.Name, notify.F(
+						"Filename", ev.Name,
+						"Status Message", "File being passed to XML_PO_import."))
 					time.Sleep(2 * time.Second)
 
-					c1 := exec.Command("./bin/XML_PO_import", ev.Name)
+					c1 := exec.Command("./bin/XML_PO_import", "-config="+*configPath, ev.Name)
+					// XML_PO_import leaves its counts in mfile.
+					mfile := filepath.Join(os.TempDir(), "edi-metrics-"+cid+".json")
+					c1.Env = append(edilog.Env(cid), metrics.EnvFile+"="+mfile)
+					c1.Stderr = os.Stderr
 
 					if err := c1.Start(); err != nil {
-						io.WriteString(os.Stdout, "fatal: "+err.Error()+"\n")
-						efrom := custemail
-						eto := mgremail
-						esub := "[EDI] FATAL ERROR"
-						emsg := fmt.Sprintf(
-							"   Filename: %s\n"+
-								"Fatal Error: %s\n"+
-								"  Date Time: %s\n",
-							ev.Name,
-							err.Error(),
-							time.Now().Format("2006-01-02, 15:04:05"))
-
-						ediEmail(efrom, eto, esub, emsg)
-						os.Remove("./errors/" + myfile)
-						os.Rename(ev.Name, "./errors/"+myfile)
+						lg.Error("Failed to start XML_PO_import", "err", err)
+						notifyFile(cid, notify.POError, "[EDI] FATAL ERROR", ev.Name, notify.F(
+							"Filename", ev.Name,
+							"Fatal Error", err.Error()))
+						moveToErrors(lg, ev.Name)
+						book.Record(cid, ledger.PO, myfile, ledger.Failed, err.Error())
+						mFiles.Inc(partner, "failed")
+						continue
+					}
+					book.Record(cid, ledger.PO, myfile, ledger.Importing, "")
+					started := time.Now()
+					// A hung host must not hold up the watcher forever.
+					timer := time.AfterFunc(*jobTimeout, func() {
+						lg.Warn("Job timeout, killing XML_PO_import", "timeout", *jobTimeout)
+						c1.Process.Kill()
+					})
+					stop, err := waitImport(c1)
+					timedout := !timer.Stop()
+					mImport.Observe(time.Since(started).Seconds())
+					if merr := metrics.Import(mfile); merr != nil {
+						lg.Warn("Failed to read XML_PO_import metrics", "err", merr)
+					}
+					if stop {
+						// Shutting down: park the file so it is not
+						// left half done in the inbox.
+						lg.Warn("Shutdown, XML_PO_import interrupted")
+						interrupted = true
+						os.MkdirAll("./retry", 0755)
+						os.Remove("./retry/" + myfile)
+						os.Rename(ev.Name, "./retry/"+myfile)
+						book.Record(cid, ledger.PO, myfile, ledger.Interrupted, "")
+						mFiles.Inc(partner, "interrupted")
+						return
+					}
+					if err != nil && (timedout || exitStatus(err) == exitRetry) &&
+						retryCount[myfile] < *retries {
+						retryCount[myfile]++
+						lg.Warn("XML_PO_import will be retried", "err", err, "retry", retryCount[myfile], "of", *retries)
+						notifyFile(cid, notify.PORetry, "[EDI] XML IMPORT RETRY: "+myfile, ev.Name, notify.F(
+							"Filename", ev.Name,
+							"Error", fmt.Sprintf("XML_PO_import timed out, %s", err.Error()),
+							"Retry", fmt.Sprintf("%d of %d in %v", retryCount[myfile], *retries, *retryDelay)))
+						scheduleRetry(ev.Name, myfile)
+						book.Record(cid, ledger.PO, myfile, ledger.Retry, err.Error())
+						mFiles.Inc(partner, "retry")
 						continue
 					}
-					if err := c1.Wait(); err != nil {
-						io.WriteString(os.Stdout, "fatal: "+err.Error()+"\n")
-						efrom := custemail
-						eto := mgremail
-						esub := "[EDI] XML IMPORT ERROR"
-						emsg := fmt.Sprintf(
-							"   Filename: %s\n"+
-								"      Error: %s\n"+
-								"  Date Time: %s\n",
-							ev.Name,
-							fmt.Sprintf("XML_PO_import returned a bad exit status, %s", err.Error()),
-							time.Now().Format("2006-01-02, 15:04:05"))
-
-						ediEmail(efrom, eto, esub, emsg)
-						os.Remove("./errors/" + myfile)
-						os.Rename(ev.Name, "./errors/"+myfile)
+					delete(retryCount, myfile)
+					if err != nil {
+						lg.Error("XML_PO_import failed", "err", err, "timedout", timedout)
+						errmsg := fmt.Sprintf("XML_PO_import returned a bad exit status, %s", err.Error())
+						if timedout {
+							errmsg = fmt.Sprintf("XML_PO_import killed after %v, %s", *jobTimeout, err.Error())
+						}
+						notifyFile(cid, notify.POError, "[EDI] XML IMPORT ERROR", ev.Name, notify.F(
+							"Filename", ev.Name,
+							"Error", errmsg))
+						moveToErrors(lg, ev.Name)
+						book.Record(cid, ledger.PO, myfile, ledger.Failed, errmsg)
+						mFiles.Inc(partner, "failed")
 						continue
 					}
 
 					os.Remove("./processed/" + myfile)
 					os.Rename(ev.Name, "./processed/"+myfile)
+					book.Record(cid, ledger.PO, myfile, ledger.Processed, "")
+					mFiles.Inc(partner, "processed")
+					lg.Info("File processed")
 				} else {
-					efrom := custemail
-					eto := mgremail
-					esub := "[EDI] File NOT PROCESSED: " + myfile
-					emsg := fmt.Sprintf(
-						"       Filename: %s \n "+
-							" Status Message: Missing file extension.\n"+
-							"      Date Time: %s\n",
-						ev.Name,
-						time.Now().Format("2006-01-02, 15:04:05"))
-
-					ediEmail(efrom, eto, esub, emsg)
-
-					os.Remove("./errors/" + myfile)
-					os.Rename(ev.Name, "./errors/"+myfile)
+					lg.Warn("File rejected, not .xml, .x12 or .edi")
+					notifyFile(cid, notify.PORejected, "[EDI] File NOT PROCESSED: "+myfile, ev.Name, notify.F(
+						"Filename", ev.Name,
+						"Status Message", "Missing file extension."))
+
+					moveToErrors(lg, ev.Name)
+					book.Record(cid, ledger.PO, myfile, ledger.Failed, "Missing file extension.")
+					mFiles.Inc(partner, "rejected")
 				}
 			}
-			changes <- etime
+			select {
+			case changes <- etime:
+			case <-stopping:
+				return
+			}
+		}
+	}
+}
+
+// importable are the extensions of the files XML_PO_import reads:
+// fXML orders, X12 interchanges of 850s and EDIFACT ones of ORDERS.
+var importable = map[string]bool{".xml": true, ".x12": true, ".edi": true}
+
+// moveToErrors moves a file that failed to ./errors, keeping any
+// earlier attempt of the same name.
+func moveToErrors(lg *slog.Logger, file string) {
+	if _, err := failedDocs.Put(file); err != nil {
+		lg.Error("Failed to move file to errors", "err", err)
+	}
+}
+
+// waitImport waits for XML_PO_import. On shutdown it waits up to
+// shutdownTimeout more, then kills it and reports stop.
+func waitImport(c1 *exec.Cmd) (stop bool, err error) {
+	done := make(chan error, 1)
+	go func() { done <- c1.Wait() }()
+	select {
+	case err = <-done:
+		return false, err
+	case <-stopping:
+	}
+	select {
+	case err = <-done:
+		return false, err
+	case <-time.After(*shutdownTimeout):
+		c1.Process.Kill()
+		return true, <-done
+	}
+}
+
+// startAPI serves the order API, if the configuration turns it on.
+func startAPI() (*poapi.Server, error) {
+	cfg := config.Get().API
+	if cfg.Listen == "" {
+		return nil, nil
+	}
+	tlsServer, err := editls.New(*cfg.TLS, func(err error) {
+		slog.Error("API TLS reload failed", "err", err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return poapi.Listen(poapi.Options{
+		Config:     func() ediconfig.API { return config.Get().API },
+		TLS:        tlsServer,
+		Import:     importJob,
+		Retries:    *retries,
+		RetryDelay: *retryDelay,
+		Book:       book,
+	})
+}
+
+// importJob runs XML_PO_import for an order submitted through the API,
+// as sendChanges does for a dropped file. The order stays in the job
+// directory and the response is written there, for the partner to
+// fetch, rather than to the outbox.
+func importJob(j *poapi.Job) (bool, error) {
+	name := path.Base(j.File())
+	lg := slog.With("id", j.ID, "file", name)
+	mReceived.Inc(j.Partner)
+	c1 := exec.Command("./bin/XML_PO_import", "-config="+*configPath, "-out="+j.Dir(), j.File())
+	mfile := filepath.Join(os.TempDir(), "edi-metrics-"+j.ID+".json")
+	c1.Env = append(edilog.Env(j.ID), metrics.EnvFile+"="+mfile)
+	c1.Stderr = os.Stderr
+	if err := c1.Start(); err != nil {
+		lg.Error("Failed to start XML_PO_import", "err", err)
+		book.Record(j.ID, ledger.PO, name, ledger.Failed, err.Error())
+		mFiles.Inc(j.Partner, "failed")
+		return false, err
+	}
+	book.Record(j.ID, ledger.PO, name, ledger.Importing, "api")
+	started := time.Now()
+	timer := time.AfterFunc(*jobTimeout, func() {
+		lg.Warn("Job timeout, killing XML_PO_import", "timeout", *jobTimeout)
+		c1.Process.Kill()
+	})
+	stop, err := waitImport(c1)
+	timedout := !timer.Stop()
+	mImport.Observe(time.Since(started).Seconds())
+	if merr := metrics.Import(mfile); merr != nil {
+		lg.Warn("Failed to read XML_PO_import metrics", "err", merr)
+	}
+	switch {
+	case stop:
+		lg.Warn("Shutdown, XML_PO_import interrupted")
+		book.Record(j.ID, ledger.PO, name, ledger.Interrupted, "")
+		mFiles.Inc(j.Partner, "interrupted")
+		return true, poapi.ErrInterrupted
+	case err != nil && (timedout || exitStatus(err) == exitRetry):
+		lg.Warn("XML_PO_import will be retried", "err", err, "try", j.Tries, "of", *retries+1)
+		book.Record(j.ID, ledger.PO, name, ledger.Retry, err.Error())
+		mFiles.Inc(j.Partner, "retry")
+		return true, fmt.Errorf("host not reached, %v", err)
+	case err != nil:
+		errmsg := fmt.Sprintf("XML_PO_import returned a bad exit status, %s", err.Error())
+		if timedout {
+			errmsg = fmt.Sprintf("XML_PO_import killed after %v, %s", *jobTimeout, err.Error())
+		}
+		lg.Error("XML_PO_import failed", "err", err, "timedout", timedout)
+		notifyFile(j.ID, notify.POError, "[EDI] XML IMPORT ERROR", j.File(), notify.F(
+			"Filename", j.File(),
+			"Error", errmsg))
+		book.Record(j.ID, ledger.PO, name, ledger.Failed, errmsg)
+		mFiles.Inc(j.Partner, "failed")
+		return false, errors.New(errmsg)
+	}
+	book.Record(j.ID, ledger.PO, name, ledger.Processed, "api")
+	mFiles.Inc(j.Partner, "processed")
+	lg.Info("API order processed")
+	return false, nil
+}
+
+// resumeRetries moves files left in ./retry by the last run back into
+// the watched directory, where they are picked up as new arrivals.
+func resumeRetries() {
+	if isdir, _ := isDir(*watchPath); !isdir {
+		return
+	}
+	ents, _ := ioutil.ReadDir("./retry")
+	for _, e := range ents {
+		if e.IsDir() {
+			continue
+		}
+		if err := os.Rename("./retry/"+e.Name(), path.Join(*watchPath, e.Name())); err != nil {
+			slog.Error("Failed to resume", "file", e.Name(), "err", err)
 		}
 	}
 }
 
+// exitStatus returns the exit status of a child that ran and failed, or -1.
+func exitStatus(err error) int {
+	if ee, ok := err.(*exec.ExitError); ok {
+		return ee.ExitCode()
+	}
+	return -1
+}
+
+// scheduleRetry parks a file in ./retry and moves it back to where it
+// came from after retryDelay, where the watcher sees it as a new arrival.
+func scheduleRetry(name string, file string) {
+	os.MkdirAll("./retry", 0755)
+	os.Remove("./retry/" + file)
+	if err := os.Rename(name, "./retry/"+file); err != nil {
+		slog.Error("Failed to park for retry", "path", name, "err", err)
+		return
+	}
+	time.AfterFunc(*retryDelay, func() {
+		if err := os.Rename("./retry/"+file, name); err != nil {
+			slog.Error("Failed to retry", "path", name, "err", err)
+		}
+	})
+}
+
 func modTime(p string) (time.Time, error) {
 	switch s, err := os.Stat(p); {
 	case os.IsNotExist(err):
@@ -383,18 +784,18 @@ func watchDir(w *fsnotify.Watcher, p string) {
 		return
 
 	case err != nil:
-		log.Printf("Failed to watch %s: %s", p, err)
+		slog.Error("Failed to watch", "path", p, "err", err)
 	}
 
 	for _, e := range ents {
 		sub := path.Join(p, e.Name())
 		if excludeRe != nil && excludeRe.MatchString(sub) {
-			debugPrint("excluding %s", sub)
+			slog.Debug("Excluding", "path", sub)
 			continue
 		}
 		switch isdir, err := isDir(sub); {
 		case err != nil:
-			log.Printf("Failed to watch %s: %s", sub, err)
+			slog.Error("Failed to watch", "path", sub, "err", err)
 
 		case isdir:
 			watchDir(w, sub)
@@ -405,14 +806,14 @@ func watchDir(w *fsnotify.Watcher, p string) {
 }
 
 func watch(w *fsnotify.Watcher, p string) {
-	debugPrint("Watching %s", p)
+	slog.Debug("Watching", "path", p)
 
 	switch err := w.Add(p); {
 	case os.IsNotExist(err):
-		debugPrint("%s no longer exists", p)
+		slog.Debug("No longer exists", "path", p)
 
 	case err != nil:
-		log.Printf("Failed to watch %s: %s", p, err)
+		slog.Error("Failed to watch", "path", p, "err", err)
 	}
 }
 
@@ -426,9 +827,3 @@ func isDir(p string) (bool, error) {
 		return s.IsDir(), nil
 	}
 }
-
-func debugPrint(f string, vals ...interface{}) {
-	if *debug {
-		log.Printf("DEBUG: "+f, vals...)
-	}
-}
@@ -4,20 +4,36 @@ Watches 24/7 for outbound files, and when files arrive
 it instantly sends them to the clients sftp server
 using a child process expect script to run sftp
 
+For each X12 interchange sent a 997 or 999 is owed, and a CONTRL for
+each EDIFACT interchange that asks for one; those not come within
+x12.ackWithin are reported overdue (see package acks).
+
+The files of a paused partner are held in ./held/public_output_service
+until the partner is resumed. edictl resends a file already sent by
+putting it back from ./processed.
+
+SIGTERM or SIGINT lets the upload in progress finish, or parks its
+file in ./retry after -shutdown-timeout, and exits 0, or 75 when a
+file was parked. SIGHUP reloads the configuration file.
+
 */
 
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
-	"net/smtp"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"reflect"
 	"regexp"
@@ -26,7 +42,17 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/blackjack/syslog"
+	"github.com/cloud3000/BaseEDI/acks"
+	"github.com/cloud3000/BaseEDI/ediconfig"
+	"github.com/cloud3000/BaseEDI/edifact"
+	"github.com/cloud3000/BaseEDI/edihttp"
+	"github.com/cloud3000/BaseEDI/edilog"
+	"github.com/cloud3000/BaseEDI/hold"
+	"github.com/cloud3000/BaseEDI/hostpool"
+	"github.com/cloud3000/BaseEDI/ledger"
+	"github.com/cloud3000/BaseEDI/metrics"
+	"github.com/cloud3000/BaseEDI/notify"
+	"github.com/cloud3000/BaseEDI/x12"
 	"github.com/fsnotify/fsnotify"
 )
 
@@ -35,12 +61,19 @@ var (
 	term      = flag.Bool("t", false, "Just run in the terminal (instead of an acme win)")
 	exclude   = flag.String("x", "", "Exclude files and directories matching this regular expression")
 	watchPath = flag.String("p", ".", "The path to watch")
+
+	configPath = flag.String("config", ediconfig.DefaultPath, "The configuration file")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "How long SIGTERM waits for an upload to finish")
+	stallTimeout    = flag.Duration("stall-timeout", 30*time.Minute, "Fail /healthz when one upload holds up the watcher this long")
 )
 
 var excludeRe *regexp.Regexp
 
 const (
 	rebuildDelay  = 200 * time.Millisecond
+	beatEvery     = 10 * time.Second // how often an idle watcher shows it is alive
+	ackCheckEvery = time.Minute      // how often overdue acknowledgments are looked for
 	customeremail = "customer@cloud3000.com"
 	ediadminemail = "edimgr@cloud3000.com"
 
@@ -50,11 +83,38 @@ const (
 	smtppass    = "fghrty456"
 	smtpserv    = "cloud3000.com"
 	smtpport    = ":587"
+
+	// exitRetry means shutdown parked an upload in ./retry.
+	exitRetry = 75
 )
 
 var (
 	hasSetPGID bool
 	killChan   = make(chan time.Time, 1)
+	// config is replaced as a whole when SIGHUP reloads the file.
+	config *ediconfig.Live
+	// book is the document ledger.
+	book *ledger.Ledger
+	// notifier sends the service's notifications.
+	notifier *notify.Dispatcher
+	// holds parks the documents of paused partners.
+	holds *hold.Holds
+
+	// stopping is closed on SIGTERM. sendChanges finishes the upload in
+	// hand, or parks its file in ./retry if that takes too long, and
+	// closes stopped.
+	stopping    = make(chan struct{})
+	stopped     = make(chan struct{})
+	interrupted bool
+
+	// watcher beats each time sendChanges comes round, for /healthz.
+	watcher edihttp.Heartbeat
+)
+
+var (
+	mTransfers = metrics.NewCounter("edi_transfers_total",
+		"Outbound transfers, by partner and result: sent, failed, interrupted or held.", "partner", "result")
+	mTransferTime = metrics.NewHistogram("edi_transfer_seconds", "How long sftp uploads took.", nil)
 )
 
 type ui interface {
@@ -69,61 +129,150 @@ func (w writerUI) redisplay(f func(io.Writer)) { f(w) }
 
 func (w writerUI) rerun() <-chan struct{} { return nil }
 
-func _ediEMAIL(mailfrom string, mailto string, mailsub string, mailmsg string) int {
-	// Set up authentication information.
-	auth := smtp.PlainAuth("", smtpuser, smtppass, smtpserv)
-
-	// Connect to the server, authenticate, set the sender and recipient,
-	// and send the email all in one step.
-	to := []string{mailto}
-	msg := []byte("To: " + mailto + "\r\n" +
-		"From: " + mailfrom + "\r\n" +
-		"Subject: " + mailsub + "\r\n" +
-		"\r\n" +
-		mailmsg + "\r\n")
-	err := smtp.SendMail(smtpserv+smtpport, auth, smtpuser, to, msg)
-	if err != nil {
-		fmt.Printf("%v\n", err)
+// notifyFile sends a notification about an outbound document, with
+// the document attached. id is the document's correlation ID.
+func notifyFile(id string, typ string, subject string, name string, fields []notify.Field) {
+	notifier.Notify(notify.Event{
+		Type:        typ,
+		ID:          id,
+		Subject:     subject,
+		Partner:     notify.PartnerOf(name),
+		Fields:      fields,
+		Attachments: []notify.Attachment{{Path: name}},
+	})
+}
+
+// notifyDefaults are the notification settings built into the service.
+func notifyDefaults(cfg *ediconfig.Config) notify.Defaults {
+	serv, port, user, pass := cfg.Mail.Settings(smtpserv, smtpport, smtpuser, smtppass)
+	return notify.Defaults{
+		Source: "public_output_service",
+		From:   customeremail,
+		To:     ediadminemail,
+		Mail:   ediconfig.Mail{Server: serv, Port: port, User: user, Password: pass},
 	}
-	return 0
 }
 
 func main() {
-	syslog.Openlog("public_output_service", syslog.LOG_PID, syslog.LOG_USER)
-	syslog.Syslog(syslog.LOG_INFO, "public_output_service started")
-	defer syslog.Syslog(syslog.LOG_INFO, "public_output_service ended")
-
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s: [flags] command [command args…]\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var err error
+	if config, err = ediconfig.NewLive(*configPath); err != nil {
+		edilog.Fatal("Failed to load configuration", "err", err)
+	}
+	closeLog, err := edilog.Setup("public_output_service", config.Get().Log)
+	if err != nil {
+		edilog.Fatal("Failed to open log", "err", err)
+	}
+	if *debug {
+		edilog.SetLevel("debug")
+	}
+	slog.Info("public_output_service started")
 
 	t := reflect.TypeOf(syscall.SysProcAttr{})
 	f, ok := t.FieldByName(setpgidName)
 	if ok && f.Type.Kind() == reflect.Bool {
-		debugPrint("syscall.SysProcAttr.Setpgid exists and is a bool")
+		slog.Debug("syscall.SysProcAttr.Setpgid exists and is a bool")
 		hasSetPGID = true
 	} else if ok {
-		debugPrint("syscall.SysProcAttr.Setpgid exists but is a %s, not a bool", f.Type.Kind())
+		slog.Debug("syscall.SysProcAttr.Setpgid is not a bool", "kind", f.Type.Kind())
 	} else {
-		debugPrint("syscall.SysProcAttr.Setpgid does not exist")
+		slog.Debug("syscall.SysProcAttr.Setpgid does not exist")
 	}
 
-	if flag.NArg() == 0 {
-		flag.Usage()
-		os.Exit(1)
+	if book, err = ledger.Open(config.Get().Ledger, "public_output_service"); err != nil {
+		edilog.Fatal("Failed to open ledger", "err", err)
+	}
+	if notifier, err = notify.New(config.Get().Notify, notifyDefaults(config.Get())); err != nil {
+		edilog.Fatal("Failed to start notifications", "err", err)
+	}
+	if holds, err = hold.Open(hold.Dir("public_output_service")); err != nil {
+		edilog.Fatal("Failed to read paused partners", "err", err)
+	}
+	web, err := edihttp.Listen("public_output_service", config.Get().HTTP)
+	if err != nil {
+		edilog.Fatal("Failed to start HTTP", "err", err)
+	}
+	healthChecks(web)
+	// edictl's interfaces are for operators only, apart from what the
+	// load balancer reaches.
+	admin, err := edihttp.ListenAdmin("public_output_service", func() ediconfig.Admin { return config.Get().Admin })
+	if err != nil {
+		edilog.Fatal("Failed to start the admin interface", "err", err)
 	}
+	admin.Handle("/admin/partners", holds.Handler(*watchPath))
+	admin.Handle("/admin/partners/", holds.Handler(*watchPath))
+	admin.Handle("/admin/config", edihttp.ConfigHandler(config.Get))
+	admin.Handle("/admin/test", edihttp.TestHandler(func() []edihttp.Check {
+		return []edihttp.Check{{Name: "sftp login", Fn: sftpLogin}, {Name: "smtp", Fn: notifier.Check}}
+	}))
+	admin.Handle("/admin/resend/", http.HandlerFunc(resend))
+	admin.Handle("/admin/acks", http.HandlerFunc(listAcks))
+	// Send the digests and summaries the notify policies hold back.
+	go notifier.Run()
+	go watchAcks()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 
 	myui := ui(writerUI{os.Stdout})
 
 	timer := time.NewTimer(0)
 	changes := startWatching(*watchPath)
+	resumeRetries()
 	lastRun := time.Time{}
 	lastChange := time.Now()
 
 	for {
 		select {
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				// The next upload uses the new outbound settings.
+				cfg, err := config.Reload()
+				if err != nil {
+					slog.Error("Reload failed, keeping the old configuration", "err", err)
+					continue
+				}
+				if err := notifier.Update(cfg.Notify, notifyDefaults(cfg)); err != nil {
+					slog.Error("Reload failed, keeping the old notifications", "err", err)
+				}
+				// The level follows the file; the sink needs a restart.
+				edilog.SetLevel(cfg.Log.Level)
+				if *debug {
+					edilog.SetLevel("debug")
+				}
+				slog.Info("Reloaded", "config", *configPath)
+				continue
+			}
+			slog.Info("Shutting down", "signal", sig)
+			close(stopping)
+			<-stopped
+			status := 0
+			if interrupted {
+				// The file is in ./retry and goes again on the next start.
+				status = exitRetry
+			}
+			admin.Close(*shutdownTimeout)
+			web.Close(*shutdownTimeout)
+			if err := notifier.Close(*shutdownTimeout); err != nil {
+				slog.Error("Failed to flush notifications", "err", err)
+			}
+			if err := book.Close(); err != nil {
+				slog.Error("Failed to flush ledger", "err", err)
+				status = 1
+			}
+			slog.Info("public_output_service ended", "status", status)
+			closeLog()
+			os.Exit(status)
+
 		case lastChange = <-changes:
 			timer.Reset(rebuildDelay)
 
@@ -148,16 +297,14 @@ func run(myui ui) time.Time {
 			reflect.ValueOf(&attr).Elem().FieldByName(setpgidName).SetBool(true)
 			cmd.SysProcAttr = &attr
 		}
-		io.WriteString(out, "Args: "+strings.Join(flag.Args(), " ")+"\n")
+		slog.Debug("Running", "args", strings.Join(flag.Args(), " "))
 		start := time.Now()
 		if err := cmd.Start(); err != nil {
-			io.WriteString(out, "fatal: "+err.Error()+"\n")
-			os.Exit(1)
+			edilog.Fatal("Failed to run", "args", strings.Join(flag.Args(), " "), "err", err)
 		}
 		if s := wait(start, cmd); s != 0 {
-			io.WriteString(out, "exit status "+strconv.Itoa(s)+"\n")
+			slog.Warn("Command failed", "args", strings.Join(flag.Args(), " "), "status", s)
 		}
-		io.WriteString(out, time.Now().String()+"\n")
 	})
 
 	return time.Now()
@@ -178,10 +325,10 @@ func wait(start time.Time, cmd *exec.Cmd) int {
 				p = -p
 			}
 			if n == 0 {
-				debugPrint("Sending SIGTERM")
+				slog.Debug("Sending SIGTERM", "pid", p)
 				syscall.Kill(p, syscall.SIGTERM)
 			} else {
-				debugPrint("Sending SIGKILL")
+				slog.Debug("Sending SIGKILL", "pid", p)
 				syscall.Kill(p, syscall.SIGKILL)
 			}
 			n++
@@ -203,7 +350,7 @@ func wait(start time.Time, cmd *exec.Cmd) int {
 func kill() {
 	select {
 	case killChan <- time.Now():
-		debugPrint("Killing")
+		slog.Debug("Killing")
 	}
 }
 
@@ -215,7 +362,7 @@ func startWatching(p string) <-chan time.Time {
 
 	switch isdir, err := isDir(p); {
 	case err != nil:
-		log.Fatalf("Failed to watch %s: %s", p, err)
+		edilog.Fatal("Failed to watch", "path", p, "err", err)
 	case isdir:
 		watchDir(w, p)
 	default:
@@ -231,7 +378,7 @@ func startWatching(p string) <-chan time.Time {
 
 func fcheck(e error) {
 	if e != nil {
-		io.WriteString(os.Stdout, "fatal: "+e.Error()+"\n")
+		slog.Error("Failed to write sftp script", "err", e)
 		panic(e)
 	}
 }
@@ -239,9 +386,7 @@ func fcheck(e error) {
 func sftpScript(fname string) string {
 	myext := path.Ext(fname)
 	myfile := strings.Replace(path.Base(fname), myext, ".exp", 4)
-	fmt.Printf("Script File: %s\n", myfile)
-	syslog.Syslogf(syslog.LOG_INFO, "Output File: %s\n", fname)
-	syslog.Syslogf(syslog.LOG_INFO, "Script File: %s\n", myfile)
+	slog.Debug("Writing sftp script", "file", fname, "script", myfile)
 	os.Remove(myfile)
 
 	f, oerr := os.Create(myfile)
@@ -274,22 +419,26 @@ func sftpScript(fname string) string {
 	fcheck(ferr)
 	_, ferr = f.WriteString("expect  \"$ \"\n")
 	fcheck(ferr)
-	_, ferr = f.WriteString("send -- \"sftp username@customerdomain.com\\r\"\n")
+	out := config.Get().Outbound
+	sftpcmd := fmt.Sprintf("sftp -P %d", out.Port)
+	for _, o := range out.Options {
+		sftpcmd += " -o " + o
+	}
+	sftpcmd += " " + out.User + "@" + out.Host
+	_, ferr = f.WriteString("send -- \"" + sftpcmd + "\\r\"\n")
 	fcheck(ferr)
 	_, ferr = f.WriteString("expect \"password: \"\n")
 	fcheck(ferr)
-	_, ferr = f.WriteString("send -- \"password\\r\"\n")
+	_, ferr = f.WriteString("send -- \"" + out.Password + "\\r\"\n")
 	fcheck(ferr)
 	_, ferr = f.WriteString("expect \"sftp> \"\n")
 	fcheck(ferr)
-	_, ferr = f.WriteString("send -- \"cd dir1\r\"\n")
-	fcheck(ferr)
-	_, ferr = f.WriteString("expect  \"sftp> \"\n")
-	fcheck(ferr)
-	_, ferr = f.WriteString("send -- \"cd dir2\r\"\n")
-	fcheck(ferr)
-	_, ferr = f.WriteString("expect  \"sftp> \"\n")
-	fcheck(ferr)
+	for _, d := range out.Dirs {
+		_, ferr = f.WriteString("send -- \"cd " + d + "\\r\"\n")
+		fcheck(ferr)
+		_, ferr = f.WriteString("expect  \"sftp> \"\n")
+		fcheck(ferr)
+	}
 	_, ferr = f.WriteString("send -- \"put " + fname + "\\r\"\n")
 	fcheck(ferr)
 	_, ferr = f.WriteString("expect  \"sftp> \"\n")
@@ -309,44 +458,272 @@ func sftpScript(fname string) string {
 	return myfile
 }
 
+// sftpLogin logs in to the outbound sftp server and out again, as an
+// upload does, for edictl test.
+func sftpLogin() error {
+	out := config.Get().Outbound
+	sftpcmd := fmt.Sprintf("sftp -P %d", out.Port)
+	for _, o := range out.Options {
+		sftpcmd += " -o " + o
+	}
+	sftpcmd += " " + out.User + "@" + out.Host
+	// The password goes in a file only we can read, not on a command line.
+	f, err := os.CreateTemp("", "edi-sftp-test-*.exp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, `set timeout %d
+spawn %s
+expect {
+	timeout { exit 2 }
+	eof { exit 3 }
+	"password: "
+}
+send -- "%s\r"
+expect {
+	timeout { exit 2 }
+	"password: " { exit 4 }
+	"sftp> "
+}
+send -- "quit\r"
+expect eof
+`, int(edihttp.TestTimeout/time.Second)-5, sftpcmd, out.Password)
+	if err := f.Close(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), edihttp.TestTimeout)
+	defer cancel()
+	b, err := exec.CommandContext(ctx, "expect", f.Name()).CombinedOutput()
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		return err // nil when the login went through
+	}
+	switch ee.ExitCode() {
+	case 2:
+		return fmt.Errorf("%s: no answer", sftpcmd)
+	case 3:
+		// sftp gave up before asking, its last words say why.
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		return fmt.Errorf("%s: %s", sftpcmd, strings.TrimSpace(lines[len(lines)-1]))
+	case 4:
+		return fmt.Errorf("%s: password refused", sftpcmd)
+	}
+	return fmt.Errorf("%s: %v", sftpcmd, err)
+}
+
+// resend puts a file that was sent back in the outbox to go again:
+// POST /admin/resend/<name>.
+func resend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !edihttp.SameOrigin(r) {
+		http.Error(w, "cross-origin request refused", http.StatusForbidden)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/admin/resend/")
+	// ./processed has the orders public_input_service took in as well.
+	if name != path.Base(name) || !sendable[path.Ext(name)] ||
+		!(strings.HasPrefix(name, "RESPONSE_") || strings.Contains(name, "_MR_")) {
+		http.Error(w, "not an outbound file: "+name, http.StatusBadRequest)
+		return
+	}
+	src := "./processed/" + name
+	b, err := os.ReadFile(src)
+	if os.IsNotExist(err) {
+		http.Error(w, name+" has not been sent", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dst := path.Join(*watchPath, name)
+	if _, err := os.Stat(dst); err == nil {
+		http.Error(w, name+" is already waiting to be sent", http.StatusConflict)
+		return
+	}
+	// Written beside it and renamed in, so the watcher sees it whole.
+	tmp := "./processed/.resend-" + name
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	by := edihttp.Operator(r) + " from " + r.RemoteAddr
+	id := ledger.IDOf(config.Get().Ledger, name)
+	book.Record(id, docKind(name), name, ledger.Resend, by)
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Resending", "id", id, "file", name, "by", by)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Name string `json:"name"`
+		ID   string `json:"id,omitempty"`
+	}{name, id})
+}
+
+// listAcks lists the acknowledgments partners owe us, and those that
+// came this past week: GET /admin/acks.
+func listAcks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	list, err := acks.Open(config.Get().X12.AckFile).All()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// expectAcks notes the 997 or 999 owed for each group of the X12
+// interchange in name, just sent, but a group of acknowledgments; or
+// the CONTRL owed for an EDIFACT interchange that asks for one.
+func expectAcks(lg *slog.Logger, name string) {
+	cfg := config.Get().X12
+	if cfg.AckWithin.Duration <= 0 {
+		return
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		lg.Warn("Failed to read interchange for its acknowledgments", "err", err)
+		return
+	}
+	now := time.Now()
+	owe := func(partner string, interchange string, group string, code string) acks.Owed {
+		return acks.Owed{
+			Partner:     partner,
+			Interchange: interchange,
+			Group:       group,
+			Code:        code,
+			Doc:         path.Base(name),
+			Kind:        docKind(name),
+			Sent:        now,
+			Due:         now.Add(cfg.AckWithin.Duration),
+		}
+	}
+	var owed []acks.Owed
+	if path.Ext(name) == ".edi" {
+		ic, err := edifact.Parse(b)
+		if err != nil {
+			lg.Warn("Interchange sent is not valid EDIFACT, no acknowledgment expected", "err", err)
+			return
+		}
+		if ic.AckRequested {
+			owed = append(owed, owe(ic.Receiver, ic.Control, ic.Control, "UNB"))
+		}
+	} else {
+		ic, err := x12.Parse(b)
+		if err != nil {
+			lg.Warn("Interchange sent is not valid X12, no acknowledgment expected", "err", err)
+			return
+		}
+		for _, g := range ic.Groups {
+			if g.Code != "FA" {
+				owed = append(owed, owe(ic.Receiver, ic.Control, g.Control, g.Code))
+			}
+		}
+	}
+	if len(owed) == 0 {
+		return
+	}
+	if err := acks.Open(cfg.AckFile).Expect(owed...); err != nil {
+		lg.Error("Failed to note acknowledgments owed", "err", err)
+	}
+}
+
+// watchAcks reports each acknowledgment a partner has not sent within
+// x12.ackWithin, once.
+func watchAcks() {
+	for range time.Tick(ackCheckEvery) {
+		cfg := config.Get()
+		if cfg.X12.AckWithin.Duration <= 0 {
+			continue
+		}
+		late, err := acks.Open(cfg.X12.AckFile).Overdue(time.Now())
+		if err != nil {
+			slog.Error("Failed to look for overdue acknowledgments", "err", err)
+			continue
+		}
+		for _, o := range late {
+			id := ledger.IDOf(cfg.Ledger, o.Doc)
+			slog.Warn("Acknowledgment overdue", "id", id, "file", o.Doc, "partner", o.Partner, "group", o.Group, "due", o.Due)
+			notifyFile(id, notify.AckOverdue, "[EDI] Acknowledgment Overdue: "+o.Doc, "./processed/"+o.Doc, notify.F(
+				"Filename", o.Doc,
+				"Partner", o.Partner,
+				"Interchange", o.Interchange,
+				"Group", o.Code+" "+o.Group,
+				"Sent", o.Sent.Format(time.DateTime),
+				"Due", o.Due.Format(time.DateTime)))
+			book.Record(id, o.Kind, o.Doc, ledger.AckOverdue, o.Code+" "+o.Group)
+		}
+	}
+}
+
+// healthChecks adds the service's checks to /healthz and /readyz.
+func healthChecks(web *edihttp.Server) {
+	alive := watcher.Check(*stallTimeout)
+	web.Live("watcher", func() error {
+		if _, err := os.Stat(*watchPath); err != nil {
+			return err
+		}
+		return alive()
+	})
+	web.Ready("sftp", func() error {
+		out := config.Get().Outbound
+		return hostpool.Probe(net.JoinHostPort(out.Host, strconv.Itoa(out.Port)), edihttp.CheckTimeout/2)
+	})
+	web.Ready("smtp", notifier.Check)
+	web.Ready("disk", func() error {
+		return edihttp.DiskFree(config.Get().HTTP.MinFreeMB, ".", *watchPath)
+	})
+	web.Ready("dirs", func() error {
+		return edihttp.Writable(".", *watchPath, "./processed")
+	})
+}
+
 func sendChanges(w *fsnotify.Watcher, changes chan<- time.Time) {
+	defer close(stopped)
+	defer w.Close()
+	defer watcher.Stop()
+	beat := time.NewTicker(beatEvery)
+	defer beat.Stop()
 	for {
+		watcher.Beat()
 		select {
+		case <-stopping:
+			return
+
+		case <-beat.C:
+
 		case err := <-w.Errors:
-			log.Fatalf("Watcher error: %s\n", err)
+			edilog.Fatal("Watcher error", "err", err)
 
 		case ev := <-w.Events:
 			if excludeRe != nil && excludeRe.MatchString(ev.Name) {
-				debugPrint("ignoring event for excluded %s", ev.Name)
+				slog.Debug("Ignoring event for excluded file", "path", ev.Name)
 				continue
 			}
 			etime, err := modTime(ev.Name)
 			if err != nil {
-				log.Printf("Failed to get event time: %s", err)
+				slog.Warn("Failed to get event time", "err", err)
 				continue
 			}
-			debugPrint("%s at %s", ev, etime)
-			debugPrint(" Operation: %s ", ev.Op)
-			if ev.Op&fsnotify.Write != 0 {
-				io.WriteString(os.Stdout, "WRITE"+"\n")
-			}
-			if ev.Op&fsnotify.Chmod != 0 {
-				io.WriteString(os.Stdout, "CHMOD"+"\n")
-			}
-			if ev.Op&fsnotify.Remove != 0 {
-				io.WriteString(os.Stdout, "REMOVE"+"\n")
-			}
-			if ev.Op&fsnotify.Rename != 0 {
-				io.WriteString(os.Stdout, "RENAME"+"\n")
-			}
-			if ev.Op&fsnotify.Create != 0 {
-			}
+			slog.Debug("Event", "path", ev.Name, "op", ev.Op, "time", etime)
 
 			if ev.Op&fsnotify.Create != 0 {
-				io.WriteString(os.Stdout, "CREATE"+"\n")
 				switch isdir, err := isDir(ev.Name); {
 				case err != nil:
-					log.Printf("Couldn't check if %s is a directory: %s", ev.Name, err)
+					slog.Warn("Couldn't check for a directory", "path", ev.Name, "err", err)
 					continue
 
 				case isdir:
@@ -356,65 +733,146 @@ func sendChanges(w *fsnotify.Watcher, changes chan<- time.Time) {
 				time.Sleep(1 * time.Second)
 				myext := path.Ext(ev.Name)
 				scriptfile := strings.Replace(path.Base(ev.Name), myext, ".exp", 4)
-				if myext == ".xml" {
+				if sendable[myext] {
+					// A response keeps the ID of its order; anything
+					// else dropped in the outbox gets its own.
+					doc := path.Base(ev.Name)
+					cid := ledger.IDOf(config.Get().Ledger, doc)
+					if cid == "" {
+						cid = edilog.NewID()
+					}
+					lg := slog.With("id", cid, "file", doc)
+					partner := notify.PartnerOf(doc)
+					if holds.Paused(partner) {
+						held, err := holds.Park(ev.Name, partner)
+						if err != nil {
+							lg.Error("Failed to hold file for paused partner", "partner", partner, "err", err)
+						} else {
+							lg.Info("Partner paused, file held", "partner", partner, "to", held)
+							book.Record(cid, docKind(ev.Name), doc, ledger.Held, held)
+							mTransfers.Inc(partner, "held")
+							continue
+						}
+					}
+					outbound := config.Get().Outbound
+					lg.Info("Sending", "sftp", outbound.User+"@"+outbound.Host)
 					c1 := exec.Command("expect", sftpScript(ev.Name))
+					c1.Env = edilog.Env(cid)
 
+					started := time.Now()
 					if err := c1.Start(); err != nil {
-						io.WriteString(os.Stdout, "fatal: "+err.Error()+"\n")
-						efrom := customeremail
-						eto := ediadminemail
-						esub := "[EDI] Response Transfer Error: "
-						emsg := fmt.Sprintf(
-							"Transfer Filename: %s\n\n"+
-								"     sftp: username@customerdomain.com\n"+
-								"Directory: /dir1/dir2\n"+
-								"     Program Name: expect %s\n"+
-								"      Start Error: %s\n"+
-								"        Date Time: %s\n",
-							ev.Name,
-							scriptfile,
-							err.Error(),
-							time.Now().Format("2006-01-02 15:04:05"))
-						_ediEMAIL(efrom, eto, esub, emsg)
+						lg.Error("Failed to start expect", "err", err)
+						notifyFile(cid, notify.SendError, "[EDI] Response Transfer Error: ", ev.Name, notify.F(
+							"Transfer Filename", path.Base(ev.Name),
+							"sftp", outbound.User+"@"+outbound.Host,
+							"Directory", "/"+strings.Join(outbound.Dirs, "/"),
+							"Program Name", "expect "+scriptfile,
+							"Start Error", err.Error()))
+						book.Record(cid, docKind(ev.Name), doc, ledger.SendFailed, err.Error())
+						mTransfers.Inc(partner, "failed")
+						notifier.Close(time.Minute)
+						book.Close()
 						os.Exit(1)
 					}
-					if err := c1.Wait(); err != nil {
-						io.WriteString(os.Stdout, "fatal: "+err.Error()+"\n")
-						efrom := customeremail
-						eto := ediadminemail
-						esub := "[EDI] Response Transfer Error: "
-						emsg := fmt.Sprintf(
-							"Transfer Filename: %s\n\n"+
-								"     sftp: username@customerdomain.com\n"+
-								"Directory: /dir1/dir2\n"+
-								"     Program Name: expect %s\n"+
-								"     Return Error: %s\n"+
-								"        Date Time: %s\n",
-							path.Base(ev.Name),
-							scriptfile,
-							err.Error(),
-							time.Now().Format("2006-01-02 15:04:05"))
-						_ediEMAIL(efrom, eto, esub, emsg)
+					stop, err := waitUpload(c1)
+					mTransferTime.Observe(time.Since(started).Seconds())
+					if stop {
+						// Shutting down: park the file so the next
+						// start sends it again.
+						lg.Warn("Shutdown, upload interrupted")
+						interrupted = true
+						os.MkdirAll("./retry", 0755)
+						os.Remove("./retry/" + path.Base(ev.Name))
+						os.Rename(ev.Name, "./retry/"+path.Base(ev.Name))
+						os.Remove(scriptfile)
+						book.Record(cid, docKind(ev.Name), doc, ledger.Interrupted, "")
+						mTransfers.Inc(partner, "interrupted")
+						return
+					}
+					if err != nil {
+						lg.Error("Upload failed", "err", err)
+						notifyFile(cid, notify.SendError, "[EDI] Response Transfer Error: ", ev.Name, notify.F(
+							"Transfer Filename", path.Base(ev.Name),
+							"sftp", outbound.User+"@"+outbound.Host,
+							"Directory", "/"+strings.Join(outbound.Dirs, "/"),
+							"Program Name", "expect "+scriptfile,
+							"Return Error", err.Error()))
+						book.Record(cid, docKind(ev.Name), doc, ledger.SendFailed, err.Error())
+						mTransfers.Inc(partner, "failed")
+						notifier.Close(time.Minute)
+						book.Close()
 						os.Exit(1)
 					}
-					efrom := customeremail
-					eto := ediadminemail
-					esub := "[EDI] Response Transfer: "
-					emsg := fmt.Sprintf(
-						" Filename: %s\n\n"+
-							"     sftp: username@customerdomain.com\n"+
-							"Directory: /dir1/dir2\n"+
-							"Date Time: %s\n"+
-							"   Status: Transfer Completed Successfully.",
-						path.Base(ev.Name),
-						time.Now().Format("2006-01-02 15:04:05"))
-					_ediEMAIL(efrom, eto, esub, emsg)
+					notifyFile(cid, notify.SendOK, "[EDI] Response Transfer: ", ev.Name, notify.F(
+						"Filename", path.Base(ev.Name),
+						"sftp", outbound.User+"@"+outbound.Host,
+						"Directory", "/"+strings.Join(outbound.Dirs, "/"),
+						"Status", "Transfer Completed Successfully."))
 					os.Remove("./processed/" + path.Base(ev.Name))
 					os.Rename(ev.Name, "./processed/"+path.Base(ev.Name))
 					os.Remove(scriptfile)
+					book.Record(cid, docKind(ev.Name), doc, ledger.Sent,
+						fmt.Sprintf("%s@%s", outbound.User, outbound.Host))
+					mTransfers.Inc(partner, "sent")
+					lg.Info("Sent")
+					if myext == ".x12" || myext == ".edi" {
+						expectAcks(lg, "./processed/"+doc)
+					}
 				}
 			}
-			changes <- etime
+			select {
+			case changes <- etime:
+			case <-stopping:
+				return
+			}
+		}
+	}
+}
+
+// sendable are the extensions of the documents sent: fXML, and X12 or
+// EDIFACT for the partners who trade in them.
+var sendable = map[string]bool{".xml": true, ".x12": true, ".edi": true}
+
+// docKind tells receipts from PO responses by their file name.
+func docKind(name string) string {
+	if strings.Contains(path.Base(name), "_MR_") {
+		return ledger.Receipt
+	}
+	return ledger.Response
+}
+
+// waitUpload waits for the expect script. On shutdown it waits up to
+// shutdownTimeout more, then kills it and reports stop.
+func waitUpload(c1 *exec.Cmd) (stop bool, err error) {
+	done := make(chan error, 1)
+	go func() { done <- c1.Wait() }()
+	select {
+	case err = <-done:
+		return false, err
+	case <-stopping:
+	}
+	select {
+	case err = <-done:
+		return false, err
+	case <-time.After(*shutdownTimeout):
+		c1.Process.Kill()
+		return true, <-done
+	}
+}
+
+// resumeRetries moves files parked in ./retry by the last run back
+// into the watched directory, where they are sent as new arrivals.
+func resumeRetries() {
+	if isdir, _ := isDir(*watchPath); !isdir {
+		return
+	}
+	ents, _ := ioutil.ReadDir("./retry")
+	for _, e := range ents {
+		if e.IsDir() {
+			continue
+		}
+		if err := os.Rename("./retry/"+e.Name(), path.Join(*watchPath, e.Name())); err != nil {
+			slog.Error("Failed to resume", "file", e.Name(), "err", err)
 		}
 	}
 }
@@ -444,18 +902,18 @@ func watchDir(w *fsnotify.Watcher, p string) {
 		return
 
 	case err != nil:
-		log.Printf("Failed to watch %s: %s", p, err)
+		slog.Error("Failed to watch", "path", p, "err", err)
 	}
 
 	for _, e := range ents {
 		sub := path.Join(p, e.Name())
 		if excludeRe != nil && excludeRe.MatchString(sub) {
-			debugPrint("excluding %s", sub)
+			slog.Debug("Excluding", "path", sub)
 			continue
 		}
 		switch isdir, err := isDir(sub); {
 		case err != nil:
-			log.Printf("Failed to watch %s: %s", sub, err)
+			slog.Error("Failed to watch", "path", sub, "err", err)
 
 		case isdir:
 			watchDir(w, sub)
@@ -466,14 +924,14 @@ func watchDir(w *fsnotify.Watcher, p string) {
 }
 
 func watch(w *fsnotify.Watcher, p string) {
-	debugPrint("Watching %s", p)
+	slog.Debug("Watching", "path", p)
 
 	switch err := w.Add(p); {
 	case os.IsNotExist(err):
-		debugPrint("%s no longer exists", p)
+		slog.Debug("No longer exists", "path", p)
 
 	case err != nil:
-		log.Printf("Failed to watch %s: %s", p, err)
+		slog.Error("Failed to watch", "path", p, "err", err)
 	}
 }
 
@@ -487,9 +945,3 @@ func isDir(p string) (bool, error) {
 		return s.IsDir(), nil
 	}
 }
-
-func debugPrint(f string, vals ...interface{}) {
-	if *debug {
-		log.Printf("DEBUG: "+f, vals...)
-	}
-}
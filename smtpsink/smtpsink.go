@@ -0,0 +1,218 @@
+/*
+Package smtpsink is a local SMTP server that keeps the mail it is sent.
+
+It speaks just enough SMTP for net/smtp.SendMail: EHLO, AUTH PLAIN
+and LOGIN (any credentials), MAIL, RCPT, DATA, RSET, NOOP and QUIT.
+Point the mail settings of the programs at it to see what they send
+without bothering anyone.
+*/
+package smtpsink
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is one mail the sink received.
+type Message struct {
+	From     string
+	To       []string
+	Data     []byte
+	Subject  string
+	Received time.Time
+}
+
+// Body returns the message body after the headers, decoded if it is
+// quoted-printable. A multipart body is returned as it is.
+func (m Message) Body() string {
+	msg, err := mail.ReadMessage(bytes.NewReader(m.Data))
+	if err != nil {
+		return ""
+	}
+	var r io.Reader = msg.Body
+	if strings.EqualFold(msg.Header.Get("Content-Transfer-Encoding"), "quoted-printable") {
+		r = quotedprintable.NewReader(r)
+	}
+	b, _ := io.ReadAll(r)
+	return string(b)
+}
+
+// Sink is the SMTP server.
+type Sink struct {
+	mu       sync.Mutex
+	l        net.Listener
+	messages []Message
+}
+
+// Start listens on addr, "127.0.0.1:0" picks a free port.
+func Start(addr string) (*Sink, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Sink{l: l}
+	go s.serve()
+	return s, nil
+}
+
+// Addr is the host:port the sink listens on.
+func (s *Sink) Addr() string {
+	return s.l.Addr().String()
+}
+
+// Close stops the sink.
+func (s *Sink) Close() error {
+	return s.l.Close()
+}
+
+// Messages returns the mail received so far.
+func (s *Sink) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.messages...)
+}
+
+// Reset forgets the mail received so far.
+func (s *Sink) Reset() {
+	s.mu.Lock()
+	s.messages = nil
+	s.mu.Unlock()
+}
+
+// WaitFor waits until a message whose subject contains sub arrives.
+func (s *Sink) WaitFor(sub string, timeout time.Duration) (Message, bool) {
+	deadline := time.Now().Add(timeout)
+	for {
+		for _, m := range s.Messages() {
+			if strings.Contains(m.Subject, sub) {
+				return m, true
+			}
+		}
+		if time.Now().After(deadline) {
+			return Message{}, false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (s *Sink) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.session(conn)
+	}
+}
+
+func (s *Sink) session(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(w, format+"\r\n", args...)
+		w.Flush()
+	}
+
+	reply("220 smtpsink ready")
+	var m Message
+	for {
+		conn.SetDeadline(time.Now().Add(time.Minute))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(line)
+		if i := strings.IndexByte(verb, ' '); i >= 0 {
+			verb = verb[:i]
+		}
+		switch verb {
+		case "EHLO":
+			reply("250-smtpsink")
+			reply("250-8BITMIME")
+			reply("250 AUTH PLAIN LOGIN")
+		case "HELO":
+			reply("250 smtpsink")
+		case "AUTH":
+			if strings.HasPrefix(strings.ToUpper(line), "AUTH LOGIN") {
+				reply("334 VXNlcm5hbWU6")
+				r.ReadString('\n')
+				reply("334 UGFzc3dvcmQ6")
+				r.ReadString('\n')
+			}
+			reply("235 2.7.0 Authentication successful")
+		case "MAIL":
+			m = Message{From: addr(line)}
+			reply("250 OK")
+		case "RCPT":
+			m.To = append(m.To, addr(line))
+			reply("250 OK")
+		case "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			data, err := readData(r)
+			if err != nil {
+				return
+			}
+			m.Data = data
+			m.Received = time.Now()
+			if msg, err := mail.ReadMessage(bytes.NewReader(data)); err == nil {
+				m.Subject = msg.Header.Get("Subject")
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, m)
+			s.mu.Unlock()
+			m = Message{}
+			reply("250 OK queued")
+		case "RSET":
+			m = Message{}
+			reply("250 OK")
+		case "NOOP":
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+// readData reads a DATA section up to the lone dot, undoing dot stuffing.
+func readData(r *bufio.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if line == ".\r\n" || line == ".\n" {
+			return buf.Bytes(), nil
+		}
+		if strings.HasPrefix(line, "..") {
+			line = line[1:]
+		}
+		buf.WriteString(line)
+	}
+}
+
+// addr pulls the address out of "MAIL FROM:<a@b>" or "RCPT TO:<a@b>".
+func addr(line string) string {
+	i := strings.IndexByte(line, '<')
+	j := strings.LastIndexByte(line, '>')
+	if i < 0 || j < i {
+		if k := strings.IndexByte(line, ':'); k >= 0 {
+			return strings.TrimSpace(line[k+1:])
+		}
+		return ""
+	}
+	return line[i+1 : j]
+}
@@ -0,0 +1,286 @@
+package x12
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Acknowledgment statuses: TA104 for an interchange, AK501 or IK501 for
+// a set and AK901 for a group.
+const (
+	Accepted           = "A"
+	AcceptedWithErrors = "E" // taken, though with errors noted
+	PartiallyAccepted  = "P" // some of a group's sets rejected
+	Rejected           = "R"
+)
+
+// maxCodes is how many error codes an AK5, IK5 or AK9 carries.
+const maxCodes = 5
+
+// FunctionalAck is what the acknowledgments of an interchange say,
+// gathered as it is read: the TA1 on the interchange and a 997 or 999
+// for each of its functional groups but acknowledgments, which are not
+// acknowledged.
+type FunctionalAck struct {
+	Interchange *Interchange
+	// Error is what is wrong with the interchange envelope, nil if
+	// nothing; the interchange is then rejected whole by a TA1.
+	Error  *EnvelopeError
+	Groups []*GroupAck
+}
+
+// GroupAck is what an acknowledgment says of a group, from AK1 to AK9.
+type GroupAck struct {
+	Group *Group
+	Codes []string // AK9 error codes
+	Sets  []*SetAck
+}
+
+// SetAck is what it says of a set, from AK2 to AK5 or IK5.
+type SetAck struct {
+	Set    *Transaction
+	Codes  []string      // AK5 or IK5 error codes
+	Errors SegmentErrors // the AK3 and AK4, or IK3 and IK4, segments
+	// Taken means the set was used in spite of its Errors, which are
+	// then reported as accepted with errors.
+	Taken bool
+}
+
+// NewFunctionalAck starts the acknowledgment of ic and err, as Parse
+// returned them. The group or set an *EnvelopeError in err is about is
+// in error; the rest are accepted until the caller finds otherwise.
+func NewFunctionalAck(ic *Interchange, err error) *FunctionalAck {
+	a := &FunctionalAck{Interchange: ic}
+	for _, g := range ic.Groups {
+		if g.Code == "FA" {
+			continue
+		}
+		ga := &GroupAck{Group: g}
+		for _, t := range g.Sets {
+			ga.Sets = append(ga.Sets, &SetAck{Set: t})
+		}
+		a.Groups = append(a.Groups, ga)
+	}
+	var env *EnvelopeError
+	if !errors.As(err, &env) {
+		return a
+	}
+	if env.Level == LevelInterchange {
+		a.Error = env
+		return a
+	}
+	// Parse stops at the first error, so it is in the last group read,
+	// and in its last set.
+	if len(ic.Groups) == 0 {
+		return a
+	}
+	g := ic.Groups[len(ic.Groups)-1]
+	switch {
+	case env.Level == LevelGroup && a.Group(g) != nil:
+		a.Group(g).Codes = append(a.Group(g).Codes, env.Code)
+	case env.Level == LevelSet && len(g.Sets) > 0 && a.Set(g.Sets[len(g.Sets)-1]) != nil:
+		sa := a.Set(g.Sets[len(g.Sets)-1])
+		sa.Codes = append(sa.Codes, env.Code)
+	}
+	return a
+}
+
+// Group returns the acknowledgment of g, nil if g is not acknowledged.
+func (a *FunctionalAck) Group(g *Group) *GroupAck {
+	for _, ga := range a.Groups {
+		if ga.Group == g {
+			return ga
+		}
+	}
+	return nil
+}
+
+// Set returns the acknowledgment of t, nil if t is not acknowledged.
+func (a *FunctionalAck) Set(t *Transaction) *SetAck {
+	for _, ga := range a.Groups {
+		for _, sa := range ga.Sets {
+			if sa.Set == t {
+				return sa
+			}
+		}
+	}
+	return nil
+}
+
+// Status is the set's AK501 or IK501.
+func (sa *SetAck) Status() string {
+	switch {
+	case len(sa.Codes) == 0 && len(sa.Errors) == 0:
+		return Accepted
+	case len(sa.Codes) == 0 && sa.Taken:
+		return AcceptedWithErrors
+	}
+	return Rejected
+}
+
+// Status is the group's AK901.
+func (ga *GroupAck) Status() string {
+	if len(ga.Codes) > 0 {
+		return Rejected
+	}
+	accepted, errs := 0, false
+	for _, sa := range ga.Sets {
+		switch sa.Status() {
+		case Accepted:
+			accepted++
+		case AcceptedWithErrors:
+			accepted++
+			errs = true
+		}
+	}
+	switch {
+	case accepted < len(ga.Sets) && accepted > 0:
+		return PartiallyAccepted
+	case accepted < len(ga.Sets):
+		return Rejected
+	case errs:
+		return AcceptedWithErrors
+	}
+	return Accepted
+}
+
+// WriteFunctionalAck writes the acknowledgments in a: a TA1 if the
+// interchange asked for one or is rejected, and unless it is rejected
+// a set of type code, "997" or "999", for each group.
+func WriteFunctionalAck(w *Writer, a *FunctionalAck, code string) {
+	ic := a.Interchange
+	if a.Error != nil || ic.AckRequested {
+		// The TA1 comes before any group.
+		status, note := Accepted, "000"
+		if a.Error != nil {
+			status, note = Rejected, a.Error.Code
+		}
+		w.write("TA1", ic.Control, ic.Date.Format("060102"), ic.Date.Format("1504"), status, note)
+	}
+	if a.Error != nil {
+		return
+	}
+	ik := code == "999"
+	for _, ga := range a.Groups {
+		g := ga.Group
+		w.Begin(code)
+		// AK103 is from version 005010 on, and always in a 999.
+		if ik || g.Version >= "005010" {
+			w.Segment("AK1", g.Code, g.Control, g.Version)
+		} else {
+			w.Segment("AK1", g.Code, g.Control)
+		}
+		accepted := 0
+		for _, sa := range ga.Sets {
+			w.Segment("AK2", sa.Set.Code, sa.Set.Control)
+			writeSegmentErrors(w, sa.Errors, ik)
+			status := sa.Status()
+			if status != Rejected {
+				accepted++
+			}
+			codes := sa.Codes
+			if len(codes) == 0 && len(sa.Errors) > 0 {
+				// 5: one or more segments in error.
+				codes = []string{"5"}
+			}
+			ak5 := "AK5"
+			if ik {
+				ak5 = "IK5"
+			}
+			w.Segment(ak5, append([]string{status}, first(codes, maxCodes)...)...)
+		}
+		if len(ga.Codes) > 0 {
+			accepted = 0
+		}
+		n := strconv.Itoa(len(ga.Sets))
+		w.Segment("AK9", append([]string{ga.Status(), n, n, strconv.Itoa(accepted)}, first(ga.Codes, maxCodes)...)...)
+		w.End()
+	}
+}
+
+// writeSegmentErrors writes errs as AK3 and AK4 segments, or as IK3
+// and IK4 for a 999, one AK3 for each segment in error.
+func writeSegmentErrors(w *Writer, errs SegmentErrors, ik bool) {
+	seg, elem := "AK3", "AK4"
+	if ik {
+		seg, elem = "IK3", "IK4"
+	}
+	last := 0
+	for _, e := range errs {
+		if e.Pos != last {
+			w.Segment(seg, e.Segment, strconv.Itoa(e.Pos), "", e.Code)
+			last = e.Pos
+		}
+		// An element error without a code is reported by its segment.
+		if e.Element > 0 && e.ElementCode != "" {
+			w.Segment(elem, strconv.Itoa(e.Element), "", e.ElementCode)
+		}
+	}
+}
+
+// first returns at most the first n of s.
+func first(s []string, n int) []string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// AckReport is what a partner's 997 or 999 says of a group we sent.
+type AckReport struct {
+	Code    string // AK101, the group's GS01
+	Control string // AK102, its GS06
+	Status  string // AK901
+	// Sets are the AK501 or IK501 of the sets acknowledged, by their
+	// control numbers.
+	Sets map[string]string
+}
+
+// ReadFunctionalAck reads the 997 or 999 in t.
+func ReadFunctionalAck(t *Transaction) (*AckReport, error) {
+	if t.Code != "997" && t.Code != "999" {
+		return nil, SegmentErrors{{Set: t.Control, Pos: 1, Segment: "ST", Code: "8", Element: 1, ElementCode: "7", Msg: "not a 997 or 999"}}
+	}
+	r := &AckReport{Sets: make(map[string]string)}
+	var ak1, ak9 bool
+	set := ""
+	for _, s := range t.Segments {
+		switch s.ID {
+		case "AK1":
+			r.Code, r.Control, ak1 = s.E(1), s.E(2), true
+		case "AK2":
+			set = s.E(2)
+		case "AK5", "IK5":
+			r.Sets[set] = s.E(1)
+		case "AK9":
+			r.Status, ak9 = s.E(1), true
+		}
+	}
+	switch {
+	case !ak1:
+		return nil, SegmentErrors{{Set: t.Control, Pos: 2, Segment: "AK1", Code: "3", Msg: "no AK1"}}
+	case !ak9:
+		return nil, SegmentErrors{{Set: t.Control, Pos: len(t.Segments) + 2, Segment: "AK9", Code: "3", Msg: "no AK9"}}
+	case r.Control == "":
+		return nil, SegmentErrors{{Set: t.Control, Pos: 2, Segment: "AK1", Code: "8", Element: 2, ElementCode: "1", Msg: "no group control number"}}
+	}
+	return r, nil
+}
+
+// String describes r for people.
+func (r *AckReport) String() string {
+	status := statusNames[r.Status]
+	if status == "" {
+		status = "status " + r.Status
+	}
+	return fmt.Sprintf("group %s %s %s", r.Code, r.Control, status)
+}
+
+// statusNames are the acknowledgment statuses in words.
+var statusNames = map[string]string{
+	Accepted:           "accepted",
+	AcceptedWithErrors: "accepted with errors",
+	PartiallyAccepted:  "partially accepted",
+	Rejected:           "rejected",
+}
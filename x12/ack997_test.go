@@ -0,0 +1,112 @@
+package x12
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAckStatus(t *testing.T) {
+	// Each set is accepted, has errors, has errors but was taken, or
+	// has envelope error codes, one or more than an AK5 carries.
+	const (
+		ok    = "ok"
+		errs  = "errors"
+		taken = "taken"
+		coded = "code"
+		many  = "six codes"
+	)
+	tests := []struct {
+		name   string
+		code   string // 997 or 999
+		sets   []string
+		group  []string // AK9 codes
+		status string   // AK901
+		want   []string // the segments from the first AK2
+	}{
+		{"all accepted", "997", []string{ok, ok}, nil, Accepted, []string{
+			"AK2*850*0001", "AK5*A",
+			"AK2*850*0002", "AK5*A",
+			"AK9*A*2*2*2",
+		}},
+		{"one taken with errors", "997", []string{ok, taken}, nil, AcceptedWithErrors, []string{
+			"AK2*850*0001", "AK5*A",
+			"AK2*850*0002", "AK3*BEG*3**8", "AK4*2**1", "AK5*E*5",
+			"AK9*E*2*2*2",
+		}},
+		{"one rejected", "997", []string{ok, errs}, nil, PartiallyAccepted, []string{
+			"AK2*850*0001", "AK5*A",
+			"AK2*850*0002", "AK3*BEG*3**8", "AK4*2**1", "AK5*R*5",
+			"AK9*P*2*2*1",
+		}},
+		{"taken and rejected", "997", []string{taken, coded}, nil, PartiallyAccepted, []string{
+			"AK2*850*0001", "AK3*BEG*3**8", "AK4*2**1", "AK5*E*5",
+			"AK2*850*0002", "AK5*R*4",
+			"AK9*P*2*2*1",
+		}},
+		{"all rejected", "997", []string{errs, coded}, nil, Rejected, []string{
+			"AK2*850*0001", "AK3*BEG*3**8", "AK4*2**1", "AK5*R*5",
+			"AK2*850*0002", "AK5*R*4",
+			"AK9*R*2*2*0",
+		}},
+		{"envelope codes, though taken", "997", []string{many}, nil, Rejected, []string{
+			"AK2*850*0001", "AK5*R*1*2*3*4*5",
+			"AK9*R*1*1*0",
+		}},
+		{"group rejected", "997", []string{ok}, []string{"4"}, Rejected, []string{
+			"AK2*850*0001", "AK5*A",
+			"AK9*R*1*1*0*4",
+		}},
+		{"group codes cut to five", "997", []string{ok}, []string{"1", "2", "3", "4", "5", "6"}, Rejected, []string{
+			"AK2*850*0001", "AK5*A",
+			"AK9*R*1*1*0*1*2*3*4*5",
+		}},
+		{"no sets", "997", nil, nil, Accepted, []string{
+			"AK9*A*0*0*0",
+		}},
+		{"999", "999", []string{ok, taken}, nil, AcceptedWithErrors, []string{
+			"AK2*850*0001", "IK5*A",
+			"AK2*850*0002", "IK3*BEG*3**8", "IK4*2**1", "IK5*E*5",
+			"AK9*E*2*2*2",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &Group{Code: "PO", Control: "7", Version: "004010"}
+			ga := &GroupAck{Group: g, Codes: tt.group}
+			for i, kind := range tt.sets {
+				set := &Transaction{Code: "850", Control: fmt.Sprintf("%04d", i+1)}
+				g.Sets = append(g.Sets, set)
+				sa := &SetAck{Set: set}
+				switch kind {
+				case errs, taken:
+					sa.Errors = SegmentErrors{{Set: set.Control, Pos: 3, Segment: "BEG", Code: "8", Element: 2, ElementCode: "1"}}
+					sa.Taken = kind == taken
+				case coded:
+					sa.Codes = []string{"4"}
+				case many:
+					sa.Codes = []string{"1", "2", "3", "4", "5", "6"}
+					sa.Taken = true
+				}
+				ga.Sets = append(ga.Sets, sa)
+			}
+			if got := ga.Status(); got != tt.status {
+				t.Errorf("Status = %s, want %s", got, tt.status)
+			}
+			w := testWriter("FA")
+			WriteFunctionalAck(w, &FunctionalAck{Interchange: &Interchange{Control: "000000101"}, Groups: []*GroupAck{ga}}, tt.code)
+			segs := setSegments(t, w.Bytes())
+			ak1 := "AK1*PO*7"
+			if tt.code == "999" {
+				ak1 += "*004010"
+			}
+			if segs[1] != ak1 {
+				t.Errorf("%s, want %s", segs[1], ak1)
+			}
+			if got := segs[2 : len(segs)-1]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s written as\n%s\nwant\n%s", tt.code, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package x12
+
+import (
+	"strconv"
+	"time"
+)
+
+// Receiving condition codes, RCD08.
+const (
+	ConditionDamaged = "01" // damaged product or container
+)
+
+// Advice is what an 861 receiving advice tells of: the goods received
+// against one order, and how much of them was taken.
+type Advice struct {
+	ID       string // BRA01
+	Date     time.Time
+	Received time.Time // DTM*050; zero if not known
+	Carrier  string    // TD505
+	Tracking string    // REF*CN
+	Order    string    // REF*PO, the purchase order number
+	Project  string    // REF*PJ
+	Contract string    // REF*CT
+	Lines    []AdviceLine
+}
+
+// AdviceLine is a line of an 861, one RCD loop.
+type AdviceLine struct {
+	Line        string // the purchase order line number
+	Code        string // the buyer's part number
+	Description string
+	UOM         string
+	Shipped     string // SN1, the packing list quantity
+	Received    string // the quantity that came
+	Damaged     string // the part of Received that is rejected as damaged
+}
+
+// WriteAdvice writes the 861 for a. Each line is an RCD giving the
+// quantity accepted, what was received less what was damaged, and the
+// quantity rejected, with ConditionDamaged when any was.
+func WriteAdvice(w *Writer, a Advice) {
+	w.Begin("861")
+	// 00 original, 1 receiving dock advice.
+	w.Segment("BRA", a.ID, a.Date.Format("20060102"), "00", "1", a.Date.Format("1504"))
+	for _, r := range []struct{ qual, v string }{{"PO", a.Order}, {"PJ", a.Project}, {"CT", a.Contract}, {"CN", a.Tracking}} {
+		if r.v != "" {
+			w.Segment("REF", r.qual, r.v)
+		}
+	}
+	if !a.Received.IsZero() {
+		w.Segment("DTM", "050", a.Received.Format("20060102"))
+	}
+	if a.Carrier != "" {
+		w.Segment("TD5", "", "", "", "", a.Carrier)
+	}
+
+	var hash float64
+	for i, l := range a.Lines {
+		received, _ := strconv.ParseFloat(l.Received, 64)
+		damaged, _ := strconv.ParseFloat(l.Damaged, 64)
+		if damaged > received {
+			damaged = received
+		}
+		rcd := []string{strconv.Itoa(i + 1), number(received - damaged), l.UOM}
+		if damaged > 0 {
+			rcd = append(rcd, number(damaged), l.UOM, "", "", ConditionDamaged)
+		}
+		w.Segment("RCD", rcd...)
+		if l.Shipped != "" {
+			w.Segment("SN1", l.Line, l.Shipped, l.UOM)
+		}
+		w.Segment("LIN", l.Line, "BP", l.Code)
+		if l.Description != "" {
+			w.Segment("PID", "F", "", "", "", l.Description)
+		}
+		hash += received
+	}
+	w.Segment("CTT", strconv.Itoa(len(a.Lines)), number(hash))
+	w.End()
+}
+
+// number writes a quantity without needless decimals.
+func number(n float64) string {
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
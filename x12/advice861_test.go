@@ -0,0 +1,122 @@
+package x12
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteAdvice(t *testing.T) {
+	advice := func(lines ...AdviceLine) Advice {
+		return Advice{ID: "RA1", Date: time.Date(2024, 1, 3, 9, 30, 0, 0, time.UTC), Order: "PO123", Lines: lines}
+	}
+	head := []string{"ST*861*0001", "BRA*RA1*20240103*00*1*0930", "REF*PO*PO123"}
+	tests := []struct {
+		name string
+		a    Advice
+		want []string // after head
+	}{
+		{"no damage", advice(
+			AdviceLine{Line: "1", Code: "ABC-1", Description: "Widgets", UOM: "EA", Shipped: "10", Received: "10"},
+		), []string{
+			"RCD*1*10*EA",
+			"SN1*1*10*EA",
+			"LIN*1*BP*ABC-1",
+			"PID*F****Widgets",
+			"CTT*1*10",
+			"SE*9*0001",
+		}},
+		{"damage of zero", advice(
+			AdviceLine{Line: "1", Code: "ABC-1", UOM: "EA", Received: "10", Damaged: "0"},
+		), []string{
+			"RCD*1*10*EA",
+			"LIN*1*BP*ABC-1",
+			"CTT*1*10",
+			"SE*7*0001",
+		}},
+		{"partial damage", advice(
+			AdviceLine{Line: "1", Code: "ABC-1", UOM: "EA", Shipped: "10", Received: "10", Damaged: "3"},
+		), []string{
+			"RCD*1*7*EA*3*EA***01",
+			"SN1*1*10*EA",
+			"LIN*1*BP*ABC-1",
+			"CTT*1*10",
+			"SE*8*0001",
+		}},
+		{"damage greater than received", advice(
+			AdviceLine{Line: "1", Code: "ABC-1", UOM: "EA", Shipped: "10", Received: "4", Damaged: "6"},
+		), []string{
+			"RCD*1*0*EA*4*EA***01",
+			"SN1*1*10*EA",
+			"LIN*1*BP*ABC-1",
+			"CTT*1*4",
+			"SE*8*0001",
+		}},
+		{"all damaged", advice(
+			AdviceLine{Line: "1", Code: "ABC-1", UOM: "LB", Received: "2.5", Damaged: "2.5"},
+		), []string{
+			"RCD*1*0*LB*2.5*LB***01",
+			"LIN*1*BP*ABC-1",
+			"CTT*1*2.5",
+			"SE*7*0001",
+		}},
+		{"short shipment", advice(
+			AdviceLine{Line: "1", Code: "ABC-1", UOM: "EA", Shipped: "10", Received: "8"},
+		), []string{
+			"RCD*1*8*EA",
+			"SN1*1*10*EA",
+			"LIN*1*BP*ABC-1",
+			"CTT*1*8",
+			"SE*8*0001",
+		}},
+		{"lines numbered in order", advice(
+			AdviceLine{Line: "3", Code: "ABC-1", UOM: "EA", Received: "1.5", Damaged: "0.5"},
+			AdviceLine{Line: "7", Code: "DEF-2", UOM: "EA", Received: "2"},
+		), []string{
+			"RCD*1*1*EA*0.5*EA***01",
+			"LIN*3*BP*ABC-1",
+			"RCD*2*2*EA",
+			"LIN*7*BP*DEF-2",
+			"CTT*2*3.5",
+			"SE*9*0001",
+		}},
+		{"no lines", advice(), []string{
+			"CTT*0*0",
+			"SE*5*0001",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := testWriter("RC")
+			WriteAdvice(w, tt.a)
+			want := append(append([]string{}, head...), tt.want...)
+			if got := setSegments(t, w.Bytes()); !reflect.DeepEqual(got, want) {
+				t.Errorf("861 written as\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+		})
+	}
+}
+
+func TestWriteAdviceHeader(t *testing.T) {
+	w := testWriter("RC")
+	WriteAdvice(w, Advice{
+		ID: "RA2", Date: time.Date(2024, 1, 3, 9, 30, 0, 0, time.UTC), Received: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+		Carrier: "UPS", Tracking: "1Z9", Order: "PO123", Project: "G41", Contract: "C-9",
+	})
+	want := []string{
+		"ST*861*0001",
+		"BRA*RA2*20240103*00*1*0930",
+		"REF*PO*PO123",
+		"REF*PJ*G41",
+		"REF*CT*C-9",
+		"REF*CN*1Z9",
+		"DTM*050*20240102",
+		"TD5*****UPS",
+		"CTT*0*0",
+		"SE*10*0001",
+	}
+	if got := setSegments(t, w.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("861 written as\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,131 @@
+package x12
+
+import (
+	"strconv"
+	"time"
+)
+
+// Shipment is what an 856 advance ship notice tells of: packages
+// shipped against one order.
+type Shipment struct {
+	ID       string // BSN02
+	Date     time.Time
+	Received time.Time // DTM*050, when the shipper had the goods; zero if not known
+	Carrier  string    // TD505, the carrier's name
+	Tracking string    // REF*CN, the carrier's reference
+	Order    string    // PRF01, the purchase order number
+	Project  string    // REF*PJ
+	Contract string    // REF*CT
+	Packages []Package
+}
+
+// Package is a pack level in an 856.
+type Package struct {
+	ID        string // MAN*GM, the package's marks and number
+	Type      string // TD101 packaging code, such as PLT or CTN
+	Weight    string // TD107, in pounds
+	Volume    string // TD109, in cubic feet
+	Length    string // MEA, in inches
+	Width     string
+	Height    string
+	Hazardous string // the UN number, if the package is hazardous
+	Items     []Item
+}
+
+// Item is an item level in an 856.
+type Item struct {
+	Line        string // the purchase order line number
+	Code        string // the buyer's part number
+	Description string
+	Qty         string
+	UOM         string
+}
+
+// WriteASN writes the 856 for s, in hierarchical levels of shipment,
+// order, pack and item.
+func WriteASN(w *Writer, s Shipment) {
+	w.Begin("856")
+	// 0001: shipment, order, packaging, item.
+	w.Segment("BSN", "00", s.ID, s.Date.Format("20060102"), s.Date.Format("1504"), "0001")
+
+	hl := 0
+	level := func(parent int, code string, children bool) int {
+		hl++
+		child := "0"
+		if children {
+			child = "1"
+		}
+		p := ""
+		if parent > 0 {
+			p = strconv.Itoa(parent)
+		}
+		w.Segment("HL", strconv.Itoa(hl), p, code, child)
+		return hl
+	}
+	var weight float64
+	for _, p := range s.Packages {
+		n, _ := strconv.ParseFloat(p.Weight, 64)
+		weight += n
+	}
+
+	ship := level(0, "S", true)
+	pkgType := ""
+	if len(s.Packages) > 0 {
+		pkgType = s.Packages[0].Type
+	}
+	w.Segment("TD1", pkgType, strconv.Itoa(len(s.Packages)), "", "", "", "G", number(weight), "LB")
+	if s.Carrier != "" {
+		w.Segment("TD5", "", "", "", "", s.Carrier)
+	}
+	if s.Tracking != "" {
+		w.Segment("REF", "CN", s.Tracking)
+	}
+	if !s.Received.IsZero() {
+		w.Segment("DTM", "050", s.Received.Format("20060102"))
+	}
+
+	order := level(ship, "O", len(s.Packages) > 0)
+	w.Segment("PRF", s.Order)
+	if s.Project != "" {
+		w.Segment("REF", "PJ", s.Project)
+	}
+	if s.Contract != "" {
+		w.Segment("REF", "CT", s.Contract)
+	}
+
+	var hash float64
+	for _, p := range s.Packages {
+		pack := level(order, "P", len(p.Items) > 0)
+		w.Segment("MAN", "GM", p.ID)
+		w.Segment("TD1", p.Type, "1", "", "", "", "G", p.Weight, "LB", p.Volume, cubicFeet(p.Volume))
+		for _, m := range []struct{ qual, v string }{{"LN", p.Length}, {"WD", p.Width}, {"HT", p.Height}} {
+			if m.v != "" {
+				w.Segment("MEA", "PD", m.qual, m.v, "IN")
+			}
+		}
+		if p.Hazardous != "" {
+			// HM: hazardous materials, with the UN number.
+			w.Segment("TD4", "HM", "", "", "UN"+p.Hazardous)
+		}
+		for _, it := range p.Items {
+			level(pack, "I", false)
+			w.Segment("LIN", it.Line, "BP", it.Code)
+			w.Segment("SN1", it.Line, it.Qty, it.UOM)
+			if it.Description != "" {
+				w.Segment("PID", "F", "", "", "", it.Description)
+			}
+			n, _ := strconv.ParseFloat(it.Qty, 64)
+			hash += n
+		}
+	}
+	w.Segment("CTT", strconv.Itoa(hl), number(hash))
+	w.End()
+}
+
+// cubicFeet is the TD110 unit for a volume, if there is one.
+func cubicFeet(volume string) string {
+	if volume == "" {
+		return ""
+	}
+	return "CF"
+}
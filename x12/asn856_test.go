@@ -0,0 +1,142 @@
+package x12
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testWriter starts an interchange to ACME, one segment to a line.
+func testWriter(code string) *Writer {
+	return NewWriter(Envelope{
+		SenderQual: "ZZ", Sender: "BASEEDI", ReceiverQual: "ZZ", Receiver: "ACME",
+		Version: "004010", Control: 12, Group: 34, Code: code,
+		Date: time.Date(2024, 1, 3, 9, 0, 0, 0, time.UTC),
+	}, DefaultDelimiters, true)
+}
+
+// setSegments returns the segments of the one set in an interchange,
+// ST to SE, after checking that it parses.
+func setSegments(t *testing.T, b []byte) []string {
+	t.Helper()
+	if _, err := Parse(b); err != nil {
+		t.Fatalf("the interchange does not parse: %v\n%s", err, b)
+	}
+	var segs []string
+	in := false
+	for _, line := range strings.Split(string(b), "\n") {
+		seg := strings.TrimSuffix(line, "~")
+		in = in || strings.HasPrefix(seg, "ST*")
+		if in {
+			segs = append(segs, seg)
+		}
+		if strings.HasPrefix(seg, "SE*") {
+			break
+		}
+	}
+	return segs
+}
+
+func TestWriteASN(t *testing.T) {
+	tests := []struct {
+		name string
+		s    Shipment
+		want []string
+	}{
+		{"packages and items", Shipment{
+			ID: "SH1", Date: time.Date(2024, 1, 3, 9, 30, 0, 0, time.UTC), Received: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+			Carrier: "UPS", Tracking: "1Z9", Order: "PO123", Project: "G41", Contract: "C-9",
+			Packages: []Package{
+				{ID: "PKG1", Type: "PLT", Weight: "120.5", Volume: "40", Length: "48", Width: "40", Height: "36", Hazardous: "1993",
+					Items: []Item{
+						{Line: "1", Code: "ABC-1", Description: "Widgets", Qty: "10", UOM: "EA"},
+						{Line: "2", Code: "DEF-2", Qty: "2.5", UOM: "LB"},
+					}},
+				{ID: "PKG2", Type: "CTN", Weight: "4.5",
+					Items: []Item{{Line: "3", Code: "GHI-3", Qty: "1", UOM: "EA"}}},
+				{ID: "PKG3", Type: "CTN"},
+			},
+		}, []string{
+			"ST*856*0001",
+			"BSN*00*SH1*20240103*0930*0001",
+			"HL*1**S*1",
+			"TD1*PLT*3****G*125*LB",
+			"TD5*****UPS",
+			"REF*CN*1Z9",
+			"DTM*050*20240102",
+			"HL*2*1*O*1",
+			"PRF*PO123",
+			"REF*PJ*G41",
+			"REF*CT*C-9",
+			"HL*3*2*P*1",
+			"MAN*GM*PKG1",
+			"TD1*PLT*1****G*120.5*LB*40*CF",
+			"MEA*PD*LN*48*IN",
+			"MEA*PD*WD*40*IN",
+			"MEA*PD*HT*36*IN",
+			"TD4*HM***UN1993",
+			"HL*4*3*I*0",
+			"LIN*1*BP*ABC-1",
+			"SN1*1*10*EA",
+			"PID*F****Widgets",
+			"HL*5*3*I*0",
+			"LIN*2*BP*DEF-2",
+			"SN1*2*2.5*LB",
+			"HL*6*2*P*1",
+			"MAN*GM*PKG2",
+			"TD1*CTN*1****G*4.5*LB",
+			"HL*7*6*I*0",
+			"LIN*3*BP*GHI-3",
+			"SN1*3*1*EA",
+			"HL*8*2*P*0",
+			"MAN*GM*PKG3",
+			"TD1*CTN*1****G**LB",
+			"CTT*8*13.5",
+			"SE*36*0001",
+		}},
+		{"no packages", Shipment{
+			ID: "SH2", Date: time.Date(2024, 1, 3, 9, 30, 0, 0, time.UTC), Order: "PO124",
+		}, []string{
+			"ST*856*0001",
+			"BSN*00*SH2*20240103*0930*0001",
+			"HL*1**S*1",
+			"TD1**0****G*0*LB",
+			"HL*2*1*O*0",
+			"PRF*PO124",
+			"CTT*2*0",
+			"SE*8*0001",
+		}},
+		{"delimiters in the data", Shipment{
+			ID: "SH*3", Date: time.Date(2024, 1, 3, 9, 30, 0, 0, time.UTC), Order: "PO~125", Carrier: "R:L",
+			Packages: []Package{{ID: "PKG1", Type: "CTN", Weight: "2",
+				Items: []Item{{Line: "1", Code: "ABC-1", Description: "Nuts*bolts", Qty: "4", UOM: "EA"}}}},
+		}, []string{
+			"ST*856*0001",
+			"BSN*00*SH 3*20240103*0930*0001",
+			"HL*1**S*1",
+			"TD1*CTN*1****G*2*LB",
+			"TD5*****R L",
+			"HL*2*1*O*1",
+			"PRF*PO 125",
+			"HL*3*2*P*1",
+			"MAN*GM*PKG1",
+			"TD1*CTN*1****G*2*LB",
+			"HL*4*3*I*0",
+			"LIN*1*BP*ABC-1",
+			"SN1*1*4*EA",
+			"PID*F****Nuts bolts",
+			"CTT*4*4",
+			"SE*16*0001",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := testWriter("SH")
+			WriteASN(w, tt.s)
+			if got := setSegments(t, w.Bytes()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("856 written as\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package x12
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// maxControl is the largest ISA13; the numbers go round to 1 after it.
+const maxControl = 999999999
+
+// Controls hands out interchange and group control numbers. They are
+// kept in a file, so they go on from one run to the next, and the file
+// is locked while a number is taken, so programs running at once never
+// get the same one.
+type Controls struct {
+	path string
+}
+
+// controlState is what the control file holds: the numbers last used.
+type controlState struct {
+	Interchange int `json:"interchange"`
+	Group       int `json:"group"`
+}
+
+// OpenControls returns the control numbers kept in the file at path.
+// The file is made when the first number is taken.
+func OpenControls(path string) *Controls {
+	return &Controls{path: path}
+}
+
+// Next takes the next interchange and group control numbers.
+func (c *Controls) Next() (interchange int, group int, err error) {
+	f, err := os.OpenFile(c.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return 0, 0, fmt.Errorf("%s: lock: %v", c.path, err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	var st controlState
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &st); err != nil {
+			return 0, 0, fmt.Errorf("%s: %v", c.path, err)
+		}
+	}
+	st.Interchange = st.Interchange%maxControl + 1
+	st.Group = st.Group%maxControl + 1
+	if b, err = json.Marshal(st); err != nil {
+		return 0, 0, err
+	}
+	if err := f.Truncate(0); err != nil {
+		return 0, 0, err
+	}
+	if _, err := f.WriteAt(append(b, '\n'), 0); err != nil {
+		return 0, 0, err
+	}
+	// A number handed out must not be handed out again after a crash.
+	if err := f.Sync(); err != nil {
+		return 0, 0, err
+	}
+	return st.Interchange, st.Group, nil
+}
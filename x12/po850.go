@@ -0,0 +1,266 @@
+package x12
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// PO is an 850 purchase order.
+type PO struct {
+	Set      string // the set's control number
+	Purpose  string // BEG01: 00 original, 01 cancellation, 04 change, 05 replace
+	Type     string // BEG02: SA stand-alone, BK blanket, RL release
+	Number   string // BEG03
+	Release  string // BEG04
+	Date     time.Time
+	Currency string            // CUR02
+	Refs     map[string]string // REF02 by REF01, such as PJ project and CT contract
+	Dates    map[string]time.Time
+	Terms    string // FOB05, the Incoterms code
+	Location string // FOB03
+	// Description is the header PID05, describing the order as a whole.
+	Description string
+	Notes       []string
+	Parties     []Party
+	Lines       []POLine
+	Count       int    // CTT01, the line items counted
+	Hash        string // CTT02, the quantities summed
+}
+
+// Party is an N1 loop: who a party to the order is and where.
+type Party struct {
+	Code    string // N101: BY buyer, ST ship to, VN vendor, SE selling party
+	Name    string
+	IDQual  string // N103
+	ID      string // N104
+	Address []string
+	City    string
+	State   string
+	Postal  string
+	Country string
+	Contact string // PER02
+	Phone   string // the PER number qualified TE
+	Email   string // the PER number qualified EM
+}
+
+// POLine is a PO1 loop, one line item.
+type POLine struct {
+	Number string // PO101, the buyer's line number
+	Qty    string
+	UOM    string
+	Price  string
+	// IDs are the product IDs by qualifier: BP buyer's part, VP
+	// vendor's part, IN buyer's item and so on.
+	IDs          map[string]string
+	Descriptions []string // PID05, free-form descriptions in turn
+	Dates        map[string]time.Time
+	Refs         map[string]string
+	Notes        []string
+}
+
+// The segments of each loop after the one starting it.
+var (
+	n1Loop  = []string{"N2", "N3", "N4", "REF", "PER"}
+	po1Loop = []string{"CUR", "PO3", "CTP", "PID", "MEA", "PWK", "PO4", "REF", "PER", "SAC", "DTM", "TD5", "MSG", "NTE", "SCH"}
+)
+
+// ReadPO reads the 850 in t.
+func ReadPO(t *Transaction) (*PO, error) {
+	po := &PO{Set: t.Control, Refs: make(map[string]string), Dates: make(map[string]time.Time)}
+	var errs SegmentErrors
+	bad := func(s Segment, code string, element int, elementCode string, format string, args ...any) {
+		errs = append(errs, &SegmentError{
+			Set:         t.Control,
+			Pos:         s.Pos,
+			Segment:     s.ID,
+			Code:        code,
+			Element:     element,
+			ElementCode: elementCode,
+			Msg:         fmt.Sprintf(format, args...),
+		})
+	}
+	date := func(s Segment, element int) time.Time {
+		d, err := Date(s.E(element), "")
+		if err != nil {
+			bad(s, "8", element, "8", "bad date %q", s.E(element))
+		}
+		return d
+	}
+	number := func(s Segment, element int) string {
+		v := s.E(element)
+		if v == "" {
+			return v
+		}
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			bad(s, "8", element, "6", "%q is not a number", v)
+		}
+		return v
+	}
+
+	if t.Code != "850" {
+		return nil, SegmentErrors{{Set: t.Control, Pos: 1, Segment: "ST", Code: "8", Element: 1, ElementCode: "7", Msg: "not an 850"}}
+	}
+	segs := t.Segments
+	var beg, ctt *Segment
+	for i := 0; i < len(segs); i++ {
+		s := segs[i]
+		switch s.ID {
+		case "BEG":
+			if beg != nil {
+				bad(s, "5", 0, "", "more than one BEG")
+				continue
+			}
+			beg = &segs[i]
+			po.Purpose, po.Type, po.Number, po.Release = s.E(1), s.E(2), s.E(3), s.E(4)
+			if po.Number == "" {
+				bad(s, "8", 3, "1", "no purchase order number")
+			}
+			po.Date = date(s, 5)
+		case "CUR":
+			po.Currency = s.E(2)
+		case "REF":
+			po.Refs[s.E(1)] = s.E(2)
+		case "DTM":
+			po.Dates[s.E(1)] = date(s, 2)
+		case "FOB":
+			po.Location, po.Terms = s.E(3), s.E(5)
+		case "PID":
+			if po.Description == "" {
+				po.Description = s.E(5)
+			}
+		case "MSG":
+			po.Notes = append(po.Notes, s.E(1))
+		case "NTE":
+			po.Notes = append(po.Notes, s.E(2))
+		case "N1":
+			loop := Loop(segs[i:], n1Loop)
+			po.Parties = append(po.Parties, party(loop))
+			i += len(loop) - 1
+		case "PO1":
+			loop := Loop(segs[i:], po1Loop)
+			l := POLine{
+				Number: s.E(1),
+				Qty:    number(s, 2),
+				UOM:    s.E(3),
+				Price:  number(s, 4),
+				IDs:    make(map[string]string),
+				Dates:  make(map[string]time.Time),
+				Refs:   make(map[string]string),
+			}
+			if l.Qty == "" {
+				bad(s, "8", 2, "1", "no quantity")
+			}
+			// PO106 and PO107 are the first qualifier and ID, pairs
+			// follow to PO124.
+			for e := 6; e+1 <= len(s.Elements); e += 2 {
+				if s.E(e) != "" {
+					l.IDs[s.E(e)] = s.E(e + 1)
+				}
+			}
+			for _, s := range loop[1:] {
+				switch s.ID {
+				case "PID":
+					if s.E(5) != "" {
+						l.Descriptions = append(l.Descriptions, s.E(5))
+					}
+				case "DTM":
+					l.Dates[s.E(1)] = date(s, 2)
+				case "REF":
+					l.Refs[s.E(1)] = s.E(2)
+				case "MSG":
+					l.Notes = append(l.Notes, s.E(1))
+				case "NTE":
+					l.Notes = append(l.Notes, s.E(2))
+				}
+			}
+			po.Lines = append(po.Lines, l)
+			i += len(loop) - 1
+		case "CTT":
+			ctt = &segs[i]
+			po.Hash = s.E(2)
+			n, err := strconv.Atoi(s.E(1))
+			if err != nil {
+				bad(s, "8", 1, "6", "%q is not a count", s.E(1))
+			}
+			po.Count = n
+		}
+	}
+	if beg == nil {
+		bad(Segment{ID: "BEG", Pos: 2}, "3", 0, "", "no BEG")
+	}
+	if len(po.Lines) == 0 {
+		bad(Segment{ID: "PO1", Pos: len(segs) + 2}, "3", 0, "", "no line items")
+	}
+	if ctt != nil && po.Count != len(po.Lines) {
+		bad(*ctt, "8", 1, "", "CTT01 counts %d line items, the order has %d", po.Count, len(po.Lines))
+	}
+	if errs != nil {
+		return po, errs
+	}
+	return po, nil
+}
+
+// party reads an N1 loop.
+func party(loop []Segment) Party {
+	n1 := loop[0]
+	p := Party{Code: n1.E(1), Name: n1.E(2), IDQual: n1.E(3), ID: n1.E(4)}
+	for _, s := range loop[1:] {
+		switch s.ID {
+		case "N3":
+			for _, a := range s.Elements {
+				if a != "" {
+					p.Address = append(p.Address, a)
+				}
+			}
+		case "N4":
+			p.City, p.State, p.Postal, p.Country = s.E(1), s.E(2), s.E(3), s.E(4)
+		case "PER":
+			if p.Contact == "" {
+				p.Contact = s.E(2)
+			}
+			// PER03 to PER08 are qualifier and number pairs.
+			for e := 3; e+1 <= len(s.Elements); e += 2 {
+				switch s.E(e) {
+				case "TE":
+					p.Phone = s.E(e + 1)
+				case "EM":
+					p.Email = s.E(e + 1)
+				}
+			}
+		}
+	}
+	return p
+}
+
+// Party returns the first party with one of codes, in the order the
+// codes are given.
+func (po *PO) Party(codes ...string) (Party, bool) {
+	for _, c := range codes {
+		for _, p := range po.Parties {
+			if p.Code == c {
+				return p, true
+			}
+		}
+	}
+	return Party{}, false
+}
+
+// Loop returns the loop starting at segs[0]: it and the segments
+// after it whose IDs are in members.
+func Loop(segs []Segment, members []string) []Segment {
+	n := 1
+	for n < len(segs) && in(segs[n].ID, members) {
+		n++
+	}
+	return segs[:n]
+}
+
+func in(id string, ids []string) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
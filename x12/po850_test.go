@@ -0,0 +1,209 @@
+package x12
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSet is an 850 of the segments given, written with * and ~.
+func testSet(segs ...string) *Transaction {
+	t := &Transaction{Code: "850", Control: "0001"}
+	d := Delimiters{Segment: '~', Element: '*', Component: ':'}
+	for _, raw := range segs {
+		t.Segments = append(t.Segments, split(raw, d, len(t.Segments)+2))
+	}
+	return t
+}
+
+func TestReadPO(t *testing.T) {
+	po, err := ReadPO(testSet(
+		"BEG*00*SA*PO123**20240102",
+		"CUR*BY*USD",
+		"REF*PJ*G41",
+		"REF*CT*C-9",
+		"FOB*PP*ZZ*Houston**FCA",
+		"PID*F****Order of widgets",
+		"N1*VN*Widget Co*92*V1",
+		"N3*1 Main St",
+		"N4*Houston*TX*77001*US",
+		"PER*IC*Pat*TE*555-0100",
+		"PO1*1*10*EA*2.5**BP*ABC-1*VP*W-1",
+		"PID*F****Widgets",
+		"DTM*002*20240201",
+		"PO1*2*1.5*LB*4",
+		"CTT*2*11.5",
+	))
+	if err != nil {
+		t.Fatalf("ReadPO: %v", err)
+	}
+	switch {
+	case po.Number != "PO123" || po.Purpose != "00" || po.Type != "SA":
+		t.Errorf("BEG read as %s %s %s", po.Purpose, po.Type, po.Number)
+	case !po.Date.Equal(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)):
+		t.Errorf("date %v", po.Date)
+	case po.Currency != "USD" || po.Refs["PJ"] != "G41" || po.Refs["CT"] != "C-9":
+		t.Errorf("currency %s, refs %v", po.Currency, po.Refs)
+	case po.Terms != "FCA" || po.Location != "Houston" || po.Description != "Order of widgets":
+		t.Errorf("terms %s at %s, description %q", po.Terms, po.Location, po.Description)
+	case len(po.Parties) != 1 || po.Parties[0].Name != "Widget Co" || po.Parties[0].City != "Houston" || po.Parties[0].Phone != "555-0100":
+		t.Errorf("parties %+v", po.Parties)
+	case len(po.Lines) != 2 || po.Count != 2 || po.Hash != "11.5":
+		t.Fatalf("%d lines, CTT %d %s", len(po.Lines), po.Count, po.Hash)
+	}
+	l := po.Lines[0]
+	if l.Qty != "10" || l.UOM != "EA" || l.Price != "2.5" || l.IDs["BP"] != "ABC-1" || l.IDs["VP"] != "W-1" ||
+		len(l.Descriptions) != 1 || !l.Dates["002"].Equal(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("line 1 read as %+v", l)
+	}
+}
+
+func TestReadPOErrors(t *testing.T) {
+	type want struct {
+		pos         int
+		segment     string
+		code        string
+		element     int
+		elementCode string
+	}
+	tests := []struct {
+		name string
+		set  *Transaction
+		want []want
+	}{
+		{"no order number", testSet("BEG*00*SA***20240102", "PO1*1*1*EA"),
+			[]want{{2, "BEG", "8", 3, "1"}}},
+		{"bad date", testSet("BEG*00*SA*PO1**2024013", "PO1*1*1*EA"),
+			[]want{{2, "BEG", "8", 5, "8"}}},
+		{"quantity not a number", testSet("BEG*00*SA*PO1**20240102", "PO1*1*ten*EA"),
+			[]want{{3, "PO1", "8", 2, "6"}}},
+		{"no quantity", testSet("BEG*00*SA*PO1**20240102", "PO1*1**EA"),
+			[]want{{3, "PO1", "8", 2, "1"}}},
+		{"bad line date", testSet("BEG*00*SA*PO1**20240102", "PO1*1*1*EA", "DTM*002*soon"),
+			[]want{{4, "DTM", "8", 2, "8"}}},
+		{"two BEGs", testSet("BEG*00*SA*PO1**20240102", "BEG*00*SA*PO2**20240102", "PO1*1*1*EA"),
+			[]want{{3, "BEG", "5", 0, ""}}},
+		{"CTT count", testSet("BEG*00*SA*PO1**20240102", "PO1*1*1*EA", "CTT*2"),
+			[]want{{4, "CTT", "8", 1, ""}}},
+		{"no BEG", testSet("PO1*1*1*EA"),
+			[]want{{2, "BEG", "3", 0, ""}}},
+		{"no lines", testSet("BEG*00*SA*PO1**20240102"),
+			[]want{{3, "PO1", "3", 0, ""}}},
+		{"every error", testSet("BEG*00*SA***x", "PO1*1*x*EA"),
+			[]want{{2, "BEG", "8", 3, "1"}, {2, "BEG", "8", 5, "8"}, {3, "PO1", "8", 2, "6"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadPO(tt.set)
+			var errs SegmentErrors
+			if !errors.As(err, &errs) {
+				t.Fatalf("ReadPO returned %v, want SegmentErrors", err)
+			}
+			if len(errs) != len(tt.want) {
+				t.Fatalf("%d errors, want %d: %v", len(errs), len(tt.want), err)
+			}
+			for i, w := range tt.want {
+				e := errs[i]
+				got := want{e.Pos, e.Segment, e.Code, e.Element, e.ElementCode}
+				if got != w || e.Set != "0001" {
+					t.Errorf("error %d is %+v in set %s, want %+v", i, got, e.Set, w)
+				}
+			}
+		})
+	}
+}
+
+func TestReadPONot850(t *testing.T) {
+	set := testSet("BEG*00*SA*PO1**20240102", "PO1*1*1*EA")
+	set.Code = "860"
+	if po, err := ReadPO(set); po != nil || err == nil {
+		t.Errorf("ReadPO of an 860 = %v, %v", po, err)
+	}
+}
+
+func TestPOAckRoundTrip(t *testing.T) {
+	po, err := ReadPO(testSet(
+		"BEG*00*SA*PO123*R1*20240102",
+		"CUR*BY*USD",
+		"REF*PJ*G41",
+		"PO1*1*10*EA*2.5**VP*W-1*BP*ABC-1",
+		"DTM*002*20240201",
+		"PO1*2*4*LB*1",
+		"CTT*2*14",
+	))
+	if err != nil {
+		t.Fatalf("ReadPO: %v", err)
+	}
+	tests := []struct {
+		name  string
+		ack   POAck
+		lines int
+		ack01 string
+		qty   string
+	}{
+		{"accepted", POAck{Type: AckDetail, Status: ItemAccepted, Message: "Order taken"}, 2, ItemAccepted, "10"},
+		{"rejected", POAck{Type: AckReject, Status: ItemRejected, Message: "Contract*G41~closed"}, 2, ItemRejected, "0"},
+		{"no detail", POAck{Type: AckNoDetail, Message: strings.Repeat("x", msgLen+10)}, 0, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.ack.Date = time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)
+			w := NewWriter(Envelope{
+				SenderQual: "ZZ", Sender: "BASEEDI", ReceiverQual: "ZZ", Receiver: "ACME",
+				Version: "004010", Control: 12, Group: 34, Code: "PR",
+				Date: time.Date(2024, 1, 3, 9, 0, 0, 0, time.UTC),
+			}, DefaultDelimiters, false)
+			WritePOAck(w, po, tt.ack)
+			ic, err := Parse(w.Bytes())
+			if err != nil {
+				t.Fatalf("the 855 does not parse: %v", err)
+			}
+			if ic.Receiver != "ACME" || ic.Control != "000000012" || ic.Groups[0].Code != "PR" || ic.Groups[0].Control != "34" {
+				t.Errorf("envelope to %s, control %s, group %s %s", ic.Receiver, ic.Control, ic.Groups[0].Code, ic.Groups[0].Control)
+			}
+			set := ic.Groups[0].Sets[0]
+			if set.Code != "855" {
+				t.Fatalf("set %s, want 855", set.Code)
+			}
+			var msg string
+			var po1s, acks []Segment
+			for _, s := range set.Segments {
+				switch s.ID {
+				case "BAK":
+					if s.E(2) != tt.ack.Type || s.E(3) != "PO123" || s.E(4) != "20240102" || s.E(5) != "R1" || s.E(9) != "20240103" {
+						t.Errorf("BAK %v", s.Elements)
+					}
+				case "MSG":
+					msg += s.E(1)
+				case "PO1":
+					po1s = append(po1s, s)
+				case "ACK":
+					acks = append(acks, s)
+				}
+			}
+			if strings.ContainsAny(msg, "*~") {
+				t.Errorf("delimiters left in MSG %q", msg)
+			}
+			if len(msg) != len(tt.ack.Message) {
+				t.Errorf("MSG carries %d characters, want %d", len(msg), len(tt.ack.Message))
+			}
+			if len(po1s) != tt.lines || len(acks) != tt.lines {
+				t.Fatalf("%d PO1 and %d ACK, want %d", len(po1s), len(acks), tt.lines)
+			}
+			if tt.lines == 0 {
+				return
+			}
+			// The buyer's part comes first whatever order it came in.
+			if p := po1s[0]; p.E(1) != "1" || p.E(2) != "10" || p.E(6) != "BP" || p.E(7) != "ABC-1" || p.E(8) != "VP" {
+				t.Errorf("PO1 %v", p.Elements)
+			}
+			if a := acks[0]; a.E(1) != tt.ack01 || a.E(2) != tt.qty || a.E(3) != "EA" {
+				t.Errorf("ACK %v", a.Elements)
+			}
+			if d := acks[0].E(5); (tt.ack01 == ItemAccepted) != (d == "20240201") {
+				t.Errorf("ACK date %q", d)
+			}
+		})
+	}
+}
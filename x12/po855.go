@@ -0,0 +1,99 @@
+package x12
+
+import (
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Acknowledgment types, BAK02.
+const (
+	AckDetail   = "AD" // accepted, lines acknowledged without change
+	AckReject   = "RD" // rejected, with the lines rejected
+	AckNoDetail = "AK" // acknowledged, no detail or change
+)
+
+// Line item statuses, ACK01.
+const (
+	ItemAccepted = "IA"
+	ItemRejected = "IR"
+)
+
+// msgLen is the longest MSG01.
+const msgLen = 264
+
+// POAck is the answer to a purchase order, for its 855.
+type POAck struct {
+	Type string // BAK02, one of the Ack constants
+	// Status is the ACK01 given every line; with "" the lines are left
+	// out.
+	Status  string
+	Message string // the answer in words, sent as MSG segments
+	Date    time.Time
+}
+
+// WritePOAck writes the 855 answering po.
+func WritePOAck(w *Writer, po *PO, a POAck) {
+	w.Begin("855")
+	w.Segment("BAK", "00", a.Type, po.Number, po.Date.Format("20060102"), po.Release,
+		"", "", "", a.Date.Format("20060102"))
+	if po.Currency != "" {
+		w.Segment("CUR", "BY", po.Currency)
+	}
+	for _, q := range []string{"PJ", "CT"} {
+		if v := po.Refs[q]; v != "" {
+			w.Segment("REF", q, v)
+		}
+	}
+	if a.Message != "" {
+		w.Segment("N9", "L1", "RESPONSE")
+		for msg := a.Message; msg != ""; {
+			n := len(msg)
+			if n > msgLen {
+				n = msgLen
+			}
+			w.Segment("MSG", msg[:n])
+			msg = msg[n:]
+		}
+	}
+	if a.Status != "" {
+		for _, l := range po.Lines {
+			po1 := []string{l.Number, l.Qty, l.UOM, l.Price, ""}
+			for _, q := range idOrder(l.IDs) {
+				po1 = append(po1, q, l.IDs[q])
+			}
+			w.Segment("PO1", po1...)
+			qty := l.Qty
+			if a.Status == ItemRejected {
+				qty = "0"
+			}
+			ack := []string{a.Status, qty, l.UOM}
+			if d, ok := l.Dates["002"]; ok && a.Status == ItemAccepted {
+				// 068: the ship date, as asked.
+				ack = append(ack, "068", d.Format("20060102"))
+			}
+			w.Segment("ACK", ack...)
+		}
+		w.Segment("CTT", strconv.Itoa(len(po.Lines)), po.Hash)
+	}
+	w.End()
+}
+
+// idOrder is the order product IDs are written in: the usual
+// qualifiers first, then any others.
+func idOrder(ids map[string]string) []string {
+	var qs []string
+	for _, q := range []string{"BP", "VP", "IN", "MG", "UP"} {
+		if _, ok := ids[q]; ok {
+			qs = append(qs, q)
+		}
+	}
+	var rest []string
+	for q := range ids {
+		if !in(q, qs) {
+			rest = append(rest, q)
+		}
+	}
+	sort.Strings(rest)
+	return append(qs, rest...)
+}
@@ -0,0 +1,188 @@
+package x12
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDelimiters are the delimiters most partners expect.
+var DefaultDelimiters = Delimiters{Segment: '~', Element: '*', Component: ':', Repetition: '^'}
+
+// DelimitersOf returns the delimiters written as a string of four: the
+// segment terminator and the element, component and repetition
+// separators, such as "~*:^".
+func DelimitersOf(s string) Delimiters {
+	if len(s) != 4 {
+		return DefaultDelimiters
+	}
+	return Delimiters{Segment: s[0], Element: s[1], Component: s[2], Repetition: s[3]}
+}
+
+// Envelope is what a Writer puts on the ISA and GS segments.
+type Envelope struct {
+	SenderQual   string // ISA05
+	Sender       string // ISA06 and GS02
+	ReceiverQual string // ISA07
+	Receiver     string // ISA08 and GS03
+	// AppSender and AppReceiver are GS02 and GS03 when they are not
+	// the ISA IDs.
+	AppSender   string
+	AppReceiver string
+	// Version is the GS08 version, such as 004010; ISA12 is its first
+	// five digits.
+	Version      string
+	Usage        string // ISA15, P production or T test
+	AckRequested bool   // ISA14, asking for a TA1
+	Control      int    // ISA13
+	Group        int    // GS06
+	Code         string // GS01, such as PR for 855s
+	Date         time.Time
+}
+
+// Writer writes an interchange of one functional group.
+type Writer struct {
+	env        Envelope
+	d          Delimiters
+	lineBreaks bool
+	b          bytes.Buffer
+	group      bool // the GS is written
+	sets       int
+	set        string // the control number of the open set, "" if none
+	segs       int    // segments in the open set
+}
+
+// NewWriter starts an interchange, writing its ISA; the GS is written
+// with the first set. With lineBreaks each segment is followed by a
+// newline, for people to read. d.Repetition is only written from
+// version 00402.
+func NewWriter(env Envelope, d Delimiters, lineBreaks bool) *Writer {
+	w := &Writer{env: env, d: d, lineBreaks: lineBreaks}
+	isaVersion := "00401"
+	if len(env.Version) >= 5 {
+		isaVersion = env.Version[:5]
+	}
+	rep := "U"
+	if isaVersion >= "00402" {
+		rep = string(d.Repetition)
+	}
+	ack := "0"
+	if env.AckRequested {
+		ack = "1"
+	}
+	usage := env.Usage
+	if usage == "" {
+		usage = "P"
+	}
+	// The ISA is fixed length, every element padded.
+	w.write("ISA", "00", pad("", 10), "00", pad("", 10),
+		pad(env.SenderQual, 2), pad(env.Sender, 15), pad(env.ReceiverQual, 2), pad(env.Receiver, 15),
+		env.Date.Format("060102"), env.Date.Format("1504"), rep, isaVersion,
+		fmt.Sprintf("%09d", env.Control), ack, usage, string(d.Component))
+	return w
+}
+
+// Begin starts a transaction set of type code, numbering the sets
+// 0001, 0002 and on.
+func (w *Writer) Begin(code string) {
+	if w.set != "" {
+		w.End()
+	}
+	if !w.group {
+		env := w.env
+		gsSender, gsReceiver := env.Sender, env.Receiver
+		if env.AppSender != "" {
+			gsSender = env.AppSender
+		}
+		if env.AppReceiver != "" {
+			gsReceiver = env.AppReceiver
+		}
+		w.write("GS", env.Code, gsSender, gsReceiver, env.Date.Format("20060102"), env.Date.Format("1504"),
+			strconv.Itoa(env.Group), "X", env.Version)
+		w.group = true
+	}
+	w.sets++
+	w.set = fmt.Sprintf("%04d", w.sets)
+	w.segs = 0
+	w.Segment("ST", code, w.set)
+}
+
+// Segment writes a segment in the open set. Trailing empty elements are
+// left off, and delimiters in the data are replaced with spaces.
+func (w *Writer) Segment(id string, elements ...string) {
+	for i, e := range elements {
+		elements[i] = w.clean(e)
+	}
+	for len(elements) > 0 && elements[len(elements)-1] == "" {
+		elements = elements[:len(elements)-1]
+	}
+	w.segs++
+	w.write(id, elements...)
+}
+
+// Composite joins the components of a composite element.
+func (w *Writer) Composite(components ...string) string {
+	for i, c := range components {
+		components[i] = w.clean(c)
+	}
+	for len(components) > 0 && components[len(components)-1] == "" {
+		components = components[:len(components)-1]
+	}
+	return strings.Join(components, string(w.d.Component))
+}
+
+// End ends the open set, writing its SE.
+func (w *Writer) End() {
+	if w.set == "" {
+		return
+	}
+	w.Segment("SE", strconv.Itoa(w.segs+1), w.set)
+	w.set = ""
+}
+
+// Bytes ends the open set and the interchange and returns it. An
+// interchange with no sets, only a TA1, has no group.
+func (w *Writer) Bytes() []byte {
+	w.End()
+	groups := "0"
+	if w.group {
+		w.write("GE", strconv.Itoa(w.sets), strconv.Itoa(w.env.Group))
+		groups = "1"
+	}
+	w.write("IEA", groups, fmt.Sprintf("%09d", w.env.Control))
+	return w.b.Bytes()
+}
+
+func (w *Writer) write(id string, elements ...string) {
+	w.b.WriteString(id)
+	for _, e := range elements {
+		w.b.WriteByte(w.d.Element)
+		w.b.WriteString(e)
+	}
+	w.b.WriteByte(w.d.Segment)
+	if w.lineBreaks && w.d.Segment != '\n' {
+		w.b.WriteByte('\n')
+	}
+}
+
+// clean replaces the delimiters in s, which X12 has no way to escape.
+func (w *Writer) clean(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == rune(w.d.Segment), r == rune(w.d.Element), r == rune(w.d.Component),
+			w.d.Repetition != 0 && r == rune(w.d.Repetition), r == '\n', r == '\r':
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+// pad pads or cuts s to n characters, as the ISA wants.
+func pad(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s + strings.Repeat(" ", n-len(s))
+}
@@ -0,0 +1,388 @@
+/*
+Package x12 reads and writes ANSI ASC X12 interchanges.
+
+An interchange starts with the fixed-length ISA segment, which also
+sets its delimiters: the element separator is the character after
+"ISA", the component separator is ISA16 and the segment terminator is
+the character after that. From version 00402 ISA11 is the repetition
+separator. Line breaks after segment terminators are ignored.
+
+Inside the interchange, GS and GE enclose functional groups and ST and
+SE the transaction sets in each. Parse checks the envelopes: each
+trailer must be there, carry its header's control number and count
+what it encloses. An envelope that is wrong is an *EnvelopeError,
+carrying the code an acknowledgment reports it with.
+
+A transaction set's segments are left for a reader of that set, such
+as ReadPO for the 850, which reports what is wrong with them as
+SegmentErrors.
+
+A Writer writes an interchange, numbering it with Controls, which keeps
+the interchange and group control numbers in a file so they are not
+used twice. WritePOAck writes the 855 answering an 850, WriteASN the
+856 telling of a shipment and WriteAdvice the 861 telling what was
+received.
+*/
+package x12
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isaLen is the length of the ISA segment, its terminator included.
+const isaLen = 106
+
+// Envelope levels an EnvelopeError is at.
+const (
+	LevelInterchange = "interchange"
+	LevelGroup       = "group"
+	LevelSet         = "set"
+)
+
+// Delimiters separate an interchange's segments, their elements, the
+// components of a composite element and the repeats of an element.
+type Delimiters struct {
+	Segment    byte
+	Element    byte
+	Component  byte
+	Repetition byte // 0 before version 00402
+}
+
+// Segment is one segment: its ID and elements, Elements[0] being the
+// first element after the ID.
+type Segment struct {
+	ID       string
+	Elements []string
+	// Pos is the segment's position in its transaction set, ST being
+	// 1, or in the interchange for envelope segments.
+	Pos int
+}
+
+// E returns element n, counting from 1 as the standard does, or "" if
+// the segment does not have it.
+func (s Segment) E(n int) string {
+	if n < 1 || n > len(s.Elements) {
+		return ""
+	}
+	return s.Elements[n-1]
+}
+
+// Interchange is an ISA/IEA envelope.
+type Interchange struct {
+	Delims       Delimiters
+	SenderQual   string // ISA05
+	Sender       string // ISA06, trimmed
+	ReceiverQual string // ISA07
+	Receiver     string // ISA08, trimmed
+	Date         time.Time
+	Version      string // ISA12
+	Control      string // ISA13
+	AckRequested bool   // ISA14
+	Usage        string // ISA15, P production or T test
+	Groups       []*Group
+}
+
+// Group is a GS/GE functional group.
+type Group struct {
+	Code     string // GS01, PO for purchase orders
+	Sender   string // GS02
+	Receiver string // GS03
+	Date     time.Time
+	Control  string // GS06
+	Version  string // GS08, such as 004010
+	Sets     []*Transaction
+}
+
+// Transaction is an ST/SE transaction set.
+type Transaction struct {
+	Code    string // ST01, such as 850
+	Control string // ST02
+	// Segments are those between ST and SE.
+	Segments []Segment
+}
+
+// EnvelopeError is an interchange whose envelopes are wrong.
+type EnvelopeError struct {
+	Level   string // LevelInterchange, LevelGroup or LevelSet
+	Control string // the control number of the envelope at fault, if known
+	Pos     int    // the segment, counting from the ISA; 0 if none
+	Segment string // its ID
+	// Code is the TA1 note code for the interchange, the AK9 code for
+	// a group or the AK5 code for a set.
+	Code string
+	Msg  string
+}
+
+func (e *EnvelopeError) Error() string {
+	where := e.Level
+	if e.Control != "" {
+		where += " " + e.Control
+	}
+	if e.Pos > 0 {
+		where += fmt.Sprintf(", segment %d (%s)", e.Pos, e.Segment)
+	}
+	return fmt.Sprintf("x12: %s: %s", where, e.Msg)
+}
+
+// SegmentError is a segment of a transaction set in error.
+type SegmentError struct {
+	Set     string // the set's control number
+	Pos     int    // the segment's position in the set, ST being 1
+	Segment string
+	// Code is the AK3 segment syntax error code.
+	Code string
+	// Element is the element in error, counting from 1, with its AK4
+	// code in ElementCode; 0 if it is the segment as a whole.
+	Element     int
+	ElementCode string
+	Msg         string
+}
+
+func (e *SegmentError) Error() string {
+	if e.Element > 0 {
+		return fmt.Sprintf("x12: set %s, segment %d (%s%02d): %s", e.Set, e.Pos, e.Segment, e.Element, e.Msg)
+	}
+	return fmt.Sprintf("x12: set %s, segment %d (%s): %s", e.Set, e.Pos, e.Segment, e.Msg)
+}
+
+// SegmentErrors are all the errors found in a transaction set.
+type SegmentErrors []*SegmentError
+
+func (es SegmentErrors) Error() string {
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Parse reads the interchange in b, checking its envelopes. With an
+// *EnvelopeError it returns as much of the interchange as it read, the
+// group or set in error last, so that it can be acknowledged; the
+// interchange is nil if its ISA could not be read.
+func Parse(b []byte) (*Interchange, error) {
+	b = bytes.TrimLeft(b, " \t\r\n")
+	if len(b) < isaLen || string(b[:3]) != "ISA" {
+		return nil, &EnvelopeError{Level: LevelInterchange, Code: "022", Msg: "does not start with an ISA segment"}
+	}
+	d := Delimiters{Element: b[3], Component: b[104], Segment: b[105]}
+	if !delimiter(d.Element) {
+		return nil, &EnvelopeError{Level: LevelInterchange, Pos: 1, Segment: "ISA", Code: "026", Msg: fmt.Sprintf("bad element separator %q", d.Element)}
+	}
+	if !delimiter(d.Component) || d.Component == d.Element {
+		return nil, &EnvelopeError{Level: LevelInterchange, Pos: 1, Segment: "ISA", Code: "027", Msg: fmt.Sprintf("bad component separator %q", d.Component)}
+	}
+	if !delimiter(d.Segment) && d.Segment != '\n' && d.Segment != '\r' || d.Segment == d.Element || d.Segment == d.Component {
+		return nil, &EnvelopeError{Level: LevelInterchange, Pos: 1, Segment: "ISA", Code: "022", Msg: fmt.Sprintf("bad segment terminator %q", d.Segment)}
+	}
+	isa := strings.Split(string(b[:isaLen-1]), string(d.Element))
+	if len(isa) != 17 {
+		return nil, &EnvelopeError{Level: LevelInterchange, Pos: 1, Segment: "ISA", Code: "022", Msg: fmt.Sprintf("ISA has %d elements, not 16", len(isa)-1)}
+	}
+	ic := &Interchange{
+		Delims:       d,
+		SenderQual:   isa[5],
+		Sender:       strings.TrimSpace(isa[6]),
+		ReceiverQual: isa[7],
+		Receiver:     strings.TrimSpace(isa[8]),
+		Version:      isa[12],
+		Control:      isa[13],
+		AckRequested: isa[14] == "1",
+		Usage:        isa[15],
+	}
+	if len(ic.Control) != 9 || !digits(ic.Control) {
+		return nil, &EnvelopeError{Level: LevelInterchange, Pos: 1, Segment: "ISA", Code: "018", Msg: fmt.Sprintf("bad control number %q", ic.Control)}
+	}
+	bad := func(pos int, seg string, code string, format string, args ...any) error {
+		return &EnvelopeError{Level: LevelInterchange, Control: ic.Control, Pos: pos, Segment: seg, Code: code, Msg: fmt.Sprintf(format, args...)}
+	}
+	var err error
+	if ic.Date, err = Date(isa[9], isa[10]); err != nil {
+		code := "014"
+		if len(isa[10]) != 4 {
+			code = "015"
+		}
+		return nil, bad(1, "ISA", code, "bad date %s %s", isa[9], isa[10])
+	}
+	if ic.Version >= "00402" {
+		if len(isa[11]) != 1 || !delimiter(isa[11][0]) {
+			return ic, bad(1, "ISA", "022", "bad repetition separator %q", isa[11])
+		}
+		d.Repetition = isa[11][0]
+		ic.Delims = d
+	}
+
+	var (
+		g    *Group
+		t    *Transaction
+		gPos int // where g started
+		tPos int // where t started
+		done bool
+	)
+	for i, raw := range bytes.Split(b[isaLen:], []byte{d.Segment}) {
+		raw = bytes.Trim(raw, "\r\n")
+		if len(raw) == 0 {
+			continue
+		}
+		pos := i + 2
+		s := split(string(raw), d, pos)
+		if done {
+			return ic, bad(pos, s.ID, "022", "segment after IEA")
+		}
+		switch s.ID {
+		case "ISA":
+			return ic, bad(pos, s.ID, "022", "more than one interchange")
+
+		case "GS":
+			if t != nil {
+				return ic, &EnvelopeError{Level: LevelSet, Control: t.Control, Pos: tPos, Segment: "ST", Code: "2", Msg: "no SE before GS"}
+			}
+			if g != nil {
+				return ic, &EnvelopeError{Level: LevelGroup, Control: g.Control, Pos: gPos, Segment: "GS", Code: "3", Msg: "no GE before GS"}
+			}
+			g, gPos = &Group{
+				Code:     s.E(1),
+				Sender:   s.E(2),
+				Receiver: s.E(3),
+				Control:  s.E(6),
+				Version:  s.E(8),
+			}, pos
+			ic.Groups = append(ic.Groups, g)
+			if !digits(g.Control) || len(g.Control) > 9 {
+				return ic, &EnvelopeError{Level: LevelGroup, Control: g.Control, Pos: pos, Segment: s.ID, Code: "6", Msg: fmt.Sprintf("bad control number %q", g.Control)}
+			}
+			if g.Date, err = Date(s.E(4), s.E(5)); err != nil {
+				return ic, &EnvelopeError{Level: LevelGroup, Control: g.Control, Pos: pos, Segment: s.ID, Code: "6", Msg: fmt.Sprintf("bad date %s %s", s.E(4), s.E(5))}
+			}
+
+		case "GE":
+			if g == nil {
+				return ic, bad(pos, s.ID, "024", "GE outside a functional group")
+			}
+			if t != nil {
+				return ic, &EnvelopeError{Level: LevelSet, Control: t.Control, Pos: tPos, Segment: "ST", Code: "2", Msg: "no SE before GE"}
+			}
+			if s.E(2) != g.Control {
+				return ic, &EnvelopeError{Level: LevelGroup, Control: g.Control, Pos: pos, Segment: s.ID, Code: "4", Msg: fmt.Sprintf("GE02 %s is not GS06 %s", s.E(2), g.Control)}
+			}
+			if n, _ := strconv.Atoi(s.E(1)); n != len(g.Sets) || !digits(s.E(1)) {
+				return ic, &EnvelopeError{Level: LevelGroup, Control: g.Control, Pos: pos, Segment: s.ID, Code: "5", Msg: fmt.Sprintf("GE01 counts %s sets, the group has %d", s.E(1), len(g.Sets))}
+			}
+			g = nil
+
+		case "ST":
+			if g == nil {
+				return ic, bad(pos, s.ID, "024", "ST outside a functional group")
+			}
+			if t != nil {
+				return ic, &EnvelopeError{Level: LevelSet, Control: t.Control, Pos: tPos, Segment: "ST", Code: "2", Msg: "no SE before ST"}
+			}
+			t, tPos = &Transaction{Code: s.E(1), Control: s.E(2)}, pos
+			g.Sets = append(g.Sets, t)
+			if t.Code == "" {
+				return ic, &EnvelopeError{Level: LevelSet, Control: t.Control, Pos: pos, Segment: s.ID, Code: "6", Msg: "no transaction set identifier"}
+			}
+			if len(t.Control) < 4 || len(t.Control) > 9 {
+				return ic, &EnvelopeError{Level: LevelSet, Control: t.Control, Pos: pos, Segment: s.ID, Code: "7", Msg: fmt.Sprintf("bad control number %q", t.Control)}
+			}
+
+		case "SE":
+			if t == nil {
+				return ic, bad(pos, s.ID, "022", "SE outside a transaction set")
+			}
+			if s.E(2) != t.Control {
+				return ic, &EnvelopeError{Level: LevelSet, Control: t.Control, Pos: pos, Segment: s.ID, Code: "3", Msg: fmt.Sprintf("SE02 %s is not ST02 %s", s.E(2), t.Control)}
+			}
+			// SE01 counts ST and SE too.
+			if n, _ := strconv.Atoi(s.E(1)); n != len(t.Segments)+2 || !digits(s.E(1)) {
+				return ic, &EnvelopeError{Level: LevelSet, Control: t.Control, Pos: pos, Segment: s.ID, Code: "4", Msg: fmt.Sprintf("SE01 counts %s segments, the set has %d", s.E(1), len(t.Segments)+2)}
+			}
+			t = nil
+
+		case "IEA":
+			if t != nil {
+				return ic, &EnvelopeError{Level: LevelSet, Control: t.Control, Pos: tPos, Segment: "ST", Code: "2", Msg: "no SE before IEA"}
+			}
+			if g != nil {
+				return ic, &EnvelopeError{Level: LevelGroup, Control: g.Control, Pos: gPos, Segment: "GS", Code: "3", Msg: "no GE before IEA"}
+			}
+			if s.E(2) != ic.Control {
+				return ic, bad(pos, s.ID, "001", "IEA02 %s is not ISA13 %s", s.E(2), ic.Control)
+			}
+			if n, _ := strconv.Atoi(s.E(1)); n != len(ic.Groups) || !digits(s.E(1)) {
+				return ic, bad(pos, s.ID, "021", "IEA01 counts %s groups, the interchange has %d", s.E(1), len(ic.Groups))
+			}
+			done = true
+
+		default:
+			if t == nil {
+				return ic, bad(pos, s.ID, "022", "segment outside a transaction set")
+			}
+			s.Pos = len(t.Segments) + 2
+			t.Segments = append(t.Segments, s)
+		}
+	}
+	if !done {
+		return ic, bad(0, "", "023", "ends without IEA")
+	}
+	return ic, nil
+}
+
+// split splits a segment into its ID and elements.
+func split(raw string, d Delimiters, pos int) Segment {
+	els := strings.Split(raw, string(d.Element))
+	return Segment{ID: strings.TrimSpace(els[0]), Elements: els[1:], Pos: pos}
+}
+
+// Date reads an X12 date, CCYYMMDD or YYMMDD, and an optional time,
+// HHMM with optional seconds.
+func Date(date string, clock string) (time.Time, error) {
+	layout := "20060102"
+	if len(date) == 6 {
+		layout = "060102"
+	}
+	switch len(clock) {
+	case 0:
+	case 4:
+		layout += "1504"
+	case 6:
+		layout += "150405"
+	default:
+		if len(clock) > 6 {
+			// Decimal seconds.
+			layout += "150405"
+			clock = clock[:6]
+			break
+		}
+		return time.Time{}, fmt.Errorf("bad time %q", clock)
+	}
+	return time.Parse(layout, date+clock)
+}
+
+// delimiter reports whether c can be a delimiter: printable, and not
+// a letter, digit or space.
+func delimiter(c byte) bool {
+	switch {
+	case c <= ' ' || c >= 0x7f:
+		return c == 0x1c || c == 0x1d || c == 0x1e || c == 0x1f || c == 0x07
+	case c >= '0' && c <= '9', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		return false
+	}
+	return true
+}
+
+func digits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,202 @@
+package x12
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testISA is an ISA with element separator e, component separator c
+// and segment terminator s.
+func testISA(e byte, c byte, s byte, version string, control string) string {
+	rep := "U"
+	if version >= "00402" {
+		rep = "^"
+	}
+	return strings.Join([]string{"ISA", "00", pad("", 10), "00", pad("", 10),
+		"ZZ", pad("ACME", 15), "ZZ", pad("BASEEDI", 15), "240102", "1230",
+		rep, version, control, "0", "P", string(c)}, string(e)) + string(s)
+}
+
+// testPO is an interchange of one 850, its segments written with * and
+// ~ for the test's delimiters to replace.
+const testPO = `GS*PO*ACME*BASEEDI*20240102*1230*7*X*004010~
+ST*850*0001~
+BEG*00*SA*PO123**20240102~
+REF*PJ*G41~
+N1*VN*Widget Co~
+PO1*1*10*EA*2.5**BP*ABC-1~
+PID*F****Widgets~
+DTM*002*20240201~
+CTT*1~
+SE*9*0001~
+GE*1*7~
+IEA*1*000000101~
+`
+
+// testInterchange is testPO with its ISA, in delimiters d, a line break
+// after each segment.
+func testInterchange(d Delimiters, body string) []byte {
+	body = strings.NewReplacer("*", string(d.Element), "~", string(d.Segment)).Replace(body)
+	if d.Segment == '\n' {
+		body = strings.ReplaceAll(body, "\n\n", "\n")
+	}
+	return []byte(testISA(d.Element, d.Component, d.Segment, "00401", "000000101") + "\n" + body)
+}
+
+func TestParseDelimiters(t *testing.T) {
+	tests := []struct {
+		name string
+		d    Delimiters
+		crlf bool
+	}{
+		{"usual", Delimiters{Segment: '~', Element: '*', Component: ':'}, false},
+		{"pipes", Delimiters{Segment: '~', Element: '|', Component: '>'}, false},
+		{"newline terminator", Delimiters{Segment: '\n', Element: '*', Component: '>'}, false},
+		{"control characters", Delimiters{Segment: 0x1c, Element: 0x1d, Component: 0x1f}, false},
+		{"CRLF after segments", Delimiters{Segment: '~', Element: '*', Component: ':'}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testInterchange(tt.d, testPO)
+			if tt.crlf {
+				b = []byte(strings.ReplaceAll(string(b), "\n", "\r\n"))
+			}
+			ic, err := Parse(b)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if ic.Delims != tt.d {
+				t.Errorf("delimiters %q, want %q", ic.Delims, tt.d)
+			}
+			if ic.Sender != "ACME" || ic.Control != "000000101" || ic.Usage != "P" {
+				t.Errorf("ISA read as sender %q, control %q, usage %q", ic.Sender, ic.Control, ic.Usage)
+			}
+			if len(ic.Groups) != 1 || len(ic.Groups[0].Sets) != 1 {
+				t.Fatalf("%d groups, want 1 with 1 set", len(ic.Groups))
+			}
+			set := ic.Groups[0].Sets[0]
+			if set.Code != "850" || len(set.Segments) != 7 || set.Segments[0].ID != "BEG" || set.Segments[0].Pos != 2 {
+				t.Errorf("set %s has %d segments, the first %s at %d", set.Code, len(set.Segments), set.Segments[0].ID, set.Segments[0].Pos)
+			}
+		})
+	}
+}
+
+func TestParseRepetitionSeparator(t *testing.T) {
+	b := testISA('*', ':', '~', "00501", "000000101") + strings.ReplaceAll(testPO, "004010", "005010")
+	ic, err := Parse([]byte(b))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if ic.Delims.Repetition != '^' || ic.Version != "00501" {
+		t.Errorf("repetition %q, version %s", ic.Delims.Repetition, ic.Version)
+	}
+}
+
+func TestParseEnvelopeErrors(t *testing.T) {
+	usual := Delimiters{Segment: '~', Element: '*', Component: ':'}
+	tests := []struct {
+		name  string
+		b     []byte
+		level string
+		code  string
+		// partial is whether the interchange read so far comes back.
+		partial bool
+	}{
+		{"no ISA", []byte("GS*PO~"), LevelInterchange, "022", false},
+		{"letter element separator", []byte(testISA('A', ':', '~', "00401", "000000101") + testPO), LevelInterchange, "026", false},
+		{"component separator same as element", []byte(testISA('*', '*', '~', "00401", "000000101") + testPO), LevelInterchange, "027", false},
+		{"segment terminator same as component", []byte(testISA('*', ':', ':', "00401", "000000101") + testPO), LevelInterchange, "022", false},
+		{"bad control number", []byte(testISA('*', ':', '~', "00401", "00000010X") + testPO), LevelInterchange, "018", false},
+		{"IEA control mismatch", testInterchange(usual, strings.Replace(testPO, "IEA*1*000000101", "IEA*1*000000102", 1)), LevelInterchange, "001", true},
+		{"IEA group count", testInterchange(usual, strings.Replace(testPO, "IEA*1*", "IEA*2*", 1)), LevelInterchange, "021", true},
+		{"no IEA", testInterchange(usual, strings.Replace(testPO, "IEA*1*000000101~\n", "", 1)), LevelInterchange, "023", true},
+		{"segment after IEA", testInterchange(usual, testPO+"GS*PO~\n"), LevelInterchange, "022", true},
+		{"GE control mismatch", testInterchange(usual, strings.Replace(testPO, "GE*1*7", "GE*1*8", 1)), LevelGroup, "4", true},
+		{"GE set count", testInterchange(usual, strings.Replace(testPO, "GE*1*7", "GE*2*7", 1)), LevelGroup, "5", true},
+		{"GS bad control number", testInterchange(usual, strings.Replace(testPO, "*1230*7*", "*1230*X7*", 1)), LevelGroup, "6", true},
+		{"SE control mismatch", testInterchange(usual, strings.Replace(testPO, "SE*9*0001", "SE*9*0002", 1)), LevelSet, "3", true},
+		{"SE segment count", testInterchange(usual, strings.Replace(testPO, "SE*9*0001", "SE*8*0001", 1)), LevelSet, "4", true},
+		{"no SE before GE", testInterchange(usual, strings.Replace(testPO, "SE*9*0001~\n", "", 1)), LevelSet, "2", true},
+		{"ST control number short", testInterchange(usual, strings.NewReplacer("ST*850*0001", "ST*850*01", "SE*9*0001", "SE*9*01").Replace(testPO)), LevelSet, "7", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ic, err := Parse(tt.b)
+			var env *EnvelopeError
+			if !errors.As(err, &env) {
+				t.Fatalf("Parse returned %v, want an *EnvelopeError", err)
+			}
+			if env.Level != tt.level || env.Code != tt.code {
+				t.Errorf("level %s code %s, want %s %s: %v", env.Level, env.Code, tt.level, tt.code, err)
+			}
+			if (ic != nil) != tt.partial {
+				t.Errorf("interchange returned: %v, want %v", ic != nil, tt.partial)
+			}
+		})
+	}
+}
+
+func TestFunctionalAckRoundTrip(t *testing.T) {
+	usual := Delimiters{Segment: '~', Element: '*', Component: ':'}
+	tests := []struct {
+		name   string
+		body   string
+		status string
+		sets   map[string]string
+	}{
+		{"accepted", testPO, Accepted, map[string]string{"0001": Accepted}},
+		{"set rejected", strings.Replace(testPO, "SE*9*0001", "SE*8*0001", 1), Rejected, map[string]string{"0001": Rejected}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ic, err := Parse(testInterchange(usual, tt.body))
+			a := NewFunctionalAck(ic, err)
+			w := NewWriter(Envelope{
+				SenderQual: "ZZ", Sender: "BASEEDI", ReceiverQual: "ZZ", Receiver: "ACME",
+				Version: "004010", Control: 5, Group: 6, Code: "FA",
+				Date: time.Date(2024, 1, 2, 12, 30, 0, 0, time.UTC),
+			}, DefaultDelimiters, true)
+			WriteFunctionalAck(w, a, "997")
+			out, err := Parse(w.Bytes())
+			if err != nil {
+				t.Fatalf("the 997 does not parse: %v", err)
+			}
+			r, err := ReadFunctionalAck(out.Groups[0].Sets[0])
+			if err != nil {
+				t.Fatalf("ReadFunctionalAck: %v", err)
+			}
+			if r.Code != "PO" || r.Control != "7" || r.Status != tt.status {
+				t.Errorf("AK1 %s %s, AK9 %s; want PO 7, %s", r.Code, r.Control, r.Status, tt.status)
+			}
+			for set, status := range tt.sets {
+				if r.Sets[set] != status {
+					t.Errorf("set %s: %q, want %q", set, r.Sets[set], status)
+				}
+			}
+		})
+	}
+}
+
+func TestDate(t *testing.T) {
+	tests := []struct {
+		date, clock string
+		want        time.Time
+		err         bool
+	}{
+		{"20240102", "", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), false},
+		{"240102", "1230", time.Date(2024, 1, 2, 12, 30, 0, 0, time.UTC), false},
+		{"20240102", "123045", time.Date(2024, 1, 2, 12, 30, 45, 0, time.UTC), false},
+		{"20240102", "12304567", time.Date(2024, 1, 2, 12, 30, 45, 0, time.UTC), false},
+		{"20240102", "12", time.Time{}, true},
+		{"20241302", "", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := Date(tt.date, tt.clock)
+		if (err != nil) != tt.err || !got.Equal(tt.want) {
+			t.Errorf("Date(%q, %q) = %v, %v; want %v, error %v", tt.date, tt.clock, got, err, tt.want, tt.err)
+		}
+	}
+}